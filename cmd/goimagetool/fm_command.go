@@ -3,20 +3,14 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
 
 	"goimagetool/internal/core"
 	"goimagetool/internal/tui/fm"
 )
 
-// Вызовите runFM(st, args) из вашего switch/case в main.go (case "fm": ...)
-
-func runFM(st *core.State, args []string) error {
-	hostDir := ""
-	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
-		hostDir = args[0]
-	}
-	if st == nil || st.FS == nil {
+// runFM — case "fm" в main.go. FIT без FS открывается сразу в FIT-режиме.
+func runFM(st *core.State, hostDir string) error {
+	if st == nil || (st.FS == nil && st.Kind != core.KindKernelFIT) {
 		return fmt.Errorf("no image loaded; use 'load' first")
 	}
 	return fm.Run(st, hostDir)
@@ -2,64 +2,190 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"goimagetool/internal/common"
+	"goimagetool/internal/compress"
 	"goimagetool/internal/core"
+	"goimagetool/internal/fs/ext2"
 	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/arm64"
+	"goimagetool/internal/image/cpio"
+	"goimagetool/internal/image/cramfs"
+	"goimagetool/internal/image/jffs2"
+	"goimagetool/internal/image/partition"
+	"goimagetool/internal/image/romfs"
+	"goimagetool/internal/image/simg"
+	"goimagetool/internal/image/squashfs"
+	"goimagetool/internal/image/tarball"
+	"goimagetool/internal/image/ubi"
+	"goimagetool/internal/image/ubifs"
 	"goimagetool/internal/image/uboot/fit"
+	"goimagetool/internal/image/uboot/legacy"
 )
 
 func usage() {
-	fmt.Println(`goimagetool - unified image tool (Go)
+	fmt.Print(`goimagetool - unified image tool (Go)
 Usage:
   goimagetool [--session <path|auto>] <commands...>
+  (the session file is rewritten at exit only if the commands changed the image)
+  (scratch dirs for squashfs/ext2 go to $GOIMAGETOOL_TMP if set)
+  --allow-unsafe-paths  load tar/cpio entries whose ".." climbs above / (clamped to /)
+  --max-size SIZE       cap decompressed data and entry sizes (default 4G, 0 = off; env GOIMAGETOOL_MAX_SIZE)
+  --no-clobber          store/extract fail instead of overwriting an existing output image
+  --backup              rename an existing output image to <path>.bak before writing it
+  --fail-on-audit       store fails (exit 2, nothing written) on 'fs audit' findings instead of warning
+  --no-autosave         never rewrite the --session file at exit (session save still works)
+  -k, --keep-going      a failing command does not stop the run: the rest still execute (also every
+                        line of apply), failures are listed at the end and the exit status is the worst one
+  -v, --verbose         progress on stderr: files/bytes while staging squashfs/ext2, sizes after compression
 
 Load:
   goimagetool load auto <path>
-  goimagetool load initramfs <path> [compression]        # auto|none|gzip|zstd|lz4|lzma|bzip2|xz
+  goimagetool load initramfs <path> [compression] [--zstd-dict <file>]  # auto|none|gzip|zstd|lz4|lzma|bzip2|xz
   goimagetool load kernel-legacy <uImagePath>
-  goimagetool load kernel-fit <itbPath> [compression]
-  goimagetool load squashfs <imgPath> [compression]
-  goimagetool load ext2 <imgPath> [compression]
+  goimagetool load kernel-fit <itbPath> [compression] [--zstd-dict <file>]
+  goimagetool load kernel-raw <Image> [compression]      # bare kernel; info shows the arm64 Image header
+  goimagetool load squashfs <imgPath> [compression] [--native]  # --native: built-in reader, not go-diskfs (any compressor, keeps owners/devices/xattrs)
+  goimagetool load ext2 <imgPath> [compression] [--zstd-dict <file>] [--native]  # --native: built-in reader, not debugfs; ext2/squashfs also take Android sparse images
   goimagetool load tar <path> [compression]              # auto|none|gzip
+  goimagetool load jffs2 <imgPath> [compression]         # read-only: either byte order; zlib/rtime/rubin nodes
+  goimagetool load ubi <imgPath> [compression] [--volume <name|id>]  # volumes as files; --volume: its UBIFS tree
+  goimagetool load ubifs <imgPath> [compression]         # read-only, as of the last commit (journal not replayed)
+  goimagetool load romfs <imgPath> [compression]
+  goimagetool load cramfs <imgPath> [compression]        # read-only: either byte order, -p padded; no mtimes
+  goimagetool load --into <slot> <type> <path> ...       # keep as a named slot; working image untouched
 
-Store:
-  goimagetool store initramfs <path> [compression]
+Store (initramfs/squashfs/ext2/tar accept --verify: reload the output and diff it):
+  goimagetool store initramfs <path> [compression] [--level N] [--zstd-dict <file>] [--preserve-order <file>] [--no-check] [--reproducible] [--exclude <glob>]...
+      [--prepend <cpio|dir>]  # uncompressed archive first (early microcode), then the main one compressed
+      [--pad512]              # zeros after the trailer to a 512-byte boundary, like cpio -H newc
+      [--zero-ino]            # inode 0 everywhere instead of 1, 2, ... in path order
+      # boot-sanity warnings (see 'check initramfs') go to stderr unless --no-check
   goimagetool store kernel-legacy <uImagePath>
-  goimagetool store kernel-fit <itbPath> [compression]
-  goimagetool store squashfs <imgPath> [compression]          # gzip|xz|zstd|lz4|lzo|lzma
-  goimagetool store ext2 <imgPath> [blockSize] [compression]  # 1024|2048|4096
-  goimagetool store tar <path> [compression]                  # none|gzip
+  goimagetool store kernel-fit <itbPath> [compression] [--level N] [--zstd-dict <file>] [--reencode]
+  goimagetool store kernel-raw <path> [compression]
+  goimagetool store squashfs <imgPath> [compression]          # gzip|xz|zstd|lz4|lzma; default: the loaded squashfs's, else gzip
+      [--xz-dict SIZE] [--xz-bcj x86,arm,armthumb,powerpc,ia64,sparc] [--gzip-level 1-9] [--gzip-window 8-15] [--reencode]
+      [--no-fragments]    # tails in own blocks: larger image, no fragment table (old kernels/bootloaders)
+      [--non-exportable]  # drop the NFS export table (slightly smaller; not NFS-exportable)
+      [--non-sparse]      # store zero blocks as data instead of holes
+      [--reproducible]
+      [--allow-drops]     # skip device nodes/unsupported names and strip setuid/setgid/sticky
+                          # with a warning instead of failing
+      (--always-fragments is rejected: the go-diskfs writer cannot force it)
+  goimagetool store ext2 <imgPath> [blockSize] [compression] [--level N] [--zstd-dict <file>] [--sparse SIZE] [--reencode] [--reproducible]  # 1024|2048|4096
+  goimagetool store tar <path> [compression] [--level N] [--sparse SIZE] [--reproducible] [--exclude <glob>]...  # none|gzip|zstd; --sparse: PAX sparse for zero runs >= SIZE
+      [--image-names | --passwd <file> --group <file>]  # uname/gname from the image's /etc/passwd, /etc/group or host files
+      [--numeric-owner]       # blank names even with the above (the default: numeric uid/gid only)
+  goimagetool store romfs <imgPath> [compression] [--volume NAME]  # genromfs layout; keeps only the exec bit: no owners, mtimes, other perms
+  (--level: gzip 1..9, zstd 1..22; other codecs have no level)
+  (--reproducible: every mtime becomes $SOURCE_DATE_EPOCH (default 0) and the
+   format's own timestamps/UUIDs are fixed, so the same tree gives the same bytes)
+  (kernel-fit/squashfs/ext2 unchanged since load are written from the original bytes;
+   --reencode forces re-serialization)
 
 FS:
-  goimagetool fs ls [-L] [path]
-  goimagetool fs add <srcPath> <dstPathInImage>
-  goimagetool fs extract <dstDir>
+  goimagetool fs cd [path] | fs pwd                      # relative image paths in fs commands start here (kept in the session)
+  goimagetool fs ls [-L] [-R] [-h] [--sort name|size|mtime] [--reverse] [path]
+      # -R: recursive tree + totals (--sort orders each dir); -h|--human: KiB/MiB sizes
+  goimagetool fs du [--block SIZE] [-h] [path]           # data size per child dir, largest first; bytes unless -h
+  goimagetool fs grep [-i] [-n] [--regex|--binary] <pattern> [path]
+      # files whose data matches; -n: path:line:text (binary data: path:offset);
+      # --binary: pattern is hex bytes ("7f454c46"); exit 1 when nothing matches
+  goimagetool fs find [path] [-type f|d|l|c|b|p] [-name glob] [-size [+|-]N] [-perm [-|/]octal]
+      # paths of matching entries (all predicates must hold); -perm -4000: setuid
+  goimagetool fs stat [-L] <path>
+  goimagetool fs audit                                   # world-writable, non-root setuid/setgid, symlinks out of the tree;
+      # exit 1 on findings. Every store of a filesystem prints them as warnings
+  goimagetool fs symlink-check [--all]                   # "path -> target: status" for absolute, dangling and looping
+      # symlinks, resolved inside the image; --all lists the ok ones too; exit 1 on dangling/loop
+  goimagetool fs add [-L] [--owner uid:gid] [--mode <octal|u+x,go-w>] [--exclude <glob>]... <srcPath> <dstPathInImage>
+      # host owner and mode are kept unless overridden (for every entry of a dir);
+      # -L|--follow-symlinks: store what host symlinks point to, not the links
+  goimagetool fs chmod [-R] <octal|u+x,go-w> <glob>
+  goimagetool fs chown [-R] <uid:gid> <glob>
+  goimagetool fs setcap <caps|-r> <path>                 # security.capability xattr, setcap(8) syntax: cap_net_raw+ep;
+      # -r removes it. Kept by tar (SCHILY.xattr) and sessions, dropped by the other formats
+  goimagetool fs getcap <path>                           # prints "<path> <caps>", nothing without capabilities
+  goimagetool fs extract <dstDir> [--metadata <file.json>]  # + manifest: mode/owner/mtime/rdev/target
+  goimagetool fs import <srcDir> --metadata <file.json>     # rebuild FS from extract + manifest
+  goimagetool fs cp [-r] <src> <dst>                     # inside the image; dst dir = copy into it
   goimagetool fs ln -s <target> <dstPathInImage>
   goimagetool fs mknod <c|b|p> <major> <minor> <dstPathInImage>
+  goimagetool fs overlay <slot>                          # copy slot entries over the working FS
+
+Script:
+  goimagetool apply <script>                             # fs edits, one per line: add, rm [-r], mkdir [-p],
+                                                         # ln -s, mknod, chmod [-R], chown [-R]; stops at first error
+  goimagetool patch <img> [--set /path=hostfile]... [--rm /path]... -o <out>
+      # load auto, edit, store in the same format: same outer compression, squashfs compressor,
+      # ext2 block size/UUID, romfs volume; a replaced file keeps its mode and owner
+
+Check:
+  goimagetool check initramfs                            # /init, /sbin/init, /dev/console, dangling bin links; exit 1 on warnings
+
+Detect:
+  goimagetool detect <path> [--json]                     # load-auto type, compression, inner format
+
+Slots ("." = working image):
+  goimagetool diff <slot|.> <slot|.>                     # exit 1 when they differ
 
 FIT:
-  goimagetool fit new|ls|add|rm|set-default|extract|verify ...
+  goimagetool fit new|ls|add|rm|set-default|extract|verify|sign|open-ramdisk|put-ramdisk ...
+  goimagetool fit ls --no-data <file.itb>               # table of contents from disk: sizes/offsets, payloads not read
+  goimagetool fit add [-t type] [-H crc32,sha256] [--load-base ADDR] [--sanitize] <name> <file>   # -H: one hash-N node per algo (default sha1)
+      # name: DT node name, [a-zA-Z][0-9a-zA-Z,._+-]{0,30}[@unit]; --sanitize rewrites an invalid one
+      # arm64 Image: type kernel, load = entry = ADDR (default 0) + text_offset
+  goimagetool fit config ls | rm <name> | set-default <name>
+  goimagetool fit config add [--kernel K] [--fdt F] [--ramdisk R] [--compatible "vendor,board"]... <name>
+  goimagetool fit sign --key priv.pem [--algo sha256,rsa2048] [--key-name N] [config|image]
+      # signature-N node written on store; no target = every config; rsa2048|rsa4096, PKCS#1 v1.5
+  goimagetool fit open-ramdisk [name]                    # ramdisk image (default: the default config's) becomes the working FS
+  goimagetool fit put-ramdisk [name]                     # store the FS back into it (same compression), FIT is the working image again
+
+uImage (legacy, host file):
+  goimagetool uimage verify <path>                       # HCRC/DCRC status; exit 3 if bad
+  goimagetool uimage fix-crc <path>                      # recompute HCRC/DCRC in place
 
 TUI:
   goimagetool fm [hostStartDir]
+      # F2 toggles the image panel to the FIT image list: F3 info, F4 set type, F5 extract to host
+      # (from the host panel: add the file), F6 set default, F8 remove; a loaded FIT opens in this mode
 
 Image (host file ops):
-  goimagetool image resize <path> (+SIZE|-SIZE|--to SIZE[K|M|G])
-  goimagetool image pad    <path> --align SIZE[K|M|G]
+  goimagetool partition ls <disk.img>
+  goimagetool partition create <disk.img> [--entries N] [--align SIZE] <name:size|-[:type]>...
+      # new GPT over the whole file; defaults 128 entries, 1M alignment; type linux|efi|swap|bios|GUID
+  goimagetool image info <path>                          # raw file: size/alignment, partition table, magic at 0 and each partition
+  goimagetool image resize <path> (+SIZE|-SIZE|--to SIZE[K|M|G]) [--no-sparse]
+  goimagetool image pad    <path> --align SIZE[K|M|G] [--no-sparse]
+      # growing leaves a hole (sparse tail); --no-sparse writes real zeros
+
+Compression (raw files, streamed):
+  goimagetool compress <in> <out> <codec>[:level] [--zstd-dict <file>]   # gzip|zstd|lz4|lzma|bzip2|none
+  goimagetool decompress <in> <out> [codec] [--zstd-dict <file>]         # default auto (by magic)
+  goimagetool codecs                      # (= compress --list) codecs, aliases, compress/decompress/detect support
 
 Session:
-  goimagetool session save [path] | load [path] | clear
+  goimagetool session save [path] | load [path] | clear | info [path]
 
 Other:
-  goimagetool info | help
+  goimagetool info [-h|--human] [--json] | help         # --json: stable schema (schemaVersion, kind, fileCount, totalSize, details)
+  goimagetool selftest                                   # round-trip fidelity matrix per format
 `)
 }
 
@@ -94,6 +220,215 @@ func isDigits(s string) bool {
 	return true
 }
 
+// keepGoing (--keep-going): a failing command does not end the run; the
+// remaining ones still execute and the exit status reports the failures.
+var keepGoing bool
+
+// commands are the words the argument loop dispatches on.
+var commands = map[string]bool{
+	"session": true, "load": true, "fs": true, "fit": true, "store": true, "info": true, "detect": true,
+	"check": true, "apply": true, "patch": true, "diff": true, "codecs": true, "compress": true, "decompress": true,
+	"selftest": true, "fm": true, "uimage": true, "partition": true, "image": true,
+}
+
+// nextCommand: where to resume after a failed command, the next command
+// word at or after j (len(args) if none). j is past the arguments the
+// command is known to take; options it did not get to are skipped by name.
+func nextCommand(args []string, j int) int {
+	for j < len(args) && !commands[args[j]] {
+		j++
+	}
+	return j
+}
+
+// flagError is a bad option value found by the flag helpers below: a
+// missing value exits 1 like other usage errors, a bad one 2.
+type flagError struct {
+	msg  string
+	code int
+}
+
+func (e *flagError) Error() string { return e.msg }
+
+// report prints err and returns the exit status it stands for.
+func report(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	var fe *flagError
+	if errors.As(err, &fe) {
+		return fe.code
+	}
+	return 2
+}
+
+// isOpt: optional positional argument present at args[j] (not a --flag).
+func isOpt(args []string, j int) bool {
+	return j < len(args) && !strings.HasPrefix(args[j], "--")
+}
+
+// zstdDictFlag consumes "--zstd-dict <file>" at args[j] and stores the
+// dictionary in st; returns the number of tokens consumed (0 or 2).
+func zstdDictFlag(st *core.State, args []string, j int) (int, error) {
+	if j >= len(args) || args[j] != "--zstd-dict" {
+		return 0, nil
+	}
+	if j+1 >= len(args) {
+		return 0, &flagError{"--zstd-dict needs a file", 1}
+	}
+	d, err := os.ReadFile(args[j+1])
+	if err != nil {
+		return 0, fmt.Errorf("zstd-dict: %w", err)
+	}
+	st.Codec.ZstdDict = d
+	return 2, nil
+}
+
+// levelFlag consumes "--level N" at args[j] into st.Codec.Level (gzip
+// 1..9, zstd 1..22; checked by the codec); returns tokens consumed.
+func levelFlag(st *core.State, args []string, j int) (int, error) {
+	if j >= len(args) || args[j] != "--level" {
+		return 0, nil
+	}
+	if j+1 >= len(args) {
+		return 0, &flagError{"--level needs a number", 1}
+	}
+	n, err := strconv.Atoi(args[j+1])
+	if err != nil {
+		return 0, fmt.Errorf("--level: %w", err)
+	}
+	st.Codec.Level = n
+	return 2, nil
+}
+
+// excludeFlag consumes "--exclude <glob>" at args[j] into *dst; returns
+// the number of tokens consumed (0 or 2).
+func excludeFlag(args []string, j int, dst *[]string) (int, error) {
+	if j >= len(args) || args[j] != "--exclude" {
+		return 0, nil
+	}
+	if j+1 >= len(args) {
+		return 0, &flagError{"--exclude needs a pattern", 1}
+	}
+	if err := memfs.CheckPatterns(args[j+1 : j+2]); err != nil {
+		return 0, fmt.Errorf("--exclude: %w", err)
+	}
+	*dst = append(*dst, args[j+1])
+	return 2, nil
+}
+
+// sparseFlag consumes "--sparse SIZE" at args[j] (SIZE as in parseSize; 0
+// turns holes off) into *dst; returns the number of tokens consumed.
+func sparseFlag(args []string, j int, dst *int) (int, error) {
+	if j >= len(args) || args[j] != "--sparse" {
+		return 0, nil
+	}
+	if j+1 >= len(args) {
+		return 0, &flagError{"--sparse needs a size", 1}
+	}
+	n, err := parseSize(args[j+1])
+	if err != nil {
+		return 0, fmt.Errorf("--sparse: %w", err)
+	}
+	*dst = int(n)
+	if n == 0 {
+		*dst = -1
+	}
+	return 2, nil
+}
+
+// interruptGrace: сколько после Ctrl-C ждём, пока отменяемая операция
+// сама уберёт за собой, прежде чем выйти жёстко.
+const interruptGrace = 5 * time.Second
+
+// reproducible applies `store --reproducible` (mtimes = SOURCE_DATE_EPOCH)
+// and returns the epoch for the format options.
+func reproducible(st *core.State) (time.Time, error) {
+	t, err := st.Reproducible()
+	if err != nil {
+		return t, fmt.Errorf("--reproducible: %w", err)
+	}
+	return t, nil
+}
+
+// exitInterrupted exits 130 if err is the SIGINT/SIGTERM cancellation.
+func exitInterrupted(err error) {
+	if errors.Is(err, context.Canceled) {
+		common.CleanupTemp()
+		fmt.Fprintln(os.Stderr, "interrupted")
+		os.Exit(130)
+	}
+}
+
+// auditStore prints the fs audit findings for what store is about to write
+// as warnings; with --fail-on-audit they are an error instead, before any output.
+func auditStore(st *core.State, exclude ...string) error {
+	found, _ := st.Audit(exclude...)
+	label := "warning: audit:"
+	if core.FailOnAudit {
+		label = "audit:"
+	}
+	for _, f := range found {
+		fmt.Fprintln(os.Stderr, label, f)
+	}
+	if core.FailOnAudit && len(found) > 0 {
+		return fmt.Errorf("store: %d audit findings (--fail-on-audit)", len(found))
+	}
+	return nil
+}
+
+// verifyStored reloads a just-written image and fails if it does not
+// decode back to the in-memory FS; entries left out by --exclude are
+// expected to be missing, and extras that early (the archive written by
+// --prepend, may be nil) holds are expected too.
+func verifyStored(st *core.State, typ, out, comp string, early *memfs.FS, exclude ...string) error {
+	all, err := st.VerifyStored(typ, out, comp)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	var diffs []core.FSDiff
+	for _, d := range all {
+		if d.Attr == "missing" && memfs.Excluded(d.Path, exclude) {
+			continue
+		}
+		if d.Attr == "extra" && early != nil {
+			if _, ok := early.Get(d.Path); ok {
+				continue
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	if len(diffs) == 0 {
+		fmt.Println("verify: OK")
+		return nil
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(os.Stderr, "verify:", d)
+	}
+	return fmt.Errorf("verify: %d differences after reloading %s", len(diffs), out)
+}
+
+// printCodecs: the compress codec table, one row per codec.
+func printCodecs() {
+	yn := func(ok bool) string {
+		if ok {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Printf("%-6s %-8s %-8s %-10s %-6s %s\n", "CODEC", "ALIASES", "COMPRESS", "DECOMPRESS", "DETECT", "LEVELS")
+	for _, c := range compress.Codecs() {
+		caps := compress.CapsOf(c)
+		aliases, levels := strings.Join(c.Aliases(), ","), caps.Levels
+		if aliases == "" {
+			aliases = "-"
+		}
+		if levels == "" {
+			levels = "-"
+		}
+		fmt.Printf("%-6s %-8s %-8s %-10s %-6s %s\n", c.Name(), aliases, yn(caps.Compress), yn(caps.Decompress), yn(caps.Detect), levels)
+	}
+	fmt.Println("none (raw) stores data as is; auto picks the codec by magic when decompressing")
+}
+
 type autoDetect struct {
 	typ  string
 	comp string
@@ -125,13 +460,49 @@ func detectImageType(path string) (autoDetect, error) {
 		switch le {
 		case 0x73717368:
 			return autoDetect{typ: "squashfs", comp: "auto"}, nil
+		case simg.Magic:
+			// Android sparse: смотрим, что лежит внутри, сам образ развернёт загрузчик
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return r, err
+			}
+			inner, err := simg.Prefix(f, 4096)
+			if err != nil {
+				return r, err
+			}
+			switch t := sniffFormat(inner); t {
+			case "ext2":
+				return autoDetect{typ: "ext2", comp: "none"}, nil
+			case "squashfs":
+				return autoDetect{typ: "squashfs", comp: "auto"}, nil
+			default:
+				return r, fmt.Errorf("%s: android sparse image holds %s, not ext2/squashfs", path, t)
+			}
 		}
 	}
+	if arm64.IsImage(head) {
+		return autoDetect{typ: "kernel-raw", comp: "none"}, nil
+	}
 	if n >= 262 && bytes.Equal(head[257:257+5], []byte("ustar")) {
 		return autoDetect{typ: "tar", comp: "none"}, nil
 	}
-	if n >= 6 && bytes.Equal(head[:6], []byte("070701")) {
-		return autoDetect{typ: "initramfs", comp: "none"}, nil
+	if cpio.IsNewc(head) {
+		// auto: a compressed archive may follow (early microcode + main initramfs)
+		return autoDetect{typ: "initramfs", comp: "auto"}, nil
+	}
+	if jffs2.IsJFFS2(head) {
+		return autoDetect{typ: "jffs2", comp: "none"}, nil
+	}
+	if ubi.IsUBI(head) {
+		return autoDetect{typ: "ubi", comp: "none"}, nil
+	}
+	if ubifs.IsUBIFS(head) {
+		return autoDetect{typ: "ubifs", comp: "none"}, nil
+	}
+	if romfs.IsRomfs(head) {
+		return autoDetect{typ: "romfs", comp: "none"}, nil
+	}
+	if cramfs.IsCramfs(head[:n]) {
+		return autoDetect{typ: "cramfs", comp: "none"}, nil
 	}
 	if n >= 2 && head[0] == 0x1f && head[1] == 0x8b {
 		if strings.HasSuffix(strings.ToLower(path), ".tar.gz") || strings.HasSuffix(strings.ToLower(path), ".tgz") {
@@ -174,6 +545,16 @@ func detectImageType(path string) (autoDetect, error) {
 		return autoDetect{typ: "initramfs", comp: "auto"}, nil
 	case ".sqsh", ".squashfs":
 		return autoDetect{typ: "squashfs", comp: "auto"}, nil
+	case ".jffs2":
+		return autoDetect{typ: "jffs2", comp: "auto"}, nil
+	case ".ubi":
+		return autoDetect{typ: "ubi", comp: "auto"}, nil
+	case ".ubifs":
+		return autoDetect{typ: "ubifs", comp: "auto"}, nil
+	case ".romfs":
+		return autoDetect{typ: "romfs", comp: "auto"}, nil
+	case ".cramfs":
+		return autoDetect{typ: "cramfs", comp: "auto"}, nil
 	case ".ext2", ".img":
 		buf := make([]byte, 2)
 		if _, err := f.Seek(1024+56, io.SeekStart); err == nil {
@@ -187,6 +568,117 @@ func detectImageType(path string) (autoDetect, error) {
 	return autoDetect{typ: "initramfs", comp: "auto"}, nil
 }
 
+// detectReport — результат `detect`: что выберет `load auto`, чем сжато и
+// что внутри после распаковки начала файла.
+type detectReport struct {
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+	Compression string `json:"compression"`
+	Inner       string `json:"inner"`
+	Error       string `json:"error,omitempty"`
+}
+
+// detectPrefix: сколько сжатых байт читаем и сколько распакованных смотрим.
+const (
+	detectReadBytes  = 1 << 20
+	detectInnerBytes = 64 << 10
+)
+
+func detectImage(path string) (detectReport, error) {
+	r := detectReport{Path: path, Inner: "unknown"}
+	ad, err := detectImageType(path)
+	if err != nil {
+		return r, err
+	}
+	r.Type = ad.typ
+	f, err := os.Open(path)
+	if err != nil {
+		return r, err
+	}
+	defer f.Close()
+	head := make([]byte, detectReadBytes)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if simg.IsSparse(head) {
+		r.Compression = "android-sparse"
+		inner, err := simg.Prefix(bytes.NewReader(head), detectInnerBytes)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Inner = sniffFormat(inner)
+		return r, nil
+	}
+	r.Compression = compress.Detect(head)
+	inner, err := compress.DecompressPrefix(head, r.Compression, detectInnerBytes, compress.CompressOpts{})
+	if err != nil {
+		// тип и сжатие уже известны — ошибку распаковки только сообщаем
+		r.Error = err.Error()
+		return r, nil
+	}
+	r.Inner = sniffFormat(inner)
+	return r, nil
+}
+
+// loadDetected loads p as detectImageType saw it (load auto, patch).
+func loadDetected(st *core.State, p string, ad autoDetect) error {
+	switch ad.typ {
+	case "initramfs":
+		return st.LoadInitramfs(p, ad.comp)
+	case "kernel-legacy":
+		return st.LoadKernelLegacy(p)
+	case "kernel-fit":
+		return st.LoadKernelFIT(p, ad.comp)
+	case "kernel-raw":
+		return st.LoadKernelRaw(p, ad.comp)
+	case "squashfs":
+		return st.LoadSquashFS(p, ad.comp)
+	case "ext2":
+		return st.LoadExt2(p, ad.comp)
+	case "tar":
+		return st.LoadTar(p, ad.comp)
+	case "jffs2":
+		return st.LoadJFFS2(p, ad.comp)
+	case "ubi":
+		return st.LoadUBI(p, ad.comp, "")
+	case "ubifs":
+		return st.LoadUBIFS(p, ad.comp)
+	case "romfs":
+		return st.LoadRomfs(p, ad.comp)
+	case "cramfs":
+		return st.LoadCramfs(p, ad.comp)
+	}
+	return fmt.Errorf("%s: unknown image type", p)
+}
+
+// sniffFormat — формат по сигнатуре в начале (уже распакованных) данных.
+func sniffFormat(b []byte) string {
+	switch {
+	case len(b) >= 6 && (bytes.Equal(b[:6], []byte("070701")) || bytes.Equal(b[:6], []byte("070702"))):
+		return "initramfs"
+	case len(b) >= 262 && bytes.Equal(b[257:262], []byte("ustar")):
+		return "tar"
+	case len(b) >= 4 && binary.LittleEndian.Uint32(b) == 0x73717368:
+		return "squashfs"
+	case len(b) >= 4 && binary.BigEndian.Uint32(b) == 0xd00dfeed:
+		return "kernel-fit"
+	case len(b) >= 4 && binary.BigEndian.Uint32(b) == 0x27051956:
+		return "kernel-legacy"
+	case len(b) >= 1024+58 && binary.LittleEndian.Uint16(b[1024+56:]) == 0xEF53:
+		return "ext2"
+	case jffs2.IsJFFS2(b):
+		return "jffs2"
+	case ubi.IsUBI(b):
+		return "ubi"
+	case ubifs.IsUBIFS(b):
+		return "ubifs"
+	case romfs.IsRomfs(b):
+		return "romfs"
+	case cramfs.IsCramfs(b):
+		return "cramfs"
+	}
+	return "unknown"
+}
+
 func parseSize(arg string) (int64, error) {
 	if arg == "" {
 		return 0, fmt.Errorf("empty size")
@@ -231,8 +723,8 @@ func doImageResize(path, spec string) error {
 		if delta < 0 {
 			return fmt.Errorf("delta < 0")
 		}
-		return os.Truncate(path, cur+delta)
-	case strings.HasPrefix(spec, "-"):
+		return core.ResizeFileTo(path, cur+delta)
+	case strings.HasPrefix(spec, "-") && !strings.HasPrefix(spec, "--to"):
 		delta, err := parseSize(strings.TrimPrefix(spec, "-"))
 		if err != nil {
 			return err
@@ -253,6 +745,9 @@ func doImageResize(path, spec string) error {
 			if err != nil {
 				return err
 			}
+			if newSize > cur {
+				return core.ResizeFileTo(path, newSize)
+			}
 			return os.Truncate(path, newSize)
 		}
 		// support: image resize <path> --to SIZE  (split args already)
@@ -268,16 +763,171 @@ func doImagePad(path string, alignStr string) error {
 	if err != nil || align <= 0 {
 		return fmt.Errorf("bad align")
 	}
-	fi, err := os.Stat(path)
+	return core.PadAlign(path, align)
+}
+
+// doImageInfo: quick facts about a raw file without loading it: size and
+// its alignment, the partition table, and what each partition (and the
+// file itself) starts with.
+func doImageInfo(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	cur := fi.Size()
-	mod := cur % align
-	if mod == 0 {
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	fmt.Printf("Size: %d bytes (%s)\n", size, common.HumanSize(size))
+	var aligned []string
+	for _, a := range []struct {
+		name string
+		n    int64
+	}{{"512", 512}, {"4K", 4 << 10}, {"1M", 1 << 20}} {
+		ok := "no"
+		if size > 0 && size%a.n == 0 {
+			ok = "yes"
+		}
+		aligned = append(aligned, a.name+" "+ok)
+	}
+	fmt.Println("Aligned:", strings.Join(aligned, ", "))
+	fmt.Println("Content at 0:", contentAt(f, 0))
+	t, err := partition.DetectR(f)
+	switch {
+	case errors.Is(err, partition.ErrNoTable) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		fmt.Println("Partition table: none")
+		return nil
+	case err != nil:
+		fmt.Println("Partition table: unreadable:", err)
 		return nil
 	}
-	return os.Truncate(path, cur+(align-mod))
+	fmt.Printf("Partition table: %s, %d partitions\n", map[partition.Scheme]string{partition.MBR: "MBR", partition.GPT: "GPT"}[t.Scheme], len(t.Entries))
+	fmt.Printf("%-3s %10s %10s %8s  %-5s %s\n", "#", "START", "END", "SIZE", "1M", "CONTENT")
+	for _, e := range t.Entries {
+		start := int64(e.StartLBA) * partition.SectorSize
+		mib := "no"
+		if start%(1<<20) == 0 {
+			mib = "yes"
+		}
+		content := "past the end of the file"
+		if start < size {
+			content = contentAt(f, start)
+		}
+		fmt.Printf("%-3d %10d %10d %8s  %-5s %s\n", e.Index, e.StartLBA, e.EndLBA, common.HumanSize(int64(e.EndLBA-e.StartLBA+1)*partition.SectorSize), mib, content)
+	}
+	return nil
+}
+
+// contentAt names the format whose magic starts at off, as detect does:
+// a filesystem or image kind, else a compressed stream, else "unknown".
+func contentAt(r io.ReaderAt, off int64) string {
+	head := make([]byte, detectInnerBytes)
+	n, _ := r.ReadAt(head, off)
+	head = head[:n]
+	if t := sniffFormat(head); t != "unknown" {
+		return t
+	}
+	if simg.IsSparse(head) {
+		return "android-sparse"
+	}
+	if c := compress.Detect(head); c != "none" {
+		return c + " data"
+	}
+	if len(head) > 0 && bytes.Count(head, []byte{0}) == len(head) {
+		return "zeros"
+	}
+	if len(head) >= 512 && head[510] == 0x55 && head[511] == 0xAA {
+		return "boot sector (MBR, FAT, ...)"
+	}
+	return "unknown"
+}
+
+// parsePartSpec: "name:size[:type]", size "-" = rest of the disk.
+func parsePartSpec(s string) (partition.PartSpec, error) {
+	f := strings.Split(s, ":")
+	if len(f) < 2 || len(f) > 3 || f[0] == "" {
+		return partition.PartSpec{}, fmt.Errorf("bad partition %q (want name:size[:type])", s)
+	}
+	p := partition.PartSpec{Name: f[0]}
+	if len(f) == 3 {
+		p.Type = f[2]
+	}
+	if f[1] != "-" {
+		n, err := parseSize(f[1])
+		if err != nil || n == 0 {
+			return p, fmt.Errorf("bad partition size %q", f[1])
+		}
+		p.Size = n
+	}
+	return p, nil
+}
+
+func printPartitions(ents []partition.Entry, scheme partition.Scheme) {
+	fmt.Println(map[partition.Scheme]string{partition.MBR: "MBR", partition.GPT: "GPT"}[scheme])
+	fmt.Printf("%-3s %10s %10s %8s  %-36s %s\n", "#", "START", "END", "SIZE", "TYPE", "NAME")
+	for _, e := range ents {
+		size := int64(e.EndLBA-e.StartLBA+1) * partition.SectorSize
+		fmt.Printf("%-3d %10d %10d %8s  %-36s %s\n", e.Index, e.StartLBA, e.EndLBA, common.HumanSize(size), e.Type, e.Name)
+	}
+}
+
+func crcStatus(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "BAD"
+}
+
+func printUImageCheck(c *legacy.Check) {
+	fmt.Println(c.H.String())
+	fmt.Printf("HCRC: %s (stored 0x%08x, computed 0x%08x)\n", crcStatus(c.HCRCOK()), c.H.HCRC, c.HCRCCalc)
+	if c.Truncated {
+		fmt.Printf("DCRC: BAD (payload truncated)\n")
+		return
+	}
+	fmt.Printf("DCRC: %s (stored 0x%08x, computed 0x%08x)\n", crcStatus(c.DCRCOK()), c.H.DCRC, c.DCRCCalc)
+}
+
+// doUImageVerify: returns false if any CRC is bad.
+func doUImageVerify(path string) (bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	c, err := legacy.Verify(b)
+	if err != nil {
+		return false, err
+	}
+	printUImageCheck(c)
+	return c.HCRCOK() && c.DCRCOK(), nil
+}
+
+// doUImageFixCRC rewrites only the header (HCRC/DCRC fields); payload and
+// any trailing bytes stay byte-identical.
+func doUImageFixCRC(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c, err := legacy.FixCRC(b)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(b[:legacy.HeaderSize], 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	printUImageCheck(c)
+	return nil
 }
 
 func main() {
@@ -291,6 +941,14 @@ func main() {
 	if env := os.Getenv("GOIMAGETOOL_SESSION"); env != "" {
 		sessionPath = env
 	}
+	if env := os.Getenv("GOIMAGETOOL_MAX_SIZE"); env != "" {
+		n, err := parseSize(env)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "GOIMAGETOOL_MAX_SIZE:", err)
+			os.Exit(2)
+		}
+		common.MaxDecompressedSize = n
+	}
 	if len(args) >= 1 && args[0] == "--session" {
 		switch {
 		case len(args) >= 2 && args[1] == "auto":
@@ -305,8 +963,28 @@ func main() {
 		}
 	}
 
+	// Ctrl-C посреди store не должен оставлять гигабайты во временном каталоге.
+	// store squashfs/ext2 видят отмену ctx сами (mke2fs убивается, temp
+	// убирается release); всё прочее, второй Ctrl-C или зависший шаг —
+	// жёсткий выход, как раньше.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sig:
+		case <-time.After(interruptGrace):
+		}
+		common.CleanupTemp()
+		fmt.Fprintln(os.Stderr, "interrupted")
+		os.Exit(130)
+	}()
+
 	st := core.New()
 	loaded := false
+	autosave := true
 
 	if sessionPath != "" {
 		if err := st.LoadSession(sessionPath); err == nil {
@@ -316,18 +994,89 @@ func main() {
 			_ = os.MkdirAll(dir, 0o755)
 		}
 	}
+	// сессия переписывается в конце, только если команды что-то изменили
+	st.MarkSaved()
 
 	i := 0
+	start := 0 // where the running command began
+	// and the state it began with: a failed load --into leaves its scratch State in st
+	base, baseLoaded := st, loaded
+	var failed []string // --keep-going: the failed commands, for the summary
+	code := 0
+	loadFailed := false // a load failed under --keep-going: nothing is stored after it
+	// fail ends the run with status c, or under --keep-going records the
+	// failed command and returns where the loop goes on: past next, the end
+	// of the command's arguments, at the next command word. The error has
+	// been printed already.
+	fail := func(c, next int) int {
+		if !keepGoing {
+			os.Exit(c)
+		}
+		next = nextCommand(args, min(max(next, start+1), len(args)))
+		failed = append(failed, fmt.Sprintf("%s (exit %d)", strings.Join(args[start:next], " "), c))
+		code = max(code, c)
+		st, loaded = base, baseLoaded
+		if args[start] == "load" || args[start] == "session" && start+1 < len(args) && args[start+1] == "load" {
+			loadFailed = true
+		}
+		return next
+	}
+cmds:
 	for i < len(args) {
+		start, base, baseLoaded = i, st, loaded
 		switch args[i] {
 		case "help", "-h", "--help":
 			usage()
 			return
+		case "--allow-unsafe-paths":
+			// только для разбора подозрительных архивов: ".." обрезается до корня
+			common.AllowUnsafePaths = true
+			i++
+
+		case "--max-size":
+			if i+1 >= len(args) {
+				usage()
+				i = fail(1, i+2)
+				continue cmds
+			}
+			n, err := parseSize(args[i+1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "--max-size:", err)
+				i = fail(2, i+2)
+				continue cmds
+			}
+			common.MaxDecompressedSize = n
+			i += 2
+
+		case "-v", "--verbose":
+			st.Progress = core.NewTextProgress(os.Stderr)
+			i++
+
+		case "--no-clobber":
+			common.OutputClobber = common.ClobberNever
+			i++
+
+		case "--backup":
+			common.OutputClobber = common.ClobberBackup
+			i++
+
+		case "--fail-on-audit":
+			core.FailOnAudit = true
+			i++
+
+		case "--no-autosave":
+			autosave = false
+			i++
+
+		case "--keep-going", "-k":
+			keepGoing = true
+			i++
 
 		case "session":
 			if i+1 >= len(args) {
 				usage()
-				os.Exit(1)
+				i = fail(1, len(args))
+				continue cmds
 			}
 			act := args[i+1]
 			switch act {
@@ -340,9 +1089,15 @@ func main() {
 				if p == "" {
 					p = defaultSessionPath()
 				}
+				if loadFailed {
+					fmt.Fprintln(os.Stderr, "session save: skipped, an earlier load failed")
+					i = fail(2, i+2)
+					continue cmds
+				}
 				if err := st.SaveSession(p); err != nil {
 					fmt.Fprintln(os.Stderr, "session save:", err)
-					os.Exit(2)
+					i = fail(2, i+2)
+					continue cmds
 				}
 				i += 2
 			case "load":
@@ -356,78 +1111,120 @@ func main() {
 				}
 				if err := st.LoadSession(p); err != nil {
 					fmt.Fprintln(os.Stderr, "session load:", err)
-					os.Exit(2)
+					i = fail(2, i+2)
+					continue cmds
 				}
 				loaded = true
 				i += 2
 			case "clear":
+				prog := st.Progress
 				st = core.New()
+				st.Progress = prog
 				loaded = false
 				i += 2
+			case "info":
+				p := sessionPath
+				if isOpt(args, i+2) {
+					p = args[i+2]
+					i++
+				}
+				if p == "" {
+					p = defaultSessionPath()
+				}
+				inf, err := core.ReadSessionInfo(p)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "session info:", err)
+					i = fail(2, i+2)
+					continue cmds
+				}
+				fit := "no"
+				if inf.HasFIT {
+					fit = fmt.Sprintf("yes (%d images)", inf.FITImages)
+				}
+				fmt.Printf("Session: %s\n   Kind: %s\nEntries: %d\n   Data: %d bytes\n    FIT: %s\n    Raw: %d bytes\n",
+					p, inf.Kind, inf.Entries, inf.DataBytes, fit, inf.RawBytes)
+				i += 2
 			default:
 				fmt.Fprintln(os.Stderr, "unknown session action:", act)
-				os.Exit(2)
+				i = fail(2, i+2)
+				continue cmds
 			}
 
 		case "load":
+			// load --into NAME ...: грузим во временный State и кладём FS в слот
+			into := ""
+			if i+2 < len(args) && args[i+1] == "--into" {
+				into = args[i+2]
+				i += 2
+			}
 			if i+2 >= len(args) {
 				usage()
-				os.Exit(1)
+				i = fail(1, len(args))
+				continue cmds
+			}
+			cur, curLoaded := st, loaded
+			if into != "" {
+				st = core.New()
+				st.Codec = cur.Codec
+				st.Progress = cur.Progress
+			} else {
+				st.Cwd = "" // новый образ — с корня
 			}
 			typ := args[i+1]
 			switch typ {
 			case "auto":
 				p := args[i+2]
+				n, err := zstdDictFlag(st, args, i+3)
+				if err != nil {
+					i = fail(report(err), i+3)
+					continue cmds
+				}
+				i += n
 				ad, err := detectImageType(p)
 				if err != nil {
 					fmt.Fprintln(os.Stderr, "auto:", err)
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
 				}
-				switch ad.typ {
-				case "initramfs":
-					if err := st.LoadInitramfs(p, ad.comp); err != nil {
-						fmt.Fprintln(os.Stderr, "load:", err)
-						os.Exit(2)
-					}
-				case "kernel-legacy":
-					if err := st.LoadKernelLegacy(p); err != nil {
-						fmt.Fprintln(os.Stderr, "load:", err)
-						os.Exit(2)
-					}
-				case "kernel-fit":
-					if err := st.LoadKernelFIT(p, ad.comp); err != nil {
-						fmt.Fprintln(os.Stderr, "load:", err)
-						os.Exit(2)
-					}
-				case "squashfs":
-					if err := st.LoadSquashFS(p, ad.comp); err != nil {
-						fmt.Fprintln(os.Stderr, "load:", err)
-						os.Exit(2)
-					}
-				case "ext2":
-					if err := st.LoadExt2(p, ad.comp); err != nil {
-						fmt.Fprintln(os.Stderr, "load:", err)
-						os.Exit(2)
-					}
-				case "tar":
-					if err := st.LoadTar(p, ad.comp); err != nil {
-						fmt.Fprintln(os.Stderr, "load:", err)
-						os.Exit(2)
-					}
-				default:
-					fmt.Fprintln(os.Stderr, "auto: unknown type")
-					os.Exit(2)
+				if err := loadDetected(st, p, ad); err != nil {
+					fmt.Fprintln(os.Stderr, "load:", err)
+					i = fail(2, i+3)
+					continue cmds
 				}
 				loaded = true
 				i += 3
 
-			case "initramfs", "kernel-legacy", "kernel-fit", "squashfs", "ext2", "tar":
+			case "initramfs", "kernel-legacy", "kernel-fit", "kernel-raw", "squashfs", "ext2", "tar", "jffs2", "ubi", "ubifs", "romfs", "cramfs":
 				p := args[i+2]
 				comp := "auto"
-				if (typ == "initramfs" || typ == "kernel-fit" || typ == "ext2" || typ == "squashfs" || typ == "tar") && i+3 < len(args) {
+				if typ != "kernel-legacy" && isOpt(args, i+3) {
 					comp = args[i+3]
 					i++
 				}
+				native, volume := false, ""
+				if typ == "ubi" && i+4 < len(args) && args[i+3] == "--volume" {
+					volume = args[i+4]
+					i += 2
+				}
+				for typ == "initramfs" || typ == "kernel-fit" || typ == "ext2" || typ == "squashfs" {
+					if (typ == "ext2" || typ == "squashfs") && i+3 < len(args) && args[i+3] == "--native" {
+						native = true
+						i++
+						continue
+					}
+					if typ == "squashfs" {
+						break
+					}
+					n, err := zstdDictFlag(st, args, i+3)
+					if err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					}
+					if n == 0 {
+						break
+					}
+					i += n
+				}
 				var err error
 				switch typ {
 				case "initramfs":
@@ -436,115 +1233,612 @@ func main() {
 					err = st.LoadKernelLegacy(p)
 				case "kernel-fit":
 					err = st.LoadKernelFIT(p, comp)
+				case "kernel-raw":
+					err = st.LoadKernelRaw(p, comp)
 				case "squashfs":
-					err = st.LoadSquashFS(p, comp)
+					if native {
+						err = st.LoadSquashFSNative(p, comp)
+					} else {
+						err = st.LoadSquashFS(p, comp)
+					}
 				case "ext2":
-					err = st.LoadExt2(p, comp)
+					if native {
+						err = st.LoadExt2Native(p, comp)
+					} else {
+						err = st.LoadExt2(p, comp)
+					}
 				case "tar":
 					err = st.LoadTar(p, comp)
+				case "jffs2":
+					err = st.LoadJFFS2(p, comp)
+				case "ubi":
+					err = st.LoadUBI(p, comp, volume)
+				case "ubifs":
+					err = st.LoadUBIFS(p, comp)
+				case "romfs":
+					err = st.LoadRomfs(p, comp)
+				case "cramfs":
+					err = st.LoadCramfs(p, comp)
 				}
 				if err != nil {
 					fmt.Fprintln(os.Stderr, "load:", err)
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
 				}
 				loaded = true
 				i += 3
 
 			default:
 				fmt.Fprintln(os.Stderr, "unknown load type:", typ)
-				os.Exit(2)
+				i = fail(2, i+3)
+				continue cmds
 			}
-
-		case "fs":
-			if !loaded {
+			// имена образов, которые не годятся в имя узла DT (U-Boot может отвергнуть)
+			if m, _ := st.Meta.(*core.FitMeta); m != nil && m.F != nil {
+				for _, w := range m.F.BadNames() {
+					fmt.Fprintln(os.Stderr, "warning: fit:", w)
+				}
+			}
+			if into != "" {
+				if st.FS == nil {
+					fmt.Fprintf(os.Stderr, "load --into %s: %s has no filesystem\n", into, typ)
+					i = fail(2, i)
+					continue cmds
+				}
+				if err := cur.SetSlot(into, st.FS); err != nil {
+					fmt.Fprintln(os.Stderr, "load:", err)
+					i = fail(2, i)
+					continue cmds
+				}
+				st, loaded = cur, curLoaded
+			}
+
+		case "fs":
+			if !loaded && !(i+1 < len(args) && args[i+1] == "import") {
 				fmt.Fprintln(os.Stderr, "no image loaded; use 'load' or 'session load' first")
-				os.Exit(2)
+				i = fail(2, i+2)
+				continue cmds
 			}
 			if i+1 >= len(args) {
 				usage()
-				os.Exit(1)
+				i = fail(1, len(args))
+				continue cmds
 			}
 			a := args[i+1]
 			switch a {
 			case "ls":
-				p := "/"
-				follow := false
+				p := ""
+				follow, recursive, human := false, false, false
+				sortBy, reverse := "name", false
 				consumed := 2
 				j := i + 2
-				if j < len(args) && args[j] == "-L" {
-					follow = true
+				for j < len(args) && (args[j] == "-L" || args[j] == "-R" || args[j] == "-h" || args[j] == "--human" || args[j] == "--sort" || args[j] == "--reverse") {
+					if args[j] == "--sort" {
+						if j+1 >= len(args) {
+							fmt.Fprintln(os.Stderr, "fs ls: --sort needs name, size or mtime")
+							i = fail(1, i+consumed)
+							continue cmds
+						}
+						sortBy = args[j+1]
+						j++
+						consumed++
+					}
+					follow = follow || args[j] == "-L"
+					recursive = recursive || args[j] == "-R"
+					human = human || args[j] == "-h" || args[j] == "--human"
+					reverse = reverse || args[j] == "--reverse"
 					j++
 					consumed++
 				}
+				order, err := core.ParseEntryOrder(sortBy, reverse)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs ls:", err)
+					i = fail(1, i+consumed)
+					continue cmds
+				}
 				if j < len(args) && !strings.HasPrefix(args[j], "-") {
 					p = args[j]
 					consumed++
 				}
-				resolved, ent := resolvePathFollow(st.FS, p, follow)
+				resolved, ent, err := resolvePathFollow(st.FS, st.FSPath(p), follow)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs ls:", err)
+					i = fail(2, i+consumed)
+					continue cmds
+				}
 				fmt.Printf("TYPE MODE    UID:GID  SIZE  NAME\n")
 				if ent == nil {
 					i += consumed
 					break
 				}
-				if ent.Mode&memfs.ModeDir != 0 {
-					for _, e := range st.FS.List(resolved) {
-						printEntryLine(e)
+				if recursive && ent.Mode.Type() == memfs.ModeDir {
+					tot, err := st.FSTreeSorted(resolved, follow, order, func(depth int, e *memfs.Entry, loop bool) {
+						fmt.Print(strings.Repeat("  ", depth))
+						printEntryLine(e, human)
+						if loop {
+							fmt.Printf("%s  (symlink loop, not followed)\n", strings.Repeat("  ", depth))
+						}
+					})
+					if err != nil {
+						fmt.Fprintln(os.Stderr, "fs ls:", err)
+						i = fail(2, i+consumed)
+						continue cmds
+					}
+					bytes := fmt.Sprintf("%d bytes", tot.Bytes)
+					if human {
+						bytes = common.HumanSize(tot.Bytes)
+					}
+					fmt.Printf("total: %d files, %d dirs, %d symlinks, %d devices, %s\n",
+						tot.Files, tot.Dirs, tot.Links, tot.Devices, bytes)
+					i += consumed
+					break
+				}
+				if ent.Mode.Type() == memfs.ModeDir {
+					es := st.FS.List(resolved)
+					order.Sort(es)
+					for _, e := range es {
+						printEntryLine(e, human)
 					}
 				} else {
-					printEntryLine(ent)
+					printEntryLine(ent, human)
 				}
 				i += consumed
 
-			case "add":
+			case "du":
+				p := ""
+				var block int64
+				human := false
+				j := i + 2
+				for j < len(args) && strings.HasPrefix(args[j], "-") {
+					switch args[j] {
+					case "--block":
+						if j+1 >= len(args) {
+							fmt.Fprintln(os.Stderr, "fs du: --block needs a size")
+							i = fail(1, j)
+							continue cmds
+						}
+						n, err := parseSize(args[j+1])
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "fs du:", err)
+							i = fail(2, j)
+							continue cmds
+						}
+						block = n
+						j += 2
+					case "-h", "--human":
+						human = true
+						j++
+					default:
+						fmt.Fprintln(os.Stderr, "fs du: unknown option", args[j])
+						i = fail(1, j)
+						continue cmds
+					}
+				}
+				if j < len(args) && !strings.HasPrefix(args[j], "-") {
+					p = args[j]
+					j++
+				}
+				dirs, total, err := st.FSDu(st.FSPath(p), block)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs du:", err)
+					i = fail(2, j)
+					continue cmds
+				}
+				for _, d := range dirs {
+					fmt.Printf("%10s  %s\n", common.FormatSize(d.Bytes, human), d.Name)
+				}
+				fmt.Printf("%10s  total\n", common.FormatSize(total, human))
+				i = j
+
+			case "grep":
+				var opt core.GrepOptions
+				j := i + 2
+				for j < len(args) && strings.HasPrefix(args[j], "-") {
+					switch args[j] {
+					case "-i":
+						opt.IgnoreCase = true
+					case "-n":
+						opt.All = true
+					case "--regex":
+						opt.Regex = true
+					case "--binary":
+						opt.Binary = true
+					default:
+						fmt.Fprintln(os.Stderr, "fs grep: unknown flag", args[j])
+						i = fail(2, j)
+						continue cmds
+					}
+					j++
+				}
+				if j >= len(args) {
+					usage()
+					i = fail(1, j)
+					continue cmds
+				}
+				pattern, p := args[j], ""
+				j++
+				if j < len(args) && !strings.HasPrefix(args[j], "-") {
+					p = args[j]
+					j++
+				}
+				matches, err := st.FSGrep(pattern, st.FSPath(p), opt)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs grep:", err)
+					i = fail(2, j)
+					continue cmds
+				}
+				for _, m := range matches {
+					switch {
+					case !opt.All:
+						fmt.Println(m.Path)
+					case m.Line == 0:
+						fmt.Printf("%s:%#x\n", m.Path, m.Offset)
+					default:
+						fmt.Printf("%s:%d:%s\n", m.Path, m.Line, m.Text)
+					}
+				}
+				if len(matches) == 0 {
+					i = fail(1, j)
+					continue cmds
+				}
+				i = j
+
+			case "find":
+				var opt core.FindOptions
+				p := ""
+				j := i + 2
+				if j < len(args) && !strings.HasPrefix(args[j], "-") {
+					p = args[j]
+					j++
+				}
+				for j < len(args) && strings.HasPrefix(args[j], "-") {
+					if j+1 >= len(args) {
+						fmt.Fprintf(os.Stderr, "fs find: %s needs a value\n", args[j])
+						i = fail(1, j)
+						continue cmds
+					}
+					v := args[j+1]
+					switch args[j] {
+					case "-type":
+						opt.Type = v
+					case "-name":
+						opt.Name = v
+					case "-size":
+						// +N больше, -N меньше, N ровно; суффиксы как у --block
+						opt.HasSize = true
+						switch {
+						case strings.HasPrefix(v, "+"):
+							opt.SizeCmp, v = 1, v[1:]
+						case strings.HasPrefix(v, "-"):
+							opt.SizeCmp, v = -1, v[1:]
+						}
+						n, err := parseSize(v)
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "fs find: -size:", err)
+							i = fail(2, j)
+							continue cmds
+						}
+						opt.Size = n
+					case "-perm":
+						opt.PermMatch = '='
+						if strings.HasPrefix(v, "-") || strings.HasPrefix(v, "/") {
+							opt.PermMatch, v = v[0], v[1:]
+						}
+						n, err := strconv.ParseUint(v, 8, 32)
+						if err != nil || n > 0o7777 {
+							fmt.Fprintln(os.Stderr, "fs find: -perm: want octal mode, -mode or /mode:", args[j+1])
+							i = fail(2, j)
+							continue cmds
+						}
+						opt.Perm = memfs.Mode(n)
+					default:
+						fmt.Fprintln(os.Stderr, "fs find: unknown predicate", args[j])
+						i = fail(2, j)
+						continue cmds
+					}
+					j += 2
+				}
+				found, err := st.FSFind(st.FSPath(p), opt)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs find:", err)
+					i = fail(2, j)
+					continue cmds
+				}
+				for _, e := range found {
+					fmt.Println(e.Name)
+				}
+				i = j
+
+			case "cd":
+				p := "/"
+				if isOpt(args, i+2) {
+					p = args[i+2]
+					i++
+				}
+				if err := st.FSChdir(p); err != nil {
+					fmt.Fprintln(os.Stderr, "fs cd:", err)
+					i = fail(2, i+2)
+					continue cmds
+				}
+				i += 2
+
+			case "pwd":
+				fmt.Println(st.FSPwd())
+				i += 2
+
+			case "audit":
+				found, err := st.Audit()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs audit:", err)
+					i = fail(2, i+2)
+					continue cmds
+				}
+				for _, f := range found {
+					fmt.Println(f)
+				}
+				if len(found) > 0 {
+					fmt.Fprintf(os.Stderr, "fs audit: %d findings\n", len(found))
+					i = fail(1, i+2)
+					continue cmds
+				}
+				i += 2
+
+			case "symlink-check":
+				all := i+2 < len(args) && args[i+2] == "--all"
+				links, err := st.SymlinkCheck()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs symlink-check:", err)
+					i = fail(2, i+2)
+					continue cmds
+				}
+				broken := 0
+				for _, l := range links {
+					if l.Dangling || l.Loop {
+						broken++
+					}
+					if all || !l.OK() {
+						fmt.Println(l)
+					}
+				}
+				if broken > 0 {
+					fmt.Fprintf(os.Stderr, "fs symlink-check: %d of %d symlinks dangle or loop\n", broken, len(links))
+					i = fail(1, i+2)
+					continue cmds
+				}
+				i += 2
+				if all {
+					i++
+				}
+
+			case "overlay":
+				if i+2 >= len(args) {
+					usage()
+					i = fail(1, i+3)
+					continue cmds
+				}
+				n, err := st.FSOverlay(args[i+2])
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs overlay:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				fmt.Printf("overlay: %d entries from %s\n", n, args[i+2])
+				i += 3
+
+			case "stat":
+				follow := false
+				j := i + 2
+				if j < len(args) && args[j] == "-L" {
+					follow = true
+					j++
+				}
+				if j >= len(args) {
+					usage()
+					i = fail(1, j+1)
+					continue cmds
+				}
+				resolved, ent, err := resolvePathFollow(st.FS, st.FSPath(args[j]), follow)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs stat:", err)
+					i = fail(2, j+1)
+					continue cmds
+				}
+				if ent == nil {
+					fmt.Fprintln(os.Stderr, "fs stat: no such entry:", resolved)
+					i = fail(2, j+1)
+					continue cmds
+				}
+				printStat(resolved, ent)
+				i = j + 1
+
+			case "setcap":
 				if i+3 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+4)
+					continue cmds
 				}
-				src, dst := args[i+2], args[i+3]
-				if err := st.FSAddLocal(src, dst); err != nil {
-					fmt.Fprintln(os.Stderr, "fs add:", err)
-					os.Exit(2)
+				caps := args[i+2]
+				if caps == "-r" {
+					caps = ""
+				}
+				if err := st.FSSetCap(st.FSPath(args[i+3]), caps); err != nil {
+					fmt.Fprintln(os.Stderr, "fs setcap:", err)
+					i = fail(2, i+4)
+					continue cmds
 				}
 				i += 4
+
+			case "getcap":
+				if i+2 >= len(args) {
+					usage()
+					i = fail(1, i+3)
+					continue cmds
+				}
+				p := st.FSPath(args[i+2])
+				caps, err := st.FSGetCap(p)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "fs getcap:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				if caps != "" {
+					fmt.Println(p, caps)
+				}
+				i += 3
+
+			case "chmod", "chown":
+				recursive := false
+				j := i + 2
+				if j < len(args) && args[j] == "-R" {
+					recursive = true
+					j++
+				}
+				if j+1 >= len(args) {
+					usage()
+					i = fail(1, j+2)
+					continue cmds
+				}
+				var n int
+				var err error
+				if a == "chmod" {
+					n, err = st.FSChmod(st.FSPath(args[j+1]), args[j], recursive)
+				} else {
+					n, err = st.FSChown(st.FSPath(args[j+1]), args[j], recursive)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "fs %s: %v\n", a, err)
+					i = fail(2, j+2)
+					continue cmds
+				}
+				fmt.Printf("%s: %d entries\n", a, n)
+				i = j + 2
+
+			case "add":
+				var opt core.AddOptions
+				j := i + 2
+				for j+1 < len(args) && strings.HasPrefix(args[j], "-") {
+					if args[j] == "-L" || args[j] == "--follow-symlinks" {
+						opt.Follow = true
+						j++
+						continue
+					}
+					switch args[j] {
+					case "--owner":
+						uid, gid, err := core.ParseOwner(args[j+1])
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "fs add:", err)
+							i = fail(2, j)
+							continue cmds
+						}
+						opt.Owner, opt.UID, opt.GID = true, uid, gid
+					case "--mode":
+						opt.Mode = args[j+1]
+					case "--exclude":
+						opt.Exclude = append(opt.Exclude, args[j+1])
+					default:
+						fmt.Fprintln(os.Stderr, "fs add: unknown flag", args[j])
+						i = fail(2, j)
+						continue cmds
+					}
+					j += 2
+				}
+				if j+1 >= len(args) {
+					usage()
+					i = fail(1, j+2)
+					continue cmds
+				}
+				src, dst := args[j], st.FSPath(args[j+1])
+				if err := st.FSAddLocalWith(src, dst, opt); err != nil {
+					fmt.Fprintln(os.Stderr, "fs add:", err)
+					i = fail(2, j+2)
+					continue cmds
+				}
+				i = j + 2
 			case "extract":
 				if i+2 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+3)
+					continue cmds
 				}
 				dst := args[i+2]
 				if err := os.MkdirAll(dst, 0755); err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
 				}
 				if err := st.FSExtract(dst); err != nil {
 					fmt.Fprintln(os.Stderr, "fs extract:", err)
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				if i+4 < len(args) && args[i+3] == "--metadata" {
+					if err := st.WriteManifest(args[i+4]); err != nil {
+						fmt.Fprintln(os.Stderr, "fs extract:", err)
+						i = fail(2, i+3)
+						continue cmds
+					}
+					i += 2
 				}
 				i += 3
+			case "import":
+				if i+4 >= len(args) || args[i+3] != "--metadata" {
+					usage()
+					i = fail(1, i+5)
+					continue cmds
+				}
+				if err := st.FSImport(args[i+2], args[i+4]); err != nil {
+					fmt.Fprintln(os.Stderr, "fs import:", err)
+					i = fail(2, i+5)
+					continue cmds
+				}
+				loaded = true
+				i += 5
+			case "cp":
+				recursive := false
+				j := i + 2
+				if j < len(args) && args[j] == "-r" {
+					recursive = true
+					j++
+				}
+				if j+1 >= len(args) {
+					usage()
+					i = fail(1, j+2)
+					continue cmds
+				}
+				if _, err := st.FSCopy(st.FSPath(args[j]), st.FSPath(args[j+1]), recursive); err != nil {
+					fmt.Fprintln(os.Stderr, "fs cp:", err)
+					i = fail(2, j+2)
+					continue cmds
+				}
+				i = j + 2
 			case "ln":
 				if i+4 >= len(args) || args[i+2] != "-s" {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+5)
+					continue cmds
 				}
-				target, dst := args[i+3], args[i+4]
+				target, dst := args[i+3], st.FSPath(args[i+4])
 				st.FS.PutSymlink(dst, target, 0, 0, time.Now())
 				i += 5
 			case "mknod":
 				if i+6 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+6)
+					continue cmds
 				}
 				typ := args[i+2]
 				var maj, min int
 				if _, err := fmt.Sscanf(args[i+3], "%d", &maj); err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(2)
+					i = fail(2, i+6)
+					continue cmds
 				}
 				if _, err := fmt.Sscanf(args[i+4], "%d", &min); err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(2)
+					i = fail(2, i+6)
+					continue cmds
 				}
-				dst := args[i+5]
+				dst := st.FSPath(args[i+5])
 				var mode memfs.Mode
 				switch typ {
 				case "c":
@@ -555,19 +1849,22 @@ func main() {
 					mode = memfs.ModeFIFO
 				default:
 					fmt.Fprintln(os.Stderr, "unknown node type, use c|b|p")
-					os.Exit(2)
+					i = fail(2, i+6)
+					continue cmds
 				}
 				st.FS.PutNode(dst, mode, 0o666, 0, 0, uint32(maj), uint32(min), time.Now())
 				i += 6
 			default:
 				fmt.Fprintln(os.Stderr, "unknown fs action:", a)
-				os.Exit(2)
+				i = fail(2, i+2)
+				continue cmds
 			}
 
 		case "fit":
 			if i+1 >= len(args) {
 				usage()
-				os.Exit(1)
+				i = fail(1, len(args))
+				continue cmds
 			}
 			a := args[i+1]
 			switch a {
@@ -578,10 +1875,41 @@ func main() {
 				i += 2
 
 			case "ls":
+				if i+2 < len(args) && args[i+2] == "--no-data" {
+					// оглавление ITB с диска, payload не читаем и ничего не загружаем
+					if i+3 >= len(args) {
+						usage()
+						i = fail(1, i+2)
+						continue cmds
+					}
+					f, err := os.Open(args[i+3])
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						i = fail(2, i+2)
+						continue cmds
+					}
+					infos, err := fit.ReadHeader(f)
+					f.Close()
+					if err != nil {
+						fmt.Fprintln(os.Stderr, "fit ls:", err)
+						i = fail(2, i+2)
+						continue cmds
+					}
+					for _, in := range infos {
+						ext := ""
+						if in.External {
+							ext = ", external"
+						}
+						fmt.Printf("%s (%s, %s, %d bytes at 0x%x%s)\n", in.Name, in.Type, strings.Join(in.HashAlgos, ","), in.Size, in.Offset, ext)
+					}
+					i += 4
+					break
+				}
 				m, _ := st.Meta.(*core.FitMeta)
 				if m == nil || m.F == nil {
 					fmt.Fprintln(os.Stderr, "no FIT loaded")
-					os.Exit(2)
+					i = fail(2, i+2)
+					continue cmds
 				}
 				for _, name := range m.F.List() {
 					mark := ""
@@ -593,7 +1921,11 @@ func main() {
 					if typ == "" {
 						typ = "blob"
 					}
-					fmt.Printf("%s%s (%s, %s)\n", name, mark, typ, img.HashAlgo)
+					addr := ""
+					if img.Load != 0 || img.Entry != 0 {
+						addr = fmt.Sprintf(", load 0x%x entry 0x%x", img.Load, img.Entry)
+					}
+					fmt.Printf("%s%s (%s, %s%s)\n", name, mark, typ, img.HashAlgos(), addr)
 				}
 				i += 2
 
@@ -601,17 +1933,25 @@ func main() {
 				m, _ := st.Meta.(*core.FitMeta)
 				if m == nil || m.F == nil {
 					fmt.Fprintln(os.Stderr, "no FIT loaded")
-					os.Exit(2)
+					i = fail(2, i+2)
+					continue cmds
 				}
 				j := i + 2
 				setType := ""
 				setHash := "sha1"
+				var loadBase uint64
+				sanitize := false
 				for j < len(args) && strings.HasPrefix(args[j], "-") {
 					switch args[j] {
+					case "--sanitize":
+						sanitize = true
+						j++
+						continue
 					case "--type", "-t":
 						if j+1 >= len(args) {
 							fmt.Fprintln(os.Stderr, "fit add: missing value for --type")
-							os.Exit(2)
+							i = fail(2, j)
+							continue cmds
 						}
 						setType = args[j+1]
 						j += 2
@@ -619,56 +1959,102 @@ func main() {
 					case "--hash", "-H":
 						if j+1 >= len(args) {
 							fmt.Fprintln(os.Stderr, "fit add: missing value for --hash")
-							os.Exit(2)
+							i = fail(2, j)
+							continue cmds
 						}
 						setHash = args[j+1]
 						j += 2
 						continue
+					case "--load-base":
+						if j+1 >= len(args) {
+							fmt.Fprintln(os.Stderr, "fit add: missing value for --load-base")
+							i = fail(2, j)
+							continue cmds
+						}
+						v, err := strconv.ParseUint(args[j+1], 0, 64)
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "fit add: bad --load-base:", args[j+1])
+							i = fail(2, j)
+							continue cmds
+						}
+						loadBase = v
+						j += 2
+						continue
 					default:
 						fmt.Fprintln(os.Stderr, "fit add: unknown flag", args[j])
-						os.Exit(2)
+						i = fail(2, j)
+						continue cmds
 					}
 				}
 				if j+1 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, j+2)
+					continue cmds
 				}
 				name, file := args[j], args[j+1]
+				if sanitize && fit.CheckNodeName(name) != nil {
+					name = fit.SanitizeNodeName(name)
+					fmt.Fprintf(os.Stderr, "fit add: image name %q -> %q\n", args[j], name)
+				}
 				b, err := os.ReadFile(file)
 				if err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(2)
+					i = fail(2, j+2)
+					continue cmds
+				}
+				// arm64 Image: тип и load/entry берём из заголовка (base + text_offset)
+				ah, _ := arm64.Parse(b)
+				if ah != nil && setType == "" {
+					setType = "kernel"
 				}
 				if err := m.F.AddTyped(name, b, setHash, setType); err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(2)
+					i = fail(2, j+2)
+					continue cmds
+				}
+				if ah != nil && setType == "kernel" {
+					img, _ := m.F.Get(name)
+					img.Load = ah.LoadAddr(loadBase)
+					img.Entry = img.Load
 				}
 				i = j + 2
 
 			case "rm":
 				if i+2 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+3)
+					continue cmds
 				}
 				name := args[i+2]
 				m, _ := st.Meta.(*core.FitMeta)
 				if m == nil || m.F == nil {
 					fmt.Fprintln(os.Stderr, "no FIT loaded")
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
 				}
+				wasDefault := m.F.Default == name
+				users := m.F.ConfigsUsing(name)
 				m.F.Remove(name)
+				if wasDefault && m.F.Default != "" {
+					fmt.Fprintln(os.Stderr, "fit rm: default image is now", m.F.Default)
+				}
+				if len(users) > 0 {
+					fmt.Fprintf(os.Stderr, "fit rm: warning: %s still referenced by config %s\n", name, strings.Join(users, ", "))
+				}
 				i += 3
 
 			case "set-default":
 				if i+2 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+3)
+					continue cmds
 				}
 				name := args[i+2]
 				m, _ := st.Meta.(*core.FitMeta)
 				if m == nil || m.F == nil {
 					fmt.Fprintln(os.Stderr, "no FIT loaded")
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
 				}
 				m.F.SetDefault(name)
 				i += 3
@@ -676,22 +2062,37 @@ func main() {
 			case "extract":
 				if i+3 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+4)
+					continue cmds
 				}
 				name, out := args[i+2], args[i+3]
 				m, _ := st.Meta.(*core.FitMeta)
 				if m == nil || m.F == nil {
 					fmt.Fprintln(os.Stderr, "no FIT loaded")
-					os.Exit(2)
+					i = fail(2, i+4)
+					continue cmds
 				}
 				img, err := m.F.Get(name)
 				if err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(2)
+					i = fail(2, i+4)
+					continue cmds
+				}
+				if err := common.PrepareOutput(out); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					i = fail(2, i+4)
+					continue cmds
+				}
+				data, err := img.ReadData()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					i = fail(2, i+4)
+					continue cmds
 				}
-				if err := os.WriteFile(out, img.Data, 0644); err != nil {
+				if err := os.WriteFile(out, data, 0644); err != nil {
 					fmt.Fprintln(os.Stderr, err)
-					os.Exit(2)
+					i = fail(2, i+4)
+					continue cmds
 				}
 				i += 4
 
@@ -699,97 +2100,552 @@ func main() {
 				m, _ := st.Meta.(*core.FitMeta)
 				if m == nil || m.F == nil {
 					fmt.Fprintln(os.Stderr, "no FIT loaded")
-					os.Exit(2)
+					i = fail(2, i+2)
+					continue cmds
 				}
 				if i+2 < len(args) && !strings.HasPrefix(args[i+2], "-") {
 					ok, err := m.F.VerifyOne(args[i+2])
 					if err != nil {
 						fmt.Fprintln(os.Stderr, err)
-						os.Exit(2)
+						i = fail(2, i+3)
+						continue cmds
 					}
 					if !ok {
 						fmt.Fprintln(os.Stderr, "verify: mismatch")
-						os.Exit(2)
+						i = fail(2, i+3)
+						continue cmds
 					}
 					fmt.Println("OK")
 					i += 3
 				} else {
 					if err := m.F.Verify(); err != nil {
 						fmt.Fprintln(os.Stderr, err)
-						os.Exit(2)
+						i = fail(2, i+2)
+						continue cmds
 					}
-					fmt.Println("OK")
+					fmt.Printf("OK (%d images, %d configs)\n", len(m.F.List()), len(m.F.Configs))
 					i += 2
 				}
 
-			default:
-				fmt.Fprintln(os.Stderr, "unknown fit action:", a)
-				os.Exit(2)
-			}
-
-		case "store":
-			if !loaded {
-				fmt.Fprintln(os.Stderr, "nothing loaded to store")
-				os.Exit(2)
-			}
-			if i+2 >= len(args) {
-				usage()
-				os.Exit(1)
-			}
-			typ := args[i+1]
-			switch typ {
-			case "initramfs":
-				out := args[i+2]
-				comp := "none"
-				if i+3 < len(args) {
-					comp = args[i+3]
-					i++
+			case "sign":
+				m, _ := st.Meta.(*core.FitMeta)
+				if m == nil || m.F == nil {
+					fmt.Fprintln(os.Stderr, "no FIT loaded")
+					i = fail(2, i+2)
+					continue cmds
 				}
-				if err := st.StoreInitramfs(out, comp); err != nil {
-					fmt.Fprintln(os.Stderr, "store:", err)
-					os.Exit(2)
+				j := i + 2
+				keyPath, algo, keyName := "", "sha256,rsa2048", ""
+				for j < len(args) && strings.HasPrefix(args[j], "-") {
+					if j+1 >= len(args) {
+						fmt.Fprintln(os.Stderr, "fit sign: missing value for", args[j])
+						i = fail(2, j)
+						continue cmds
+					}
+					switch args[j] {
+					case "--key", "-k":
+						keyPath = args[j+1]
+					case "--algo", "-a":
+						algo = args[j+1]
+					case "--key-name":
+						keyName = args[j+1]
+					default:
+						fmt.Fprintln(os.Stderr, "fit sign: unknown flag", args[j])
+						i = fail(2, j)
+						continue cmds
+					}
+					j += 2
 				}
-				i += 3
-			case "kernel-legacy":
-				out := args[i+2]
-				if err := st.StoreKernelLegacy(out); err != nil {
-					fmt.Fprintln(os.Stderr, "store:", err)
-					os.Exit(2)
+				if keyPath == "" {
+					fmt.Fprintln(os.Stderr, "fit sign: --key is required")
+					i = fail(2, j)
+					continue cmds
 				}
-				i += 3
-			case "kernel-fit":
-				out := args[i+2]
-				comp := "none"
-				if i+3 < len(args) {
-					comp = args[i+3]
-					i++
+				if keyName == "" {
+					// как mkimage -k: ключ <name>.key, hint — имя без расширения
+					keyName = strings.TrimSuffix(filepath.Base(keyPath), filepath.Ext(keyPath))
 				}
-				if err := st.StoreKernelFIT(out, comp); err != nil {
-					fmt.Fprintln(os.Stderr, "store:", err)
-					os.Exit(2)
+				pemBytes, err := os.ReadFile(keyPath)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					i = fail(2, j)
+					continue cmds
 				}
-				i += 3
-			case "squashfs":
-				out := args[i+2]
-				comp := "gzip"
-				if i+3 < len(args) {
+				key, err := fit.ParsePrivateKey(pemBytes)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					i = fail(2, j)
+					continue cmds
+				}
+				// необязательная цель: только имя существующего конфига или образа,
+				// иначе это уже следующая команда (fit sign … store kernel-fit …)
+				var targets []string
+				if j < len(args) {
+					_, cerr := m.F.Config(args[j])
+					_, ierr := m.F.Get(args[j])
+					if cerr == nil || ierr == nil {
+						targets = append(targets, args[j])
+						j++
+					}
+				}
+				if err := m.F.Sign(key, algo, keyName, targets...); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					i = fail(2, j)
+					continue cmds
+				}
+				i = j
+
+			case "open-ramdisk", "put-ramdisk":
+				m, _ := st.Meta.(*core.FitMeta)
+				if m == nil || m.F == nil {
+					fmt.Fprintln(os.Stderr, "no FIT loaded")
+					i = fail(2, i+2)
+					continue cmds
+				}
+				// необязательное имя — только существующий образ, иначе это
+				// уже следующая команда (fit open-ramdisk fs ls …)
+				name := ""
+				if i+2 < len(args) {
+					if _, err := m.F.Get(args[i+2]); err == nil {
+						name = args[i+2]
+						i++
+					}
+				}
+				var err error
+				if a == "open-ramdisk" {
+					err = st.FitOpenRamdisk(name)
+				} else {
+					if name == "" {
+						name = m.Ramdisk
+					}
+					err = st.FitPutRamdisk(name)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "fit %s: %v\n", a, err)
+					i = fail(2, i+2)
+					continue cmds
+				}
+				if img, _ := m.F.Get(name); a == "put-ramdisk" && img != nil {
+					signed := len(img.Signatures) > 0
+					for _, c := range m.F.Configs {
+						signed = signed || len(c.Signatures) > 0 && c.Ramdisk == name
+					}
+					if signed {
+						fmt.Fprintf(os.Stderr, "fit put-ramdisk: warning: signatures over %s no longer match; run fit sign again\n", name)
+					}
+				}
+				i += 2
+
+			case "config":
+				m, _ := st.Meta.(*core.FitMeta)
+				if m == nil || m.F == nil {
+					fmt.Fprintln(os.Stderr, "no FIT loaded")
+					i = fail(2, i+3)
+					continue cmds
+				}
+				if i+2 >= len(args) {
+					usage()
+					i = fail(1, len(args))
+					continue cmds
+				}
+				switch args[i+2] {
+				case "ls":
+					for _, c := range m.F.Configs {
+						mark := ""
+						if m.F.DefaultConfig == c.Name {
+							mark = " *"
+						}
+						fdt := strings.Join(append([]string{c.FDT}, c.Overlays...), ",")
+						fmt.Printf("%s%s kernel=%s fdt=%s ramdisk=%s compatible=%q",
+							c.Name, mark, c.Kernel, fdt, c.Ramdisk, c.Compatible)
+						if len(c.Loadables) > 0 {
+							fmt.Printf(" loadables=%s", strings.Join(c.Loadables, ","))
+						}
+						fmt.Println()
+					}
+					i += 3
+				case "add":
+					c := &fit.Config{}
+					j := i + 3
+					for j < len(args) && strings.HasPrefix(args[j], "--") {
+						if j+1 >= len(args) {
+							fmt.Fprintln(os.Stderr, "fit config add: missing value for", args[j])
+							i = fail(2, j)
+							continue cmds
+						}
+						v := args[j+1]
+						switch args[j] {
+						case "--kernel":
+							c.Kernel = v
+						case "--fdt":
+							c.FDT = v
+						case "--ramdisk":
+							c.Ramdisk = v
+						case "--compatible":
+							c.Compatible = append(c.Compatible, v)
+						default:
+							fmt.Fprintln(os.Stderr, "fit config add: unknown flag", args[j])
+							i = fail(2, j)
+							continue cmds
+						}
+						j += 2
+					}
+					if j >= len(args) {
+						usage()
+						i = fail(1, j+1)
+						continue cmds
+					}
+					c.Name = args[j]
+					if c.Kernel == "" {
+						c.Kernel = m.F.Default
+					}
+					for _, ref := range []string{c.Kernel, c.FDT, c.Ramdisk} {
+						if _, err := m.F.Get(ref); ref != "" && err != nil {
+							fmt.Fprintln(os.Stderr, "fit config add: no image", ref)
+							i = fail(2, j+1)
+							continue cmds
+						}
+					}
+					if err := m.F.AddConfig(c); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						i = fail(2, j+1)
+						continue cmds
+					}
+					i = j + 1
+				case "rm", "set-default":
+					if i+3 >= len(args) {
+						usage()
+						i = fail(1, i+4)
+						continue cmds
+					}
+					name := args[i+3]
+					if _, err := m.F.Config(name); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						i = fail(2, i+4)
+						continue cmds
+					}
+					if args[i+2] == "rm" {
+						m.F.RemoveConfig(name)
+					} else {
+						m.F.DefaultConfig = name
+					}
+					i += 4
+				default:
+					fmt.Fprintln(os.Stderr, "unknown fit config action:", args[i+2])
+					i = fail(2, i+3)
+					continue cmds
+				}
+
+			default:
+				fmt.Fprintln(os.Stderr, "unknown fit action:", a)
+				i = fail(2, i+2)
+				continue cmds
+			}
+
+		case "store":
+			if !loaded {
+				fmt.Fprintln(os.Stderr, "nothing loaded to store")
+				i = fail(2, i+3)
+				continue cmds
+			}
+			if loadFailed {
+				// состояние после упавшей загрузки неполное, писать его нельзя
+				fmt.Fprintln(os.Stderr, "store: skipped, an earlier load failed")
+				i = fail(2, i+3)
+				continue cmds
+			}
+			if i+2 >= len(args) {
+				usage()
+				i = fail(1, len(args))
+				continue cmds
+			}
+			typ := args[i+1]
+			verify := false
+			switch typ {
+			case "initramfs":
+				out := args[i+2]
+				comp := "none"
+				if isOpt(args, i+3) {
 					comp = args[i+3]
 					i++
 				}
-				if err := st.StoreSquashFS(out, comp); err != nil {
+				var opt cpio.StoreOptions
+				noCheck, repro := false, false
+				for {
+					if n, err := zstdDictFlag(st, args, i+3); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if n, err := levelFlag(st, args, i+3); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--verify" {
+						verify = true
+						i++
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--no-check" {
+						noCheck = true
+						i++
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--reproducible" {
+						repro = true
+						i++
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--pad512" {
+						opt.Pad512 = true
+						i++
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--zero-ino" {
+						opt.ZeroIno = true
+						i++
+						continue
+					}
+					if n, err := excludeFlag(args, i+3, &opt.Exclude); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--prepend" {
+						if i+4 >= len(args) {
+							fmt.Fprintln(os.Stderr, "--prepend needs a cpio file or a directory")
+							i = fail(1, i+3)
+							continue cmds
+						}
+						b, err := core.InitramfsPrepend(args[i+4])
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "store:", err)
+							i = fail(2, i+3)
+							continue cmds
+						}
+						opt.Prepend = b
+						i += 2
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--preserve-order" {
+						if i+4 >= len(args) {
+							fmt.Fprintln(os.Stderr, "--preserve-order needs a file")
+							i = fail(1, i+3)
+							continue cmds
+						}
+						f, err := os.Open(args[i+4])
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "store:", err)
+							i = fail(2, i+3)
+							continue cmds
+						}
+						opt.Order, err = cpio.ReadOrderFile(f)
+						f.Close()
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "store:", err)
+							i = fail(2, i+3)
+							continue cmds
+						}
+						i += 2
+						continue
+					}
+					break
+				}
+				if !noCheck {
+					warn, _ := st.CheckInitramfs()
+					for _, w := range warn {
+						fmt.Fprintln(os.Stderr, "warning:", w)
+					}
+				}
+				if err := auditStore(st, opt.Exclude...); err != nil {
+					i = fail(report(err), i+3)
+					continue cmds
+				}
+				if repro {
+					if _, err := reproducible(st); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					}
+				}
+				if err := st.StoreInitramfsWith(out, comp, opt); err != nil {
+					fmt.Fprintln(os.Stderr, "store:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				if verify {
+					// the prepended archive's entries come back as extras
+					var early *memfs.FS
+					if len(opt.Prepend) > 0 {
+						early, _ = cpio.LoadNewc(bytes.NewReader(opt.Prepend))
+					}
+					if err := verifyStored(st, typ, out, comp, early, opt.Exclude...); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					}
+				}
+				i += 3
+			case "kernel-legacy":
+				out := args[i+2]
+				if err := st.StoreKernelLegacy(out); err != nil {
+					fmt.Fprintln(os.Stderr, "store:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				i += 3
+			case "kernel-raw":
+				out := args[i+2]
+				comp := "none"
+				if isOpt(args, i+3) {
+					comp = args[i+3]
+					i++
+				}
+				if err := st.StoreKernelRaw(out, comp); err != nil {
 					fmt.Fprintln(os.Stderr, "store:", err)
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
 				}
 				i += 3
+			case "kernel-fit":
+				out := args[i+2]
+				comp := "none"
+				if isOpt(args, i+3) {
+					comp = args[i+3]
+					i++
+				}
+				for {
+					if n, err := zstdDictFlag(st, args, i+3); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if n, err := levelFlag(st, args, i+3); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--reencode" {
+						st.Reencode = true
+						i++
+						continue
+					}
+					break
+				}
+				if err := st.StoreKernelFIT(out, comp); err != nil {
+					fmt.Fprintln(os.Stderr, "store:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				i += 3
+			case "squashfs":
+				out := args[i+2]
+				opts := squashfs.Options{Compression: st.SquashFSCompression()}
+				if isOpt(args, i+3) {
+					opts.Compression = args[i+3]
+					i++
+				}
+				var dropped []string
+				j := i + 3
+				for j < len(args) && strings.HasPrefix(args[j], "--") {
+					flag := true
+					switch args[j] {
+					case "--lz4-hc":
+						opts.LZ4HC = true
+					case "--verify":
+						verify = true
+					case "--reencode":
+						st.Reencode = true
+					case "--no-fragments":
+						opts.NoFragments = true
+					case "--always-fragments":
+						opts.AlwaysFragments = true
+					case "--non-exportable":
+						opts.NonExportable = true
+					case "--non-sparse":
+						opts.NonSparse = true
+					case "--reproducible":
+						t, err := reproducible(st)
+						if err != nil {
+							i = fail(report(err), j)
+							continue cmds
+						}
+						opts.MkfsTime = t
+					case "--allow-drops":
+						opts.Dropped = func(p, reason string) {
+							fmt.Fprintf(os.Stderr, "warning: squashfs: %s: %s\n", p, reason)
+							dropped = append(dropped, p)
+						}
+					default:
+						flag = false
+					}
+					if flag {
+						j++
+						continue
+					}
+					if j+1 >= len(args) {
+						fmt.Fprintln(os.Stderr, "store squashfs: missing value for", args[j])
+						i = fail(2, j)
+						continue cmds
+					}
+					v := args[j+1]
+					var err error
+					switch args[j] {
+					case "--gzip-level":
+						opts.GzipLevel, err = strconv.Atoi(v)
+					case "--gzip-window":
+						opts.GzipWindow, err = strconv.Atoi(v)
+					case "--xz-dict":
+						var n int64
+						n, err = parseSize(v)
+						opts.XzDictSize = int(n)
+					case "--xz-bcj":
+						opts.XzFilters = strings.Split(v, ",")
+					default:
+						err = fmt.Errorf("unknown flag %s", args[j])
+					}
+					if err != nil {
+						fmt.Fprintln(os.Stderr, "store squashfs:", err)
+						i = fail(2, j)
+						continue cmds
+					}
+					j += 2
+				}
+				if err := auditStore(st); err != nil {
+					i = fail(report(err), j)
+					continue cmds
+				}
+				if err := st.StoreSquashFSCtx(ctx, out, opts); err != nil {
+					exitInterrupted(err)
+					fmt.Fprintln(os.Stderr, "store:", err)
+					i = fail(2, j)
+					continue cmds
+				}
+				if verify {
+					if err := verifyStored(st, typ, out, opts.Compression, nil, dropped...); err != nil {
+						i = fail(report(err), j)
+						continue cmds
+					}
+				}
+				i = j
 			case "ext2":
 				out := args[i+2]
 				bs := 1024
 				comp := "none"
-				if i+3 < len(args) {
+				if isOpt(args, i+3) {
 					nxt := args[i+3]
 					if isDigits(nxt) {
 						fmt.Sscanf(nxt, "%d", &bs)
-						if i+4 < len(args) {
+						if isOpt(args, i+4) {
 							comp = args[i+4]
 							i++
 						}
@@ -798,30 +2654,436 @@ func main() {
 					}
 					i++
 				}
-				if err := st.StoreExt2(out, bs, comp); err != nil {
+				opts := ext2.Options{BlockSize: bs}
+				repro := false
+				for {
+					if n, err := zstdDictFlag(st, args, i+3); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if n, err := levelFlag(st, args, i+3); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--verify" {
+						verify = true
+						i++
+						continue
+					}
+					if n, err := sparseFlag(args, i+3, &opts.SparseThreshold); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--reencode" {
+						st.Reencode = true
+						i++
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--reproducible" {
+						repro = true
+						i++
+						continue
+					}
+					break
+				}
+				if err := auditStore(st); err != nil {
+					i = fail(report(err), i+3)
+					continue cmds
+				}
+				if repro {
+					t, err := reproducible(st)
+					if err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					}
+					opts.Epoch = t
+					opts.UUID = st.TreeUUID()
+				}
+				if err := st.StoreExt2Ctx(ctx, out, comp, opts); err != nil {
+					exitInterrupted(err)
 					fmt.Fprintln(os.Stderr, "store:", err)
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				if verify {
+					if err := verifyStored(st, typ, out, comp, nil); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					}
 				}
 				i += 3
 			case "tar":
 				out := args[i+2]
 				comp := "none"
-				if i+3 < len(args) {
+				if isOpt(args, i+3) {
 					comp = args[i+3]
 					i++
 				}
-				if err := st.StoreTar(out, comp); err != nil {
+				var opt tarball.WriteOptions
+				repro := false
+				for {
+					if n, err := levelFlag(st, args, i+3); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--verify" {
+						verify = true
+						i++
+						continue
+					}
+					if n, err := sparseFlag(args, i+3, &opt.SparseThreshold); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if n, err := excludeFlag(args, i+3, &opt.Exclude); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					} else if n > 0 {
+						i += n
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--reproducible" {
+						repro = true
+						i++
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--numeric-owner" {
+						opt.NumericOwner = true
+						i++
+						continue
+					}
+					if i+3 < len(args) && args[i+3] == "--image-names" {
+						users, groups, err := st.ImageOwnerNames()
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "store:", err)
+							i = fail(2, i+3)
+							continue cmds
+						}
+						opt.Unames, opt.Gnames = users, groups
+						i++
+						continue
+					}
+					if i+4 < len(args) && (args[i+3] == "--passwd" || args[i+3] == "--group") {
+						b, err := os.ReadFile(args[i+4])
+						if err != nil {
+							fmt.Fprintln(os.Stderr, "store:", err)
+							i = fail(2, i+3)
+							continue cmds
+						}
+						if args[i+3] == "--passwd" {
+							opt.Unames = tarball.ParseIDNames(b)
+						} else {
+							opt.Gnames = tarball.ParseIDNames(b)
+						}
+						i += 2
+						continue
+					}
+					break
+				}
+				if err := auditStore(st, opt.Exclude...); err != nil {
+					i = fail(report(err), i+3)
+					continue cmds
+				}
+				if repro {
+					if _, err := reproducible(st); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					}
+				}
+				if err := st.StoreTarWith(out, comp, opt); err != nil {
+					fmt.Fprintln(os.Stderr, "store:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				if verify {
+					if err := verifyStored(st, typ, out, comp, nil, opt.Exclude...); err != nil {
+						i = fail(report(err), i+3)
+						continue cmds
+					}
+				}
+				i += 3
+			case "romfs":
+				out := args[i+2]
+				comp := "none"
+				if isOpt(args, i+3) {
+					comp = args[i+3]
+					i++
+				}
+				var opt romfs.Options
+				if i+4 < len(args) && args[i+3] == "--volume" {
+					opt.Volume = args[i+4]
+					i += 2
+				}
+				if err := auditStore(st); err != nil {
+					i = fail(report(err), i+3)
+					continue cmds
+				}
+				if err := st.StoreRomfs(out, comp, opt); err != nil {
 					fmt.Fprintln(os.Stderr, "store:", err)
-					os.Exit(2)
+					i = fail(2, i+3)
+					continue cmds
 				}
 				i += 3
 			default:
 				fmt.Fprintln(os.Stderr, "unknown store type:", typ)
-				os.Exit(2)
+				i = fail(2, i+3)
+				continue cmds
 			}
 
 		case "info":
-			fmt.Println(st.Info())
+			human, asJSON := false, false
+			i++
+			for i < len(args) && (args[i] == "-h" || args[i] == "--human" || args[i] == "--json") {
+				human = human || args[i] != "--json"
+				asJSON = asJSON || args[i] == "--json"
+				i++
+			}
+			if asJSON {
+				// стабильная схема для сборочных систем, см. core.InfoReport
+				b, _ := json.MarshalIndent(st.InfoJSON(), "", "  ")
+				fmt.Println(string(b))
+				break
+			}
+			fmt.Println(st.InfoWith(human))
+
+		case "detect":
+			if i+1 >= len(args) {
+				usage()
+				i = fail(1, i+2)
+				continue cmds
+			}
+			asJSON := i+2 < len(args) && args[i+2] == "--json"
+			r, err := detectImage(args[i+1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "detect:", err)
+				i = fail(2, i+2)
+				continue cmds
+			}
+			if asJSON {
+				b, _ := json.Marshal(r)
+				fmt.Println(string(b))
+				i++
+			} else {
+				fmt.Printf("%s: type=%s compression=%s inner=%s\n", r.Path, r.Type, r.Compression, r.Inner)
+				if r.Error != "" {
+					fmt.Fprintln(os.Stderr, "detect:", r.Error)
+				}
+			}
+			i += 2
+
+		case "check":
+			if i+1 >= len(args) {
+				usage()
+				i = fail(1, i+2)
+				continue cmds
+			}
+			if args[i+1] != "initramfs" {
+				fmt.Fprintln(os.Stderr, "unknown check:", args[i+1])
+				i = fail(2, i+2)
+				continue cmds
+			}
+			warn, err := st.CheckInitramfs()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "check:", err)
+				i = fail(2, i+2)
+				continue cmds
+			}
+			for _, w := range warn {
+				fmt.Println("warning:", w)
+			}
+			if len(warn) > 0 {
+				fmt.Fprintf(os.Stderr, "check: %d warnings\n", len(warn))
+				i = fail(1, i+2)
+				continue cmds
+			}
+			fmt.Println("initramfs: ok")
+			i += 2
+
+		case "apply":
+			if i+1 >= len(args) {
+				usage()
+				i = fail(1, i+2)
+				continue cmds
+			}
+			if !loaded {
+				fmt.Fprintln(os.Stderr, "no image loaded; use 'load' or 'session load' first")
+				i = fail(2, i+2)
+				continue cmds
+			}
+			if err := st.ApplyFileWith(args[i+1], keepGoing); err != nil {
+				fmt.Fprintln(os.Stderr, "apply:", err)
+				i = fail(2, i+2)
+				continue cmds
+			}
+			i += 2
+
+		case "patch":
+			// load auto + правки + store в тот же формат с теми же параметрами
+			if i+1 >= len(args) {
+				usage()
+				i = fail(1, i+2)
+				continue cmds
+			}
+			in, out := args[i+1], ""
+			var ops []core.PatchOp
+			i += 2
+		opts:
+			for i+1 < len(args) {
+				switch args[i] {
+				case "--set":
+					p, host, ok := strings.Cut(args[i+1], "=")
+					if !ok || p == "" || host == "" {
+						fmt.Fprintln(os.Stderr, "patch: --set wants /path=hostfile, got", args[i+1])
+						i = fail(2, i)
+						continue cmds
+					}
+					ops = append(ops, core.PatchOp{Path: p, Host: host})
+				case "--rm":
+					ops = append(ops, core.PatchOp{Path: args[i+1]})
+				case "-o", "--output":
+					out = args[i+1]
+				default:
+					break opts
+				}
+				i += 2
+			}
+			if out == "" {
+				fmt.Fprintln(os.Stderr, "use: patch <img> [--set /path=hostfile] [--rm /path]... -o <out>")
+				i = fail(2, i)
+				continue cmds
+			}
+			ad, err := detectImageType(in)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "patch:", err)
+				i = fail(2, i)
+				continue cmds
+			}
+			comp := "none"
+			if r, err := detectImage(in); err == nil && r.Compression != "android-sparse" {
+				comp = r.Compression
+			}
+			st.Cwd = ""
+			if ad.typ == "tar" {
+				// load tar merges into the working FS and keeps the kind
+				st.FS, st.Kind = memfs.New(), core.KindTar
+			}
+			if err := loadDetected(st, in, ad); err != nil {
+				fmt.Fprintln(os.Stderr, "patch:", err)
+				i = fail(2, i)
+				continue cmds
+			}
+			loaded = true
+			if err := st.Patch(ops); err != nil {
+				fmt.Fprintln(os.Stderr, "patch:", err)
+				i = fail(2, i)
+				continue cmds
+			}
+			if err := auditStore(st); err != nil {
+				i = fail(report(err), i)
+				continue cmds
+			}
+			if err := st.StoreSame(out, comp); err != nil {
+				fmt.Fprintln(os.Stderr, "patch:", err)
+				i = fail(2, i)
+				continue cmds
+			}
+
+		case "diff":
+			if i+2 >= len(args) {
+				usage()
+				i = fail(1, i+3)
+				continue cmds
+			}
+			diffs, err := st.DiffSlots(args[i+1], args[i+2])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "diff:", err)
+				i = fail(2, i+3)
+				continue cmds
+			}
+			for _, d := range diffs {
+				fmt.Println(d)
+			}
+			if len(diffs) > 0 {
+				fmt.Fprintf(os.Stderr, "diff: %d differences\n", len(diffs))
+				i = fail(1, i+3)
+				continue cmds
+			}
+			i += 3
+
+		case "codecs":
+			printCodecs()
+			i++
+
+		case "compress":
+			if i+1 < len(args) && args[i+1] == "--list" {
+				printCodecs()
+				i += 2
+				break
+			}
+			if i+3 >= len(args) {
+				usage()
+				i = fail(1, i+4)
+				continue cmds
+			}
+			in, out, codec := args[i+1], args[i+2], args[i+3]
+			i += 4
+			n, err := zstdDictFlag(st, args, i)
+			if err != nil {
+				i = fail(report(err), i)
+				continue cmds
+			}
+			i += n
+			if err := st.CompressFile(in, out, codec); err != nil {
+				fmt.Fprintln(os.Stderr, "compress:", err)
+				i = fail(2, i)
+				continue cmds
+			}
+
+		case "decompress":
+			if i+2 >= len(args) {
+				usage()
+				i = fail(1, i+3)
+				continue cmds
+			}
+			in, out, codec := args[i+1], args[i+2], "auto"
+			i += 3
+			if isOpt(args, i) {
+				codec = args[i]
+				i++
+			}
+			n, err := zstdDictFlag(st, args, i)
+			if err != nil {
+				i = fail(report(err), i)
+				continue cmds
+			}
+			i += n
+			used, err := st.DecompressFile(in, out, codec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "decompress:", err)
+				i = fail(2, i)
+				continue cmds
+			}
+			if used == "none" && codec == "auto" {
+				fmt.Fprintln(os.Stderr, "decompress: no known compression, copied as is")
+			}
+
+		case "selftest":
+			core.PrintSelfTest(os.Stdout, core.SelfTest())
 			i++
 
 		case "fm":
@@ -832,105 +3094,263 @@ func main() {
 			} else {
 				i++
 			}
-			// TUI запускается из отдельного пакета; здесь просто хелпер
-			fmt.Println("TUI FM is available in this build. Run: goimagetool fm <dir> (if integrated).")
-			_ = host
+			if err := runFM(st, host); err != nil {
+				fmt.Fprintln(os.Stderr, "fm:", err)
+				i = fail(2, i)
+				continue cmds
+			}
+
+		case "uimage":
+			if i+2 >= len(args) {
+				usage()
+				i = fail(1, i+3)
+				continue cmds
+			}
+			sub, p := args[i+1], args[i+2]
+			switch sub {
+			case "verify":
+				ok, err := doUImageVerify(p)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "uimage verify:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				if !ok {
+					i = fail(3, i+3)
+					continue cmds
+				}
+			case "fix-crc":
+				if err := doUImageFixCRC(p); err != nil {
+					fmt.Fprintln(os.Stderr, "uimage fix-crc:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+			default:
+				fmt.Fprintln(os.Stderr, "unknown uimage action:", sub)
+				i = fail(2, i+3)
+				continue cmds
+			}
+			i += 3
+
+		case "partition":
+			if i+2 >= len(args) {
+				usage()
+				i = fail(1, len(args))
+				continue cmds
+			}
+			path := args[i+2]
+			switch args[i+1] {
+			case "ls":
+				ents, scheme, err := partition.List(path)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "partition ls:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				printPartitions(ents, scheme)
+				i += 3
+			case "create":
+				var opt partition.GPTOptions
+				var parts []partition.PartSpec
+				j := i + 3
+				for j < len(args) {
+					if (args[j] == "--entries" || args[j] == "--align") && j+1 < len(args) {
+						n, err := parseSize(args[j+1])
+						if err != nil || n <= 0 {
+							fmt.Fprintf(os.Stderr, "partition create: bad %s %s\n", args[j], args[j+1])
+							i = fail(2, j)
+							continue cmds
+						}
+						if args[j] == "--entries" {
+							opt.Entries = int(n)
+						} else {
+							opt.Align = n
+						}
+						j += 2
+						continue
+					}
+					if !strings.Contains(args[j], ":") {
+						break
+					}
+					p, err := parsePartSpec(args[j])
+					if err != nil {
+						fmt.Fprintln(os.Stderr, "partition create:", err)
+						i = fail(2, j)
+						continue cmds
+					}
+					parts = append(parts, p)
+					j++
+				}
+				t, err := partition.CreateGPT(path, parts, opt)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "partition create:", err)
+					i = fail(2, j)
+					continue cmds
+				}
+				printPartitions(t.Entries, t.Scheme)
+				i = j
+			default:
+				fmt.Fprintln(os.Stderr, "unknown partition action:", args[i+1])
+				i = fail(2, i+2)
+				continue cmds
+			}
 
 		case "image":
 			if i+1 >= len(args) {
 				usage()
-				os.Exit(1)
+				i = fail(1, len(args))
+				continue cmds
 			}
 			sub := args[i+1]
 			switch sub {
+			case "info":
+				if i+2 >= len(args) {
+					usage()
+					i = fail(1, i+3)
+					continue cmds
+				}
+				if err := doImageInfo(args[i+2]); err != nil {
+					fmt.Fprintln(os.Stderr, "image info:", err)
+					i = fail(2, i+3)
+					continue cmds
+				}
+				i += 3
 			case "resize":
 				if i+2 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+4)
+					continue cmds
 				}
 				path := args[i+2]
 				if i+3 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+4)
+					continue cmds
 				}
 				spec := args[i+3]
 				// также поддержим форму: "--to", "<SIZE>"
 				if spec == "--to" {
 					if i+4 >= len(args) {
 						fmt.Fprintln(os.Stderr, "use: image resize <path> --to SIZE[K|M|G]")
-						os.Exit(2)
+						i = fail(2, i+4)
+						continue cmds
 					}
 					spec = "--to " + args[i+4]
 					i++
 				}
+				if i+4 < len(args) && args[i+4] == "--no-sparse" {
+					core.ZeroFillGrow = true
+					i++
+				}
 				if err := doImageResize(path, spec); err != nil {
 					fmt.Fprintln(os.Stderr, "image resize:", err)
-					os.Exit(2)
+					i = fail(2, i+4)
+					continue cmds
 				}
+				core.ZeroFillGrow = false
 				i += 4
 			case "pad":
 				if i+2 >= len(args) || i+3 >= len(args) || args[i+3] == "" || args[i+3] == "--align" && i+4 >= len(args) {
 					usage()
-					os.Exit(1)
+					i = fail(1, i+5)
+					continue cmds
 				}
 				path := args[i+2]
 				if args[i+3] != "--align" {
 					fmt.Fprintln(os.Stderr, "use: image pad <path> --align SIZE[K|M|G]")
-					os.Exit(2)
+					i = fail(2, i+5)
+					continue cmds
 				}
 				if i+4 >= len(args) {
 					fmt.Fprintln(os.Stderr, "use: image pad <path> --align SIZE[K|M|G]")
-					os.Exit(2)
+					i = fail(2, i+5)
+					continue cmds
 				}
 				align := args[i+4]
+				if i+5 < len(args) && args[i+5] == "--no-sparse" {
+					core.ZeroFillGrow = true
+					i++
+				}
 				if err := doImagePad(path, align); err != nil {
 					fmt.Fprintln(os.Stderr, "image pad:", err)
-					os.Exit(2)
+					i = fail(2, i+5)
+					continue cmds
 				}
+				core.ZeroFillGrow = false
 				i += 5
 			default:
 				fmt.Fprintln(os.Stderr, "unknown image action:", sub)
-				os.Exit(2)
+				i = fail(2, i+2)
+				continue cmds
 			}
 
 		default:
 			usage()
-			os.Exit(1)
+			i = fail(1, i+1)
+			continue cmds
 		}
 	}
 
-	if sessionPath != "" {
+	// после упавшей загрузки состояние неполное — сессию не переписываем
+	if sessionPath != "" && autosave && st.Dirty() && !loadFailed {
 		_ = st.SaveSession(sessionPath)
 	}
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "keep-going: %d failed:\n", len(failed))
+		for _, f := range failed {
+			fmt.Fprintln(os.Stderr, "  "+f)
+		}
+		os.Exit(code)
+	}
 }
 
 // util
 
-func printEntryLine(e *memfs.Entry) {
+// printEntryLine: one fs ls row; SIZE is raw bytes unless human (-h).
+func printEntryLine(e *memfs.Entry, human bool) {
 	t := "-"
 	name := strings.TrimPrefix(e.Name, "/")
 	size := len(e.Data)
-	switch {
-	case e.Mode&memfs.ModeDir != 0:
+	switch e.Mode.Type() {
+	case memfs.ModeDir:
 		t = "d"
-	case e.Mode&memfs.ModeLink != 0:
+	case memfs.ModeLink:
 		t = "l"
 		name = fmt.Sprintf("%s -> %s", name, e.Target)
 		size = len(e.Target)
-	case e.Mode&memfs.ModeChar != 0:
+	case memfs.ModeChar:
 		t = "c"
-	case e.Mode&memfs.ModeBlock != 0:
+	case memfs.ModeBlock:
 		t = "b"
-	case e.Mode&memfs.ModeFIFO != 0:
+	case memfs.ModeFIFO:
 		t = "p"
 	default:
 		t = "f"
 	}
-	fmt.Printf("%s    %06o %d:%d %5d %s\n",
-		t, uint32(e.Mode)&0o7777, e.UID, e.GID, size, name)
+	fmt.Printf("%s    %06o %d:%d %5s %s\n",
+		t, uint32(e.Mode)&0o7777, e.UID, e.GID, common.FormatSize(int64(size), human), name)
 }
 
-func resolvePathFollow(fs *memfs.FS, p string, follow bool) (string, *memfs.Entry) {
+func printStat(p string, e *memfs.Entry) {
+	size := len(e.Data)
+	if e.Mode.Type() == memfs.ModeLink {
+		size = len(e.Target)
+	}
+	fmt.Printf("  Path: %s\n", p)
+	fmt.Printf("  Type: %s\n", e.Mode.TypeName())
+	fmt.Printf("  Mode: %04o (%s)\n", uint32(e.Mode)&0o7777, e.Mode.Symbolic())
+	fmt.Printf("   Own: %d:%d\n", e.UID, e.GID)
+	fmt.Printf("  Size: %d\n", size)
+	fmt.Printf(" MTime: %s\n", e.MTime.UTC().Format(time.RFC3339))
+	switch e.Mode.Type() {
+	case memfs.ModeLink:
+		fmt.Printf("Target: %s\n", e.Target)
+	case memfs.ModeChar, memfs.ModeBlock:
+		fmt.Printf("Device: %d:%d\n", e.RdevMajor, e.RdevMinor)
+	}
+}
+
+func resolvePathFollow(fs *memfs.FS, p string, follow bool) (string, *memfs.Entry, error) {
 	p = filepath.ToSlash(p)
 	if p == "" {
 		p = "/"
@@ -938,63 +3358,13 @@ func resolvePathFollow(fs *memfs.FS, p string, follow bool) (string, *memfs.Entr
 	if !strings.HasPrefix(p, "/") {
 		p = "/" + p
 	}
-	snap := fs.Snapshot()
 	if !follow {
-		return p, snap[p]
+		e, _ := fs.Get(p)
+		return p, e, nil
 	}
-
-	limit := 40
-	cur := "/"
-	rest := strings.Split(strings.TrimPrefix(p, "/"), "/")
-	for step := 0; step < limit; step++ {
-		if len(rest) == 0 {
-			return cur, snap[cur]
-		}
-		c := rest[0]
-		if c == "" {
-			rest = rest[1:]
-			continue
-		}
-		var next string
-		if cur == "/" {
-			next = "/" + c
-		} else {
-			next = cur + "/" + c
-		}
-		e := snap[next]
-		if e == nil {
-			return next, nil
-		}
-		if e.Mode&memfs.ModeLink != 0 {
-			tgt := e.Target
-			if tgt == "" {
-				return next, e
-			}
-			var newPath string
-			if strings.HasPrefix(tgt, "/") {
-				newPath = tgt
-			} else {
-				if cur == "/" {
-					newPath = "/" + tgt
-				} else {
-					newPath = cur + "/" + tgt
-				}
-			}
-			if len(rest) > 1 {
-				tail := strings.Join(rest[1:], "/")
-				if strings.HasSuffix(newPath, "/") {
-					newPath += tail
-				} else {
-					newPath = newPath + "/" + tail
-				}
-			}
-			newPath = filepath.ToSlash(filepath.Clean("/" + strings.TrimPrefix(newPath, "/")))
-			cur = "/"
-			rest = strings.Split(strings.TrimPrefix(newPath, "/"), "/")
-			continue
-		}
-		cur = next
-		rest = rest[1:]
+	resolved, e, err := fs.ResolveLink(p, memfs.DefaultMaxHops)
+	if errors.Is(err, memfs.ErrNotExist) {
+		return resolved, nil, nil
 	}
-	return cur, snap[cur]
+	return resolved, e, err
 }
@@ -5,6 +5,7 @@ go 1.24.0
 toolchain go1.24.9
 
 require (
+	github.com/anchore/go-lzo v0.1.0
 	github.com/diskfs/go-diskfs v1.7.0
 	github.com/dsnet/compress v0.0.1
 	github.com/gdamore/tcell/v2 v2.9.0
@@ -12,11 +13,11 @@ require (
 	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/rivo/tview v0.42.0
 	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/sys v0.35.0
 
 )
 
 require (
-	github.com/anchore/go-lzo v0.1.0 // indirect
 	github.com/gdamore/encoding v1.0.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
@@ -56,7 +57,6 @@ require (
 	github.com/yuin/goldmark v1.7.8 // indirect
 	golang.org/x/image v0.24.0 // indirect
 	golang.org/x/net v0.35.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
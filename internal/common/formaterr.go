@@ -0,0 +1,74 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FormatError pins a parse failure to a place in the image, so a corrupt
+// dump can be opened in a hex editor at the right spot. Err is the cause
+// for errors.Is: ErrCorrupt, io.ErrUnexpectedEOF or a package sentinel.
+type FormatError struct {
+	Format string // "cpio", "fdt", "ext2", "squashfs"
+	Offset int64  // byte offset in the (decompressed) image; <0 = unknown
+	Path   string // entry inside the image; "" = none
+	Msg    string
+	Err    error
+}
+
+func (e *FormatError) Error() string {
+	s := e.Format + ": " + e.Msg
+	if e.Offset >= 0 {
+		s += fmt.Sprintf(" at offset %#x", e.Offset)
+	}
+	if e.Path != "" {
+		s += " (entry " + e.Path + ")"
+	}
+	return s
+}
+
+func (e *FormatError) Unwrap() error { return e.Err }
+
+// Corrupt reports malformed data at off (-1 if unknown).
+func Corrupt(format string, off int64, msg string) error {
+	return &FormatError{Format: format, Offset: off, Msg: msg, Err: ErrCorrupt}
+}
+
+// WrapAt locates a low-level error (short read, bad field) at off. An EOF
+// inside a structure is reported as io.ErrUnexpectedEOF; errors that
+// already carry a location are returned unchanged.
+func WrapAt(format string, off int64, err error) error {
+	var fe *FormatError
+	if err == nil || errors.As(err, &fe) {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &FormatError{Format: format, Offset: off, Msg: err.Error(), Err: err}
+}
+
+// WithPath attaches the entry being read to err, keeping the innermost
+// path when one is already set.
+func WithPath(format, path string, err error) error {
+	var fe *FormatError
+	if err == nil {
+		return nil
+	}
+	if errors.As(err, &fe) {
+		if fe.Path != "" {
+			return err
+		}
+		c := *fe
+		c.Path = path
+		return &c
+	}
+	return &FormatError{Format: format, Offset: -1, Path: path, Msg: err.Error(), Err: err}
+}
+
+// TooSmall rejects input shorter than the fixed header of what ("an ext2
+// filesystem", "a uImage"), before any parsing can hit a short read.
+func TooSmall(format, what string, got, need int64) error {
+	return &FormatError{Format: format, Offset: -1, Msg: fmt.Sprintf("file too small to be %s: got %d bytes, need at least %d", what, got, need), Err: ErrCorrupt}
+}
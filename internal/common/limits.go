@@ -0,0 +1,56 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxDecompressedSize caps what a decompressor may produce and how large a
+// single cpio/tar entry or ext2 inode may claim to be, so a few KB of
+// zstd/xz cannot grow into an allocation that takes the tool down.
+// 0 disables the guard.
+var MaxDecompressedSize int64 = 4 << 30
+
+// ErrTooLarge: decompressed data or a declared entry size is over the limit.
+var ErrTooLarge = errors.New("decompressed size exceeds limit")
+
+// CheckSize fails when a declared size n is over MaxDecompressedSize.
+func CheckSize(name string, n int64) error {
+	if MaxDecompressedSize > 0 && n > MaxDecompressedSize {
+		return fmt.Errorf("%s: %d bytes: %w (%d)", name, n, ErrTooLarge, MaxDecompressedSize)
+	}
+	return nil
+}
+
+// LimitReader is io.LimitReader that reports ErrTooLarge instead of a quiet
+// EOF once r yields more than MaxDecompressedSize bytes.
+func LimitReader(r io.Reader) io.Reader {
+	if MaxDecompressedSize <= 0 {
+		return r
+	}
+	return &limitReader{r: r, n: MaxDecompressedSize}
+}
+
+type limitReader struct {
+	r io.Reader
+	n int64 // bytes still allowed
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// exactly at the limit is fine as long as the stream ends here
+		var b [1]byte
+		if k, err := l.r.Read(b[:]); k > 0 {
+			return 0, fmt.Errorf("%w (%d)", ErrTooLarge, MaxDecompressedSize)
+		} else {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	k, err := l.r.Read(p)
+	l.n -= int64(k)
+	return k, err
+}
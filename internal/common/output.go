@@ -0,0 +1,80 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Clobber says what happens to an existing output image.
+type Clobber int
+
+const (
+	ClobberOverwrite Clobber = iota // replace it (default)
+	ClobberNever                    // fail with ErrOutputExists
+	ClobberBackup                   // rename it to <path>.bak first
+)
+
+// OutputClobber applies to every image written by store and extract paths;
+// set from --no-clobber / --backup.
+var OutputClobber = ClobberOverwrite
+
+// ErrOutputExists: the output path exists and --no-clobber is in effect.
+var ErrOutputExists = errors.New("output exists (--no-clobber)")
+
+// PrepareOutput is called right before an image is created at path. It
+// fails or moves the old file aside according to OutputClobber; a missing
+// path is always fine. An older <path>.bak is replaced.
+func PrepareOutput(path string) error {
+	if OutputClobber == ClobberOverwrite {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if OutputClobber == ClobberNever {
+		return fmt.Errorf("%s: %w", path, ErrOutputExists)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: is a directory", path)
+	}
+	return os.Rename(path, path+".bak")
+}
+
+// WriteFileAtomic writes an image through write into <path>.tmp-<pid> in
+// the same directory and renames it over path only when write succeeded,
+// so a failed or interrupted store never replaces a good file with a
+// truncated one. PrepareOutput runs just before the rename; on any error
+// the temp file is removed, and until the rename CleanupTemp removes it
+// too (the signal handler). A file being replaced keeps its permissions;
+// a new one gets 0644 less the umask.
+func WriteFileAtomic(path string, write func(io.Writer) error) (err error) {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	release := registerTemp(tmp)
+	defer release()
+	if fi, serr := os.Stat(path); serr == nil && fi.Mode().IsRegular() {
+		err = f.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		err = write(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = PrepareOutput(path); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
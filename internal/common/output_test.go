@@ -0,0 +1,61 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "rootfs.img")
+	tmp := fmt.Sprintf("%s.tmp-%d", out, os.Getpid())
+	if err := os.WriteFile(out, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write keeps the old image and leaves no temp file
+	boom := errors.New("boom")
+	err := WriteFileAtomic(out, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("got %v, want boom", err)
+	}
+	if b, _ := os.ReadFile(out); string(b) != "old" {
+		t.Errorf("old image replaced by %q", b)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+
+	// the signal handler's CleanupTemp removes a write in progress
+	err = WriteFileAtomic(out, func(w io.Writer) error {
+		CleanupTemp()
+		if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+			t.Errorf("CleanupTemp kept the temp file: %v", err)
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("got %v, want boom", err)
+	}
+
+	// the replacement keeps the old file's permissions
+	if err := WriteFileAtomic(out, func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(out); string(b) != "new" || fi.Mode().Perm() != 0o600 {
+		t.Errorf("got %q mode %o, want \"new\" mode 600", b, fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrUnsafePath: an archive entry name climbs above the image root.
+var ErrUnsafePath = errors.New("entry name escapes image root")
+
+// AllowUnsafePaths lets loaders accept such names anyway (forensic
+// inspection); memfs then clamps them to "/", so nothing lands outside the
+// tree on extract.
+var AllowUnsafePaths bool
+
+// CheckEntryName rejects names whose ".." components resolve above "/",
+// e.g. "../../etc/passwd" or "a/../../b". Absolute names and ".." that stay
+// inside the tree ("a/../b") are fine.
+func CheckEntryName(name string) error {
+	if AllowUnsafePaths {
+		return nil
+	}
+	depth := 0
+	for _, c := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return ErrUnsafePath
+			}
+		default:
+			depth++
+		}
+	}
+	return nil
+}
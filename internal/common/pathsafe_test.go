@@ -0,0 +1,40 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckEntryName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"etc/passwd", true},
+		{"/etc/passwd", true},
+		{"./bin/sh", true},
+		{"a/../b", true},
+		{"a/b/../../c", true},
+		{"..", false},
+		{"../../etc/passwd", false},
+		{"/../etc/passwd", false},
+		{"a/../../b", false},
+		{"a\\..\\..\\b", false},
+	} {
+		err := CheckEntryName(tc.name)
+		if tc.ok && err != nil {
+			t.Errorf("%q: unexpected %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%q: got %v, want ErrUnsafePath", tc.name, err)
+		}
+	}
+}
+
+func TestCheckEntryNameAllowUnsafe(t *testing.T) {
+	AllowUnsafePaths = true
+	defer func() { AllowUnsafePaths = false }()
+	if err := CheckEntryName("../../etc/passwd"); err != nil {
+		t.Fatalf("AllowUnsafePaths: %v", err)
+	}
+}
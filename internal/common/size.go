@@ -0,0 +1,28 @@
+package common
+
+import "fmt"
+
+// HumanSize formats n in binary units with one decimal: 512 -> "512 B",
+// 1536 -> "1.5 KiB", 48*1024*1024 -> "48.0 MiB".
+func HumanSize(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, i := float64(n)/unit, 0
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	for (v >= unit || v <= -unit) && i < len(units)-1 {
+		v /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+// FormatSize is HumanSize with human, else the plain byte count that
+// commands print by default (stable for scripts).
+func FormatSize(n int64, human bool) string {
+	if human {
+		return HumanSize(n)
+	}
+	return fmt.Sprintf("%d", n)
+}
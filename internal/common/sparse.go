@@ -0,0 +1,76 @@
+package common
+
+import "fmt"
+
+// MaxSparseExpand caps the logical size a sparse file may expand to when a
+// loader has to materialize its holes in memory (tar sparse entries, ext2
+// files with unallocated blocks). Keeps a tiny image from turning into a
+// multi-GB allocation.
+var MaxSparseExpand int64 = 1 << 30
+
+// Region is a [Off, Off+Len) span of non-hole data.
+type Region struct {
+	Off, Len int64
+}
+
+// DataRegions splits b into data regions separated by zero runs of at least
+// minHole bytes. Runs are detected on 512-byte block boundaries, so holes
+// are block aligned. Returns nil when no hole qualifies; an all-zero b
+// yields an empty, non-nil slice.
+func DataRegions(b []byte, minHole int) []Region {
+	const blk = 512
+	if minHole < blk {
+		minHole = blk
+	}
+	out := []Region{}
+	holes := false
+	dataStart, zeroStart := int64(0), int64(-1)
+	flushHole := func(end int64) {
+		if zeroStart >= 0 && end-zeroStart >= int64(minHole) {
+			if zeroStart > dataStart {
+				out = append(out, Region{dataStart, zeroStart - dataStart})
+			}
+			dataStart = end
+			holes = true
+		}
+		zeroStart = -1
+	}
+	for off := int64(0); off < int64(len(b)); off += blk {
+		end := off + blk
+		if end > int64(len(b)) {
+			end = int64(len(b))
+		}
+		if isZero(b[off:end]) {
+			if zeroStart < 0 {
+				zeroStart = off
+			}
+			continue
+		}
+		flushHole(off)
+	}
+	flushHole(int64(len(b)))
+	if !holes {
+		return nil
+	}
+	if dataStart < int64(len(b)) {
+		out = append(out, Region{dataStart, int64(len(b)) - dataStart})
+	}
+	return out
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckSparseExpand rejects expanding a sparse file of logical size n.
+func CheckSparseExpand(name string, n int64) error {
+	if MaxSparseExpand > 0 && n > MaxSparseExpand {
+		return fmt.Errorf("%s: sparse file expands to %d bytes (limit %d)", name, n, MaxSparseExpand)
+	}
+	return nil
+}
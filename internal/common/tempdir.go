@@ -0,0 +1,63 @@
+package common
+
+import (
+	"os"
+	"sync"
+)
+
+// TempDir — parent for scratch workspaces of the external-tool paths
+// (squashfs, ext2). Empty means $GOIMAGETOOL_TMP, then os.TempDir().
+var TempDir string
+
+var (
+	tmpMu    sync.Mutex
+	tmpPaths = map[string]bool{} // scratch dirs and temp output files
+)
+
+func tempRoot() string {
+	if TempDir != "" {
+		return TempDir
+	}
+	return os.Getenv("GOIMAGETOOL_TMP")
+}
+
+// MkdirTemp creates a registered scratch dir. Call release when done; until
+// then CleanupTemp (e.g. from a signal handler) will remove it.
+func MkdirTemp(pattern string) (string, func(), error) {
+	root := tempRoot()
+	if root != "" {
+		if err := os.MkdirAll(root, 0o755); err != nil {
+			return "", nil, err
+		}
+	}
+	dir, err := os.MkdirTemp(root, pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, registerTemp(dir), nil
+}
+
+// registerTemp hands p to CleanupTemp until the returned release is called;
+// release removes p itself unless it is gone already (renamed into place).
+func registerTemp(p string) func() {
+	tmpMu.Lock()
+	tmpPaths[p] = true
+	tmpMu.Unlock()
+	return func() {
+		tmpMu.Lock()
+		delete(tmpPaths, p)
+		tmpMu.Unlock()
+		_ = os.RemoveAll(p)
+	}
+}
+
+// CleanupTemp removes every scratch dir and half-written output
+// (WriteFileAtomic) that has not been released yet.
+func CleanupTemp() {
+	tmpMu.Lock()
+	defer tmpMu.Unlock()
+	for p := range tmpPaths {
+		_ = os.RemoveAll(p)
+		delete(tmpPaths, p)
+	}
+}
@@ -1,26 +1,36 @@
 package compress
 
-// Pluggable compression codecs + auto-detect.
-// RW: gzip, zstd, lz4, lzma, bzip2
-// R-only: xz (lzo TODO)
-// Names: none|auto|gzip|gz|zstd|zst|lz4|lzma|bzip2|bz2|xz|lzo
+// Pluggable compression codecs + auto-detect: the codecs are registered in
+// registry.go (Register); the pseudo-codecs none (raw) and auto are handled
+// here.
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 
-	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zstd"
-	"github.com/pierrec/lz4/v4"
-	"github.com/ulikunitz/xz"
-	"github.com/ulikunitz/xz/lzma"
+
+	"goimagetool/internal/common"
 )
 
 var ErrUnsupported = errors.New("compression: unsupported operation")
 
+// ErrNeedDict: zstd frame references a dictionary that was not supplied.
+var ErrNeedDict = errors.New("zstd: data was compressed with a dictionary; supply it with --zstd-dict")
+
+// CompressOpts — optional per-codec knobs; zero value = plain defaults.
+type CompressOpts struct {
+	// ZstdDict: dictionary in zstd format (as produced by `zstd --train`).
+	// Used for both encoding and decoding; ignored by other codecs.
+	ZstdDict []byte
+	// Level: 0 = codec default; gzip 1..9, zstd 1..22. Other codecs
+	// reject a non-zero level.
+	Level int
+}
+
 // ---------- name helpers ----------
 
 func normalize(name string) string {
@@ -29,34 +39,20 @@ func normalize(name string) string {
 		return "auto"
 	case "none", "raw":
 		return "none"
-	case "gz":
-		return "gzip"
-	case "zst":
-		return "zstd"
-	case "bz2":
-		return "bzip2"
-	default:
-		return name
 	}
+	if c := Lookup(name); c != nil {
+		return c.Name()
+	}
+	return name
 }
 
 // ---------- magic detection (best-effort) ----------
 
 func Detect(data []byte) string {
-	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
-		return "gzip"
-	}
-	if len(data) >= 4 && data[0] == 0x28 && data[1] == 0xB5 && data[2] == 0x2F && data[3] == 0xFD {
-		return "zstd"
-	}
-	if len(data) >= 4 && data[0] == 0x04 && data[1] == 0x22 && data[2] == 0x4D && data[3] == 0x18 {
-		return "lz4"
-	}
-	if len(data) >= 6 && data[0] == 0xFD && data[1] == '7' && data[2] == 'z' && data[3] == 'X' && data[4] == 'Z' && data[5] == 0x00 {
-		return "xz"
-	}
-	if len(data) >= 3 && data[0] == 'B' && data[1] == 'Z' && data[2] == 'h' {
-		return "bzip2"
+	for _, c := range Codecs() {
+		if c.Detect(data) {
+			return c.Name()
+		}
 	}
 	// lzma "alone" и lzo raw без надёжной сигнатуры
 	return "none"
@@ -65,136 +61,116 @@ func Detect(data []byte) string {
 // ---------- high-level API (buffer-based) ----------
 
 func DecompressAuto(in []byte) ([]byte, string, error) {
+	return DecompressAutoWith(in, CompressOpts{})
+}
+
+func DecompressAutoWith(in []byte, o CompressOpts) ([]byte, string, error) {
 	kind := Detect(in)
 	if kind == "none" {
 		return in, "none", nil
 	}
-	out, err := Decompress(in, kind)
+	out, err := DecompressWith(in, kind, o)
 	return out, kind, err
 }
 
 func Decompress(in []byte, name string) ([]byte, error) {
-	switch normalize(name) {
+	return DecompressWith(in, name, CompressOpts{})
+}
+
+// DecompressWith — как Decompress, но с опциями кодека (словарь zstd).
+// Without the dictionary a dictionary-compressed zstd frame fails with ErrNeedDict.
+func DecompressWith(in []byte, name string, o CompressOpts) ([]byte, error) {
+	switch n := normalize(name); n {
 	case "none":
 		return in, nil
-	case "gzip":
-		gr, err := gzip.NewReader(bytes.NewReader(in))
-		if err != nil {
-			return nil, err
-		}
-		defer gr.Close()
-		return io.ReadAll(gr)
-	case "zstd":
-		d, err := zstd.NewReader(bytes.NewReader(in))
-		if err != nil {
-			return nil, err
-		}
-		defer d.Close()
-		return io.ReadAll(d)
-	case "lz4":
-		lr := lz4.NewReader(bytes.NewReader(in))
-		return io.ReadAll(lr)
-	case "xz":
-		xr, err := xz.NewReader(bytes.NewReader(in))
-		if err != nil {
-			return nil, err
-		}
-		return io.ReadAll(xr)
-	case "lzma":
-		lr, err := lzma.NewReader(bytes.NewReader(in))
+	case "auto":
+		out, _, err := DecompressAutoWith(in, o)
+		return out, err
+	default:
+		r, err := openReader(n, bytes.NewReader(in), o)
 		if err != nil {
 			return nil, err
 		}
-		return io.ReadAll(lr)
-	case "bzip2":
-		br, err := bzip2.NewReader(bytes.NewReader(in), &bzip2.ReaderConfig{})
-		if err != nil {
-			return nil, err
+		defer r.Close()
+		out, err := io.ReadAll(common.LimitReader(r))
+		if errors.Is(err, zstd.ErrUnknownDictionary) {
+			return nil, ErrNeedDict
 		}
-		defer br.Close()
-		return io.ReadAll(br)
-	case "lzo":
-		// TODO: lzo raw reader (R-only)
-		return nil, ErrUnsupported
-	case "auto":
-		out, _, err := DecompressAuto(in)
 		return out, err
-	default:
+	}
+}
+
+// openReader: decoding reader of the registered codec n; ErrUnsupported
+// for unknown codecs and those this build cannot read.
+func openReader(n string, r io.Reader, o CompressOpts) (io.ReadCloser, error) {
+	c := Lookup(n)
+	if c == nil {
 		return nil, ErrUnsupported
 	}
+	return c.NewReader(r, o)
 }
 
-func Compress(in []byte, name string) ([]byte, error) {
-	switch normalize(name) {
-	case "none", "auto":
-		return in, nil
-	case "gzip":
-		var buf bytes.Buffer
-		gw := gzip.NewWriter(&buf)
-		if _, err := gw.Write(in); err != nil {
-			return nil, err
-		}
-		if err := gw.Close(); err != nil {
-			return nil, err
-		}
-		return buf.Bytes(), nil
-	case "zstd":
-		var buf bytes.Buffer
-		zw, err := zstd.NewWriter(&buf)
-		if err != nil {
-			return nil, err
-		}
-		if _, err := zw.Write(in); err != nil {
-			return nil, err
-		}
-		if err := zw.Close(); err != nil {
-			return nil, err
-		}
-		return buf.Bytes(), nil
-	case "lz4":
-		var buf bytes.Buffer
-		lw := lz4.NewWriter(&buf)
-		if _, err := lw.Write(in); err != nil {
-			return nil, err
+// DecompressPrefix decodes at most n bytes from the start of in. Errors
+// past that point (truncated input, bad trailing checksum) are not reported,
+// so a header-sized read is enough to sniff what the stream holds.
+func DecompressPrefix(in []byte, name string, n int, o CompressOpts) ([]byte, error) {
+	codec := normalize(name)
+	if codec == "none" {
+		if len(in) > n {
+			return in[:n], nil
 		}
-		if err := lw.Close(); err != nil {
-			return nil, err
-		}
-		return buf.Bytes(), nil
-	case "lzma":
-		var buf bytes.Buffer
-		lw, err := lzma.NewWriter(&buf)
-		if err != nil {
-			return nil, err
-		}
-		if _, err := lw.Write(in); err != nil {
-			return nil, err
-		}
-		if err := lw.Close(); err != nil {
-			return nil, err
-		}
-		return buf.Bytes(), nil
-	case "bzip2":
-		var buf bytes.Buffer
-		bw, err := bzip2.NewWriter(&buf, &bzip2.WriterConfig{})
-		if err != nil {
-			return nil, err
-		}
-		if _, err := bw.Write(in); err != nil {
-			return nil, err
-		}
-		if err := bw.Close(); err != nil {
-			return nil, err
+		return in, nil
+	}
+	r, err := openReader(codec, bytes.NewReader(in), o)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out := make([]byte, n)
+	k, err := io.ReadFull(r, out)
+	if k == 0 && err != nil && err != io.EOF {
+		if errors.Is(err, zstd.ErrUnknownDictionary) {
+			return nil, ErrNeedDict
 		}
-		return buf.Bytes(), nil
-	case "xz":
-		// xz write — TODO
-		return nil, ErrUnsupported
-	case "lzo":
-		return nil, ErrUnsupported
-	default:
-		return nil, ErrUnsupported
+		return nil, err
+	}
+	return out[:k], nil
+}
+
+func Compress(in []byte, name string) ([]byte, error) {
+	return CompressWith(in, name, CompressOpts{})
+}
+
+func CompressWith(in []byte, name string, o CompressOpts) ([]byte, error) {
+	return CompressContext(context.Background(), in, name, o)
+}
+
+// CompressContext is CompressWith that stops with ctx.Err() once ctx is
+// cancelled; the input is fed to the codec in io.Copy-sized pieces and ctx
+// is checked before each.
+func CompressContext(ctx context.Context, in []byte, name string, o CompressOpts) ([]byte, error) {
+	n := normalize(name)
+	if n == "none" || n == "auto" {
+		return in, nil
+	}
+	var buf bytes.Buffer
+	if err := CompressStream(&buf, ctxReader{ctx, bytes.NewReader(in)}, n, o); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ctxReader fails reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return c.r.Read(p)
 }
 
 // Optional stream helpers (for future use)
@@ -211,13 +187,30 @@ func Reader(name string, r io.Reader) (io.ReadCloser, error) {
 	return io.NopCloser(bytes.NewReader(out)), nil
 }
 
+// Writer encodes what is written to it into w as it arrives, through the
+// codec's own streaming writer; Close flushes but leaves w open. Only a
+// codec without one (NewWriter answers ErrUnsupported) falls back to
+// buffering everything and compressing on Close.
 func Writer(name string, w io.Writer) (io.WriteCloser, error) {
-	// Buffering writer to match Compress() signature on Close
+	n := normalize(name)
+	if n == "none" || n == "auto" {
+		return nopCloser{w}, nil
+	}
+	if c := Lookup(n); c != nil {
+		cw, err := c.NewWriter(w, CompressOpts{})
+		if !errors.Is(err, ErrUnsupported) {
+			return cw, err
+		}
+	}
 	var buf bytes.Buffer
 	// Встроенное поле *bytes.Buffer инициализируем позиционно.
-	return nopWriteCloser{&buf, w, normalize(name)}, nil
+	return nopWriteCloser{&buf, w, n}, nil
 }
 
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
 type nopWriteCloser struct {
 	*bytes.Buffer
 	sink io.Writer
@@ -0,0 +1,84 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecompressConcatenatedStreams(t *testing.T) {
+	parts := [][]byte{[]byte("first member\n"), bytes.Repeat([]byte("second "), 1000), []byte("third\n")}
+	want := bytes.Join(parts, nil)
+	for _, name := range []string{"gzip", "zstd", "lz4", "xz", "bzip2"} {
+		var cat []byte
+		for _, p := range parts {
+			enc, err := Compress(p, name)
+			if err != nil {
+				t.Fatalf("%s: Compress: %v", name, err)
+			}
+			cat = append(cat, enc...)
+		}
+		got, kind, err := DecompressAuto(cat)
+		if err != nil {
+			t.Errorf("%s: DecompressAuto: %v", name, err)
+			continue
+		}
+		if kind != name || !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes as %s, want %d bytes", name, len(got), kind, len(want))
+		}
+		var out strings.Builder
+		if _, err := DecompressStream(&out, bytes.NewReader(cat), "auto", CompressOpts{}); err != nil || out.String() != string(want) {
+			t.Errorf("%s: DecompressStream: %d bytes, %v", name, out.Len(), err)
+		}
+	}
+}
+
+func TestLZ4FramesSmallReads(t *testing.T) {
+	a, _ := Compress([]byte("abc"), "lz4")
+	b, _ := Compress([]byte("defgh"), "lz4")
+	r := newLZ4Frames(bytes.NewReader(append(a, b...)))
+	got, err := io.ReadAll(io.LimitReader(r, 100))
+	if err != nil || string(got) != "abcdefgh" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+// Writer streams: output appears before Close, and it decodes back.
+func TestWriterStreams(t *testing.T) {
+	data := bytes.Repeat([]byte("streamed through Writer "), 200<<10)
+	for _, name := range []string{"gzip", "zstd", "lz4", "xz", "lzma", "bzip2"} {
+		var out bytes.Buffer
+		w, err := Writer(name, &out)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("%s: Write: %v", name, err)
+		}
+		if out.Len() == 0 {
+			t.Errorf("%s: nothing written before Close", name)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", name, err)
+		}
+		got, err := Decompress(out.Bytes(), name)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: round trip: %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+// The xz check is CRC32: the kernel's decoder need not have CRC64.
+func TestXZCheckCRC32(t *testing.T) {
+	enc, err := Compress([]byte("initramfs"), "xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stream flags after the 6-byte magic: 0x00, check type
+	if len(enc) < 8 || enc[7] != xz.CRC32 {
+		t.Fatalf("stream flags % x", enc[6:8])
+	}
+}
@@ -2,27 +2,43 @@ package compress
 
 import (
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
+
+	"goimagetool/internal/common"
 )
 
+// ErrBadLevel: compression level outside the codec's range.
+var ErrBadLevel = errors.New("compression level out of range")
+
 func GzipDecompress(dst io.Writer, src io.Reader) error {
 	gr, err := gzip.NewReader(src)
 	if err != nil {
 		return err
 	}
 	defer gr.Close()
-	_, err = io.Copy(dst, gr)
+	_, err = io.Copy(dst, common.LimitReader(gr))
 	return err
 }
 
 func GzipCompress(dst io.Writer, src io.Reader) error {
-	gw, err := gzip.NewWriterLevel(dst, gzip.DefaultCompression)
+	return GzipCompressLevel(dst, src, gzip.DefaultCompression)
+}
+
+// GzipCompressLevel: level as in compress/gzip — 1..9, 0 (store),
+// -1 (default) or -2 (Huffman only).
+func GzipCompressLevel(dst io.Writer, src io.Reader, level int) error {
+	gw, err := newGzipWriter(dst, level)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(gw, src); err != nil {
-		_ = gw.Close()
-		return err
+	return copyClose(gw, src)
+}
+
+func newGzipWriter(dst io.Writer, level int) (*gzip.Writer, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("gzip: %w: %d (want -2..9)", ErrBadLevel, level)
 	}
-	return gw.Close()
+	return gzip.NewWriterLevel(dst, level)
 }
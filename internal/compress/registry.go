@@ -0,0 +1,253 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Codec is one compression format. Compress, Decompress, Detect and the
+// stream helpers all dispatch through the registered codecs, so a new
+// format is one Register call.
+type Codec interface {
+	Name() string
+	Aliases() []string
+	// Detect reports whether head (the first bytes of the data, possibly
+	// fewer than the signature) starts with this codec's magic.
+	Detect(head []byte) bool
+	// NewReader decodes r; ErrUnsupported if this build cannot.
+	NewReader(r io.Reader, o CompressOpts) (io.ReadCloser, error)
+	// NewWriter encodes into w at o.Level (0 = codec default); Close
+	// flushes but leaves w open. ErrUnsupported if this build cannot.
+	NewWriter(w io.Writer, o CompressOpts) (io.WriteCloser, error)
+}
+
+// Caps is what a codec supports, as listed by the codecs command.
+type Caps struct {
+	Compress, Decompress, Detect bool
+	Levels                       string // accepted level range, "" = none
+}
+
+var (
+	regMu    sync.RWMutex
+	registry []Codec
+)
+
+// Register adds c, or replaces the codec of the same name. Detect tries
+// codecs in registration order.
+func Register(c Codec) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	for i, old := range registry {
+		if old.Name() == c.Name() {
+			registry[i] = c
+			return
+		}
+	}
+	registry = append(registry, c)
+}
+
+// Codecs lists the registered codecs in registration order.
+func Codecs() []Codec {
+	regMu.RLock()
+	defer regMu.RUnlock()
+	return append([]Codec(nil), registry...)
+}
+
+// Lookup finds a codec by name or alias; nil if there is none.
+func Lookup(name string) Codec {
+	for _, c := range Codecs() {
+		if c.Name() == name {
+			return c
+		}
+		for _, a := range c.Aliases() {
+			if a == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// CapsOf reports what c supports. Codecs that do not describe themselves
+// (a Caps method) are probed: NewReader/NewWriter answering ErrUnsupported
+// means no, and detection is reported as unknown, i.e. false.
+func CapsOf(c Codec) Caps {
+	if d, ok := c.(interface{ Caps() Caps }); ok {
+		return d.Caps()
+	}
+	var caps Caps
+	if w, err := c.NewWriter(io.Discard, CompressOpts{}); !errors.Is(err, ErrUnsupported) {
+		caps.Compress = true
+		if err == nil {
+			_ = w.Close()
+		}
+	}
+	if r, err := c.NewReader(bytes.NewReader(nil), CompressOpts{}); !errors.Is(err, ErrUnsupported) {
+		caps.Decompress = true
+		if err == nil {
+			_ = r.Close()
+		}
+	}
+	return caps
+}
+
+// codec is the built-in Codec: a fixed magic and constructor funcs, nil
+// for a direction this build does not implement.
+type codec struct {
+	name    string
+	aliases []string
+	magic   []byte // nil: no reliable signature, never detected
+	levels  string
+	reader  func(io.Reader, CompressOpts) (io.ReadCloser, error)
+	writer  func(io.Writer, CompressOpts) (io.WriteCloser, error)
+}
+
+func (c *codec) Name() string      { return c.name }
+func (c *codec) Aliases() []string { return c.aliases }
+
+func (c *codec) Detect(head []byte) bool {
+	return c.magic != nil && bytes.HasPrefix(head, c.magic)
+}
+
+func (c *codec) NewReader(r io.Reader, o CompressOpts) (io.ReadCloser, error) {
+	if c.reader == nil {
+		return nil, ErrUnsupported
+	}
+	return c.reader(r, o)
+}
+
+func (c *codec) NewWriter(w io.Writer, o CompressOpts) (io.WriteCloser, error) {
+	if o.Level != 0 && c.levels == "" {
+		return nil, fmt.Errorf("%s: compression level is not supported", c.name)
+	}
+	if c.writer == nil {
+		return nil, ErrUnsupported
+	}
+	return c.writer(w, o)
+}
+
+func (c *codec) Caps() Caps {
+	return Caps{Compress: c.writer != nil, Decompress: c.reader != nil, Detect: c.magic != nil, Levels: c.levels}
+}
+
+func init() {
+	Register(&codec{
+		name: "gzip", aliases: []string{"gz"}, magic: []byte{0x1f, 0x8b}, levels: "1-9",
+		reader: func(r io.Reader, _ CompressOpts) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		writer: func(w io.Writer, o CompressOpts) (io.WriteCloser, error) {
+			level := gzip.DefaultCompression
+			if o.Level != 0 {
+				level = o.Level
+			}
+			return newGzipWriter(w, level)
+		},
+	})
+	Register(&codec{
+		name: "zstd", aliases: []string{"zst"}, magic: []byte{0x28, 0xB5, 0x2F, 0xFD}, levels: "1-22",
+		reader: func(r io.Reader, o CompressOpts) (io.ReadCloser, error) {
+			var dopts []zstd.DOption
+			if len(o.ZstdDict) > 0 {
+				dopts = append(dopts, zstd.WithDecoderDicts(o.ZstdDict))
+			}
+			d, err := zstd.NewReader(r, dopts...)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		writer: func(w io.Writer, o CompressOpts) (io.WriteCloser, error) {
+			level := ZstdDefaultLevel
+			if o.Level != 0 {
+				level = o.Level
+			}
+			return newZstdWriter(w, level, o.ZstdDict)
+		},
+	})
+	Register(&codec{
+		name: "lz4", magic: []byte{0x04, 0x22, 0x4D, 0x18},
+		reader: func(r io.Reader, _ CompressOpts) (io.ReadCloser, error) { return newLZ4Frames(r), nil },
+		writer: func(w io.Writer, _ CompressOpts) (io.WriteCloser, error) { return lz4.NewWriter(w), nil },
+	})
+	Register(&codec{
+		name: "xz", magic: []byte{0xFD, '7', 'z', 'X', 'Z', 0x00},
+		reader: func(r io.Reader, _ CompressOpts) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xr), nil
+		},
+		// CRC32, as the kernel wants for initramfs (xz --check=crc32):
+		// its decoder may be built without CRC64
+		writer: func(w io.Writer, _ CompressOpts) (io.WriteCloser, error) {
+			return xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+		},
+	})
+	Register(&codec{
+		// lzma "alone": сигнатуры нет, только по имени; и кадров нет —
+		// склеенные потоки не читаются, декодер останавливается на первом
+		name: "lzma",
+		reader: func(r io.Reader, _ CompressOpts) (io.ReadCloser, error) {
+			lr, err := lzma.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(lr), nil
+		},
+		writer: func(w io.Writer, _ CompressOpts) (io.WriteCloser, error) { return lzma.NewWriter(w) },
+	})
+	Register(&codec{
+		name: "bzip2", aliases: []string{"bz2"}, magic: []byte("BZh"),
+		reader: func(r io.Reader, _ CompressOpts) (io.ReadCloser, error) {
+			return bzip2.NewReader(r, &bzip2.ReaderConfig{})
+		},
+		writer: func(w io.Writer, _ CompressOpts) (io.WriteCloser, error) {
+			return bzip2.NewWriter(w, &bzip2.WriterConfig{})
+		},
+	})
+	// lzo raw — TODO в обе стороны; имя знаем, чтобы ошибка была понятной
+	Register(&codec{name: "lzo"})
+}
+
+// lz4Frames reads concatenated lz4 frames (cat a.lz4 b.lz4); lz4.Reader
+// alone stops at the end of the first. gzip, zstd, xz and bzip2 readers
+// already continue across members.
+type lz4Frames struct {
+	br *bufio.Reader
+	zr *lz4.Reader
+}
+
+func newLZ4Frames(r io.Reader) io.ReadCloser {
+	br := bufio.NewReader(r)
+	return io.NopCloser(&lz4Frames{br: br, zr: lz4.NewReader(br)})
+}
+
+func (f *lz4Frames) Read(p []byte) (int, error) {
+	n, err := f.zr.Read(p)
+	if err == io.EOF {
+		if head, _ := f.br.Peek(4); bytes.Equal(head, []byte{0x04, 0x22, 0x4D, 0x18}) {
+			f.zr.Reset(f.br)
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func copyClose(w io.WriteCloser, src io.Reader) error {
+	if _, err := io.Copy(w, src); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
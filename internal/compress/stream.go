@@ -0,0 +1,76 @@
+package compress
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"goimagetool/internal/common"
+)
+
+// ParseSpec splits "zstd:19" into the codec and its level (0 = default).
+func ParseSpec(spec string) (string, int, error) {
+	name, lv, ok := strings.Cut(strings.ToLower(spec), ":")
+	if !ok {
+		return normalize(name), 0, nil
+	}
+	n, err := strconv.Atoi(lv)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: bad level %q", name, lv)
+	}
+	return normalize(name), n, nil
+}
+
+// CompressStream is CompressWith for streams: src is encoded into dst as it
+// is read, so neither side is held in memory.
+func CompressStream(dst io.Writer, src io.Reader, name string, o CompressOpts) error {
+	n := normalize(name)
+	if n == "none" {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	// auto не имеет смысла при сжатии
+	c := Lookup(n)
+	if c == nil {
+		return ErrUnsupported
+	}
+	w, err := c.NewWriter(dst, o)
+	if err != nil {
+		return err
+	}
+	return copyClose(w, src)
+}
+
+// DecompressStream decodes src into dst and returns the codec used; "auto"
+// picks it from the magic, and data without a known magic is copied as is.
+// The output is capped by common.MaxDecompressedSize like DecompressWith.
+func DecompressStream(dst io.Writer, src io.Reader, name string, o CompressOpts) (string, error) {
+	n := normalize(name)
+	if n == "auto" {
+		br := bufio.NewReader(src)
+		head, err := br.Peek(6)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		n, src = Detect(head), br
+	}
+	if n == "none" {
+		_, err := io.Copy(dst, src)
+		return n, err
+	}
+	r, err := openReader(n, src, o)
+	if err != nil {
+		return n, err
+	}
+	defer r.Close()
+	_, err = io.Copy(dst, common.LimitReader(r))
+	if errors.Is(err, zstd.ErrUnknownDictionary) {
+		return n, ErrNeedDict
+	}
+	return n, err
+}
@@ -0,0 +1,56 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"goimagetool/internal/common"
+)
+
+// ZstdDefaultLevel — уровень zstd CLI по умолчанию.
+const ZstdDefaultLevel = 3
+
+func ZstdDecompress(dst io.Writer, src io.Reader) error {
+	d, err := zstd.NewReader(src)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	_, err = io.Copy(dst, common.LimitReader(d))
+	if errors.Is(err, zstd.ErrUnknownDictionary) {
+		return ErrNeedDict
+	}
+	return err
+}
+
+func ZstdCompress(dst io.Writer, src io.Reader) error {
+	return ZstdCompressLevel(dst, src, ZstdDefaultLevel)
+}
+
+// ZstdCompressLevel: level on the zstd CLI scale, 1..22. The encoder has
+// four speed tiers, so neighbouring levels may produce identical output.
+func ZstdCompressLevel(dst io.Writer, src io.Reader, level int) error {
+	return zstdCompress(dst, src, level, nil)
+}
+
+func zstdCompress(dst io.Writer, src io.Reader, level int, dict []byte) error {
+	zw, err := newZstdWriter(dst, level, dict)
+	if err != nil {
+		return err
+	}
+	return copyClose(zw, src)
+}
+
+func newZstdWriter(dst io.Writer, level int, dict []byte) (*zstd.Encoder, error) {
+	if level < 1 || level > 22 {
+		return nil, fmt.Errorf("zstd: %w: %d (want 1..22)", ErrBadLevel, level)
+	}
+	eopts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))}
+	if len(dict) > 0 {
+		eopts = append(eopts, zstd.WithEncoderDict(dict))
+	}
+	return zstd.NewWriter(dst, eopts...)
+}
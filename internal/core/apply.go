@@ -0,0 +1,238 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// FSRemove deletes p; a non-empty directory needs recursive.
+func (s *State) FSRemove(p string, recursive bool) error {
+	if s.FS == nil {
+		return common.ErrNoImage
+	}
+	p = path.Clean("/" + p)
+	e, ok := s.FS.Get(p)
+	if !ok {
+		return fmt.Errorf("%s: %w", p, common.ErrNotFound)
+	}
+	if e.Mode.Type() == memfs.ModeDir && !recursive && len(s.FS.List(p)) > 0 {
+		return fmt.Errorf("%s: directory not empty (use -r)", p)
+	}
+	return s.FS.Remove(p)
+}
+
+// FSMkdir creates directory p (0755, root-owned). Without parents the
+// parent must already exist; an existing directory is an error only then.
+func (s *State) FSMkdir(p string, parents bool) error {
+	if s.FS == nil {
+		return common.ErrNoImage
+	}
+	p = path.Clean("/" + p)
+	if e, ok := s.FS.Get(p); ok {
+		if e.Mode.Type() != memfs.ModeDir {
+			return fmt.Errorf("%s: exists and is not a directory", p)
+		}
+		if parents {
+			return nil
+		}
+		return fmt.Errorf("%s: already exists", p)
+	}
+	if pe, ok := s.FS.Get(path.Dir(p)); !parents && (!ok || pe.Mode.Type() != memfs.ModeDir) {
+		return fmt.Errorf("%s: %w", path.Dir(p), common.ErrNotFound)
+	}
+	s.FS.PutDir(p, 0, 0, time.Now())
+	return nil
+}
+
+// ApplyFile runs the fs script at name; host paths in `add` are relative
+// to the script's directory.
+func (s *State) ApplyFile(name string) error {
+	return s.ApplyFileWith(name, false)
+}
+
+// ApplyFileWith is ApplyFile; with keepGoing every line runs and the
+// failures are returned together (apply under --keep-going).
+func (s *State) ApplyFileWith(name string, keepGoing bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.ApplyWith(f, filepath.Dir(name), name, keepGoing)
+}
+
+// Apply executes a script of fs subcommands, one per line, in order:
+//
+//	add <hostPath> <dst>
+//	rm [-r] <path>
+//	mkdir [-p] <path>
+//	ln -s <target> <dst>
+//	mknod <c|b|p> <major> <minor> <dst>
+//	chmod [-R] <mode> <glob>
+//	chown [-R] <uid:gid> <glob>
+//
+// Blank lines and '#' comments are skipped; arguments may be quoted with
+// '…' or "…". The first failing line stops the run with name:line context.
+func (s *State) Apply(r io.Reader, baseDir, name string) error {
+	return s.ApplyWith(r, baseDir, name, false)
+}
+
+// ApplyWith is Apply; with keepGoing a failing line does not stop the run,
+// and all failures come back joined, each with its name:line.
+func (s *State) ApplyWith(r io.Reader, baseDir, name string, keepGoing bool) error {
+	if s.FS == nil {
+		return common.ErrNoImage
+	}
+	var errs []error
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitScriptLine(line)
+		if err != nil {
+			err = fmt.Errorf("%s:%d: %w", name, n, err)
+		} else if err = s.applyOne(args, baseDir); err != nil {
+			err = fmt.Errorf("%s:%d: %s: %w", name, n, args[0], err)
+		}
+		if err != nil {
+			if !keepGoing {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *State) applyOne(args []string, baseDir string) error {
+	cmd, args := args[0], args[1:]
+	flag := func(f string) bool {
+		if len(args) > 0 && args[0] == f {
+			args = args[1:]
+			return true
+		}
+		return false
+	}
+	want := func(n int, usage string) error {
+		if len(args) != n {
+			return fmt.Errorf("usage: %s %s", cmd, usage)
+		}
+		return nil
+	}
+	switch cmd {
+	case "add":
+		if err := want(2, "<hostPath> <dst>"); err != nil {
+			return err
+		}
+		src := args[0]
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(baseDir, src)
+		}
+		return s.FSAddLocal(src, args[1])
+	case "rm":
+		rec := flag("-r")
+		if err := want(1, "[-r] <path>"); err != nil {
+			return err
+		}
+		return s.FSRemove(args[0], rec)
+	case "mkdir":
+		parents := flag("-p")
+		if err := want(1, "[-p] <path>"); err != nil {
+			return err
+		}
+		return s.FSMkdir(args[0], parents)
+	case "ln":
+		if !flag("-s") {
+			return fmt.Errorf("only symbolic links (ln -s) are supported")
+		}
+		if err := want(2, "-s <target> <dst>"); err != nil {
+			return err
+		}
+		s.FS.PutSymlink(args[1], args[0], 0, 0, time.Now())
+		return nil
+	case "mknod":
+		if err := want(4, "<c|b|p> <major> <minor> <dst>"); err != nil {
+			return err
+		}
+		typ, ok := map[string]memfs.Mode{"c": memfs.ModeChar, "b": memfs.ModeBlock, "p": memfs.ModeFIFO}[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown node type %q, use c|b|p", args[0])
+		}
+		maj, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("major: %w", err)
+		}
+		min, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("minor: %w", err)
+		}
+		s.FS.PutNode(args[3], typ, 0o666, 0, 0, uint32(maj), uint32(min), time.Now())
+		return nil
+	case "chmod", "chown":
+		rec := flag("-R")
+		if err := want(2, "[-R] <mode|uid:gid> <glob>"); err != nil {
+			return err
+		}
+		var err error
+		if cmd == "chmod" {
+			_, err = s.FSChmod(args[1], args[0], rec)
+		} else {
+			_, err = s.FSChown(args[1], args[0], rec)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown command")
+	}
+}
+
+// splitScriptLine splits on blanks; '…' and "…" group words (no escapes).
+func splitScriptLine(line string) ([]string, error) {
+	var out []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				out = append(out, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		out = append(out, cur.String())
+	}
+	return out, nil
+}
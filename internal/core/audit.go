@@ -0,0 +1,163 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// AuditFinding is one risky entry found by Audit.
+type AuditFinding struct {
+	Path   string
+	Reason string
+}
+
+func (f AuditFinding) String() string { return f.Path + ": " + f.Reason }
+
+// FailOnAudit turns the audit warnings printed by store into errors
+// (--fail-on-audit, for CI gating).
+var FailOnAudit bool
+
+// Audit flags risky permissions in s.FS: world-writable entries (sticky
+// directories such as /tmp excepted), setuid/setgid files owned by a
+// non-root user, and relative symlinks whose ".." climb above the image
+// root. Paths matching exclude (memfs.Excluded) are skipped, so store can
+// audit exactly what it writes.
+func (s *State) Audit(exclude ...string) ([]AuditFinding, error) {
+	if s.FS == nil {
+		return nil, common.ErrNoImage
+	}
+	var out []AuditFinding
+	add := func(e *memfs.Entry, f string, a ...any) {
+		out = append(out, AuditFinding{Path: e.Name, Reason: fmt.Sprintf(f, a...)})
+	}
+	err := s.FS.Walk(func(e *memfs.Entry) error {
+		if len(exclude) > 0 && memfs.Excluded(e.Name, exclude) {
+			return nil
+		}
+		perm := memfs.EffectivePerm(e)
+		switch e.Mode.Type() {
+		case memfs.ModeLink:
+			if linkEscapes(e.Name, e.Target) {
+				add(e, "symlink -> %s points outside the image", e.Target)
+			}
+			return nil
+		case memfs.ModeDir:
+			if perm&0o002 != 0 && perm&0o1000 == 0 {
+				add(e, "world-writable directory without sticky bit (%04o)", perm)
+			}
+			return nil
+		}
+		if perm&0o002 != 0 {
+			add(e, "world-writable %s (%04o)", e.Mode.TypeName(), perm)
+		}
+		if e.Mode.Type() == memfs.ModeFile && e.UID != 0 {
+			if perm&0o4000 != 0 {
+				add(e, "setuid, owned by uid %d", e.UID)
+			}
+			if perm&0o2000 != 0 {
+				add(e, "setgid, owned by uid %d", e.UID)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// linkEscapes: a relative target resolved from the link's directory climbs
+// above "/" (absolute targets stay inside the image by definition).
+func linkEscapes(name, target string) bool {
+	if strings.HasPrefix(target, "/") {
+		return false
+	}
+	depth := strings.Count(strings.Trim(path.Dir(name), "/"), "/") + 1
+	if path.Dir(name) == "/" {
+		depth = 0
+	}
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// SymlinkStatus is one symlink checked by SymlinkCheck. Resolved is where
+// the target leads inside the image, or the first missing component when
+// Dangling (empty for an empty target).
+type SymlinkStatus struct {
+	Path, Target, Resolved   string
+	Absolute, Dangling, Loop bool
+}
+
+// OK reports a link that resolves and has a relative target.
+func (l SymlinkStatus) OK() bool { return !l.Absolute && !l.Dangling && !l.Loop }
+
+// Status is "ok" or the comma-separated problems: absolute, dangling
+// (with the missing path), loop.
+func (l SymlinkStatus) Status() string {
+	var st []string
+	if l.Absolute {
+		st = append(st, "absolute")
+	}
+	if l.Dangling && l.Target == "" {
+		st = append(st, "dangling (empty target)")
+	} else if l.Dangling {
+		st = append(st, "dangling ("+l.Resolved+" missing)")
+	}
+	if l.Loop {
+		st = append(st, "loop")
+	}
+	if len(st) == 0 {
+		return "ok"
+	}
+	return strings.Join(st, ", ")
+}
+
+func (l SymlinkStatus) String() string { return l.Path + " -> " + l.Target + ": " + l.Status() }
+
+// SymlinkCheck resolves every symlink in s.FS within the image (never the
+// host) and reports it as dangling when a component of the target is
+// missing or the target is empty (the kernel fails such a link with ENOENT;
+// the cpio loader produces them), loop when resolution goes around in a
+// cycle, and absolute when the target starts with "/" (it only works if the
+// image is mounted as the root at runtime). Links are returned in path order.
+func (s *State) SymlinkCheck() ([]SymlinkStatus, error) {
+	if s.FS == nil {
+		return nil, common.ErrNoImage
+	}
+	var out []SymlinkStatus
+	err := s.FS.Walk(func(e *memfs.Entry) error {
+		if e.Mode.Type() != memfs.ModeLink {
+			return nil
+		}
+		l := SymlinkStatus{Path: e.Name, Target: e.Target, Absolute: strings.HasPrefix(e.Target, "/")}
+		if e.Target == "" {
+			// ResolveLink treats it as no link at all and would land on the link itself
+			l.Dangling = true
+			out = append(out, l)
+			return nil
+		}
+		resolved, _, err := s.FS.ResolveLink(e.Name, memfs.DefaultMaxHops)
+		switch {
+		case errors.Is(err, memfs.ErrLoop):
+			l.Loop = true
+		case err != nil:
+			l.Dangling = true
+		}
+		l.Resolved = resolved
+		out = append(out, l)
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSymlinkCheck(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	s := New()
+	s.FS.PutFile("/bin/busybox", []byte("\x7fELF"), 0o755, 0, 0, mt)
+	s.FS.PutSymlink("/bin/ls", "busybox", 0, 0, mt)
+	s.FS.PutSymlink("/bin/sh", "", 0, 0, mt) // what the cpio loader makes of a link without data
+	s.FS.PutSymlink("/bin/vi", "../usr/bin/vi", 0, 0, mt)
+	s.FS.PutSymlink("/sbin/init", "/bin/busybox", 0, 0, mt)
+	s.FS.PutSymlink("/loop/a", "b", 0, 0, mt)
+	s.FS.PutSymlink("/loop/b", "a", 0, 0, mt)
+
+	links, err := s.SymlinkCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range links {
+		got = append(got, l.String())
+	}
+	want := []string{
+		"/bin/ls -> busybox: ok",
+		"/bin/sh -> : dangling (empty target)",
+		"/bin/vi -> ../usr/bin/vi: dangling (/usr missing)",
+		"/loop/a -> b: loop",
+		"/loop/b -> a: loop",
+		"/sbin/init -> /bin/busybox: absolute",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// binDirs are scanned for dangling symlinks (busybox applets live here).
+var binDirs = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin"}
+
+// CheckInitramfs looks for the usual reasons an initramfs fails to boot:
+// no /init (or /sbin/init), an init that is not an executable file or whose
+// #! interpreter is missing, no /dev/console, and dangling symlinks in the
+// bin directories. It returns human-readable warnings; none means ok.
+func (s *State) CheckInitramfs() ([]string, error) {
+	if s.FS == nil {
+		return nil, common.ErrNoImage
+	}
+	var warn []string
+	add := func(f string, a ...any) { warn = append(warn, fmt.Sprintf(f, a...)) }
+
+	initPath := "/init"
+	if _, ok := s.FS.Get(initPath); !ok {
+		initPath = "/sbin/init"
+		if _, ok := s.FS.Get(initPath); !ok {
+			add("no /init or /sbin/init: the kernel has nothing to run")
+			initPath = ""
+		} else {
+			add("no /init: the kernel only falls back to /sbin/init after mounting a root fs")
+		}
+	}
+	if initPath != "" {
+		if msg := s.checkExecutable(initPath, 0); msg != "" {
+			add("%s: %s", initPath, msg)
+		}
+	}
+
+	if e, ok := s.FS.Get("/dev/console"); !ok {
+		add("/dev/console is missing: init starts without stdin/stdout (mknod c 5 1 /dev/console)")
+	} else if e.Mode.Type() != memfs.ModeChar {
+		add("/dev/console is a %s, not a character device", e.Mode.TypeName())
+	}
+
+	for _, dir := range binDirs {
+		_ = s.FS.WalkDir(dir, func(e *memfs.Entry) error {
+			if e.Mode.Type() != memfs.ModeLink {
+				return nil
+			}
+			switch _, _, err := s.FS.ResolveLink(e.Name, memfs.DefaultMaxHops); {
+			case errors.Is(err, memfs.ErrLoop):
+				add("%s -> %s: symlink loop", e.Name, e.Target)
+			case err != nil, e.Target == "":
+				add("%s -> %s: dangling symlink", e.Name, e.Target)
+			}
+			return nil
+		})
+	}
+	return warn, nil
+}
+
+// checkExecutable follows p and reports why it can't be exec'd, or "".
+// depth counts #! hops; the kernel gives up after 4 (BINPRM_MAX_RECURSION).
+func (s *State) checkExecutable(p string, depth int) string {
+	if depth > 4 {
+		return "too many levels of #! interpreters"
+	}
+	resolved, e, err := s.FS.ResolveLink(p, memfs.DefaultMaxHops)
+	switch {
+	case errors.Is(err, memfs.ErrLoop):
+		return "symlink loop"
+	case err != nil:
+		return resolved + " not found"
+	case e.Mode.Type() != memfs.ModeFile:
+		return "not a regular file (" + e.Mode.TypeName() + ")"
+	case e.Mode&0o111 == 0:
+		return fmt.Sprintf("not executable (mode %04o)", uint32(e.Mode&0o7777))
+	}
+	// скрипт: интерпретатор тоже должен быть в образе
+	if !strings.HasPrefix(string(e.Data), "#!") {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(e.Data[2:]), "\n")
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return "empty #! line"
+	}
+	interp := f[0]
+	if !path.IsAbs(interp) {
+		return "#! interpreter " + interp + " is not an absolute path"
+	}
+	msg := s.checkExecutable(interp, depth+1)
+	if msg == "" || strings.HasPrefix(msg, "#!") || strings.HasPrefix(msg, "too many") {
+		return msg // цепочку не разворачиваем, хватит самой глубокой причины
+	}
+	return "#! interpreter " + interp + ": " + msg
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"goimagetool/internal/image/cramfs"
+)
+
+// CramfsMeta: the superblock of a loaded cramfs image.
+type CramfsMeta struct {
+	Super *cramfs.Superblock
+}
+
+// LoadCramfs reads a cramfs image (mkfs.cramfs output). cramfs is
+// read-only: store the tree as another format.
+func (s *State) LoadCramfs(path, compressionName string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadCramfsReader(r, compressionName) })
+}
+
+func (s *State) LoadCramfsReader(r io.Reader, compressionName string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
+	}
+	fs, sb, err := cramfs.Load(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	s.Kind = KindCramfs
+	s.FS = fs
+	s.Meta = &CramfsMeta{Super: sb}
+	s.Raw = b
+	s.markClean()
+	return nil
+}
+
+// cramfsInfo: the info line for kind cramfs.
+func (s *State) cramfsInfo() string {
+	m, _ := s.Meta.(*CramfsMeta)
+	if m == nil {
+		return ""
+	}
+	order := "little-endian"
+	if m.Super.BigEndian {
+		order = "big-endian"
+	}
+	return fmt.Sprintf("\ncramfs name: %q, edition %d, %d files, %s", m.Super.Name, m.Super.Edition, m.Super.Files, order)
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// FSPath resolves an image path given on the command line: absolute paths
+// are taken as is, relative ones against s.Cwd (fs cd). "" is the cwd.
+func (s *State) FSPath(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p)
+	}
+	cwd := s.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
+	return path.Join(cwd, p)
+}
+
+// FSChdir sets s.Cwd to the directory p (relative to the current one);
+// symlinks on the way are followed, like cd -P.
+func (s *State) FSChdir(p string) error {
+	if s.FS == nil {
+		return common.ErrNoImage
+	}
+	resolved, e, err := s.FS.ResolveLink(s.FSPath(p), memfs.DefaultMaxHops)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	// корня в memfs может и не быть — он всё равно каталог
+	if resolved != "/" && (e == nil || e.Mode.Type() != memfs.ModeDir) {
+		return fmt.Errorf("%s: not a directory", resolved)
+	}
+	s.Cwd = resolved
+	if resolved == "/" {
+		s.Cwd = ""
+	}
+	return nil
+}
+
+// FSPwd is s.Cwd for display: "/" when unset.
+func (s *State) FSPwd() string {
+	if s.Cwd == "" {
+		return "/"
+	}
+	return s.Cwd
+}
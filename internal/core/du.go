@@ -0,0 +1,70 @@
+package core
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// DUEntry — cumulative size of one immediate child directory.
+type DUEntry struct {
+	Name  string
+	Bytes int64
+	Files int
+}
+
+// FSDu sums regular-file data below root per immediate child directory,
+// largest first, plus the grand total for root (files directly in root
+// count only towards the total). block > 0 rounds every file up to a
+// multiple of block, 0 reports apparent sizes.
+func (s *State) FSDu(root string, block int64) ([]DUEntry, int64, error) {
+	if s.FS == nil {
+		return nil, 0, common.ErrNoImage
+	}
+	root = "/" + strings.Trim(root, "/")
+	dirs := map[string]*DUEntry{}
+	var total int64
+	err := s.FS.WalkDir(root, func(e *memfs.Entry) error {
+		if e.Name == root {
+			return nil
+		}
+		rel := strings.TrimPrefix(e.Name, withSlash(root))
+		first, _, nested := strings.Cut(rel, "/")
+		if !nested && e.Mode.Type() == memfs.ModeDir {
+			if dirs[first] == nil {
+				dirs[first] = &DUEntry{Name: path.Join(root, first)}
+			}
+			return nil
+		}
+		if e.Mode.Type() != memfs.ModeFile {
+			return nil
+		}
+		n := int64(len(e.Data))
+		if block > 0 {
+			n = int64(common.AlignUp(uint64(n), uint64(block)))
+		}
+		total += n
+		if d := dirs[first]; nested && d != nil {
+			d.Bytes += n
+			d.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]DUEntry, 0, len(dirs))
+	for _, d := range dirs {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, total, nil
+}
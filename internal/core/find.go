@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// FindOptions — предикаты fs find; заданные объединяются по И, как в
+// find(1). Нулевое значение находит всё.
+type FindOptions struct {
+	Type string // f d l c b p, "" = any
+	Name string // glob on the last path element (path.Match)
+	// SizeCmp compares the entry size (file data, symlink target length)
+	// with Size: +1 more than, -1 less than, 0 exactly; ignored if !HasSize.
+	HasSize bool
+	SizeCmp int
+	Size    int64
+	// Perm is checked when PermMatch is set: '=' exact permission bits,
+	// '-' all of Perm set, '/' any of Perm set (find -perm mode|-mode|/mode).
+	PermMatch byte
+	Perm      memfs.Mode
+}
+
+var findTypes = map[string]memfs.Mode{
+	"f": memfs.ModeFile, "d": memfs.ModeDir, "l": memfs.ModeLink,
+	"c": memfs.ModeChar, "b": memfs.ModeBlock, "p": memfs.ModeFIFO,
+}
+
+// FSFind lists the entries below root (root included) that match every
+// predicate in opt, in path order. Symlinks are not followed.
+func (s *State) FSFind(root string, opt FindOptions) ([]*memfs.Entry, error) {
+	if s.FS == nil {
+		return nil, common.ErrNoImage
+	}
+	typ, ok := findTypes[opt.Type]
+	if opt.Type != "" && !ok {
+		return nil, fmt.Errorf("-type %s: want one of f d l c b p", opt.Type)
+	}
+	if opt.Name != "" {
+		if _, err := path.Match(opt.Name, ""); err != nil {
+			return nil, fmt.Errorf("-name %s: %w", opt.Name, err)
+		}
+	}
+	root = "/" + strings.Trim(root, "/")
+	if _, ok := s.FS.Get(root); !ok {
+		return nil, fmt.Errorf("%s: %w", root, common.ErrNotFound)
+	}
+	var out []*memfs.Entry
+	err := s.FS.WalkDir(root, func(e *memfs.Entry) error {
+		if opt.Type != "" && e.Mode.Type() != typ {
+			return nil
+		}
+		if opt.Name != "" {
+			if ok, _ := path.Match(opt.Name, path.Base(e.Name)); !ok {
+				return nil
+			}
+		}
+		if opt.HasSize {
+			size := int64(len(e.Data))
+			if e.Mode.Type() == memfs.ModeLink {
+				size = int64(len(e.Target))
+			}
+			if cmp := size - opt.Size; opt.SizeCmp > 0 && cmp <= 0 || opt.SizeCmp < 0 && cmp >= 0 || opt.SizeCmp == 0 && cmp != 0 {
+				return nil
+			}
+		}
+		perm := memfs.EffectivePerm(e)
+		switch opt.PermMatch {
+		case '=':
+			if perm != opt.Perm {
+				return nil
+			}
+		case '-':
+			if perm&opt.Perm != opt.Perm {
+				return nil
+			}
+		case '/':
+			if opt.Perm != 0 && perm&opt.Perm == 0 {
+				return nil
+			}
+		}
+		out = append(out, e)
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"goimagetool/internal/compress"
+	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/cpio"
+	"goimagetool/internal/image/uboot/fit"
+)
+
+// ramdiskCodec: the image's compression property, or for "none" (U-Boot
+// passes the data on, the kernel unpacks it) the codec of the data itself.
+func ramdiskCodec(img *fit.Image, data []byte) string {
+	if c := img.Compression; c != "" && c != "none" {
+		return c
+	}
+	return compress.Detect(data)
+}
+
+// FitOpenRamdisk makes a ramdisk image of the loaded FIT the working FS
+// (kind initramfs), so fs commands and the TUI edit it; name "" is the
+// default configuration's ramdisk. The FIT stays in Meta until
+// FitPutRamdisk writes the FS back.
+func (s *State) FitOpenRamdisk(name string) error {
+	m, _ := s.Meta.(*FitMeta)
+	if m == nil || m.F == nil {
+		return errors.New("no FIT loaded")
+	}
+	if m.Ramdisk != "" {
+		return fmt.Errorf("ramdisk %s is open already; fit put-ramdisk first", m.Ramdisk)
+	}
+	if name == "" {
+		var err error
+		if name, err = m.F.DefaultRamdisk(); err != nil {
+			return err
+		}
+	}
+	img, err := m.F.Get(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	data, err := img.ReadData()
+	if err != nil {
+		return err
+	}
+	codec := ramdiskCodec(img, data)
+	if codec != "none" {
+		if data, err = compress.DecompressWith(data, codec, s.Codec); err != nil {
+			return fmt.Errorf("fit ramdisk %s: %s: %w", name, codec, err)
+		}
+	}
+	fs, raw, err := cpio.LoadSegments(data, nil)
+	if err != nil {
+		return fmt.Errorf("fit ramdisk %s: %w", name, err)
+	}
+	s.Kind = KindInitramfs
+	s.FS = fs
+	s.Raw = raw
+	s.Cwd = ""
+	s.clean = cleanMark{}
+	m.Ramdisk, m.RamdiskCodec = name, codec
+	return nil
+}
+
+// FitPutRamdisk stores the working FS as cpio into the FIT image name ("" =
+// the one FitOpenRamdisk opened), compressed as that image was, and makes
+// the FIT the working image again. Hashes are recomputed; signatures over
+// the image are stale until fit sign.
+func (s *State) FitPutRamdisk(name string) error {
+	m, _ := s.Meta.(*FitMeta)
+	if m == nil || m.F == nil {
+		return errors.New("no FIT loaded")
+	}
+	if name == "" {
+		name = m.Ramdisk
+	}
+	if name == "" {
+		return errors.New("no FIT ramdisk open (fit open-ramdisk)")
+	}
+	if s.FS == nil {
+		return errors.New("no image")
+	}
+	img, err := m.F.Get(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	codec := m.RamdiskCodec
+	if name != m.Ramdisk || codec == "" {
+		old, err := img.ReadData()
+		if err != nil {
+			return err
+		}
+		codec = ramdiskCodec(img, old)
+	}
+	var buf bytes.Buffer
+	if err := cpio.StoreNewc(&buf, s.FS); err != nil {
+		return err
+	}
+	data, err := s.compressOutput(buf.Bytes(), codec)
+	if err != nil {
+		return fmt.Errorf("fit ramdisk %s: %s: %w", name, codec, err)
+	}
+	img.SetData(data)
+	s.Kind = KindKernelFIT
+	s.FS = memfs.New()
+	s.Raw = nil
+	s.Cwd = ""
+	m.Ramdisk, m.RamdiskCodec = "", ""
+	return nil
+}
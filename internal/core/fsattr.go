@@ -0,0 +1,226 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/fs/vfscap"
+)
+
+var ErrBadModeSyntax = errors.New("bad mode syntax")
+
+// FSChmod applies mode (octal like 0755 or symbolic like u+x,go-w) to every
+// entry matching pattern, descending into directories when recursive.
+// Symlinks keep their 0777 permissions. It returns the number of entries changed.
+func (s *State) FSChmod(pattern, mode string, recursive bool) (int, error) {
+	apply, err := parseChmod(mode)
+	if err != nil {
+		return 0, err
+	}
+	return s.forEachMatch(pattern, recursive, func(e *memfs.Entry) error {
+		if e.Mode.Type() == memfs.ModeLink {
+			return nil
+		}
+		return s.FS.Chmod(e.Name, apply(e.Mode))
+	})
+}
+
+// FSChown sets uid:gid on every entry matching pattern.
+func (s *State) FSChown(pattern, owner string, recursive bool) (int, error) {
+	uid, gid, err := ParseOwner(owner)
+	if err != nil {
+		return 0, err
+	}
+	return s.forEachMatch(pattern, recursive, func(e *memfs.Entry) error {
+		return s.FS.Chown(e.Name, uid, gid)
+	})
+}
+
+// FSSetCap sets the file capabilities of the regular file p from caps in
+// setcap(8) syntax ("cap_net_raw+ep"); caps "" removes them.
+func (s *State) FSSetCap(p, caps string) error {
+	e, err := s.capFile(p)
+	if err != nil {
+		return err
+	}
+	if caps == "" {
+		return s.FS.SetXattr(e.Name, vfscap.XattrName, nil)
+	}
+	set, err := vfscap.Parse(caps)
+	if err != nil {
+		return err
+	}
+	return s.FS.SetXattr(e.Name, vfscap.XattrName, vfscap.Encode(set))
+}
+
+// FSGetCap returns the file capabilities of p as getcap(8) prints them,
+// "" when it has none.
+func (s *State) FSGetCap(p string) (string, error) {
+	e, err := s.capFile(p)
+	if err != nil {
+		return "", err
+	}
+	v, ok := e.Xattrs[vfscap.XattrName]
+	if !ok {
+		return "", nil
+	}
+	set, err := vfscap.Decode(v)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", e.Name, err)
+	}
+	return set.String(), nil
+}
+
+// capFile: only regular files carry capabilities.
+func (s *State) capFile(p string) (*memfs.Entry, error) {
+	if s.FS == nil {
+		return nil, common.ErrNoImage
+	}
+	e, ok := s.FS.Get(p)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", p, common.ErrNotFound)
+	}
+	if e.Mode.Type() != memfs.ModeFile {
+		return nil, fmt.Errorf("%s: not a regular file", p)
+	}
+	return e, nil
+}
+
+// ParseOwner parses "uid:gid" (numeric). A bare "uid" sets gid to the same value.
+func ParseOwner(s string) (uint32, uint32, error) {
+	us, gs, ok := strings.Cut(s, ":")
+	if !ok {
+		gs = us
+	}
+	uid, err := strconv.ParseUint(us, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad owner %q: want uid:gid", s)
+	}
+	gid, err := strconv.ParseUint(gs, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad owner %q: want uid:gid", s)
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+func (s *State) forEachMatch(pattern string, recursive bool, fn func(*memfs.Entry) error) (int, error) {
+	if s.FS == nil {
+		return 0, common.ErrNoImage
+	}
+	matches, err := s.FS.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("%s: %w", pattern, common.ErrNotFound)
+	}
+	done := map[string]bool{}
+	visit := func(e *memfs.Entry) error {
+		if done[e.Name] {
+			return nil
+		}
+		done[e.Name] = true
+		return fn(e)
+	}
+	for _, m := range matches {
+		e, ok := s.FS.Get(m)
+		if !ok {
+			continue
+		}
+		if err := visit(e); err != nil {
+			return len(done), err
+		}
+		if !recursive || e.Mode.Type() != memfs.ModeDir {
+			continue
+		}
+		err := s.FS.WalkDir(m, visit)
+		if err != nil {
+			return len(done), err
+		}
+	}
+	return len(done), nil
+}
+
+// parseChmod returns a function computing the new permission bits for an
+// entry. Octal modes replace the bits outright; symbolic clauses
+// ([ugoa]*[+-=][rwxXst]*, comma separated) are applied in order.
+func parseChmod(mode string) (func(memfs.Mode) memfs.Mode, error) {
+	if v, err := strconv.ParseUint(mode, 8, 32); err == nil {
+		if v > 0o7777 {
+			return nil, ErrBadModeSyntax
+		}
+		return func(memfs.Mode) memfs.Mode { return memfs.Mode(v) }, nil
+	}
+	type clause struct {
+		who   memfs.Mode
+		op    byte
+		perms string
+	}
+	var clauses []clause
+	for _, c := range strings.Split(mode, ",") {
+		i := strings.IndexAny(c, "+-=")
+		if i < 0 {
+			return nil, ErrBadModeSyntax
+		}
+		var who memfs.Mode
+		for _, r := range c[:i] {
+			switch r {
+			case 'u':
+				who |= 0o4700
+			case 'g':
+				who |= 0o2070
+			case 'o':
+				who |= 0o1007
+			case 'a':
+				who |= 0o7777
+			default:
+				return nil, ErrBadModeSyntax
+			}
+		}
+		if who == 0 {
+			who = 0o7777
+		}
+		if strings.Trim(c[i+1:], "rwxXst") != "" {
+			return nil, ErrBadModeSyntax
+		}
+		clauses = append(clauses, clause{who: who, op: c[i], perms: c[i+1:]})
+	}
+	return func(m memfs.Mode) memfs.Mode {
+		cur := m & 0o7777
+		for _, c := range clauses {
+			var bits memfs.Mode
+			for _, r := range c.perms {
+				switch r {
+				case 'r':
+					bits |= 0o444
+				case 'w':
+					bits |= 0o222
+				case 'x':
+					bits |= 0o111
+				case 'X':
+					if m.Type() == memfs.ModeDir || cur&0o111 != 0 {
+						bits |= 0o111
+					}
+				case 's':
+					bits |= 0o6000
+				case 't':
+					bits |= 0o1000
+				}
+			}
+			bits &= c.who
+			switch c.op {
+			case '+':
+				cur |= bits
+			case '-':
+				cur &^= bits
+			case '=':
+				cur = cur&^c.who | bits
+			}
+		}
+		return cur
+	}, nil
+}
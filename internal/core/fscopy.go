@@ -0,0 +1,58 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// FSCopy duplicates src to dst inside the image, like cp -P: symlinks are
+// copied as links, file data is deep-copied, metadata is kept. A directory
+// needs recursive. An existing directory dst receives src under its own
+// base name; otherwise dst is the new name and its parent must exist.
+// Returns the number of entries written.
+func (s *State) FSCopy(src, dst string, recursive bool) (int, error) {
+	if s.FS == nil {
+		return 0, common.ErrNoImage
+	}
+	src, dst = path.Clean("/"+src), path.Clean("/"+dst)
+	se, ok := s.FS.Get(src)
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", src, common.ErrNotFound)
+	}
+	isDir := se.Mode.Type() == memfs.ModeDir
+	if isDir && !recursive {
+		return 0, fmt.Errorf("%s: is a directory (use -r)", src)
+	}
+	if de, ok := s.FS.Get(dst); ok && de.Mode.Type() == memfs.ModeDir {
+		dst = path.Join(dst, path.Base(src))
+	}
+	if dst == src || strings.HasPrefix(dst, withSlash(src)) {
+		return 0, fmt.Errorf("cannot copy %s into itself (%s)", src, dst)
+	}
+	if pe, ok := s.FS.Get(path.Dir(dst)); !ok || pe.Mode.Type() != memfs.ModeDir {
+		return 0, fmt.Errorf("%s: %w", path.Dir(dst), common.ErrNotFound)
+	}
+	if de, ok := s.FS.Get(dst); ok && (de.Mode.Type() == memfs.ModeDir) != isDir {
+		return 0, fmt.Errorf("%s: exists and is of another type", dst)
+	}
+
+	// сначала собираем, потом пишем: WalkDir не должен видеть новые записи
+	var todo []*memfs.Entry
+	if err := s.FS.WalkDir(src, func(e *memfs.Entry) error {
+		c := *e
+		c.Name = dst + strings.TrimPrefix(e.Name, src)
+		c.Data = append([]byte(nil), e.Data...)
+		todo = append(todo, &c)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	for _, e := range todo {
+		putEntry(s.FS, e)
+	}
+	return len(todo), nil
+}
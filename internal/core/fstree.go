@@ -0,0 +1,161 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// TreeTotals — summary for a recursive listing.
+type TreeTotals struct {
+	Files, Dirs, Links, Devices int // Devices counts c/b/p nodes
+	Bytes                       int64
+}
+
+// FSTree visits every entry below root in tree order, calling fn with the
+// depth relative to root (direct children have depth 0). With follow, a
+// symlink that resolves to a directory is descended into right after the
+// link itself; a target that contains the link or is already being
+// expanded is reported with loop=true and not entered.
+func (s *State) FSTree(root string, follow bool, fn func(depth int, e *memfs.Entry, loop bool)) (TreeTotals, error) {
+	return s.FSTreeSorted(root, follow, EntryOrder{}, fn)
+}
+
+// FSTreeSorted is FSTree with the entries of every directory in order o
+// (fs ls -R --sort); each directory is still followed by its contents.
+func (s *State) FSTreeSorted(root string, follow bool, o EntryOrder, fn func(depth int, e *memfs.Entry, loop bool)) (TreeTotals, error) {
+	var t TreeTotals
+	if s.FS == nil {
+		return t, common.ErrNoImage
+	}
+	var walk func(dir string, depth int, stack []string) error
+	walk = func(dir string, depth int, stack []string) error {
+		for _, e := range o.subtree(s.FS, dir) {
+			d := depth + strings.Count(strings.TrimPrefix(e.Name, withSlash(dir)), "/")
+			switch e.Mode.Type() {
+			case memfs.ModeDir:
+				t.Dirs++
+			case memfs.ModeLink:
+				t.Links++
+			case memfs.ModeChar, memfs.ModeBlock, memfs.ModeFIFO:
+				t.Devices++
+			default:
+				t.Files++
+				t.Bytes += int64(len(e.Data))
+			}
+			if !follow || e.Mode.Type() != memfs.ModeLink {
+				fn(d, e, false)
+				continue
+			}
+			resolved, te, err := s.FS.ResolveLink(e.Name, memfs.DefaultMaxHops)
+			if errors.Is(err, memfs.ErrLoop) {
+				fn(d, e, true)
+				continue
+			}
+			if err != nil || te == nil || te.Mode.Type() != memfs.ModeDir {
+				fn(d, e, false)
+				continue
+			}
+			loop := strings.HasPrefix(e.Name, withSlash(resolved))
+			for _, p := range stack {
+				loop = loop || p == resolved
+			}
+			fn(d, e, loop)
+			if loop {
+				continue
+			}
+			if err := walk(resolved, d+1, append(stack, resolved)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	root = "/" + strings.Trim(root, "/")
+	return t, walk(root, 0, []string{root})
+}
+
+func withSlash(dir string) string {
+	if strings.HasSuffix(dir, "/") {
+		return dir
+	}
+	return dir + "/"
+}
+
+// EntryOrder is the fs ls order: By "name" (or ""), "size" (the SIZE
+// column: data, or the target of a symlink) or "mtime", ties by name;
+// Reverse flips it.
+type EntryOrder struct {
+	By      string
+	Reverse bool
+}
+
+// ParseEntryOrder checks the fs ls --sort key.
+func ParseEntryOrder(by string, reverse bool) (EntryOrder, error) {
+	switch by {
+	case "name", "size", "mtime":
+		return EntryOrder{By: by, Reverse: reverse}, nil
+	}
+	return EntryOrder{}, fmt.Errorf("unknown sort key %q (name, size, mtime)", by)
+}
+
+// Sort orders es, a directory listing in name order as memfs.List
+// returns it.
+func (o EntryOrder) Sort(es []*memfs.Entry) {
+	less := func(a, b *memfs.Entry) bool { return a.Name < b.Name }
+	switch o.By {
+	case "size":
+		less = func(a, b *memfs.Entry) bool { return entrySize(a) < entrySize(b) }
+	case "mtime":
+		less = func(a, b *memfs.Entry) bool { return a.MTime.Before(b.MTime) }
+	}
+	sort.SliceStable(es, func(i, j int) bool {
+		if o.Reverse {
+			return less(es[j], es[i])
+		}
+		return less(es[i], es[j])
+	})
+}
+
+func entrySize(e *memfs.Entry) int {
+	if e.Mode.Type() == memfs.ModeLink {
+		return len(e.Target)
+	}
+	return len(e.Data)
+}
+
+// subtree is the package subtree with every directory's entries in
+// order o.
+func (o EntryOrder) subtree(fs *memfs.FS, dir string) []*memfs.Entry {
+	if (o.By == "" || o.By == "name") && !o.Reverse {
+		return subtree(fs, dir)
+	}
+	var out []*memfs.Entry
+	es := fs.List(dir)
+	o.Sort(es)
+	for _, e := range es {
+		out = append(out, e)
+		if e.Mode.Type() == memfs.ModeDir {
+			out = append(out, o.subtree(fs, e.Name)...)
+		}
+	}
+	return out
+}
+
+// subtree: entries strictly below dir, ordered so that every directory is
+// immediately followed by its own contents ("/a", "/a/b", "/a-x").
+func subtree(fs *memfs.FS, dir string) []*memfs.Entry {
+	var out []*memfs.Entry
+	_ = fs.WalkDir(dir, func(e *memfs.Entry) error {
+		if e.Name != dir {
+			out = append(out, e)
+		}
+		return nil
+	})
+	key := func(p string) string { return strings.ReplaceAll(p, "/", "\x00") }
+	sort.Slice(out, func(i, j int) bool { return key(out[i].Name) < key(out[j].Name) })
+	return out
+}
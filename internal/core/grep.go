@@ -0,0 +1,141 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// GrepOptions — режимы fs grep.
+type GrepOptions struct {
+	IgnoreCase bool
+	Regex      bool // pattern is a Go regexp (RE2 syntax)
+	Binary     bool // pattern is hex bytes ("7f454c46", "7f 45 4c 46")
+	All        bool // report every match (-n), not just the file
+}
+
+// GrepMatch is one hit. Text data reports the 1-based line and the line
+// itself; binary data (--binary, or a file with NUL bytes) reports only
+// Offset, with Line == 0.
+type GrepMatch struct {
+	Path   string
+	Line   int
+	Offset int64
+	Text   string
+}
+
+// binarySniff: как grep, файл с NUL в первых байтах считаем двоичным.
+const binarySniff = 8000
+
+// FSGrep searches the data of regular files below root (symlinks are not
+// followed). Without opt.All each matching file is reported once.
+func (s *State) FSGrep(pattern, root string, opt GrepOptions) ([]GrepMatch, error) {
+	if s.FS == nil {
+		return nil, common.ErrNoImage
+	}
+	find, err := grepMatcher(pattern, opt)
+	if err != nil {
+		return nil, err
+	}
+	root = "/" + strings.Trim(root, "/")
+	if _, ok := s.FS.Get(root); !ok {
+		return nil, fmt.Errorf("%s: %w", root, common.ErrNotFound)
+	}
+	var out []GrepMatch
+	err = s.FS.WalkDir(root, func(e *memfs.Entry) error {
+		if e.Mode.Type() != memfs.ModeFile {
+			return nil
+		}
+		locs := find(e.Data, opt.All)
+		if len(locs) == 0 {
+			return nil
+		}
+		if !opt.All {
+			out = append(out, GrepMatch{Path: e.Name, Offset: int64(locs[0])})
+			return nil
+		}
+		bin := opt.Binary || bytes.IndexByte(e.Data[:min(len(e.Data), binarySniff)], 0) >= 0
+		line, lineStart, last := 1, 0, -1
+		for _, off := range locs {
+			if bin {
+				out = append(out, GrepMatch{Path: e.Name, Offset: int64(off)})
+				continue
+			}
+			// строки считаем инкрементально; одна строка — одна запись
+			line += bytes.Count(e.Data[lineStart:off], []byte{'\n'})
+			if i := bytes.LastIndexByte(e.Data[lineStart:off], '\n'); i >= 0 {
+				lineStart += i + 1
+			}
+			if line == last {
+				continue
+			}
+			last = line
+			end := bytes.IndexByte(e.Data[lineStart:], '\n')
+			if end < 0 {
+				end = len(e.Data) - lineStart
+			}
+			out = append(out, GrepMatch{Path: e.Name, Line: line, Offset: int64(off), Text: string(e.Data[lineStart : lineStart+end])})
+		}
+		return nil
+	})
+	return out, err
+}
+
+// grepMatcher returns the start offsets of matches in b (only the first
+// one unless all).
+func grepMatcher(pattern string, opt GrepOptions) (func(b []byte, all bool) []int, error) {
+	if pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+	if opt.Binary {
+		if opt.Regex || opt.IgnoreCase {
+			return nil, errors.New("--binary does not combine with --regex or -i")
+		}
+		needle, err := hex.DecodeString(strings.Join(strings.Fields(pattern), ""))
+		if err != nil {
+			return nil, fmt.Errorf("--binary pattern must be hex bytes: %w", err)
+		}
+		return func(b []byte, all bool) []int {
+			var locs []int
+			for off := 0; ; {
+				i := bytes.Index(b[off:], needle)
+				if i < 0 {
+					return locs
+				}
+				locs = append(locs, off+i)
+				if !all {
+					return locs
+				}
+				off += i + 1
+			}
+		}, nil
+	}
+	expr := pattern
+	if !opt.Regex {
+		expr = regexp.QuoteMeta(pattern)
+	}
+	if opt.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(b []byte, all bool) []int {
+		n := 1
+		if all {
+			n = -1
+		}
+		var locs []int
+		for _, m := range re.FindAllIndex(b, n) {
+			locs = append(locs, m[0])
+		}
+		return locs
+	}, nil
+}
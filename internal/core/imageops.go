@@ -15,6 +15,11 @@ var (
 	ErrAlignNonPos   = errors.New("align must be > 0")
 )
 
+// ZeroFillGrow: growing writes real zero bytes instead of extending the
+// file with a hole (image resize/pad --no-sparse), for copy tools and
+// filesystems that handle sparse files badly.
+var ZeroFillGrow bool
+
 func ParseSize(s string) (int64, error) {
 	if s == "" {
 		return 0, ErrBadSizeSyntax
@@ -99,10 +104,19 @@ func PadAlign(path string, align int64) error {
 	return growFile(path, align-rem)
 }
 
+// growFile extends path by add zero bytes; by default with ftruncate, so
+// the new tail is a hole and takes no disk space where holes exist.
 func growFile(path string, add int64) error {
 	if add <= 0 {
 		return nil
 	}
+	if !ZeroFillGrow {
+		cur, err := FileSize(path)
+		if err != nil {
+			return err
+		}
+		return os.Truncate(path, cur+add)
+	}
 	f, err := os.OpenFile(path, os.O_WRONLY, 0)
 	if err != nil {
 		return err
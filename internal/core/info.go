@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+
+	"goimagetool/internal/fs/ext2"
+	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/uboot/fit"
+)
+
+// InfoSchemaVersion is bumped only for incompatible changes to InfoReport
+// (a renamed or removed field); new fields keep the version.
+const InfoSchemaVersion = 1
+
+// InfoReport is what info --json prints. Field names are part of the CLI
+// contract: build systems parse them, so they never change within a
+// schema version.
+type InfoReport struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Kind          string `json:"kind"` // as in ImageKind.String: initramfs, kernel-fit, ...
+	// FileCount and TotalSize: regular files and their data for the
+	// filesystem kinds, images and their payloads for kernel-fit, 1 and
+	// the payload for kernel-legacy/kernel-raw, 0 when nothing is loaded.
+	FileCount int   `json:"fileCount"`
+	TotalSize int64 `json:"totalSize"`
+	// Details is one of UImageDetails (kernel-legacy), FitDetails,
+	// SquashFSDetails, Ext2Details, UBIDetails, UBIFSDetails, RomfsDetails,
+	// CramfsDetails or an empty object for other kinds.
+	Details any `json:"details"`
+}
+
+type UImageDetails struct {
+	Name  string `json:"name"`
+	Size  uint32 `json:"size"`
+	Load  uint32 `json:"load"`
+	Entry uint32 `json:"entry"`
+	Time  uint32 `json:"time"`
+	OS    uint8  `json:"os"`
+	Arch  uint8  `json:"arch"`
+	Type  uint8  `json:"type"`
+	Comp  uint8  `json:"comp"`
+	HCRC  uint32 `json:"hcrc"`
+	DCRC  uint32 `json:"dcrc"`
+}
+
+type FitImageDetails struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Size   int64    `json:"size"`
+	Hashes []string `json:"hashes"`
+	Load   uint64   `json:"load"`
+	Entry  uint64   `json:"entry"`
+}
+
+type FitConfigDetails struct {
+	Name       string   `json:"name"`
+	Kernel     string   `json:"kernel"`
+	FDT        string   `json:"fdt"`
+	Ramdisk    string   `json:"ramdisk"`
+	Compatible []string `json:"compatible"`
+}
+
+type FitDetails struct {
+	Default       string             `json:"default"`
+	DefaultConfig string             `json:"defaultConfig"`
+	Images        []FitImageDetails  `json:"images"`
+	Configs       []FitConfigDetails `json:"configs"`
+}
+
+type SquashFSDetails struct {
+	Compression string `json:"compression"`
+	BlockSize   uint32 `json:"blockSize"`
+	Inodes      uint32 `json:"inodes"`
+	Fragments   uint32 `json:"fragments"`
+	BytesUsed   uint64 `json:"bytesUsed"`
+	MkfsTime    uint32 `json:"mkfsTime"`
+}
+
+type UBIVolumeDetails struct {
+	ID       uint32 `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"` // dynamic or static
+	LEBs     int    `json:"lebs"`
+	Reserved uint32 `json:"reservedPebs"`
+}
+
+type UBIDetails struct {
+	PEBSize int                `json:"pebSize"`
+	LEBSize int                `json:"lebSize"`
+	PEBs    int                `json:"pebs"`
+	Volumes []UBIVolumeDetails `json:"volumes"`
+}
+
+type RomfsDetails struct {
+	Volume string `json:"volume"`
+	Size   uint32 `json:"size"` // full_size from the superblock
+}
+
+type CramfsDetails struct {
+	Name      string `json:"name"`
+	Edition   uint32 `json:"edition"`
+	Files     uint32 `json:"files"`
+	BigEndian bool   `json:"bigEndian"`
+	Size      uint32 `json:"size"`
+}
+
+type UBIFSDetails struct {
+	Volume      string `json:"volume"` // UBI volume, "" for a bare UBIFS image
+	LEBSize     int    `json:"lebSize"`
+	LEBCount    uint32 `json:"lebCount"`
+	MinIOSize   uint32 `json:"minIoSize"`
+	Compression string `json:"compression"`
+}
+
+type Ext2Details struct {
+	BlockSize  int    `json:"blockSize"`
+	Blocks     uint32 `json:"blocks"`
+	FreeBlocks uint32 `json:"freeBlocks"`
+	Inodes     uint32 `json:"inodes"`
+	FreeInodes uint32 `json:"freeInodes"`
+	InodeSize  int    `json:"inodeSize"`
+	UUID       string `json:"uuid"`
+	Label      string `json:"label"`
+}
+
+// InfoJSON builds the info --json report for the working image.
+func (s *State) InfoJSON() InfoReport {
+	r := InfoReport{SchemaVersion: InfoSchemaVersion, Kind: s.Kind.String(), Details: struct{}{}}
+	switch s.Kind {
+	case KindInitramfs, KindSquashFS, KindExt2, KindTar, KindJFFS2, KindUBI, KindUBIFS, KindRomfs, KindCramfs:
+		if s.FS != nil {
+			_ = s.FS.Walk(func(e *memfs.Entry) error {
+				if e.Mode.Type() == memfs.ModeFile {
+					r.FileCount++
+					r.TotalSize += int64(len(e.Data))
+				}
+				return nil
+			})
+		}
+	case KindKernelLegacy, KindKernelRaw:
+		r.FileCount, r.TotalSize = 1, int64(len(s.Raw))
+	}
+	switch m := s.Meta.(type) {
+	case *UImageMeta:
+		if h := m.H; h != nil {
+			r.Details = UImageDetails{
+				Name: string(bytes.TrimRight(h.Name[:], "\x00")), Size: h.Size, Load: h.Load, Entry: h.Entry,
+				Time: h.Time, OS: h.OS, Arch: h.Arch, Type: h.Type, Comp: h.Comp, HCRC: h.HCRC, DCRC: h.DCRC,
+			}
+		}
+	case *FitMeta:
+		// after fit open-ramdisk the kind is initramfs, details are for that
+		if m.F != nil && s.Kind == KindKernelFIT {
+			r.Details = fitDetails(m.F, &r)
+		}
+	case *UBIMeta:
+		d := UBIDetails{PEBSize: m.Image.PEBSize, LEBSize: m.Image.LEBSize, PEBs: m.Image.PEBs, Volumes: []UBIVolumeDetails{}}
+		for _, v := range m.Image.Volumes {
+			d.Volumes = append(d.Volumes, UBIVolumeDetails{ID: v.ID, Name: v.Name, Type: v.Type(), LEBs: v.LEBs, Reserved: v.Reserved})
+		}
+		r.Details = d
+	case *UBIFSMeta:
+		sb := m.Super
+		r.Details = UBIFSDetails{Volume: m.Volume, LEBSize: sb.LEBSize, LEBCount: sb.LEBCount, MinIOSize: sb.MinIOSize, Compression: sb.Compressor}
+	case *RomfsMeta:
+		r.Details = RomfsDetails{Volume: m.Super.Volume, Size: m.Super.Size}
+	case *CramfsMeta:
+		sb := m.Super
+		r.Details = CramfsDetails{Name: sb.Name, Edition: sb.Edition, Files: sb.Files, BigEndian: sb.BigEndian, Size: sb.Size}
+	case *SquashMeta:
+		if sb := m.Super; sb != nil {
+			r.Details = SquashFSDetails{
+				Compression: sb.Compressor(), BlockSize: sb.BlockSize, Inodes: sb.Inodes,
+				Fragments: sb.Fragments, BytesUsed: sb.BytesUsed, MkfsTime: sb.MkfsTime,
+			}
+		}
+	}
+	if s.Kind == KindExt2 {
+		if sum, ok := ext2.SummaryOf(s.Raw); ok {
+			r.Details = Ext2Details{
+				BlockSize: sum.BlockSize, Blocks: sum.Blocks, FreeBlocks: sum.FreeBlocks,
+				Inodes: sum.Inodes, FreeInodes: sum.FreeInodes, InodeSize: sum.InodeSize,
+				UUID: sum.UUID, Label: sum.Label,
+			}
+		}
+	}
+	return r
+}
+
+// fitDetails also counts the images into r (lists are never null, so
+// consumers can iterate without checks).
+func fitDetails(f *fit.Fit, r *InfoReport) FitDetails {
+	d := FitDetails{Default: f.Default, DefaultConfig: f.DefaultConfig, Images: []FitImageDetails{}, Configs: []FitConfigDetails{}}
+	for _, name := range f.List() {
+		img, err := f.Get(name)
+		if err != nil {
+			continue
+		}
+		size := int64(len(img.Data))
+		if img.Path != "" {
+			size = img.Size
+		}
+		hashes := []string{}
+		for _, h := range img.Hashes {
+			hashes = append(hashes, h.Algo)
+		}
+		d.Images = append(d.Images, FitImageDetails{Name: name, Type: img.Type, Size: size, Hashes: hashes, Load: img.Load, Entry: img.Entry})
+		r.FileCount++
+		r.TotalSize += size
+	}
+	for _, c := range f.Configs {
+		compat := append([]string{}, c.Compatible...)
+		d.Configs = append(d.Configs, FitConfigDetails{Name: c.Name, Kernel: c.Kernel, FDT: c.FDT, Ramdisk: c.Ramdisk, Compatible: compat})
+	}
+	return d
+}
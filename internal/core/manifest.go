@@ -0,0 +1,150 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// Manifest is the host-side record of what `fs extract` cannot keep on disk:
+// ownership, exact mode bits, mtimes, device numbers and link targets.
+// Entries are keyed by image path; encoding/json sorts the keys, so the file
+// diffs cleanly under version control.
+type Manifest struct {
+	Version int                      `json:"version"`
+	Entries map[string]ManifestEntry `json:"entries"`
+}
+
+type ManifestEntry struct {
+	Type   string `json:"type"` // dir|file|symlink|char|block|fifo
+	Mode   string `json:"mode"` // octal permission + special bits, e.g. "4755"
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+	MTime  string `json:"mtime"` // RFC3339Nano, UTC
+	Target string `json:"target,omitempty"`
+	Rdev   string `json:"rdev,omitempty"` // "major:minor"
+}
+
+var manifestTypes = map[memfs.Mode]string{
+	memfs.ModeDir:   "dir",
+	memfs.ModeFile:  "file",
+	memfs.ModeLink:  "symlink",
+	memfs.ModeChar:  "char",
+	memfs.ModeBlock: "block",
+	memfs.ModeFIFO:  "fifo",
+}
+
+func manifestType(m memfs.Mode) string {
+	if t, ok := manifestTypes[m.Type()]; ok {
+		return t
+	}
+	return "file"
+}
+
+// BuildManifest describes every entry of the current FS.
+func (s *State) BuildManifest() (*Manifest, error) {
+	if s.FS == nil {
+		return nil, common.ErrNoImage
+	}
+	mf := &Manifest{Version: 1, Entries: map[string]ManifestEntry{}}
+	err := s.FS.Walk(func(e *memfs.Entry) error {
+		me := ManifestEntry{
+			Type:  manifestType(e.Mode),
+			Mode:  fmt.Sprintf("%04o", uint32(e.Mode)&0o7777),
+			UID:   e.UID,
+			GID:   e.GID,
+			MTime: e.MTime.UTC().Format(time.RFC3339Nano),
+		}
+		switch e.Mode.Type() {
+		case memfs.ModeLink:
+			me.Target = e.Target
+		case memfs.ModeChar, memfs.ModeBlock:
+			me.Rdev = fmt.Sprintf("%d:%d", e.RdevMajor, e.RdevMinor)
+		}
+		mf.Entries[e.Name] = me
+		return nil
+	})
+	return mf, err
+}
+
+// WriteManifest stores BuildManifest as indented JSON.
+func (s *State) WriteManifest(path string) error {
+	mf, err := s.BuildManifest()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// FSImport rebuilds the FS from a host tree produced by `fs extract` and
+// applies the manifest on top: special files and links are recreated from
+// it, and every listed entry gets its recorded mode, owner and mtime.
+// Host files missing from the manifest keep FSAddLocal defaults.
+func (s *State) FSImport(dir, manifestPath string) error {
+	b, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var mf Manifest
+	if err := json.Unmarshal(b, &mf); err != nil {
+		return fmt.Errorf("manifest %s: %w", manifestPath, err)
+	}
+	if mf.Version != 1 {
+		return fmt.Errorf("manifest %s: unsupported version %d", manifestPath, mf.Version)
+	}
+
+	s.FS = memfs.New()
+	if err := s.FSAddLocal(dir, "/"); err != nil {
+		return err
+	}
+	for p, me := range mf.Entries {
+		perm, err := strconv.ParseUint(me.Mode, 8, 32)
+		if err != nil || perm > 0o7777 {
+			return fmt.Errorf("manifest %s: bad mode %q", p, me.Mode)
+		}
+		mt, err := time.Parse(time.RFC3339Nano, me.MTime)
+		if err != nil {
+			return fmt.Errorf("manifest %s: bad mtime %q", p, me.MTime)
+		}
+		switch me.Type {
+		case "dir":
+			s.FS.PutDirMode(p, memfs.ModeDir|memfs.Mode(perm), me.UID, me.GID, mt)
+		case "symlink":
+			s.FS.PutSymlink(p, me.Target, me.UID, me.GID, mt)
+		case "char", "block", "fifo":
+			var major, minor uint64
+			if me.Type != "fifo" {
+				ms, ns, ok := strings.Cut(me.Rdev, ":")
+				major, err = strconv.ParseUint(ms, 10, 32)
+				if err == nil {
+					minor, err = strconv.ParseUint(ns, 10, 32)
+				}
+				if !ok || err != nil {
+					return fmt.Errorf("manifest %s: bad rdev %q", p, me.Rdev)
+				}
+			}
+			typ := map[string]memfs.Mode{"char": memfs.ModeChar, "block": memfs.ModeBlock, "fifo": memfs.ModeFIFO}[me.Type]
+			s.FS.PutNode(p, typ, uint32(perm), me.UID, me.GID, uint32(major), uint32(minor), mt)
+		case "file":
+			e, ok := s.FS.Get(p)
+			if !ok || e.Mode.Type() == memfs.ModeDir {
+				return fmt.Errorf("manifest %s: file missing under %s", p, filepath.Clean(dir))
+			}
+			s.FS.PutFile(p, e.Data, memfs.Mode(perm), me.UID, me.GID, mt)
+		default:
+			return fmt.Errorf("manifest %s: unknown type %q", p, me.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// NormalizeOptions says what Normalize rewrites.
+type NormalizeOptions struct {
+	MTime    time.Time // every entry gets this mtime; see SourceDateEpoch
+	Owner    bool      // also set UID/GID on every entry
+	UID, GID uint32
+}
+
+// SourceDateEpoch returns $SOURCE_DATE_EPOCH (reproducible-builds.org), or
+// the Unix epoch when it is not set.
+func SourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Unix(0, 0), nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("SOURCE_DATE_EPOCH: %q is not a Unix time", v)
+	}
+	return time.Unix(n, 0), nil
+}
+
+// Normalize strips per-build metadata from fs in place. Entry order needs
+// no work: memfs walks in path order and every writer emits that order.
+func Normalize(fs *memfs.FS, opt NormalizeOptions) error {
+	return fs.Walk(func(e *memfs.Entry) error {
+		if err := fs.Chtimes(e.Name, opt.MTime); err != nil {
+			return err
+		}
+		if opt.Owner {
+			return fs.Chown(e.Name, opt.UID, opt.GID)
+		}
+		return nil
+	})
+}
+
+// Reproducible prepares s.FS for `store --reproducible`: all mtimes become
+// SOURCE_DATE_EPOCH. The returned epoch is for the format options (squashfs
+// mkfs time, ext2 times). Owners are left alone — they are part of the
+// image; use fs chown -R to change them.
+func (s *State) Reproducible() (time.Time, error) {
+	if s.FS == nil {
+		return time.Time{}, common.ErrNoImage
+	}
+	t, err := SourceDateEpoch()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t, Normalize(s.FS, NormalizeOptions{MTime: t})
+}
+
+// TreeUUID derives a UUID (version 5 layout) from the paths, metadata and
+// data of s.FS, so the same tree always gets the same filesystem UUID and
+// different trees do not share one.
+func (s *State) TreeUUID() string {
+	h := sha1.New()
+	var num [8]byte
+	put := func(v uint64) {
+		binary.LittleEndian.PutUint64(num[:], v)
+		h.Write(num[:])
+	}
+	if s.FS != nil {
+		_ = s.FS.Walk(func(e *memfs.Entry) error {
+			h.Write([]byte(e.Name + "\x00" + e.Target + "\x00"))
+			put(uint64(e.Mode))
+			put(uint64(e.UID)<<32 | uint64(e.GID))
+			put(uint64(e.RdevMajor)<<32 | uint64(e.RdevMinor))
+			put(uint64(e.MTime.Unix()))
+			put(uint64(len(e.Data)))
+			h.Write(e.Data)
+			return nil
+		})
+	}
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
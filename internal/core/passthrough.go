@@ -0,0 +1,68 @@
+package core
+
+import (
+	"bytes"
+
+	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/squashfs"
+	"goimagetool/internal/image/uboot/fit"
+)
+
+// Passthrough: re-serializing an untouched FIT, squashfs or ext2 image
+// reorders nodes, changes timestamps and breaks vendor signatures. While
+// nothing has changed since load, Raw still is the image, so Store writes
+// it verbatim (only the requested outer compression is applied).
+
+// cleanMark remembers what the loaded image looked like: the FS object and
+// its generation, and the FIT as fit.Write renders it.
+type cleanMark struct {
+	ok  bool
+	fs  *memfs.FS
+	gen uint64
+	fit []byte
+}
+
+func (s *State) markClean() {
+	s.clean = cleanMark{ok: true, fs: s.FS, fit: s.fitBytes()}
+	if s.FS != nil {
+		s.clean.gen = s.FS.Gen()
+	}
+}
+
+func (s *State) fitBytes() []byte {
+	m, _ := s.Meta.(*FitMeta)
+	if m == nil || m.F == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := fit.Write(&buf, m.F); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Unmodified reports whether the loaded image is unchanged since load, i.e.
+// Raw is still a faithful encoding of it. For FIT only the FIT model counts.
+func (s *State) Unmodified() bool {
+	c := s.clean
+	if !c.ok || s.Raw == nil {
+		return false
+	}
+	if s.Kind == KindKernelFIT {
+		return bytes.Equal(c.fit, s.fitBytes())
+	}
+	return c.fs == s.FS && s.FS != nil && s.FS.Gen() == c.gen
+}
+
+func (s *State) passthrough(kind ImageKind) bool {
+	return !s.Reencode && s.Kind == kind && s.Unmodified()
+}
+
+// sqfsUntuned: the store asks for the image's own compressor and no
+// compressor tuning, so the original bytes satisfy it.
+func sqfsUntuned(opts squashfs.Options, sb *squashfs.Superblock) bool {
+	return sb != nil && opts.Compression == sb.Compressor() &&
+		opts.GzipLevel == 0 && opts.GzipWindow == 0 && opts.XzDictSize == 0 &&
+		len(opts.XzFilters) == 0 && !opts.LZ4HC && opts.Label == "" &&
+		!opts.NoFragments && !opts.AlwaysFragments && !opts.NonExportable && !opts.NonSparse
+}
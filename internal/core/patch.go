@@ -0,0 +1,92 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/ext2"
+	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/romfs"
+	"goimagetool/internal/image/squashfs"
+)
+
+// PatchOp is one edit of patch: with Host set, Path gets the content of
+// that host file, otherwise Path is removed (recursively).
+type PatchOp struct {
+	Path string
+	Host string
+}
+
+// Patch applies ops in order. A replaced file keeps its mode and owner and
+// takes the host file's mtime; a new one is root-owned with the host
+// permission bits.
+func (s *State) Patch(ops []PatchOp) error {
+	if s.FS == nil {
+		return common.ErrNoImage
+	}
+	for _, op := range ops {
+		p := path.Clean("/" + op.Path)
+		if p == "/" {
+			return fmt.Errorf("%s: cannot patch the root", op.Path)
+		}
+		if op.Host == "" {
+			if err := s.FSRemove(p, true); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := os.Stat(op.Host)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s: not a regular file", op.Host)
+		}
+		data, err := os.ReadFile(op.Host)
+		if err != nil {
+			return err
+		}
+		mode, uid, gid := memfs.ModeFile|memfs.PermOf(info.Mode()), uint32(0), uint32(0)
+		if e, ok := s.FS.Get(p); ok {
+			if e.Mode.Type() != memfs.ModeFile {
+				return fmt.Errorf("%s: exists and is not a regular file", p)
+			}
+			mode, uid, gid = e.Mode, e.UID, e.GID
+		}
+		s.FS.PutFile(p, data, mode, uid, gid, info.ModTime())
+	}
+	return nil
+}
+
+// StoreSame writes the working FS back in the format it was loaded from,
+// with the loaded image's parameters: squashfs compressor, ext2 block size
+// and UUID, romfs volume name. comp is the outer compression (initramfs,
+// tar, ext2, romfs).
+func (s *State) StoreSame(path, comp string) error {
+	if s.FS == nil {
+		return common.ErrNoImage
+	}
+	switch s.Kind {
+	case KindInitramfs:
+		return s.StoreInitramfs(path, comp)
+	case KindTar:
+		return s.StoreTar(path, comp)
+	case KindSquashFS:
+		return s.StoreSquashFSWith(path, squashfs.Options{Compression: s.SquashFSCompression()})
+	case KindExt2:
+		opts := ext2.Options{BlockSize: ext2.BlockSizeOf(s.Raw)}
+		if sum, ok := ext2.SummaryOf(s.Raw); ok {
+			opts.UUID = sum.UUID
+		}
+		return s.StoreExt2With(path, comp, opts)
+	case KindRomfs:
+		var opt romfs.Options
+		if m, _ := s.Meta.(*RomfsMeta); m != nil {
+			opt.Volume = m.Super.Volume
+		}
+		return s.StoreRomfs(path, comp, opt)
+	}
+	return fmt.Errorf("%s images cannot be stored back (load one and store another format)", s.Kind)
+}
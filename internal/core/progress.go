@@ -0,0 +1,79 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"goimagetool/internal/common"
+)
+
+// Progress receives feedback from long operations (materializing a tree
+// for squashfs/ext2, compressing an image). State.Progress == nil keeps
+// everything quiet; the CLI sets a text reporter for -v, the TUI may show
+// its own modal.
+type Progress interface {
+	// Update is called often while stage runs, with running totals;
+	// implementations throttle the output themselves.
+	Update(stage string, files int, bytes int64)
+	// Done is called once when stage finishes: in is what went in, out
+	// what came out (0 when there is no separate output size).
+	Done(stage string, in, out int64)
+}
+
+// progressFunc adapts s.Progress to the per-entry hooks of the image
+// packages (squashfs.Options.Progress, ext2.Options.Progress); done reports
+// the final byte count. Both are no-ops when nobody listens.
+func (s *State) progressFunc(stage string) (hook func(files int, bytes int64), done func()) {
+	if s.Progress == nil {
+		return nil, func() {}
+	}
+	var total int64
+	hook = func(files int, bytes int64) {
+		total = bytes
+		s.Progress.Update(stage, files, bytes)
+	}
+	return hook, func() { s.Progress.Done(stage, total, 0) }
+}
+
+func (s *State) progressDone(stage string, in, out int64) {
+	if s.Progress != nil {
+		s.Progress.Done(stage, in, out)
+	}
+}
+
+// TextProgress prints at most one Update line per Interval and a line for
+// every Done, e.g. "materialize: 1532 files, 48.2 MiB".
+type TextProgress struct {
+	W        io.Writer
+	Interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// NewTextProgress reports to w once a second.
+func NewTextProgress(w io.Writer) *TextProgress {
+	return &TextProgress{W: w, Interval: time.Second}
+}
+
+func (p *TextProgress) Update(stage string, files int, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now := time.Now(); now.Sub(p.last) >= p.Interval {
+		p.last = now
+		fmt.Fprintf(p.W, "%s: %d files, %s\n", stage, files, common.HumanSize(bytes))
+	}
+}
+
+func (p *TextProgress) Done(stage string, in, out int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = time.Time{} // следующая стадия сразу печатает первую строку
+	if out == 0 {
+		fmt.Fprintf(p.W, "%s: done, %s\n", stage, common.HumanSize(in))
+		return
+	}
+	fmt.Fprintf(p.W, "%s: %s -> %s (%.1f%%)\n", stage, common.HumanSize(in), common.HumanSize(out), 100*float64(out)/float64(max(in, 1)))
+}
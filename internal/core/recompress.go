@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/compress"
+)
+
+// CompressFile compresses the raw file in into out with codec ("zstd",
+// "gzip:9", …; the level overrides s.Codec.Level). Both files are streamed;
+// out is replaced only after a successful run (common.WriteFileAtomic).
+func (s *State) CompressFile(in, out, codec string) error {
+	name, level, err := compress.ParseSpec(codec)
+	if err != nil {
+		return err
+	}
+	o := s.Codec
+	if level != 0 {
+		o.Level = level
+	}
+	if err := recompress(in, out, func(w io.Writer, r io.Reader) error {
+		return compress.CompressStream(w, r, name, o)
+	}); err != nil {
+		return err
+	}
+	s.progressFiles(name, in, out)
+	return nil
+}
+
+// DecompressFile decodes in into out; codec "auto" (or "") detects it by
+// magic. Returns the codec that was used.
+func (s *State) DecompressFile(in, out, codec string) (string, error) {
+	used := codec
+	if err := recompress(in, out, func(w io.Writer, r io.Reader) (err error) {
+		used, err = compress.DecompressStream(w, r, codec, s.Codec)
+		return err
+	}); err != nil {
+		return used, err
+	}
+	s.progressFiles("decompress "+used, in, out)
+	return used, nil
+}
+
+func recompress(in, out string, run func(io.Writer, io.Reader) error) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if fi, err := src.Stat(); err == nil {
+		if fo, err := os.Stat(out); err == nil && os.SameFile(fi, fo) {
+			return fmt.Errorf("%s: input and output are the same file", out)
+		}
+	}
+	return common.WriteFileAtomic(out, func(w io.Writer) error {
+		return run(w, src)
+	})
+}
+
+// progressFiles reports the sizes of in and out under -v.
+func (s *State) progressFiles(stage, in, out string) {
+	fi, err1 := os.Stat(in)
+	fo, err2 := os.Stat(out)
+	if err1 == nil && err2 == nil {
+		s.progressDone(stage, fi.Size(), fo.Size())
+	}
+}
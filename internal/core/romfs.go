@@ -0,0 +1,73 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"goimagetool/internal/image/romfs"
+)
+
+// RomfsMeta: the superblock of a loaded romfs image.
+type RomfsMeta struct {
+	Super *romfs.Superblock
+}
+
+// LoadRomfs reads a romfs image (genromfs output).
+func (s *State) LoadRomfs(path, compressionName string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadRomfsReader(r, compressionName) })
+}
+
+func (s *State) LoadRomfsReader(r io.Reader, compressionName string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
+	}
+	fs, sb, err := romfs.Load(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	s.Kind = KindRomfs
+	s.FS = fs
+	s.Meta = &RomfsMeta{Super: sb}
+	s.Raw = b
+	s.markClean()
+	return nil
+}
+
+// StoreRomfs writes the working FS as romfs. Owners, mtimes and all
+// permission bits but exec are lost (the format has no room for them).
+func (s *State) StoreRomfs(path, compressionName string, opt romfs.Options) error {
+	if s.FS == nil {
+		return errors.New("no image")
+	}
+	return writeFileVia(path, func(w io.Writer) error { return s.StoreRomfsWriter(w, compressionName, opt) })
+}
+
+func (s *State) StoreRomfsWriter(w io.Writer, compressionName string, opt romfs.Options) error {
+	if s.FS == nil {
+		return errors.New("no image")
+	}
+	var buf bytes.Buffer
+	if err := romfs.Store(&buf, s.FS, opt); err != nil {
+		return err
+	}
+	data, err := s.compressOutput(buf.Bytes(), compressionName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// romfsInfo: the info line for kind romfs.
+func (s *State) romfsInfo() string {
+	if m, _ := s.Meta.(*RomfsMeta); m != nil {
+		return fmt.Sprintf("\nromfs volume: %q", m.Super.Volume)
+	}
+	return ""
+}
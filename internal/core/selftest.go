@@ -0,0 +1,229 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/romfs"
+	"goimagetool/internal/image/squashfs"
+	"goimagetool/internal/image/uboot/fit"
+)
+
+// SelfTestAttrs are the attributes compared by SelfTest, in report order.
+var SelfTestAttrs = []string{"exists", "type", "perm", "special", "owner", "mtime", "data", "target", "rdev"}
+
+// SelfTestResult holds one format's round-trip outcome. Survived/Total are
+// keyed by attribute name; Err is set when store or load failed outright.
+type SelfTestResult struct {
+	Format   string
+	Err      error
+	Survived map[string]int
+	Total    map[string]int
+}
+
+type selfTestFormat struct {
+	name  string
+	ext   string
+	store func(*State, string) error
+	load  func(*State, string) error
+}
+
+var selfTestFormats = []selfTestFormat{
+	{"initramfs", ".cpio",
+		func(s *State, p string) error { return s.StoreInitramfs(p, "none") },
+		func(s *State, p string) error { return s.LoadInitramfs(p, "none") }},
+	{"tar", ".tar",
+		func(s *State, p string) error { return s.StoreTar(p, "none") },
+		func(s *State, p string) error { return s.LoadTar(p, "none") }},
+	{"squashfs", ".sqsh",
+		func(s *State, p string) error {
+			// спец-узлы squashfs теряет — это и должна показать таблица
+			return s.StoreSquashFSWith(p, squashfs.Options{Compression: "gzip", Dropped: func(string, string) {}})
+		},
+		func(s *State, p string) error { return s.LoadSquashFS(p, "auto") }},
+	{"ext2", ".ext2",
+		func(s *State, p string) error { return s.StoreExt2(p, 1024, "none") },
+		func(s *State, p string) error { return s.LoadExt2(p, "none") }},
+	{"romfs", ".romfs",
+		func(s *State, p string) error { return s.StoreRomfs(p, "none", romfs.Options{}) },
+		func(s *State, p string) error { return s.LoadRomfs(p, "none") }},
+}
+
+// SelfTestFS builds a synthetic tree holding every node type, each with
+// distinct uid/gid/mode/mtime so that any attribute a format drops or
+// conflates shows up in the comparison.
+func SelfTestFS() *memfs.FS {
+	t := func(n int64) time.Time { return time.Unix(1600000000+n*3600, 0) }
+	fs := memfs.New()
+	fs.PutDirMode("/etc", memfs.ModeDir|0o750, 11, 12, t(1))
+	fs.PutFile("/etc/passwd", []byte("root:x:0:0::/root:/bin/sh\n"), memfs.ModeFile|0o640, 13, 14, t(2))
+	fs.PutDirMode("/bin", memfs.ModeDir|0o755, 15, 16, t(3))
+	fs.PutFile("/bin/su", bytes.Repeat([]byte{0x7f, 'E', 'L', 'F'}, 64), memfs.ModeFile|0o4755, 17, 18, t(4))
+	fs.PutDirMode("/tmp", memfs.ModeDir|0o1777, 19, 20, t(5))
+	fs.PutSymlink("/bin/sh", "su", 21, 22, t(6))
+	fs.PutDirMode("/dev", memfs.ModeDir|0o755, 23, 24, t(7))
+	fs.PutNode("/dev/console", memfs.ModeChar, 0o600, 25, 26, 5, 1, t(8))
+	fs.PutNode("/dev/sda", memfs.ModeBlock, 0o660, 27, 28, 8, 0, t(9))
+	fs.PutNode("/dev/initctl", memfs.ModeFIFO, 0o620, 29, 30, 0, 0, t(10))
+	return fs
+}
+
+// SelfTest stores SelfTestFS to every FS-capable format, loads it back and
+// reports which attributes survived.
+func SelfTest() []SelfTestResult {
+	tmp, release, err := common.MkdirTemp("goimagetool-selftest-*")
+	if err != nil {
+		return []SelfTestResult{{Format: "all", Err: err}}
+	}
+	defer release()
+
+	var out []SelfTestResult
+	for _, f := range selfTestFormats {
+		res := SelfTestResult{Format: f.name, Survived: map[string]int{}, Total: map[string]int{}}
+		src := New()
+		src.FS = SelfTestFS()
+		p := filepath.Join(tmp, "img"+f.ext)
+		if err := f.store(src, p); err != nil {
+			res.Err = fmt.Errorf("store: %w", err)
+			out = append(out, res)
+			continue
+		}
+		dst := New()
+		if err := f.load(dst, p); err != nil {
+			res.Err = fmt.Errorf("load: %w", err)
+			out = append(out, res)
+			continue
+		}
+		compareRoundTrip(src.FS, dst.FS, &res)
+		out = append(out, res)
+	}
+	return append(out, selfTestFIT())
+}
+
+// selfTestFIT writes a FIT whose config uses every kind of image reference
+// (an fdt list with an overlay, loadables), reads it back and verifies it:
+// hashes and config references must survive. It then removes a loadable,
+// which verify has to report as a dangling reference.
+func selfTestFIT() SelfTestResult {
+	res := SelfTestResult{Format: "fit", Survived: map[string]int{}, Total: map[string]int{}}
+	src := fit.New()
+	for _, img := range [][2]string{{"kernel-1", "kernel"}, {"fdt-1", "fdt"}, {"overlay-1", "fdt"}, {"ramdisk-1", "ramdisk"}, {"firmware-1", "firmware"}} {
+		if err := src.AddTyped(img[0], bytes.Repeat([]byte(img[0]), 16), "sha256", img[1]); err != nil {
+			res.Err = err
+			return res
+		}
+	}
+	_ = src.AddConfig(&fit.Config{Name: "conf-1", Kernel: "kernel-1", FDT: "fdt-1", Overlays: []string{"overlay-1"},
+		Ramdisk: "ramdisk-1", Loadables: []string{"firmware-1"}})
+	var buf bytes.Buffer
+	if err := fit.Write(&buf, src); err != nil {
+		res.Err = fmt.Errorf("store: %w", err)
+		return res
+	}
+	dst, err := fit.Read(&buf)
+	if err != nil {
+		res.Err = fmt.Errorf("load: %w", err)
+		return res
+	}
+	for _, n := range src.List() {
+		a, _ := src.Get(n)
+		b, err := dst.Get(n)
+		res.Total["exists"]++
+		if err != nil {
+			continue
+		}
+		res.Survived["exists"]++
+		ad, _ := a.ReadData()
+		bd, _ := b.ReadData()
+		res.Total["data"]++
+		if bytes.Equal(ad, bd) {
+			res.Survived["data"]++
+		}
+	}
+	if err := dst.Verify(); err != nil {
+		res.Err = err
+		return res
+	}
+	dst.Remove("firmware-1")
+	if d := dst.DanglingRefs(); len(d) != 1 || d[0] != `conf-1: loadables "firmware-1"` {
+		res.Err = fmt.Errorf("verify: removed loadable reported as %q", d)
+	}
+	return res
+}
+
+func compareRoundTrip(src, dst *memfs.FS, res *SelfTestResult) {
+	count := func(attr string, ok bool) {
+		res.Total[attr]++
+		if ok {
+			res.Survived[attr]++
+		}
+	}
+	_ = src.Walk(func(a *memfs.Entry) error {
+		if a.Name == "/" {
+			return nil
+		}
+		b, ok := dst.Get(a.Name)
+		count("exists", ok)
+		if !ok {
+			return nil
+		}
+		compareEntry(a, b, count)
+		return nil
+	})
+}
+
+// compareEntry reports every attribute that applies to a's type, using the
+// SelfTestAttrs names.
+func compareEntry(a, b *memfs.Entry, check func(attr string, ok bool)) {
+	typ := a.Mode.Type()
+	check("type", typ == b.Mode.Type())
+	if typ != memfs.ModeLink {
+		check("perm", a.Mode&0o777 == b.Mode&0o777)
+	}
+	if a.Mode&0o7000 != 0 {
+		check("special", a.Mode&0o7000 == b.Mode&0o7000)
+	}
+	check("owner", a.UID == b.UID && a.GID == b.GID)
+	check("mtime", a.MTime.Unix() == b.MTime.Unix())
+	switch typ {
+	case memfs.ModeFile:
+		check("data", bytes.Equal(a.Data, b.Data))
+	case memfs.ModeLink:
+		check("target", a.Target == b.Target)
+	case memfs.ModeChar, memfs.ModeBlock:
+		check("rdev", a.RdevMajor == b.RdevMajor && a.RdevMinor == b.RdevMinor)
+	}
+}
+
+// PrintSelfTest renders results as a format × attribute matrix.
+func PrintSelfTest(w io.Writer, results []SelfTestResult) {
+	fmt.Fprintf(w, "%-10s", "FORMAT")
+	for _, a := range SelfTestAttrs {
+		fmt.Fprintf(w, " %-7s", a)
+	}
+	fmt.Fprintln(w)
+	for _, r := range results {
+		fmt.Fprintf(w, "%-10s", r.Format)
+		if r.Err != nil {
+			fmt.Fprintf(w, " error: %v\n", r.Err)
+			continue
+		}
+		for _, a := range SelfTestAttrs {
+			cell := "-"
+			if n := r.Total[a]; n > 0 {
+				if r.Survived[a] == n {
+					cell = "ok"
+				} else {
+					cell = fmt.Sprintf("%d/%d", r.Survived[a], n)
+				}
+			}
+			fmt.Fprintf(w, " %-7s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -19,13 +20,21 @@ type sessionEntry struct {
 	Target    string
 	RdevMajor uint32
 	RdevMinor uint32
+	Xattrs    map[string][]byte `json:",omitempty"`
 }
 
 type Session struct {
 	Kind    ImageKind
 	FS      []sessionEntry
-	MetaFIT *fit.FIT
+	MetaFIT *fit.FIT // JSON keeps only defaults and configurations
+	FIT     []byte   `json:",omitempty"` // the FIT as fit.Write renders it, images included
 	Raw     []byte
+	Clean   bool   // image unchanged since load: Raw may be stored as is
+	Cwd     string `json:",omitempty"` // fs cd
+	// FitRamdisk/FitRamdiskCodec: FitMeta.Ramdisk and RamdiskCodec, so
+	// fit put-ramdisk works in a later invocation
+	FitRamdisk      string `json:",omitempty"`
+	FitRamdiskCodec string `json:",omitempty"`
 }
 
 func (s *State) ToSession() *Session {
@@ -42,13 +51,15 @@ func (s *State) ToSession() *Session {
 			Target:    e.Target,
 			RdevMajor: e.RdevMajor,
 			RdevMinor: e.RdevMinor,
+			Xattrs:    e.Xattrs,
 		})
 	}
-	var mf *fit.FIT
+	sess := &Session{Kind: s.Kind, FS: entries, Raw: append([]byte(nil), s.Raw...), Clean: s.Unmodified(), Cwd: s.Cwd}
 	if m, _ := s.Meta.(*FitMeta); m != nil {
-		mf = m.F
+		sess.MetaFIT, sess.FitRamdisk, sess.FitRamdiskCodec = m.F, m.Ramdisk, m.RamdiskCodec
+		sess.FIT = s.fitBytes()
 	}
-	return &Session{Kind: s.Kind, FS: entries, MetaFIT: mf, Raw: append([]byte(nil), s.Raw...)}
+	return sess
 }
 
 func (s *State) FromSession(sess *Session) {
@@ -57,23 +68,79 @@ func (s *State) FromSession(sess *Session) {
 	for _, e := range sess.FS {
 		mt := time.Unix(e.MTimeUnix, 0)
 		mode := memfs.Mode(e.Mode)
-		switch {
-		case mode&memfs.ModeDir != 0:
+		// type bits overlap (ModeLink = ModeFile|ModeChar), compare the whole field
+		switch mode.Type() {
+		case memfs.ModeDir:
 			fs.PutDirMode(e.Name, mode, e.UID, e.GID, mt)
-		case mode&memfs.ModeLink != 0:
+		case memfs.ModeLink:
 			fs.PutSymlink(e.Name, e.Target, e.UID, e.GID, mt)
-		case mode&memfs.ModeChar != 0 || mode&memfs.ModeBlock != 0 || mode&memfs.ModeFIFO != 0:
-			typ := mode &^ 0o7777 | (mode & 0o7777) // keep bits
-			fs.PutNode(e.Name, typ, e.Mode, e.UID, e.GID, e.RdevMajor, e.RdevMinor, mt)
+		case memfs.ModeChar, memfs.ModeBlock, memfs.ModeFIFO:
+			fs.PutNode(e.Name, mode.Type(), e.Mode&0o7777, e.UID, e.GID, e.RdevMajor, e.RdevMinor, mt)
 		default:
 			fs.PutFile(e.Name, e.Data, mode, e.UID, e.GID, mt)
 		}
+		for k, v := range e.Xattrs {
+			_ = fs.SetXattr(e.Name, k, v)
+		}
 	}
 	s.FS = fs
 	if sess.MetaFIT != nil {
-		s.Meta = &FitMeta{F: sess.MetaFIT}
+		f := sess.MetaFIT
+		// older sessions have no FIT bytes; an empty FIT cannot be rendered
+		if len(sess.FIT) > 0 {
+			if rf, err := fit.Read(bytes.NewReader(sess.FIT)); err == nil {
+				f = rf
+			}
+		}
+		s.Meta = &FitMeta{F: f, Ramdisk: sess.FitRamdisk, RamdiskCodec: sess.FitRamdiskCodec}
 	}
 	s.Raw = append([]byte(nil), sess.Raw...)
+	if s.Kind == KindKernelRaw {
+		s.Meta = kernelRawMeta(s.Raw)
+	}
+	s.Cwd = sess.Cwd
+	s.clean = cleanMark{}
+	if sess.Clean {
+		s.markClean()
+	}
+}
+
+// sessionMark is what MarkSaved saw; Dirty compares the state against it.
+// Raw and the FS are replaced rather than edited in place, so identity plus
+// the memfs generation is enough; the FIT is edited in place and compared
+// as rendered.
+type sessionMark struct {
+	kind  ImageKind
+	fs    *memfs.FS
+	gen   uint64
+	meta  any
+	fit   []byte
+	raw   []byte
+	clean bool
+	cwd   string
+}
+
+func (s *State) sessionMark() sessionMark {
+	m := sessionMark{kind: s.Kind, fs: s.FS, meta: s.Meta, fit: s.fitBytes(), raw: s.Raw, clean: s.Unmodified(), cwd: s.Cwd}
+	if s.FS != nil {
+		m.gen = s.FS.Gen()
+	}
+	return m
+}
+
+// MarkSaved records the current state as the one in the session file.
+func (s *State) MarkSaved() { s.saved = s.sessionMark() }
+
+// Dirty reports whether anything a session stores changed since MarkSaved.
+// A State from New that was never marked is dirty.
+func (s *State) Dirty() bool {
+	a, b := s.saved, s.sessionMark()
+	return a.kind != b.kind || a.fs != b.fs || a.gen != b.gen || a.meta != b.meta ||
+		a.clean != b.clean || a.cwd != b.cwd || !bytes.Equal(a.fit, b.fit) || !sameSlice(a.raw, b.raw)
+}
+
+func sameSlice(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
 
 func (s *State) SaveSession(path string) error {
@@ -90,15 +157,49 @@ func (s *State) SaveSession(path string) error {
 	return enc.Encode(s.ToSession())
 }
 
-func (s *State) LoadSession(path string) error {
+func readSession(path string) (*Session, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var sess Session
 	if err := json.Unmarshal(b, &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *State) LoadSession(path string) error {
+	sess, err := readSession(path)
+	if err != nil {
 		return err
 	}
-	s.FromSession(&sess)
+	s.FromSession(sess)
 	return nil
 }
+
+// SessionInfo — summary of a session file, for `session info`.
+type SessionInfo struct {
+	Kind      ImageKind
+	Entries   int
+	DataBytes int64 // sum of file payloads
+	HasFIT    bool
+	FITImages int
+	RawBytes  int
+}
+
+// ReadSessionInfo summarizes the session at path without touching any State.
+func ReadSessionInfo(path string) (SessionInfo, error) {
+	sess, err := readSession(path)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	inf := SessionInfo{Kind: sess.Kind, Entries: len(sess.FS), HasFIT: sess.MetaFIT != nil, RawBytes: len(sess.Raw)}
+	for _, e := range sess.FS {
+		inf.DataBytes += int64(len(e.Data))
+	}
+	if sess.MetaFIT != nil {
+		inf.FITImages = len(sess.MetaFIT.List())
+	}
+	return inf, nil
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// CurrentSlot names the working FS (s.FS) wherever a slot name is expected.
+const CurrentSlot = "."
+
+// SetSlot keeps fs as a secondary image under name, next to the working FS.
+// Slots live only in memory; sessions do not persist them.
+func (s *State) SetSlot(name string, fs *memfs.FS) error {
+	if name == "" || name == CurrentSlot {
+		return fmt.Errorf("bad slot name %q", name)
+	}
+	if s.Slots == nil {
+		s.Slots = map[string]*memfs.FS{}
+	}
+	s.Slots[name] = fs
+	return nil
+}
+
+// Slot returns the FS loaded under name ("." = the working FS).
+func (s *State) Slot(name string) (*memfs.FS, error) {
+	if name == CurrentSlot {
+		if s.FS == nil {
+			return nil, common.ErrNoImage
+		}
+		return s.FS, nil
+	}
+	fs, ok := s.Slots[name]
+	if !ok {
+		return nil, fmt.Errorf("slot %q: %w", name, common.ErrNotFound)
+	}
+	return fs, nil
+}
+
+// SlotNames — sorted.
+func (s *State) SlotNames() []string {
+	out := make([]string, 0, len(s.Slots))
+	for n := range s.Slots {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// DiffSlots compares two slots as DiffFS does: a is the reference.
+func (s *State) DiffSlots(a, b string) ([]FSDiff, error) {
+	fa, err := s.Slot(a)
+	if err != nil {
+		return nil, err
+	}
+	fb, err := s.Slot(b)
+	if err != nil {
+		return nil, err
+	}
+	return DiffFS(fa, fb), nil
+}
+
+// FSOverlay copies every entry of slot name over the working FS: same paths
+// are replaced with all their attributes, the rest is added. Returns the
+// number of entries copied.
+func (s *State) FSOverlay(name string) (int, error) {
+	if s.FS == nil {
+		return 0, common.ErrNoImage
+	}
+	src, err := s.Slot(name)
+	if err != nil {
+		return 0, err
+	}
+	if src == s.FS {
+		return 0, nil
+	}
+	n := 0
+	err = src.Walk(func(e *memfs.Entry) error {
+		if e.Name == "/" {
+			return nil
+		}
+		if old, ok := s.FS.Get(e.Name); ok && (old.Mode.Type() == memfs.ModeDir) != (e.Mode.Type() == memfs.ModeDir) {
+			// файл поверх каталога (или наоборот): старое поддерево уходит целиком
+			if err := s.FS.Remove(e.Name); err != nil {
+				return err
+			}
+		}
+		putEntry(s.FS, e)
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// putEntry recreates e in fs with all its attributes.
+func putEntry(fs *memfs.FS, e *memfs.Entry) {
+	switch e.Mode.Type() {
+	case memfs.ModeDir:
+		fs.PutDirMode(e.Name, e.Mode, e.UID, e.GID, e.MTime)
+	case memfs.ModeLink:
+		fs.PutSymlink(e.Name, e.Target, e.UID, e.GID, e.MTime)
+	case memfs.ModeChar, memfs.ModeBlock, memfs.ModeFIFO:
+		fs.PutNode(e.Name, e.Mode.Type(), uint32(e.Mode&0o7777), e.UID, e.GID, e.RdevMajor, e.RdevMinor, e.MTime)
+	default:
+		fs.PutFile(e.Name, e.Data, e.Mode, e.UID, e.GID, e.MTime)
+	}
+	for k, v := range e.Xattrs {
+		_ = fs.SetXattr(e.Name, k, v)
+	}
+}
@@ -2,16 +2,22 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"goimagetool/internal/common"
 	"goimagetool/internal/compress"
 	"goimagetool/internal/fs/ext2"
 	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/arm64"
 	"goimagetool/internal/image/cpio"
+	"goimagetool/internal/image/jffs2"
+	"goimagetool/internal/image/simg"
 	"goimagetool/internal/image/squashfs"
 	"goimagetool/internal/image/uboot/fit"
 	"goimagetool/internal/image/uboot/legacy"
@@ -28,6 +34,12 @@ const (
 	KindSquashFS
 	KindExt2
 	KindTar
+	KindKernelRaw
+	KindJFFS2
+	KindUBI
+	KindUBIFS
+	KindRomfs
+	KindCramfs
 )
 
 func (k ImageKind) String() string {
@@ -44,6 +56,18 @@ func (k ImageKind) String() string {
 		return "ext2"
 	case KindTar:
 		return "tar"
+	case KindKernelRaw:
+		return "kernel-raw"
+	case KindJFFS2:
+		return "jffs2"
+	case KindUBI:
+		return "ubi"
+	case KindUBIFS:
+		return "ubifs"
+	case KindRomfs:
+		return "romfs"
+	case KindCramfs:
+		return "cramfs"
 	default:
 		return "none"
 	}
@@ -54,8 +78,18 @@ type UImageMeta struct {
 	H *legacy.Header
 }
 
+// KernelRawMeta: Arm64 is nil unless the kernel has an arm64 Image header.
+type KernelRawMeta struct {
+	Arm64 *arm64.Header
+}
+
 type FitMeta struct {
 	F *fit.FIT
+	// Ramdisk: the image opened as the working FS by fit open-ramdisk
+	// ("" otherwise); RamdiskCodec is how its cpio was compressed, and
+	// fit put-ramdisk compresses it the same way.
+	Ramdisk      string
+	RamdiskCodec string
 }
 
 type SquashMeta struct {
@@ -69,6 +103,26 @@ type State struct {
 
 	// Raw keeps last raw payload for formats that are not mapped to FS directly.
 	Raw []byte
+
+	// Codec: options for buffer compressors (e.g. zstd dictionary), used by load and store.
+	Codec compress.CompressOpts
+
+	// Reencode: always re-serialize on store, even if the image is
+	// unchanged since load (see passthrough.go).
+	Reencode bool
+
+	// Slots: secondary images loaded with `load --into NAME` (see slots.go).
+	Slots map[string]*memfs.FS
+
+	// Progress: feedback for long stores (see progress.go); nil = quiet.
+	Progress Progress
+
+	// Cwd: base for relative image paths on the command line (fs cd, see
+	// cwd.go); "" is the root. Saved in the session.
+	Cwd string
+
+	clean cleanMark
+	saved sessionMark // see Dirty
 }
 
 func New() *State {
@@ -79,64 +133,230 @@ func New() *State {
 }
 
 func (s *State) Info() string {
-	return fmt.Sprintf("Kind: %s", s.Kind.String())
+	return s.InfoWith(false)
+}
+
+// InfoWith is Info with sizes in KiB/MiB/GiB when human (info -h), raw
+// byte counts otherwise.
+func (s *State) InfoWith(human bool) string {
+	size := func(n int64) string {
+		if human {
+			return common.HumanSize(n)
+		}
+		return fmt.Sprintf("%d bytes", n)
+	}
+	out := fmt.Sprintf("Kind: %s", s.Kind.String())
+	if s.Raw != nil {
+		out += "\nSize: " + size(int64(len(s.Raw)))
+	}
+	switch s.Kind {
+	case KindInitramfs, KindSquashFS, KindExt2, KindTar, KindJFFS2, KindUBI, KindUBIFS, KindRomfs, KindCramfs:
+		if t, err := s.FSTree("/", false, func(int, *memfs.Entry, bool) {}); err == nil {
+			out += fmt.Sprintf("\nContent: %d files, %d dirs, %d symlinks, %d devices, %s",
+				t.Files, t.Dirs, t.Links, t.Devices, size(t.Bytes))
+		}
+	}
+	if m, _ := s.Meta.(*SquashMeta); m != nil && m.Super != nil {
+		out += "\nCompression: " + m.Super.Compressor()
+	}
+	out += s.ubiInfo(size)
+	out += s.romfsInfo()
+	out += s.cramfsInfo()
+	if m, _ := s.Meta.(*FitMeta); m != nil && m.Ramdisk != "" {
+		out += "\nFIT ramdisk: " + m.Ramdisk + " (fit put-ramdisk writes it back)"
+	}
+	if m, _ := s.Meta.(*KernelRawMeta); m != nil && m.Arm64 != nil {
+		out += "\n" + m.Arm64.String()
+	}
+	if len(s.Slots) > 0 {
+		out += "\nSlots: " + strings.Join(s.SlotNames(), ", ")
+	}
+	return out
+}
+
+// decompressInput: "auto" unpacks when a known magic is found and otherwise
+// keeps the bytes as is; an explicit codec name must succeed.
+func (s *State) decompressInput(b []byte, compressionName string) ([]byte, error) {
+	c := strings.ToLower(compressionName)
+	if c == "" || c == "none" {
+		return b, nil
+	}
+	out, _, err := compress.DecompressAutoWith(b, s.Codec)
+	if err != nil {
+		// a missing zstd dictionary or a bomb is never a reason to fall back to raw bytes
+		if c != "auto" || errors.Is(err, compress.ErrNeedDict) || errors.Is(err, common.ErrTooLarge) {
+			return nil, err
+		}
+		return b, nil
+	}
+	return out, nil
+}
+
+// unsparseInput expands an Android sparse image (fastboot/factory images)
+// into the raw filesystem; other data is returned unchanged.
+func unsparseInput(b []byte) ([]byte, error) {
+	if !simg.IsSparse(b) {
+		return b, nil
+	}
+	return simg.Unsparse(b)
+}
+
+func (s *State) compressOutput(data []byte, compressionName string) ([]byte, error) {
+	return s.compressOutputCtx(context.Background(), data, compressionName)
+}
+
+func (s *State) compressOutputCtx(ctx context.Context, data []byte, compressionName string) ([]byte, error) {
+	if compressionName == "" || strings.ToLower(compressionName) == "none" {
+		return data, nil
+	}
+	out, err := compress.CompressContext(ctx, data, compressionName, s.Codec)
+	if err != nil {
+		return nil, err
+	}
+	s.progressDone(strings.ToLower(compressionName), int64(len(data)), int64(len(out)))
+	return out, nil
+}
+
+// Every format has a reader/writer pair (…Reader/…Writer) for embedding;
+// the path-based methods only open or write the file and delegate to them.
+// Store* writes into a temp file next to path and renames it into place on
+// success (common.WriteFileAtomic), so a failed store does not leave a
+// truncated output behind or replace the previous one.
+
+func writeFileVia(path string, store func(io.Writer) error) error {
+	return common.WriteFileAtomic(path, store)
+}
+
+func loadFileVia(path string, load func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return load(f)
 }
 
 // ---------------------------- Initramfs / CPIO ----------------------------
 
 func (s *State) LoadInitramfs(path string, compressionName string) error {
-	b, err := os.ReadFile(path)
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadInitramfsReader(r, compressionName) })
+}
+
+func (s *State) LoadInitramfsReader(r io.Reader, compressionName string) error {
+	b, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	if strings.ToLower(compressionName) == "auto" || (compressionName != "" && strings.ToLower(compressionName) != "none") {
-		out, _, derr := compress.DecompressAuto(b)
-		if derr == nil {
-			b = out
-		} else if strings.ToLower(compressionName) != "auto" {
-			return derr
+	return s.LoadInitramfsBytes(b, compressionName)
+}
+
+// LoadInitramfsBytes is LoadInitramfs for an archive already in memory,
+// e.g. a FIT ramdisk image; b is not kept or modified.
+func (s *State) LoadInitramfsBytes(b []byte, compressionName string) error {
+	// a compressed archive may follow uncompressed ones (early microcode)
+	var decode func([]byte) ([]byte, bool, error)
+	if c := strings.ToLower(compressionName); c != "" && c != "none" {
+		decode = func(rest []byte) ([]byte, bool, error) {
+			if compress.Detect(rest) == "none" {
+				return nil, false, nil
+			}
+			out, err := s.decompressInput(rest, compressionName)
+			return out, true, err
 		}
 	}
-	fs, err := cpio.LoadNewc(bytes.NewReader(b))
+	fs, raw, err := cpio.LoadSegments(b, decode)
 	if err != nil {
 		return err
 	}
 	s.Kind = KindInitramfs
 	s.FS = fs
-	s.Raw = b
+	s.Raw = raw
 	s.Meta = nil
 	return nil
 }
 
 func (s *State) StoreInitramfs(path string, compressionName string) error {
+	return s.StoreInitramfsWith(path, compressionName, cpio.StoreOptions{})
+}
+
+// StoreInitramfsWith — с опциями cpio (порядок записей для vendor-раскладки).
+func (s *State) StoreInitramfsWith(path string, compressionName string, opt cpio.StoreOptions) error {
+	return writeFileVia(path, func(w io.Writer) error { return s.StoreInitramfsWriterWith(w, compressionName, opt) })
+}
+
+func (s *State) StoreInitramfsWriter(w io.Writer, compressionName string) error {
+	return s.StoreInitramfsWriterWith(w, compressionName, cpio.StoreOptions{})
+}
+
+func (s *State) StoreInitramfsWriterWith(w io.Writer, compressionName string, opt cpio.StoreOptions) error {
 	if s.FS == nil {
 		return errors.New("no image")
 	}
+	// the prepended archive stays uncompressed, only the main one is compressed
+	pre := opt.Prepend
+	opt.Prepend = nil
 	var buf bytes.Buffer
-	if err := cpio.StoreNewc(&buf, s.FS); err != nil {
+	if err := cpio.StoreNewcWith(&buf, s.FS, opt); err != nil {
 		return err
 	}
-	data := buf.Bytes()
-	if compressionName != "" && strings.ToLower(compressionName) != "none" {
-		enc, err := compress.Compress(data, compressionName)
-		if err != nil {
+	data, err := s.compressOutput(buf.Bytes(), compressionName)
+	if err != nil {
+		return err
+	}
+	if len(pre) > 0 {
+		if _, err := w.Write(cpio.PadArchive(pre)); err != nil {
 			return err
 		}
-		data = enc
 	}
-	return os.WriteFile(path, data, 0o644)
+	_, err = w.Write(data)
+	return err
+}
+
+// InitramfsPrepend reads the source of store initramfs --prepend: a
+// directory (e.g. holding kernel/x86/microcode/GenuineIntel.bin) is packed
+// into a cpio with root ownership, a file must already be uncompressed newc
+// cpio and is used byte for byte.
+func InitramfsPrepend(src string) ([]byte, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		tmp := New()
+		if err := tmp.FSAddLocalWith(src, "/", AddOptions{Owner: true}); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := cpio.StoreNewc(&buf, tmp.FS); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	if !cpio.IsNewc(b) {
+		return nil, fmt.Errorf("%s: not an uncompressed newc cpio archive", src)
+	}
+	// a compressed tail (a whole initrd) would end up in the middle of the output
+	tail := func([]byte) ([]byte, bool, error) {
+		return nil, false, errors.New("data after the cpio archive (compressed?)")
+	}
+	if _, _, err := cpio.LoadSegments(b, tail); err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	return b, nil
 }
 
 // ---------------------------- U-Boot legacy ----------------------------
 
 func (s *State) LoadKernelLegacy(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+	return loadFileVia(path, s.LoadKernelLegacyReader)
+}
 
-	h, payload, err := legacy.Read(f)
+func (s *State) LoadKernelLegacyReader(r io.Reader) error {
+	h, payload, err := legacy.Read(r)
 	if err != nil {
 		return err
 	}
@@ -154,6 +374,10 @@ func (s *State) LoadKernelLegacy(path string) error {
 }
 
 func (s *State) StoreKernelLegacy(path string) error {
+	return writeFileVia(path, s.StoreKernelLegacyWriter)
+}
+
+func (s *State) StoreKernelLegacyWriter(w io.Writer) error {
 	m, _ := s.Meta.(*UImageMeta)
 	if m == nil || m.H == nil {
 		return errors.New("no uImage header in meta")
@@ -168,163 +392,409 @@ func (s *State) StoreKernelLegacy(path string) error {
 	if data == nil {
 		data = []byte{}
 	}
-	out, err := os.Create(path)
+	return legacy.Write(w, m.H, data)
+}
+
+// ---------------------------- Raw kernel ----------------------------
+
+// kernel-raw: bare kernel image (arm64 Image, zImage, ...), kept as bytes.
+// Only the arm64 header is understood; it feeds info and fit add.
+
+func (s *State) LoadKernelRaw(path, compressionName string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadKernelRawReader(r, compressionName) })
+}
+
+func (s *State) LoadKernelRawReader(r io.Reader, compressionName string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// Image.gz и т.п. — распаковываем, заголовок нужен от самого Image
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
+	}
+	s.Kind = KindKernelRaw
+	s.Meta = kernelRawMeta(b)
+	s.Raw = b
+	return nil
+}
+
+func kernelRawMeta(b []byte) *KernelRawMeta {
+	m := &KernelRawMeta{}
+	if arm64.IsImage(b) {
+		m.Arm64, _ = arm64.Parse(b)
+	}
+	return m
+}
+
+func (s *State) StoreKernelRaw(path, compressionName string) error {
+	return writeFileVia(path, func(w io.Writer) error { return s.StoreKernelRawWriter(w, compressionName) })
+}
+
+func (s *State) StoreKernelRawWriter(w io.Writer, compressionName string) error {
+	if s.Kind != KindKernelRaw || s.Raw == nil {
+		return errors.New("no raw kernel loaded")
+	}
+	data, err := s.compressOutput(s.Raw, compressionName)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-	return legacy.Write(out, m.H, data)
+	_, err = w.Write(data)
+	return err
 }
 
 // ---------------------------- U-Boot FIT / ITB ----------------------------
 
 func (s *State) LoadKernelFIT(path string, compressionName string) error {
-	b, err := os.ReadFile(path)
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadKernelFITReader(r, compressionName) })
+}
+
+func (s *State) LoadKernelFITReader(r io.Reader, compressionName string) error {
+	b, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
 	// Accept compressed ITB as convenience.
-	if strings.ToLower(compressionName) == "auto" || (compressionName != "" && strings.ToLower(compressionName) != "none") {
-		if out, _, derr := compress.DecompressAuto(b); derr == nil {
-			b = out
-		} else if strings.ToLower(compressionName) != "auto" {
-			return derr
-		}
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
 	}
-	r := bytes.NewReader(b)
-	f, err := fit.Read(r)
+	f, err := fit.Read(bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
 	s.Kind = KindKernelFIT
 	s.Meta = &FitMeta{F: f}
 	s.Raw = b
+	s.markClean()
 	return nil
 }
 
 func (s *State) StoreKernelFIT(path string, compressionName string) error {
+	return writeFileVia(path, func(w io.Writer) error { return s.StoreKernelFITWriter(w, compressionName) })
+}
+
+func (s *State) StoreKernelFITWriter(w io.Writer, compressionName string) error {
 	m, _ := s.Meta.(*FitMeta)
 	if m == nil || m.F == nil {
 		return errors.New("no FIT loaded")
 	}
-	var buf bytes.Buffer
-	if err := fit.Write(&buf, m.F); err != nil {
-		return err
-	}
-	data := buf.Bytes()
-	if compressionName != "" && strings.ToLower(compressionName) != "none" {
-		enc, err := compress.Compress(data, compressionName)
-		if err != nil {
+	raw := s.Raw
+	if !s.passthrough(KindKernelFIT) {
+		var buf bytes.Buffer
+		if err := fit.Write(&buf, m.F); err != nil {
 			return err
 		}
-		data = enc
+		raw = buf.Bytes()
 	}
-	return os.WriteFile(path, data, 0o644)
+	data, err := s.compressOutput(raw, compressionName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 // ---------------------------- SquashFS ----------------------------
 
 func (s *State) LoadSquashFS(path, compression string) error {
-	f, err := os.Open(path)
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadSquashFSReader(r, compression) })
+}
+
+func (s *State) LoadSquashFSReader(r io.Reader, compression string) error {
+	return s.loadSquashFS(r, compression, false)
+}
+
+// LoadSquashFSNative is LoadSquashFS with the built-in reader instead of
+// go-diskfs (load squashfs --native): no temporary file, and owners,
+// device nodes, FIFOs and xattrs are kept.
+func (s *State) LoadSquashFSNative(path, compression string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadSquashFSNativeReader(r, compression) })
+}
+
+func (s *State) LoadSquashFSNativeReader(r io.Reader, compression string) error {
+	return s.loadSquashFS(r, compression, true)
+}
+
+func (s *State) loadSquashFS(r io.Reader, compression string, native bool) error {
+	b, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	fs, super, err := squashfs.Load(f, compression)
+	if b, err = unsparseInput(b); err != nil {
+		return err
+	}
+	load := squashfs.Load
+	if native {
+		load = squashfs.LoadNative
+	}
+	fs, super, err := load(bytes.NewReader(b), compression)
 	if err != nil {
 		return err
 	}
 	s.Kind = KindSquashFS
 	s.FS = fs
 	s.Meta = &SquashMeta{Super: super}
-	s.Raw = nil
+	s.Raw = b
+	s.markClean()
 	return nil
 }
 
+// SquashFSCompression is what store squashfs uses without a compression
+// argument: the loaded squashfs's own compressor if Store can write it,
+// else gzip.
+func (s *State) SquashFSCompression() string {
+	if m, _ := s.Meta.(*SquashMeta); m != nil && m.Super != nil && squashfs.CanWrite(m.Super.Compressor()) {
+		return m.Super.Compressor()
+	}
+	return "gzip"
+}
+
 func (s *State) StoreSquashFS(path, compression string) error {
+	return s.StoreSquashFSWith(path, squashfs.Options{Compression: compression})
+}
+
+// StoreSquashFSWith — то же, с настройками компрессора (xz dict/BCJ, gzip level...).
+func (s *State) StoreSquashFSWith(path string, opts squashfs.Options) error {
+	return s.StoreSquashFSCtx(context.Background(), path, opts)
+}
+
+// StoreSquashFSCtx — StoreSquashFSWith с отменой через ctx (Ctrl-C в CLI):
+// возвращает ctx.Err(), выходной файл не создаётся, временный каталог убран.
+func (s *State) StoreSquashFSCtx(ctx context.Context, path string, opts squashfs.Options) error {
+	return writeFileVia(path, func(w io.Writer) error { return s.storeSquashFS(ctx, w, opts) })
+}
+
+func (s *State) StoreSquashFSWriter(w io.Writer, opts squashfs.Options) error {
+	return s.storeSquashFS(context.Background(), w, opts)
+}
+
+func (s *State) storeSquashFS(ctx context.Context, w io.Writer, opts squashfs.Options) error {
 	if s.FS == nil {
 		return errors.New("no image")
 	}
-	var buf bytes.Buffer
-	opts := squashfs.Options{Compression: compression}
-	if err := squashfs.Store(&buf, s.FS, opts); err != nil {
+	if m, _ := s.Meta.(*SquashMeta); m != nil && s.passthrough(KindSquashFS) && sqfsUntuned(opts, m.Super) {
+		_, err := w.Write(s.Raw)
+		return err
+	}
+	hook, done := s.progressFunc("materialize")
+	if opts.Progress == nil {
+		opts.Progress = hook
+	}
+	if err := squashfs.StoreContext(ctx, w, s.FS, opts); err != nil {
 		return err
 	}
-	return os.WriteFile(path, buf.Bytes(), 0o644)
+	done()
+	return nil
 }
 
 // ---------------------------- EXT2 (external tools path) ----------------------------
 
 func (s *State) LoadExt2(path, compressionName string) error {
-	b, err := os.ReadFile(path)
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadExt2Reader(r, compressionName) })
+}
+
+func (s *State) LoadExt2Reader(r io.Reader, compressionName string) error {
+	return s.loadExt2(r, compressionName, false)
+}
+
+// LoadExt2Native is LoadExt2 with the built-in reader only, never debugfs
+// (load ext2 --native). LoadExt2 falls back to it by itself when debugfs is
+// not on PATH.
+func (s *State) LoadExt2Native(path, compressionName string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadExt2NativeReader(r, compressionName) })
+}
+
+func (s *State) LoadExt2NativeReader(r io.Reader, compressionName string) error {
+	return s.loadExt2(r, compressionName, true)
+}
+
+// loadExt2: under -v the reader that was used is reported as the stage,
+// "load ext2 (debugfs)" or "load ext2 (native)".
+func (s *State) loadExt2(r io.Reader, compressionName string, native bool) error {
+	b, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	if strings.ToLower(compressionName) == "auto" || (compressionName != "" && strings.ToLower(compressionName) != "none") {
-		if out, _, derr := compress.DecompressAuto(b); derr == nil {
-			b = out
-		} else if strings.ToLower(compressionName) != "auto" {
-			return derr
-		}
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
+	}
+	if b, err = unsparseInput(b); err != nil {
+		return err
 	}
 	fs := memfs.New()
-	if err := ext2.Load(fs, bytes.NewReader(b)); err != nil {
+	via := "native"
+	if native {
+		err = ext2.LoadNative(fs, bytes.NewReader(b), int64(len(b)))
+	} else {
+		via, err = ext2.LoadVia(fs, bytes.NewReader(b))
+	}
+	if err != nil {
 		return err
 	}
+	s.progressDone("load ext2 ("+via+")", int64(len(b)), 0)
 	s.Kind = KindExt2
 	s.FS = fs
 	s.Meta = nil
 	s.Raw = b
+	s.markClean()
 	return nil
 }
 
 func (s *State) StoreExt2(path string, blockSize int, compressionName string) error {
+	return s.StoreExt2With(path, compressionName, ext2.Options{BlockSize: blockSize})
+}
+
+func (s *State) StoreExt2With(path string, compressionName string, opts ext2.Options) error {
+	return s.StoreExt2Ctx(context.Background(), path, compressionName, opts)
+}
+
+// StoreExt2Ctx — StoreExt2With с отменой через ctx: mke2fs убивается,
+// сжатие останавливается, выходной файл не создаётся.
+func (s *State) StoreExt2Ctx(ctx context.Context, path string, compressionName string, opts ext2.Options) error {
+	return writeFileVia(path, func(w io.Writer) error { return s.storeExt2(ctx, w, compressionName, opts) })
+}
+
+func (s *State) StoreExt2Writer(w io.Writer, compressionName string, opts ext2.Options) error {
+	return s.storeExt2(context.Background(), w, compressionName, opts)
+}
+
+func (s *State) storeExt2(ctx context.Context, w io.Writer, compressionName string, opts ext2.Options) error {
 	if s.FS == nil {
 		return errors.New("no image")
 	}
-	var buf bytes.Buffer
-	if err := ext2.Store(s.FS, &buf, ext2.Options{BlockSize: blockSize}); err != nil {
-		return err
-	}
-	data := buf.Bytes()
-	if compressionName != "" && strings.ToLower(compressionName) != "none" {
-		enc, err := compress.Compress(data, compressionName)
-		if err != nil {
+	raw := s.Raw
+	same := opts.SparseThreshold == 0 && (opts.BlockSize == 0 || opts.BlockSize == ext2.BlockSizeOf(raw))
+	if !same || !s.passthrough(KindExt2) {
+		var buf bytes.Buffer
+		hook, done := s.progressFunc("materialize")
+		if opts.Progress == nil {
+			opts.Progress = hook
+		}
+		if err := ext2.StoreContext(ctx, s.FS, &buf, opts); err != nil {
 			return err
 		}
-		data = enc
+		done()
+		raw = buf.Bytes()
+	}
+	data, err := s.compressOutputCtx(ctx, raw, compressionName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ---------------------------- JFFS2 (read-only) ----------------------------
+
+// LoadJFFS2 reads a JFFS2 image (mkfs.jffs2 output or an MTD dump, either
+// byte order). There is no store jffs2: edit it and store another format.
+func (s *State) LoadJFFS2(path, compressionName string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadJFFS2Reader(r, compressionName) })
+}
+
+func (s *State) LoadJFFS2Reader(r io.Reader, compressionName string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
 	}
-	return os.WriteFile(path, data, 0o644)
+	fs, err := jffs2.Load(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	s.Kind = KindJFFS2
+	s.FS = fs
+	s.Meta = nil
+	s.Raw = b
+	s.markClean()
+	return nil
 }
 
 // ---------------------------- FS utils ----------------------------
 
+// AddOptions overrides host metadata in FSAddLocalWith; the zero value
+// keeps the host's owner and permission bits.
+type AddOptions struct {
+	Owner    bool // use UID/GID instead of the host owner
+	UID, GID uint32
+	Mode     string   // octal or symbolic as in fs chmod; symlinks keep 0777
+	Exclude  []string // source paths relative to src, see memfs.Excluded
+	// Follow stores what host symlinks inside the tree point to instead of
+	// the links (fs add -L); a link back into a directory being added is
+	// an error.
+	Follow bool
+}
+
+// FSAddLocal copies a host file or tree into the image with its host
+// metadata.
 func (s *State) FSAddLocal(src, dst string) error {
+	return s.FSAddLocalWith(src, dst, AddOptions{})
+}
+
+// FSAddLocalWith copies src (recursively for directories) to dst, applying
+// opt to every added entry.
+func (s *State) FSAddLocalWith(src, dst string, opt AddOptions) error {
+	chmod := func(m memfs.Mode) memfs.Mode { return m & 0o7777 }
+	if opt.Mode != "" {
+		var err error
+		if chmod, err = parseChmod(opt.Mode); err != nil {
+			return fmt.Errorf("%s: %w", opt.Mode, err)
+		}
+	}
+	if err := memfs.CheckPatterns(opt.Exclude); err != nil {
+		return err
+	}
 	if s.FS == nil {
 		s.FS = memfs.New()
 	}
+	return s.addLocal(src, dst, "", opt, chmod, nil)
+}
+
+// addLocal: rel — путь src относительно корня fs add, по нему --exclude;
+// parents — каталоги над src, для поиска петель при -L.
+func (s *State) addLocal(src, dst, rel string, opt AddOptions, chmod func(memfs.Mode) memfs.Mode, parents []os.FileInfo) error {
+	if memfs.Excluded(rel, opt.Exclude) {
+		return nil
+	}
 	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
+	if opt.Follow && info.Mode()&os.ModeSymlink != 0 {
+		if info, err = os.Stat(src); err != nil {
+			return fmt.Errorf("-L: %w", err)
+		}
+		for _, p := range parents {
+			if info.IsDir() && os.SameFile(info, p) {
+				return fmt.Errorf("%s: symlink loop (-L)", src)
+			}
+		}
+	}
 	mt := info.ModTime()
+	uid, gid := osUIDGID(info)
+	if opt.Owner {
+		uid, gid = opt.UID, opt.GID
+	}
 	if info.Mode()&os.ModeSymlink != 0 {
 		tgt, err := os.Readlink(src)
 		if err != nil {
 			return err
 		}
-		s.FS.PutSymlink(dst, filepath.ToSlash(tgt), 0, 0, mt)
+		s.FS.PutSymlink(dst, filepath.ToSlash(tgt), uid, gid, mt)
 		return nil
 	}
+	perm := memfs.PermOf(info.Mode())
 	if info.IsDir() {
-		s.FS.PutDir(dst, 0, 0, mt)
+		s.FS.PutDirMode(dst, chmod(memfs.ModeDir|perm), uid, gid, mt)
 		ents, err := os.ReadDir(src)
 		if err != nil {
 			return err
 		}
+		parents = append(parents, info)
 		for _, de := range ents {
-			if err := s.FSAddLocal(filepath.Join(src, de.Name()), filepath.ToSlash(filepath.Join(dst, de.Name()))); err != nil {
+			if err := s.addLocal(filepath.Join(src, de.Name()), filepath.ToSlash(filepath.Join(dst, de.Name())), strings.TrimPrefix(rel+"/"+de.Name(), "/"), opt, chmod, parents); err != nil {
 				return err
 			}
 		}
@@ -334,37 +804,51 @@ func (s *State) FSAddLocal(src, dst string) error {
 	if err != nil {
 		return err
 	}
-	mode := memfs.Mode(0o644)
-	if info.Mode().Perm()&0o111 != 0 {
-		mode = 0o755
-	}
-	s.FS.PutFile(dst, data, mode, 0, 0, mt)
+	s.FS.PutFile(dst, data, chmod(memfs.ModeFile|perm), uid, gid, mt)
 	return nil
 }
 
+// FSExtract writes the tree under dst with each entry's permissions,
+// setuid/setgid/sticky included. Directories get theirs last, so a
+// read-only one can still be filled.
 func (s *State) FSExtract(dst string) error {
 	if s.FS == nil {
 		return errors.New("no image")
 	}
-	return s.FS.Walk(func(e *memfs.Entry) error {
+	var dirs []*memfs.Entry
+	err := s.FS.Walk(func(e *memfs.Entry) error {
 		name := strings.TrimPrefix(e.Name, "/")
 		out := filepath.Join(dst, name)
-		switch {
-		case e.Name == "/":
+		if e.Name == "/" {
 			return nil
-		case e.Mode&memfs.ModeDir != 0:
+		}
+		switch e.Mode.Type() {
+		case memfs.ModeDir:
+			dirs = append(dirs, e)
 			return os.MkdirAll(out, 0o755)
-		case e.Mode&memfs.ModeLink != 0:
+		case memfs.ModeLink:
 			_ = os.RemoveAll(out)
 			return os.Symlink(e.Target, out)
-		case e.Mode&memfs.ModeChar != 0 || e.Mode&memfs.ModeBlock != 0 || e.Mode&memfs.ModeFIFO != 0:
+		case memfs.ModeChar, memfs.ModeBlock, memfs.ModeFIFO:
 			// skip special files
 			return nil
 		default:
 			if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
 				return err
 			}
-			return os.WriteFile(out, e.Data, 0o644)
+			if err := os.WriteFile(out, e.Data, 0o644); err != nil {
+				return err
+			}
+			return os.Chmod(out, memfs.HostMode(e))
 		}
 	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(filepath.Join(dst, strings.TrimPrefix(dirs[i].Name, "/")), memfs.HostMode(dirs[i])); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,12 +1,15 @@
 package core
 
 import (
+	"bufio"
 	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 
+	"goimagetool/internal/common"
+	"goimagetool/internal/compress"
 	"goimagetool/internal/fs/memfs"
 	"goimagetool/internal/image/tarball"
 )
@@ -24,24 +27,43 @@ func (s *State) LoadTar(path, comp string) error {
 		switch {
 		case strings.HasSuffix(l, ".tar.gz"), strings.HasSuffix(l, ".tgz"), strings.HasSuffix(l, ".tar.gzip"):
 			comp = "gzip"
+		case strings.HasSuffix(l, ".tar.zst"), strings.HasSuffix(l, ".tzst"):
+			comp = "zstd"
 		default:
 			comp = "none"
 		}
 	}
+	return s.LoadTarReader(f, comp)
+}
+
+// LoadTarReader: без имени файла "auto" смотрит на magic (gzip/zstd).
+func (s *State) LoadTarReader(r io.Reader, comp string) error {
+	if comp == "" || strings.ToLower(comp) == "auto" {
+		br := bufio.NewReader(r)
+		r = br
+		m, _ := br.Peek(4)
+		if comp = compress.Detect(m); comp != "gzip" && comp != "zstd" {
+			comp = "none"
+		}
+	}
 
-	var r io.Reader = f
 	var gr *gzip.Reader
 
 	switch strings.ToLower(comp) {
 	case "none":
 		// no-op
 	case "gz", "gzip":
-		g, err := gzip.NewReader(f)
+		g, err := gzip.NewReader(r)
 		if err != nil {
 			return err
 		}
 		gr = g
-		r = g
+		r = common.LimitReader(g)
+	case "zst", "zstd":
+		pr, pw := io.Pipe()
+		go func(src io.Reader) { pw.CloseWithError(compress.ZstdDecompress(pw, src)) }(r)
+		defer pr.Close()
+		r = pr
 	default:
 		return fmt.Errorf("unsupported tar compression: %s", comp)
 	}
@@ -50,7 +72,7 @@ func (s *State) LoadTar(path, comp string) error {
 		s.FS = memfs.New()
 	}
 
-	err = tarball.Load(s.FS, r)
+	err := tarball.Load(s.FS, r)
 	if gr != nil {
 		_ = gr.Close()
 	}
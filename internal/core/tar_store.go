@@ -3,51 +3,97 @@ package core
 import (
 	"compress/gzip"
 	"io"
-	"os"
 	"strings"
 
 	"goimagetool/internal/common"
+	"goimagetool/internal/compress"
+	"goimagetool/internal/fs/memfs"
 	"goimagetool/internal/image/tarball"
 )
 
 func (s *State) StoreTar(path, comp string) error {
+	return s.StoreTarWith(path, comp, tarball.WriteOptions{})
+}
+
+// StoreTarWith — с опциями tar (sparse-записи для длинных нулевых участков).
+func (s *State) StoreTarWith(path, comp string, opt tarball.WriteOptions) error {
 	if s.FS == nil {
 		return common.ErrNoImage
 	}
 
-	f, err := os.Create(path)
-	if err != nil {
-		return err
+	return writeFileVia(path, func(w io.Writer) error { return s.StoreTarWriter(w, comp, opt) })
+}
+
+// ImageOwnerNames reads the image's own /etc/passwd and /etc/group into
+// the uid→name and gid→name maps of tarball.WriteOptions; a file that is
+// missing (or not a regular file) gives a nil map.
+func (s *State) ImageOwnerNames() (users, groups map[uint32]string, err error) {
+	if s.FS == nil {
+		return nil, nil, common.ErrNoImage
+	}
+	read := func(p string) map[uint32]string {
+		if _, e, err := s.FS.ResolveLink(p, memfs.DefaultMaxHops); err == nil && e.Mode.Type() == memfs.ModeFile {
+			return tarball.ParseIDNames(e.Data)
+		}
+		return nil
 	}
-	defer f.Close()
+	return read("/etc/passwd"), read("/etc/group"), nil
+}
 
-	var w io.Writer = f
-	var cw io.Closer
+// StoreTarWriter streams the tar through the compress helpers, so the
+// archive is never held in memory; s.Codec.Level picks the gzip/zstd level.
+func (s *State) StoreTarWriter(out io.Writer, comp string, opt tarball.WriteOptions) error {
+	if s.FS == nil {
+		return common.ErrNoImage
+	}
 
+	var pack func(dst io.Writer, src io.Reader) error
 	switch strings.ToLower(comp) {
-	case "gz", "gzip":
-		gw := gzip.NewWriter(f)
-		cw = gw
-		w = gw
 	case "none", "":
-		// no-op
+		return tarball.WriteWith(s.FS, out, opt)
+	case "zst", "zstd":
+		level := compress.ZstdDefaultLevel
+		if s.Codec.Level != 0 {
+			level = s.Codec.Level
+		}
+		pack = func(dst io.Writer, src io.Reader) error { return compress.ZstdCompressLevel(dst, src, level) }
 	default:
-		// пока поддерживаем только tar и tar.gz
-		gw := gzip.NewWriter(f)
-		cw = gw
-		w = gw
+		// gz/gzip; прочее тоже в gzip, как и раньше
+		level := gzip.DefaultCompression
+		if s.Codec.Level != 0 {
+			level = s.Codec.Level
+		}
+		pack = func(dst io.Writer, src io.Reader) error { return compress.GzipCompressLevel(dst, src, level) }
 	}
 
-	err = tarball.Write(s.FS, w)
-	if cerr := closeIf(cw); err == nil {
-		err = cerr
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(tarball.WriteWith(s.FS, pw, opt))
+	}()
+	in, cout := &countWriter{}, &countWriter{w: out}
+	err := pack(cout, io.TeeReader(pr, in))
+	pr.Close() // unblocks the writer if pack gave up early
+	<-done
+	if err == nil {
+		s.progressDone(strings.ToLower(comp), in.n, cout.n)
 	}
 	return err
 }
 
-func closeIf(c io.Closer) error {
-	if c != nil {
-		return c.Close()
+// countWriter counts bytes passed to w (w == nil: count only).
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.w == nil {
+		c.n += int64(len(p))
+		return len(p), nil
 	}
-	return nil
+	k, err := c.w.Write(p)
+	c.n += int64(k)
+	return k, err
 }
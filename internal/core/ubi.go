@@ -0,0 +1,131 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"goimagetool/internal/fs/memfs"
+	"goimagetool/internal/image/ubi"
+	"goimagetool/internal/image/ubifs"
+)
+
+// UBIMeta: the parsed UBI image behind kind ubi. Volume data lives in the
+// FS (one file per volume), not here.
+type UBIMeta struct {
+	Image *ubi.Image
+}
+
+// UBIFSMeta: Volume is the UBI volume it came from ("" for a bare UBIFS
+// image).
+type UBIFSMeta struct {
+	Super  *ubifs.Superblock
+	Volume string
+}
+
+// LoadUBI reads a UBI image (ubinize output or a NAND dump). With volume
+// "" every volume becomes a file /<name> of the working FS (kind ubi), to
+// extract or to load on its own; otherwise the named volume (name or ID)
+// must hold UBIFS and its tree is loaded (kind ubifs).
+func (s *State) LoadUBI(path, compressionName, volume string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadUBIReader(r, compressionName, volume) })
+}
+
+func (s *State) LoadUBIReader(r io.Reader, compressionName, volume string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
+	}
+	im, err := ubi.Read(b, 0)
+	if err != nil {
+		return err
+	}
+	if volume != "" {
+		v, err := im.Volume(volume)
+		if err != nil {
+			return err
+		}
+		if !ubifs.IsUBIFS(v.Data) {
+			return fmt.Errorf("ubi volume %s does not hold UBIFS; load ubi without --volume and extract it", v.Name)
+		}
+		return s.loadUBIFS(v.Data, v.Name)
+	}
+	fs := memfs.New()
+	for _, v := range im.Volumes {
+		fs.PutFile("/"+volumeFileName(v), v.Data, memfs.ModeFile|0o644, 0, 0, time.Unix(0, 0))
+		v.Data = nil
+	}
+	s.Kind = KindUBI
+	s.FS = fs
+	s.Meta = &UBIMeta{Image: im}
+	s.Raw = b
+	s.markClean()
+	return nil
+}
+
+// volumeFileName: the volume name as a single path element.
+func volumeFileName(v *ubi.Volume) string {
+	name := strings.ReplaceAll(v.Name, "/", "_")
+	if name == "" || name == "." || name == ".." {
+		name = fmt.Sprintf("vol%d", v.ID)
+	}
+	return name
+}
+
+// LoadUBIFS reads a bare UBIFS image (mkfs.ubifs output, or a volume
+// extracted from a UBI image).
+func (s *State) LoadUBIFS(path, compressionName string) error {
+	return loadFileVia(path, func(r io.Reader) error { return s.LoadUBIFSReader(r, compressionName) })
+}
+
+func (s *State) LoadUBIFSReader(r io.Reader, compressionName string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if b, err = s.decompressInput(b, compressionName); err != nil {
+		return err
+	}
+	return s.loadUBIFS(b, "")
+}
+
+func (s *State) loadUBIFS(b []byte, volume string) error {
+	fs, sb, err := ubifs.Load(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	s.Kind = KindUBIFS
+	s.FS = fs
+	s.Meta = &UBIFSMeta{Super: sb, Volume: volume}
+	s.Raw = b
+	s.markClean()
+	return nil
+}
+
+// ubiInfo: the info lines for kinds ubi and ubifs.
+func (s *State) ubiInfo(size func(int64) string) string {
+	out := ""
+	switch m := s.Meta.(type) {
+	case *UBIMeta:
+		im := m.Image
+		out += fmt.Sprintf("\nUBI: %d erase blocks of %s, LEB %s", im.PEBs, size(int64(im.PEBSize)), size(int64(im.LEBSize)))
+		for _, v := range im.Volumes {
+			var data int64
+			if e, ok := s.FS.Get("/" + volumeFileName(v)); ok {
+				data = int64(len(e.Data))
+			}
+			out += fmt.Sprintf("\nVolume %d %s: %s, %d of %d LEBs, %s", v.ID, v.Name, v.Type(), v.LEBs, v.Reserved, size(data))
+		}
+	case *UBIFSMeta:
+		if m.Volume != "" {
+			out += "\nUBI volume: " + m.Volume
+		}
+		out += fmt.Sprintf("\nUBIFS: LEB %s, %d LEBs, compression %s", size(int64(m.Super.LEBSize)), m.Super.LEBCount, m.Super.Compressor)
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"fmt"
+
+	"goimagetool/internal/fs/memfs"
+)
+
+// FSDiff is one difference between two trees: Attr is "missing", "extra"
+// or one of SelfTestAttrs.
+type FSDiff struct {
+	Path string
+	Attr string
+}
+
+func (d FSDiff) String() string { return d.Path + ": " + d.Attr }
+
+// DiffFS lists entries of src that are missing or differ in dst, then
+// entries that only dst has. The root directory is not compared.
+func DiffFS(src, dst *memfs.FS) []FSDiff {
+	var out []FSDiff
+	_ = src.Walk(func(a *memfs.Entry) error {
+		if a.Name == "/" {
+			return nil
+		}
+		b, ok := dst.Get(a.Name)
+		if !ok {
+			out = append(out, FSDiff{a.Name, "missing"})
+			return nil
+		}
+		compareEntry(a, b, func(attr string, ok bool) {
+			if !ok {
+				out = append(out, FSDiff{a.Name, attr})
+			}
+		})
+		return nil
+	})
+	_ = dst.Walk(func(b *memfs.Entry) error {
+		if _, ok := src.Get(b.Name); !ok {
+			out = append(out, FSDiff{b.Name, "extra"})
+		}
+		return nil
+	})
+	return out
+}
+
+// VerifyStored reloads a file just written by Store<format> into a fresh
+// state and diffs it against the current FS.
+func (s *State) VerifyStored(format, path, comp string) ([]FSDiff, error) {
+	if s.FS == nil {
+		return nil, fmt.Errorf("no image")
+	}
+	chk := New()
+	chk.Codec = s.Codec
+	var err error
+	switch format {
+	case "initramfs":
+		err = chk.LoadInitramfs(path, "auto")
+	case "tar":
+		err = chk.LoadTar(path, comp)
+	case "squashfs":
+		err = chk.LoadSquashFS(path, "auto")
+	case "ext2":
+		err = chk.LoadExt2(path, "auto")
+	default:
+		return nil, fmt.Errorf("verify: not supported for %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("verify: reload %s: %w", path, err)
+	}
+	return DiffFS(s.FS, chk.FS), nil
+}
@@ -2,7 +2,9 @@ package ext2
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,46 +12,77 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"goimagetool/internal/common"
 	"goimagetool/internal/fs/memfs"
 )
 
 type Options struct {
 	BlockSize int
+	// SparseThreshold: zero runs of at least this many bytes become holes in
+	// the staging files, so mke2fs leaves them unallocated. 0 = BlockSize,
+	// negative = write files densely.
+	SparseThreshold int
+	// Progress, if set, is called for each entry staged for mke2fs with
+	// the running entry count and data bytes.
+	Progress func(files int, bytes int64)
+	// UUID, if set, is the filesystem UUID and directory hash seed instead
+	// of random ones.
+	UUID string
+	// Epoch, if set, makes the image reproducible: mke2fs runs with its
+	// clock fixed to Epoch, the root gets the owner of "/" rather than the
+	// caller's, and no inode time is left later than Epoch (staging the
+	// tree touches atime/ctime and symlink times).
+	Epoch time.Time
 }
 
+// Load reads an ext2 image with debugfs when it is on PATH (not on
+// Windows), otherwise — or when debugfs fails — with LoadNative.
 func Load(dst *memfs.FS, r io.Reader) error {
+	_, err := LoadVia(dst, r)
+	return err
+}
+
+// LoadVia is Load that also tells which reader was used: "debugfs" or
+// "native".
+func LoadVia(dst *memfs.FS, r io.Reader) (string, error) {
 	if dst == nil {
-		return fmt.Errorf("memfs is nil")
+		return "", fmt.Errorf("memfs is nil")
 	}
-	tmp, err := os.MkdirTemp("", "goimagetool-ext2-*")
+	tmp, release, err := common.MkdirTemp("goimagetool-ext2-*")
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer os.RemoveAll(tmp)
+	defer release()
 	img := filepath.Join(tmp, "img.ext2")
 	f, err := os.Create(img)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if _, err := io.Copy(f, r); err != nil {
+	n, err := io.Copy(f, r)
+	if err != nil {
 		_ = f.Close()
-		return err
+		return "", err
 	}
 	_ = f.Close()
+	if n < minImage {
+		return "", common.TooSmall("ext2", "an ext2 filesystem", n, minImage)
+	}
 	if runtime.GOOS != "windows" {
 		if _, err := exec.LookPath("debugfs"); err == nil {
 			rdump := filepath.Join(tmp, "rdump")
 			if err := os.MkdirAll(rdump, 0o755); err != nil {
-				return err
+				return "", err
 			}
 			cmd := exec.Command("debugfs", "-R", fmt.Sprintf("rdump / %s", rdump), img)
 			out, err := cmd.CombinedOutput()
 			if err == nil {
-				*dst = *memfs.New()
+				dst.Reset()
 				dst.PutDir("/", 0, 0, time.Unix(0, 0))
+				dirs := []string{"/"}
 				err = filepath.Walk(rdump, func(p string, fi os.FileInfo, e error) error {
 					if e != nil {
 						return e
@@ -61,7 +94,8 @@ func Load(dst *memfs.FS, r io.Reader) error {
 					ap := "/" + filepath.ToSlash(rel)
 					switch mode := fi.Mode(); {
 					case mode.IsDir():
-						dst.PutDir(ap, uidOf(fi), gidOf(fi), fi.ModTime())
+						dst.PutDirMode(ap, memfs.ModeDir|memfs.PermOf(mode), uidOf(fi), gidOf(fi), fi.ModTime())
+						dirs = append(dirs, ap)
 					case (mode & os.ModeSymlink) != 0:
 						t, err := os.Readlink(p)
 						if err != nil {
@@ -69,60 +103,118 @@ func Load(dst *memfs.FS, r io.Reader) error {
 						}
 						dst.PutSymlink(ap, t, uidOf(fi), gidOf(fi), fi.ModTime())
 					case (mode & os.ModeNamedPipe) != 0:
-						dst.PutNode(ap, memfs.ModeFIFO, uint32(mode.Perm()), uidOf(fi), gidOf(fi), 0, 0, fi.ModTime())
+						dst.PutNode(ap, memfs.ModeFIFO, uint32(memfs.PermOf(mode)), uidOf(fi), gidOf(fi), 0, 0, fi.ModTime())
 					case (mode & os.ModeDevice) != 0:
 						m := memfs.ModeChar
 						if (mode & os.ModeCharDevice) == 0 {
 							m = memfs.ModeBlock
 						}
 						maj, min := rdevOf(fi)
-						dst.PutNode(ap, m, uint32(mode.Perm()), uidOf(fi), gidOf(fi), maj, min, fi.ModTime())
+						dst.PutNode(ap, m, uint32(memfs.PermOf(mode)), uidOf(fi), gidOf(fi), maj, min, fi.ModTime())
 					default:
 						b, err := os.ReadFile(p)
 						if err != nil {
 							return err
 						}
-						dst.PutFile(ap, b, memfs.ModeFile|memfs.Mode(uint32(mode.Perm())), uidOf(fi), gidOf(fi), fi.ModTime())
+						dst.PutFile(ap, b, memfs.ModeFile|memfs.PermOf(mode), uidOf(fi), gidOf(fi), fi.ModTime())
 					}
 					return nil
 				})
-				return err
+				if err == nil {
+					err = debugfsModes(dst, img, dirs)
+				}
+				return "debugfs", err
 			} else {
 				_ = out
 			}
 		}
 	}
-	data, err := os.ReadFile(img)
+	f, err = os.Open(img)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return LoadNative(dst, bytes.NewReader(data))
+	defer f.Close()
+	return "native", LoadNative(dst, f, n)
 }
 
+// debugfsModes sets the permissions of the rdump'ed entries from their
+// inodes: the host copy rdump leaves has lost setuid, setgid and sticky.
+// One debugfs run lists every directory in dirs with "ls -p", whose lines
+// are /ino/mode/uid/gid/name/size/.
+func debugfsModes(dst *memfs.FS, img string, dirs []string) error {
+	var script strings.Builder
+	for _, d := range dirs {
+		fmt.Fprintf(&script, "ls -p %q\n", d)
+	}
+	cmd := exec.Command("debugfs", "-f", "-", img)
+	cmd.Stdin = strings.NewReader(script.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("ext2: debugfs ls: %w", err)
+	}
+	i := -1 // dirs[i] is the directory being listed
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "debugfs: ") {
+			i++
+			continue
+		}
+		f := strings.Split(line, "/")
+		if i < 0 || i >= len(dirs) || len(f) != 8 || f[5] == ".." {
+			continue
+		}
+		mode, err := strconv.ParseUint(f[2], 8, 32)
+		if err != nil || mode&0xF000 == 0xA000 {
+			continue
+		}
+		p := dirs[i]
+		if f[5] != "." {
+			p = join(p, f[5])
+		}
+		if err := dst.Chmod(p, memfs.Mode(mode&0o7777)); err != nil && !errors.Is(err, memfs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrNoMke2fs: Store needs mke2fs from e2fsprogs; there is no built-in
+// ext2 writer to fall back to.
+var ErrNoMke2fs = errors.New("ext2: mke2fs is required to write ext2 (install e2fsprogs); there is no built-in writer")
+
 func Store(src *memfs.FS, w io.Writer, opts Options) error {
+	return StoreContext(context.Background(), src, w, opts)
+}
+
+// StoreContext is Store that gives up once ctx is cancelled: staging stops
+// between entries and mke2fs is killed. The scratch dir is removed either way.
+func StoreContext(ctx context.Context, src *memfs.FS, w io.Writer, opts Options) error {
 	if src == nil {
 		return fmt.Errorf("memfs is nil")
 	}
 	if opts.BlockSize == 0 {
 		opts.BlockSize = 1024
 	}
+	// встроенного writer'а ext2 нет (есть только LoadNative) — только mke2fs
 	if runtime.GOOS == "windows" {
-		return fmt.Errorf("mke2fs is required")
+		return ErrNoMke2fs
 	}
 	mke2, err := exec.LookPath("mke2fs")
 	if err != nil {
-		return fmt.Errorf("mke2fs not found: %w", err)
+		return fmt.Errorf("%w: %v", ErrNoMke2fs, err)
 	}
-	tmp, err := os.MkdirTemp("", "goimagetool-ext2-*")
+	tmp, release, err := common.MkdirTemp("goimagetool-ext2-*")
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmp)
+	defer release()
 	staging := filepath.Join(tmp, "staging")
 	if err := os.MkdirAll(staging, 0o755); err != nil {
 		return err
 	}
-	if err := materialize(staging, src); err != nil {
+	if opts.SparseThreshold == 0 {
+		opts.SparseThreshold = opts.BlockSize
+	}
+	if err := materialize(ctx, staging, src, opts.SparseThreshold, opts.Progress); err != nil {
 		return err
 	}
 	size, err := estimate(staging, opts.BlockSize)
@@ -143,15 +235,39 @@ func Store(src *memfs.FS, w io.Writer, opts Options) error {
 		"-d", staging,
 		"-b", fmt.Sprintf("%d", opts.BlockSize),
 		"-I", "128",
-		img,
-		fmt.Sprintf("%d", blocks),
 	}
-	cmd := exec.Command(mke2, args...)
+	var ext []string
+	if opts.UUID != "" {
+		args = append(args, "-U", opts.UUID)
+		ext = append(ext, "hash_seed="+opts.UUID)
+	}
+	if !opts.Epoch.IsZero() {
+		if root, ok := src.Get("/"); ok {
+			ext = append(ext, fmt.Sprintf("root_owner=%d:%d", root.UID, root.GID))
+		}
+	}
+	if len(ext) > 0 {
+		args = append(args, "-E", strings.Join(ext, ","))
+	}
+	args = append(args, img, fmt.Sprintf("%d", blocks))
+	cmd := exec.CommandContext(ctx, mke2, args...)
 	cmd.Stdin = bytes.NewReader(nil)
+	if !opts.Epoch.IsZero() {
+		epoch := fmt.Sprintf("%d", opts.Epoch.Unix())
+		cmd.Env = append(os.Environ(), "E2FSPROGS_FAKE_TIME="+epoch, "SOURCE_DATE_EPOCH="+epoch)
+	}
 	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return fmt.Errorf("mke2fs: %v: %s", err, string(out))
 	}
+	if !opts.Epoch.IsZero() {
+		if err := clampTimes(img, uint32(opts.Epoch.Unix())); err != nil {
+			return err
+		}
+	}
 	f, err := os.Open(img)
 	if err != nil {
 		return err
@@ -161,7 +277,69 @@ func Store(src *memfs.FS, w io.Writer, opts Options) error {
 	return err
 }
 
-func materialize(base string, m *memfs.FS) error {
+// clampTimes caps the superblock times (in every backup copy too) and
+// atime, ctime and mtime of every inode of the fresh image at t. mke2fs
+// can't fake a clock of 0, and ext2 without metadata_csum has no checksums
+// to fix up, so the image is patched in place.
+func clampTimes(path string, t uint32) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sb, err := readSuper(f)
+	if err != nil {
+		return err
+	}
+	bs := int64(1024) << sb.LogBlockSize
+	isz := int(sb.InodeSize)
+	if isz == 0 {
+		isz = 128
+	}
+	clamp := func(b []byte, offs ...int) {
+		for _, at := range offs {
+			if binary.LittleEndian.Uint32(b[at:]) > t {
+				binary.LittleEndian.PutUint32(b[at:], t)
+			}
+		}
+	}
+	gr := int((sb.InodesCount + sb.InodesPerGroup - 1) / sb.InodesPerGroup)
+	gdt, err := readGDT(f, sb, gr)
+	if err != nil {
+		return err
+	}
+	sbuf := make([]byte, 1024)
+	table := make([]byte, int(sb.InodesPerGroup)*isz)
+	for g, d := range gdt {
+		// копия суперблока есть не в каждой группе (sparse_super): узнаём по magic и номеру группы
+		off := (int64(g)*int64(sb.BlocksPerGroup) + int64(sb.FirstDataBlock)) * bs
+		if g == 0 {
+			off = 1024
+		}
+		if _, err := f.ReadAt(sbuf, off); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint16(sbuf[56:]) == 0xEF53 && int(binary.LittleEndian.Uint16(sbuf[90:])) == g {
+			clamp(sbuf, 44, 48, 64, 264) // mtime, wtime, lastcheck, mkfs_time
+			if _, err := f.WriteAt(sbuf, off); err != nil {
+				return err
+			}
+		}
+		off = int64(d.InodeTable) * bs
+		if _, err := f.ReadAt(table, off); err != nil {
+			return err
+		}
+		for i := 0; i < len(table); i += isz {
+			clamp(table[i:], 8, 12, 16) // atime, ctime, mtime
+		}
+		if _, err := f.WriteAt(table, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func materialize(ctx context.Context, base string, m *memfs.FS, sparse int, progress func(int, int64)) error {
 	snap := m.Snapshot()
 	paths := make([]string, 0, len(snap))
 	for p := range snap {
@@ -177,20 +355,32 @@ func materialize(base string, m *memfs.FS) error {
 		}
 		return paths[i] < paths[j]
 	})
+	var files int
+	var written int64
 	for _, p := range paths {
 		if p == "/" {
 			continue
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		e := snap[p]
+		if progress != nil {
+			files++
+			written += int64(len(e.Data))
+			progress(files, written)
+		}
 		dst := filepath.Join(base, strings.TrimPrefix(p, "/"))
-		switch {
-		case e.Mode&memfs.ModeDir != 0:
-			if err := os.MkdirAll(dst, os.FileMode(uint32(e.Mode)&0o7777)); err != nil {
+		switch e.Mode.Type() {
+		case memfs.ModeDir:
+			if err := os.MkdirAll(dst, os.FileMode(memfs.EffectivePerm(e))); err != nil {
 				return err
 			}
 			_ = os.Chtimes(dst, e.MTime, e.MTime)
 			_ = chown(dst, int(e.UID), int(e.GID))
-		case e.Mode&memfs.ModeLink != 0:
+			// MkdirAll режет права umask'ом, а setgid/sticky не ставит вовсе
+			_ = os.Chmod(dst, memfs.HostMode(e))
+		case memfs.ModeLink:
 			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 				return err
 			}
@@ -199,16 +389,16 @@ func materialize(base string, m *memfs.FS) error {
 				return err
 			}
 			_ = lchown(dst, int(e.UID), int(e.GID))
-		case e.Mode&memfs.ModeFIFO != 0:
+		case memfs.ModeFIFO:
 			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 				return err
 			}
-			if err := mkfifo(dst, uint32(e.Mode)&0o7777); err != nil {
+			if err := mkfifo(dst, uint32(memfs.EffectivePerm(e))); err != nil {
 				return err
 			}
 			_ = os.Chtimes(dst, e.MTime, e.MTime)
 			_ = lchown(dst, int(e.UID), int(e.GID))
-		case e.Mode&memfs.ModeChar != 0 || e.Mode&memfs.ModeBlock != 0:
+		case memfs.ModeChar, memfs.ModeBlock:
 			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 				return err
 			}
@@ -221,20 +411,46 @@ func materialize(base string, m *memfs.FS) error {
 			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 				return err
 			}
-			mode := os.FileMode(uint32(e.Mode) & 0o7777)
-			if mode == 0 {
-				mode = 0o644
-			}
-			if err := os.WriteFile(dst, e.Data, mode); err != nil {
+			if err := writeSparseFile(dst, e.Data, os.FileMode(memfs.EffectivePerm(e)), sparse); err != nil {
 				return err
 			}
 			_ = os.Chtimes(dst, e.MTime, e.MTime)
 			_ = chown(dst, int(e.UID), int(e.GID))
+			// chown сбрасывает setuid/setgid — права ставим после него
+			if err := os.Chmod(dst, memfs.HostMode(e)); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+// writeSparseFile writes data skipping zero runs >= threshold (seeked holes).
+func writeSparseFile(dst string, data []byte, mode os.FileMode, threshold int) error {
+	var regions []common.Region
+	if threshold > 0 {
+		regions = common.DataRegions(data, threshold)
+	}
+	if regions == nil {
+		return os.WriteFile(dst, data, mode)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	for _, r := range regions {
+		if _, err := f.WriteAt(data[r.Off:r.Off+r.Len], r.Off); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Truncate(int64(len(data))); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func estimate(dir string, bs int) (int, error) {
 	var tot int64
 	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
@@ -257,21 +473,8 @@ func estimate(dir string, bs int) (int, error) {
 	return int(tot), nil
 }
 
-type blob struct{ b []byte }
-
-func (b *blob) ReadAt(p []byte, off int64) (int, error) {
-	if off < 0 {
-		return 0, io.ErrUnexpectedEOF
-	}
-	if int(off) >= len(b.b) {
-		return 0, io.EOF
-	}
-	n := copy(p, b.b[int(off):])
-	if n < len(p) {
-		return n, io.EOF
-	}
-	return n, nil
-}
+// minImage: boot block + superblock, the least an ext2 image can be.
+const minImage = 2048
 
 type super struct {
 	InodesCount     uint32
@@ -322,7 +525,9 @@ type gdesc struct {
 	Reserved         [12]byte
 }
 
-type inode struct {
+// rawInode — классические 128 байт inode; OSD2 в Linux-варианте:
+// blocks_hi, file_acl_hi, uid_hi, gid_hi, checksum_lo, reserved.
+type rawInode struct {
 	Mode        uint16
 	Uid         uint16
 	SizeLo      uint32
@@ -343,6 +548,28 @@ type inode struct {
 	OSD2        [12]byte
 }
 
+// inode is a decoded inode: the 128-byte base plus the full owner and
+// mtime, which readInode assembles from the high uid/gid halves in OSD2 and,
+// for large (>= 256-byte) inodes, i_mtime_extra.
+type inode struct {
+	rawInode
+	uid, gid uint32
+	mtime    time.Time
+}
+
+// Смещения в большом inode (за 128 байтами базы): i_extra_isize — сколько
+// байт дополнительных полей реально записано; *_extra — наносекунды << 2
+// и в младших двух битах старшие биты секунд (epoch, после 2038).
+const (
+	offExtraIsize = 128
+	offMtimeExtra = 136
+)
+
+// extraTime applies an i_*_extra field to the 32-bit seconds.
+func extraTime(sec, extra uint32) time.Time {
+	return time.Unix(int64(int32(sec))+int64(extra&3)<<32, int64(extra>>2))
+}
+
 type dirent struct {
 	Ino     uint32
 	RecLen  uint16
@@ -351,40 +578,105 @@ type dirent struct {
 	Name    string
 }
 
-func LoadNative(dst *memfs.FS, r io.Reader) error {
-	if dst == nil {
-		return fmt.Errorf("memfs is nil")
+// BlockSizeOf reads the block size from an image's superblock; 0 if img
+// is not ext2.
+func BlockSizeOf(img []byte) int {
+	sb, err := readSuper(bytes.NewReader(img))
+	if err != nil || sb.Magic != 0xEF53 || sb.LogBlockSize > 6 {
+		return 0
+	}
+	return int(1024 << sb.LogBlockSize)
+}
+
+// Summary is the superblock of an image as info reports it.
+type Summary struct {
+	BlockSize          int
+	Blocks, FreeBlocks uint32
+	Inodes, FreeInodes uint32
+	InodeSize          int
+	UUID               string
+	Label              string
+}
+
+// SummaryOf reads the superblock of img; false if img is not ext2.
+func SummaryOf(img []byte) (Summary, bool) {
+	sb, err := readSuper(bytes.NewReader(img))
+	if err != nil || sb.Magic != 0xEF53 || sb.LogBlockSize > 6 {
+		return Summary{}, false
+	}
+	is := int(sb.InodeSize)
+	if sb.RevLevel == 0 {
+		is = 128
 	}
+	u := sb.UUID
+	return Summary{
+		BlockSize:  int(1024 << sb.LogBlockSize),
+		Blocks:     sb.BlocksCount,
+		FreeBlocks: sb.FreeBlocksCount,
+		Inodes:     sb.InodesCount,
+		FreeInodes: sb.FreeInodesCount,
+		InodeSize:  is,
+		UUID:       fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]),
+		Label:      string(bytes.TrimRight(sb.VolumeName[:], "\x00")),
+	}, true
+}
+
+// LoadNativeReader is LoadNative for small inputs that are not seekable:
+// the whole image is read into memory first.
+func LoadNativeReader(dst *memfs.FS, r io.Reader) error {
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	img := &blob{b: data}
+	return LoadNative(dst, bytes.NewReader(data), int64(len(data)))
+}
+
+// LoadNative parses an ext2 image of size bytes without external tools.
+// Blocks are read on demand through img, so with an *os.File only the
+// metadata and the file data actually referenced are touched.
+func LoadNative(dst *memfs.FS, img io.ReaderAt, size int64) error {
+	if dst == nil {
+		return fmt.Errorf("memfs is nil")
+	}
+	if size < minImage {
+		return common.TooSmall("ext2", "an ext2 filesystem", size, minImage)
+	}
 	sb, err := readSuper(img)
 	if err != nil {
-		return err
+		return common.WrapAt("ext2", 1024, err)
 	}
+	// смещения полей суперблока — для сообщений об ошибках
 	if sb.Magic != 0xEF53 {
-		return fmt.Errorf("not ext2")
+		return common.Corrupt("ext2", 1024+56, fmt.Sprintf("not ext2: magic=%#04x", sb.Magic))
 	}
-	bs := int(1024 << sb.LogBlockSize)
-	if bs <= 0 {
-		return fmt.Errorf("bad block size")
+	if sb.LogBlockSize > 6 {
+		return common.Corrupt("ext2", 1024+24, fmt.Sprintf("bad block size: log=%d", sb.LogBlockSize))
 	}
+	bs := int(1024 << sb.LogBlockSize)
 	isz := int(sb.InodeSize)
 	if isz == 0 {
 		isz = 128
 	}
+	if sb.InodesPerGroup == 0 {
+		return common.Corrupt("ext2", 1024+40, "inodes per group is 0")
+	}
 	gr := int((uint32(sb.InodesCount) + sb.InodesPerGroup - 1) / sb.InodesPerGroup)
 	if gr <= 0 {
-		return fmt.Errorf("no groups")
+		return common.Corrupt("ext2", 1024, "no groups")
+	}
+	if int64(gr)*32 > size {
+		return common.Corrupt("ext2", 1024, fmt.Sprintf("%d block groups do not fit in a %d-byte image", gr, size))
 	}
-	gdt, err := readGDT(img, bs, gr)
+	gdt, err := readGDT(img, sb, gr)
 	if err != nil {
 		return err
 	}
-	*dst = *memfs.New()
-	dst.PutDir("/", 0, 0, time.Unix(int64(sb.Mtime), 0))
+	root, err := readInode(img, sb, gdt, bs, isz, 2)
+	if err != nil {
+		return common.WithPath("ext2", "/", err)
+	}
+	dst.Reset()
+	dst.PutDirMode("/", memfs.ModeDir|memfs.Mode(uint32(root.Mode)&0o7777), root.uid, root.gid, root.mtime)
 	seen := map[uint32]bool{}
 	return walkDir(img, sb, gdt, bs, isz, 2, "/", dst, seen)
 }
@@ -402,45 +694,83 @@ func readSuper(r io.ReaderAt) (*super, error) {
 	return &sb, nil
 }
 
-func readGDT(r io.ReaderAt, bs int, groups int) ([]gdesc, error) {
-	size := groups * 32
-	buf := make([]byte, size)
-	off := int64(2048)
-	_, err := r.ReadAt(buf, off)
-	if err != nil {
-		align := (off + int64(bs-1)) &^ int64(bs-1)
-		if _, err2 := r.ReadAt(buf, align); err2 != nil {
-			return nil, err
-		}
+// gdtOffset: the GDT starts in the block right after the superblock's,
+// block FirstDataBlock+1 — byte 2048 with 1K blocks (FirstDataBlock 1),
+// one block in otherwise.
+func gdtOffset(sb *super) int64 {
+	return int64(sb.FirstDataBlock+1) * (int64(1024) << sb.LogBlockSize)
+}
+
+// readGDT reads the descriptors of all groups and checks that their
+// bitmaps and inode tables lie inside the filesystem, so a GDT read from
+// the wrong place (or a damaged one) fails here, at the descriptor,
+// instead of turning into garbage inodes later.
+func readGDT(r io.ReaderAt, sb *super, groups int) ([]gdesc, error) {
+	off := gdtOffset(sb)
+	buf := make([]byte, groups*32)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, common.WrapAt("ext2", off, err)
 	}
 	out := make([]gdesc, groups)
 	br := bytes.NewReader(buf)
 	for i := 0; i < groups; i++ {
 		if err := binary.Read(br, binary.LittleEndian, &out[i]); err != nil {
-			return nil, err
+			return nil, common.WrapAt("ext2", off+int64(i)*32, err)
 		}
 	}
+	bs := int64(1024) << sb.LogBlockSize
+	isz := int64(sb.InodeSize)
+	if isz == 0 {
+		isz = 128
+	}
+	tableBlocks := (int64(sb.InodesPerGroup)*isz + bs - 1) / bs
+	inside := func(blk uint32, n int64) bool {
+		return blk >= sb.FirstDataBlock && int64(blk)+n <= int64(sb.BlocksCount)
+	}
+	for i, d := range out {
+		var bad string
+		switch {
+		case !inside(d.BlockBitmap, 1):
+			bad = fmt.Sprintf("block bitmap at block %d", d.BlockBitmap)
+		case !inside(d.InodeBitmap, 1):
+			bad = fmt.Sprintf("inode bitmap at block %d", d.InodeBitmap)
+		case !inside(d.InodeTable, tableBlocks):
+			bad = fmt.Sprintf("inode table of %d blocks at block %d", tableBlocks, d.InodeTable)
+		default:
+			continue
+		}
+		return nil, common.Corrupt("ext2", off+int64(i)*32, fmt.Sprintf("group %d: %s, outside blocks %d..%d", i, bad, sb.FirstDataBlock, int64(sb.BlocksCount)-1))
+	}
 	return out, nil
 }
 
 func readInode(r io.ReaderAt, sb *super, gdt []gdesc, bs, isz int, ino uint32) (*inode, error) {
 	if ino == 0 {
-		return nil, fmt.Errorf("inode 0")
+		return nil, common.Corrupt("ext2", -1, "inode 0")
 	}
 	g := int((ino - 1) / sb.InodesPerGroup)
 	idx := int((ino - 1) % sb.InodesPerGroup)
 	if g < 0 || g >= len(gdt) {
-		return nil, fmt.Errorf("inode group oob")
+		return nil, common.Corrupt("ext2", -1, fmt.Sprintf("inode %d: group %d out of range", ino, g))
 	}
 	off := int64(gdt[g].InodeTable)*int64(bs) + int64(idx*isz)
 	buf := make([]byte, isz)
 	if _, err := r.ReadAt(buf, off); err != nil {
-		return nil, err
+		return nil, common.WrapAt("ext2", off, err)
 	}
 	var in inode
 	br := bytes.NewReader(buf)
-	if err := binary.Read(br, binary.LittleEndian, &in); err != nil {
-		return nil, err
+	if err := binary.Read(br, binary.LittleEndian, &in.rawInode); err != nil {
+		return nil, common.WrapAt("ext2", off, err)
+	}
+	in.uid = uint32(in.Uid) | uint32(binary.LittleEndian.Uint16(in.OSD2[4:]))<<16
+	in.gid = uint32(in.Gid) | uint32(binary.LittleEndian.Uint16(in.OSD2[6:]))<<16
+	in.mtime = time.Unix(int64(in.Mtime), 0)
+	if isz >= 256 {
+		extra := int(binary.LittleEndian.Uint16(buf[offExtraIsize:]))
+		if offExtraIsize+extra >= offMtimeExtra+4 {
+			in.mtime = extraTime(in.Mtime, binary.LittleEndian.Uint32(buf[offMtimeExtra:]))
+		}
 	}
 	return &in, nil
 }
@@ -472,7 +802,31 @@ func readDirBlock(r io.ReaderAt, off int64, bs int) ([]dirent, error) {
 	return out, nil
 }
 
+const (
+	extentsFl    = 0x80000 // EXT4_EXTENTS_FL
+	extentMagic  = 0xF30A
+	extentMaxLen = 32768 // longer ee_len marks an uninitialized extent
+	extentDepth  = 5     // ext4 never builds deeper trees
+)
+
 func collectBlocks(r io.ReaderAt, in *inode, bs int, need int) ([]uint32, error) {
+	if in.Flags&extentsFl != 0 {
+		var root [60]byte
+		for i := 0; i < 15; i++ {
+			binary.LittleEndian.PutUint32(root[i*4:], in.Block[i])
+		}
+		var out []uint32
+		limit := (int(in.SizeLo) + bs - 1) / bs
+		if err := walkExtents(r, root[:], bs, 0, limit, &out); err != nil {
+			return nil, err
+		}
+		if need > 0 {
+			if n := (need + bs - 1) / bs; len(out) > n {
+				out = out[:n]
+			}
+		}
+		return out, nil
+	}
 	var out []uint32
 	for i := 0; i < 12; i++ {
 		if in.Block[i] != 0 {
@@ -560,11 +914,82 @@ func collectBlocks(r io.ReaderAt, in *inode, bs int, need int) ([]uint32, error)
 	return out, nil
 }
 
+// walkExtents appends the physical blocks of an ext4 extent (sub)tree to out
+// in logical order. Holes and uninitialized extents are recorded as block 0,
+// which readers treat as zero-filled. limit is the inode size in blocks:
+// nothing past it is recorded, and an initialized extent starting beyond it
+// is an error (uninitialized ones there are fallocate preallocation).
+func walkExtents(r io.ReaderAt, node []byte, bs, level, limit int, out *[]uint32) error {
+	if len(node) < 12 || binary.LittleEndian.Uint16(node[0:2]) != extentMagic {
+		return fmt.Errorf("ext4 extents: bad extent header")
+	}
+	if level > extentDepth {
+		return fmt.Errorf("ext4 extents: tree too deep")
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:4]))
+	depth := binary.LittleEndian.Uint16(node[6:8])
+	if 12+entries*12 > len(node) {
+		return fmt.Errorf("ext4 extents: entry count %d overflows node", entries)
+	}
+	for i := 0; i < entries; i++ {
+		e := node[12+i*12 : 24+i*12]
+		if depth > 0 {
+			if binary.LittleEndian.Uint16(e[8:10]) != 0 {
+				return fmt.Errorf("ext4 extents: 48-bit block numbers not supported")
+			}
+			leaf := binary.LittleEndian.Uint32(e[4:8])
+			buf := make([]byte, bs)
+			if _, err := r.ReadAt(buf, int64(leaf)*int64(bs)); err != nil && err != io.EOF {
+				return err
+			}
+			if err := walkExtents(r, buf, bs, level+1, limit, out); err != nil {
+				return err
+			}
+			continue
+		}
+		logical := int(binary.LittleEndian.Uint32(e[0:4]))
+		n := int(binary.LittleEndian.Uint16(e[4:6]))
+		uninit := n > extentMaxLen
+		if uninit {
+			n -= extentMaxLen
+		}
+		if binary.LittleEndian.Uint16(e[6:8]) != 0 {
+			return fmt.Errorf("ext4 extents: 48-bit block numbers not supported")
+		}
+		start := binary.LittleEndian.Uint32(e[8:12])
+		if logical >= limit {
+			if uninit {
+				continue
+			}
+			return fmt.Errorf("ext4 extents: extent at logical block %d past the inode size (%d blocks)", logical, limit)
+		}
+		for len(*out) < logical {
+			*out = append(*out, 0)
+		}
+		for j := 0; j < n && len(*out) < limit; j++ {
+			if uninit {
+				*out = append(*out, 0)
+			} else {
+				*out = append(*out, start+uint32(j))
+			}
+		}
+	}
+	return nil
+}
+
 func readFileData(r io.ReaderAt, in *inode, bs int) ([]byte, error) {
 	sz := int(in.SizeLo)
 	if sz < 0 {
 		return nil, fmt.Errorf("bad size")
 	}
+	if err := common.CheckSize("ext2 inode", int64(sz)); err != nil {
+		return nil, err
+	}
+	if int64(in.Blocks512)*512 < int64(sz) {
+		if err := common.CheckSparseExpand("ext2 inode", int64(sz)); err != nil {
+			return nil, err
+		}
+	}
 	blocks, err := collectBlocks(r, in, bs, sz)
 	if err != nil {
 		return nil, err
@@ -576,20 +1001,26 @@ func readFileData(r io.ReaderAt, in *inode, bs int) ([]byte, error) {
 			chunk = sz - len(out)
 		}
 		buf := make([]byte, chunk)
-		if _, err := r.ReadAt(buf, int64(b)*int64(bs)); err != nil && err != io.EOF {
-			return nil, err
+		if b != 0 {
+			if _, err := r.ReadAt(buf, int64(b)*int64(bs)); err != nil && err != io.EOF {
+				return nil, common.WrapAt("ext2", int64(b)*int64(bs), err)
+			}
 		}
 		out = append(out, buf...)
 		if len(out) >= sz {
 			break
 		}
 	}
+	if len(out) < sz {
+		// trailing hole
+		out = append(out, make([]byte, sz-len(out))...)
+	}
 	return out, nil
 }
 
 func readSymlinkTarget(in *inode, bs int, r io.ReaderAt) (string, error) {
 	sz := int(in.SizeLo)
-	if sz <= 60 {
+	if sz <= 60 && in.Flags&extentsFl == 0 {
 		var raw [60]byte
 		for i := 0; i < 15; i++ {
 			binary.LittleEndian.PutUint32(raw[i*4:(i+1)*4], in.Block[i])
@@ -614,40 +1045,41 @@ func walkDir(r io.ReaderAt, sb *super, gdt []gdesc, bs, isz int, ino uint32, pat
 	seen[ino] = true
 	in, err := readInode(r, sb, gdt, bs, isz, ino)
 	if err != nil {
-		return err
+		return common.WithPath("ext2", path, err)
 	}
 	blocks, err := collectBlocks(r, in, bs, 0)
 	if err != nil {
-		return err
+		return common.WithPath("ext2", path, err)
 	}
 	for _, b := range blocks {
+		if b == 0 {
+			continue
+		}
 		ents, err := readDirBlock(r, int64(b)*int64(bs), bs)
 		if err != nil {
-			return err
+			return common.WithPath("ext2", path, common.WrapAt("ext2", int64(b)*int64(bs), err))
 		}
 		for _, de := range ents {
 			if de.Name == "." || de.Name == ".." {
 				continue
 			}
+			full := join(path, de.Name)
 			child, err := readInode(r, sb, gdt, bs, isz, de.Ino)
 			if err != nil {
-				return err
+				return common.WithPath("ext2", full, err)
 			}
-			full := join(path, de.Name)
 			perm := memfs.Mode(uint32(child.Mode) & 0o7777)
-			uid := uint32(child.Uid)
-			gid := uint32(child.Gid)
-			mt := time.Unix(int64(child.Mtime), 0)
+			uid, gid, mt := child.uid, child.gid, child.mtime
 			switch {
 			case (child.Mode&0xF000) == 0x4000:
-				dst.PutDir(full, uid, gid, mt)
+				dst.PutDirMode(full, memfs.ModeDir|perm, uid, gid, mt)
 				if err := walkDir(r, sb, gdt, bs, isz, de.Ino, full, dst, seen); err != nil {
 					return err
 				}
 			case (child.Mode&0xF000) == 0xA000:
 				tgt, err := readSymlinkTarget(child, bs, r)
 				if err != nil {
-					return err
+					return common.WithPath("ext2", full, err)
 				}
 				dst.PutSymlink(full, tgt, uid, gid, mt)
 			case (child.Mode&0xF000) == 0x1000:
@@ -666,7 +1098,7 @@ func walkDir(r io.ReaderAt, sb *super, gdt []gdesc, bs, isz int, ino uint32, pat
 				if (child.Mode&0xF000) == 0x8000 {
 					b, err := readFileData(r, child, bs)
 					if err != nil {
-						return err
+						return common.WithPath("ext2", full, err)
 					}
 					dst.PutFile(full, b, memfs.ModeFile|perm, uid, gid, mt)
 				}
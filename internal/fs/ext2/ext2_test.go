@@ -0,0 +1,203 @@
+package ext2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+func TestLoadNativeShortInput(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 1024, 1081, minImage - 1} {
+		err := LoadNativeReader(memfs.New(), bytes.NewReader(make([]byte, n)))
+		if !errors.Is(err, common.ErrCorrupt) || !strings.Contains(err.Error(), "file too small") {
+			t.Errorf("%d bytes: got %v, want a too-small ErrCorrupt", n, err)
+		}
+	}
+}
+
+// Random garbage, some with the ext2 magic planted so parsing goes past the
+// superblock: every buffer must give an error, never a panic.
+func TestLoadNativeRandomInput(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		b := make([]byte, rnd.Intn(3*minImage))
+		rnd.Read(b)
+		if i%2 == 0 && len(b) >= 1024+58 {
+			binary.LittleEndian.PutUint16(b[1024+56:], 0xEF53)
+			b[1024+24] = byte(rnd.Intn(3)) // block size 1K..4K
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("buffer %d (%d bytes): panic: %v", i, len(b), r)
+				}
+			}()
+			_ = LoadNativeReader(memfs.New(), bytes.NewReader(b))
+		}()
+	}
+}
+
+// Staging for mke2fs must not lose setuid to umask, os.FileMode or chown.
+func TestStoreLoadSpecialBits(t *testing.T) {
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("mke2fs not found")
+	}
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutDirMode("/", memfs.ModeDir|0o755, 0, 0, mt)
+	src.PutFile("/bin/su", []byte("\x7fELF"), 0o4755, 0, 0, mt)
+	src.PutDirMode("/tmp", memfs.ModeDir|0o1777, 0, 0, mt)
+
+	var buf bytes.Buffer
+	if err := Store(src, &buf, Options{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	img := buf.Bytes()
+	native := memfs.New()
+	if err := LoadNativeReader(native, bytes.NewReader(img)); err != nil {
+		t.Fatalf("LoadNativeReader: %v", err)
+	}
+	// the default loader: debugfs rdump when it is installed
+	dflt := memfs.New()
+	via, err := LoadVia(dflt, bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("LoadVia: %v", err)
+	}
+	if _, err := exec.LookPath("debugfs"); err == nil && via != "debugfs" {
+		t.Errorf("LoadVia: read with %s, want debugfs", via)
+	}
+	for name, dst := range map[string]*memfs.FS{"native": native, via: dflt} {
+		for p, want := range map[string]memfs.Mode{"/": memfs.ModeDir | 0o755, "/bin/su": memfs.ModeFile | 0o4755, "/tmp": memfs.ModeDir | 0o1777} {
+			e, ok := dst.Get(p)
+			if !ok {
+				t.Fatalf("%s: %s: missing", name, p)
+			}
+			if e.Mode != want {
+				t.Errorf("%s: %s: mode %o, want %o", name, p, e.Mode, want)
+			}
+		}
+	}
+}
+
+// mke2fs images of every block size list back; with 1K blocks the
+// superblock is in block 1 (FirstDataBlock 1), so the GDT is at 2048, not
+// one block in. The big file spreads a 1K image over several groups.
+func TestLoadNativeBlockSizes(t *testing.T) {
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("mke2fs not found")
+	}
+	mt := time.Unix(1700000000, 0)
+	big := bytes.Repeat([]byte("goimagetool"), 900<<10)
+	src := memfs.New()
+	src.PutDirMode("/", memfs.ModeDir|0o755, 0, 0, mt)
+	src.PutFile("/etc/hostname", []byte("box\n"), memfs.ModeFile|0o644, 0, 0, mt)
+	src.PutFile("/etc/init.d/rcS", []byte("#!/bin/sh\n"), memfs.ModeFile|0o755, 0, 0, mt)
+	src.PutFile("/var/big", big, memfs.ModeFile|0o644, 0, 0, mt)
+	src.PutSymlink("/bin/sh", "busybox", 0, 0, mt)
+
+	for _, bs := range []int{1024, 2048, 4096} {
+		var buf bytes.Buffer
+		if err := Store(src, &buf, Options{BlockSize: bs}); err != nil {
+			t.Fatalf("%d: Store: %v", bs, err)
+		}
+		sb, err := readSuper(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[int]uint32{1024: 1}[bs]; sb.FirstDataBlock != want {
+			t.Fatalf("%d: FirstDataBlock %d", bs, sb.FirstDataBlock)
+		}
+		if want := map[int]int64{1024: 2048, 2048: 2048, 4096: 4096}[bs]; gdtOffset(sb) != want {
+			t.Fatalf("%d: GDT at %d, want %d", bs, gdtOffset(sb), want)
+		}
+		dst := memfs.New()
+		if err := LoadNativeReader(dst, &buf); err != nil {
+			t.Fatalf("%d: LoadNativeReader: %v", bs, err)
+		}
+		var names []string
+		for _, e := range dst.List("/etc") {
+			names = append(names, e.Name)
+		}
+		if strings.Join(names, " ") != "/etc/hostname /etc/init.d" {
+			t.Errorf("%d: /etc lists %q", bs, names)
+		}
+		if e, ok := dst.Get("/etc/init.d/rcS"); !ok || e.Mode != memfs.ModeFile|0o755 {
+			t.Errorf("%d: /etc/init.d/rcS = %+v", bs, e)
+		}
+		if e, ok := dst.Get("/var/big"); !ok || !bytes.Equal(e.Data, big) {
+			t.Errorf("%d: /var/big differs", bs)
+		}
+		if e, ok := dst.Get("/bin/sh"); !ok || e.Target != "busybox" {
+			t.Errorf("%d: /bin/sh = %+v", bs, e)
+		}
+	}
+}
+
+// extentNode builds an extent tree node of size bytes: a header and the
+// given 12-byte entries (leaf: logical, len, start; index: logical, child).
+func extentNode(size int, depth uint16, ents ...[3]uint32) []byte {
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint16(b[0:], extentMagic)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(ents)))
+	binary.LittleEndian.PutUint16(b[4:], uint16((size-12)/12))
+	binary.LittleEndian.PutUint16(b[6:], depth)
+	for i, e := range ents {
+		o := 12 + i*12
+		binary.LittleEndian.PutUint32(b[o:], e[0])
+		if depth > 0 {
+			binary.LittleEndian.PutUint32(b[o+4:], e[1])
+			continue
+		}
+		binary.LittleEndian.PutUint16(b[o+4:], uint16(e[1]))
+		binary.LittleEndian.PutUint32(b[o+8:], e[2])
+	}
+	return b
+}
+
+func TestWalkExtents(t *testing.T) {
+	const bs = 1024
+	// block 5 of the "disk" holds a leaf for the depth-1 case
+	disk := make([]byte, 8*bs)
+	copy(disk[5*bs:], extentNode(bs, 0, [3]uint32{0, 2, 100}, [3]uint32{2, 1, 200}))
+
+	for _, tc := range []struct {
+		name  string
+		root  []byte
+		limit int
+		want  []uint32
+		err   string
+	}{
+		{"hole", extentNode(60, 0, [3]uint32{0, 1, 10}, [3]uint32{3, 2, 20}), 5, []uint32{10, 0, 0, 20, 21}, ""},
+		{"uninitialized", extentNode(60, 0, [3]uint32{0, extentMaxLen + 2, 10}), 2, []uint32{0, 0}, ""},
+		{"index depth 1", extentNode(60, 1, [3]uint32{0, 5}), 3, []uint32{100, 101, 200}, ""},
+		{"cut at the size", extentNode(60, 0, [3]uint32{0, 8, 10}), 3, []uint32{10, 11, 12}, ""},
+		{"preallocated past the size", extentNode(60, 0, [3]uint32{0, 1, 10}, [3]uint32{4, extentMaxLen + 4, 30}), 1, []uint32{10}, ""},
+		{"logical block out of range", extentNode(60, 0, [3]uint32{0xfffffff0, 1, 10}), 4, nil, "past the inode size"},
+		{"bad magic", make([]byte, 60), 1, nil, "bad extent header"},
+	} {
+		var out []uint32
+		err := walkExtents(bytes.NewReader(disk), tc.root, bs, 0, tc.limit, &out)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !slices.Equal(out, tc.want) {
+			t.Errorf("%s: blocks %v, want %v", tc.name, out, tc.want)
+		}
+	}
+}
@@ -19,7 +19,7 @@ func mkfifo(path string, perm uint32) error {
 
 func mknod(path string, e *memfs.Entry, _, _ uint32) error {
 	_ = os.MkdirAll(filepath.Dir(path), 0o755)
-	return os.WriteFile(path, nil, os.FileMode(uint32(e.Mode)&0o7777))
+	return os.WriteFile(path, nil, os.FileMode(memfs.EffectivePerm(e)))
 }
 
 func uidOf(os.FileInfo) uint32            { return 0 }
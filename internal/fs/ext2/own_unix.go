@@ -17,7 +17,7 @@ func mkfifo(path string, perm uint32) error {
 }
 
 func mknod(path string, e *memfs.Entry, maj, min uint32) error {
-	mode := uint32(e.Mode) & 0o7777
+	mode := uint32(memfs.EffectivePerm(e))
 	t := uint32(syscall.S_IFCHR)
 	if e.Mode&memfs.ModeBlock != 0 {
 		t = syscall.S_IFBLK
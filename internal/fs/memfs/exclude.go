@@ -0,0 +1,48 @@
+package memfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Excluded reports whether rel, a slash-separated path relative to the
+// tree root, matches one of pats (path.Match syntax). A pattern without a
+// slash is tried against every path component, so ".git" and "*.o" apply
+// at any depth; one with a slash ("build/tmp", "/boot") is anchored at the
+// root. Everything below an excluded directory is excluded as well.
+func Excluded(rel string, pats []string) bool {
+	rel = strings.Trim(rel, "/")
+	if rel == "" || rel == "." {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for _, p := range pats {
+		anchored := strings.Contains(p, "/")
+		p = strings.Trim(p, "/")
+		if !anchored {
+			for _, c := range parts {
+				if ok, _ := path.Match(p, c); ok {
+					return true
+				}
+			}
+			continue
+		}
+		if n := strings.Count(p, "/") + 1; n <= len(parts) {
+			if ok, _ := path.Match(p, strings.Join(parts[:n], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckPatterns reports the first malformed pattern in pats.
+func CheckPatterns(pats []string) error {
+	for _, p := range pats {
+		if _, err := path.Match(strings.Trim(p, "/"), ""); err != nil {
+			return fmt.Errorf("exclude pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
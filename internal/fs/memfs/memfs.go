@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,8 +22,16 @@ const (
 	ModeFile  Mode = 0100000
 	ModeLink  Mode = 0120000
 	// perms come in lower 9 bits, e.g. 0755, 0644, etc.
+
+	// ModeType masks the file type bits. The type values overlap bitwise
+	// (block = dir|char, link = file|char), so compare Type() for equality
+	// instead of testing single bits when the exact type matters.
+	ModeType Mode = 0170000
 )
 
+// Type returns the file type bits of m.
+func (m Mode) Type() Mode { return m & ModeType }
+
 type Entry struct {
 	Name        string
 	Mode        Mode
@@ -32,13 +41,43 @@ type Entry struct {
 	Target      string // for symlinks
 	RdevMajor   uint32 // for char/block
 	RdevMinor   uint32 // for char/block
+	// Xattrs: extended attributes by full name ("security.capability").
+	// SetXattr replaces the map instead of changing it, so a copied Entry
+	// may share it.
+	Xattrs      map[string][]byte
 }
 
+// FS is safe for concurrent use: readers (Get/List/Walk/Snapshot/...) take
+// the read lock, mutators (Put*/Remove/WriteFile/...) the write lock.
+// Entries returned by Get/List/Walk point into the FS and must not be
+// modified without going through FS methods; use Snapshot for a detached copy.
 type FS struct {
-	m map[string]*Entry
+	mu  sync.RWMutex
+	m   map[string]*Entry
+	gen uint64 // bumped by every mutator
+}
+
+// Gen returns a counter that changes whenever the FS is modified, so callers
+// can tell whether anything happened since they last looked.
+func (fs *FS) Gen() uint64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.gen
+}
+
+func New() *FS { return &FS{m: newRoot()} }
+
+func newRoot() map[string]*Entry {
+	return map[string]*Entry{"/": {Name: "/", Mode: ModeDir | 0o755}}
 }
 
-func New() *FS { return &FS{m: map[string]*Entry{"/": {Name: "/", Mode: ModeDir | 0o755}}} }
+// Reset drops every entry, leaving an empty root directory.
+func (fs *FS) Reset() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	fs.m = newRoot()
+}
 
 func clean(p string) string {
 	if p == "" { return "/" }
@@ -50,6 +89,13 @@ func clean(p string) string {
 }
 
 func (fs *FS) MkdirAll(dir string, uid, gid uint32, mt time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	fs.mkdirAll(dir, uid, gid, mt)
+}
+
+func (fs *FS) mkdirAll(dir string, uid, gid uint32, mt time.Time) {
 	d := clean(dir)
 	parts := strings.Split(d, "/")[1:]
 	cur := ""
@@ -62,8 +108,11 @@ func (fs *FS) MkdirAll(dir string, uid, gid uint32, mt time.Time) {
 }
 
 func (fs *FS) PutFile(p string, data []byte, mode Mode, uid, gid uint32, mt time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
 	p = clean(p)
-	fs.MkdirAll(path.Dir(p), uid, gid, mt)
+	fs.mkdirAll(path.Dir(p), uid, gid, mt)
 	if mode&ModeFile == 0 && mode&ModeDir == 0 && mode&ModeLink == 0 {
 		mode |= ModeFile
 	}
@@ -74,38 +123,53 @@ func (fs *FS) PutFile(p string, data []byte, mode Mode, uid, gid uint32, mt time
 }
 
 func (fs *FS) PutDirMode(p string, mode Mode, uid, gid uint32, mt time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
 	p = clean(p)
-	fs.MkdirAll(p, uid, gid, mt)
+	fs.mkdirAll(p, uid, gid, mt)
 	if mode&ModeDir == 0 {
 		mode |= ModeDir
 	}
 	fs.m[p] = &Entry{Name: p, Mode: mode, UID: uid, GID: gid, MTime: mt}
 }
 
+// PutDir — for directories whose permissions are unknown (implicit parents,
+// host-side defaults): 0755. Loaders that read a mode use PutDirMode.
 func (fs *FS) PutDir(p string, uid, gid uint32, mt time.Time) {
 	fs.PutDirMode(p, ModeDir|0o755, uid, gid, mt)
 }
 
 func (fs *FS) PutSymlink(dst, target string, uid, gid uint32, mt time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
 	dst = clean(dst)
-	fs.MkdirAll(path.Dir(dst), uid, gid, mt)
+	fs.mkdirAll(path.Dir(dst), uid, gid, mt)
 	fs.m[dst] = &Entry{Name: dst, Mode: ModeLink | 0o777, UID: uid, GID: gid, MTime: mt, Target: target}
 }
 
 func (fs *FS) PutNode(dst string, typ Mode, perm uint32, uid, gid, major, minor uint32, mt time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
 	dst = clean(dst)
-	fs.MkdirAll(path.Dir(dst), uid, gid, mt)
+	fs.mkdirAll(path.Dir(dst), uid, gid, mt)
 	mode := typ | Mode(perm&0o7777)
 	fs.m[dst] = &Entry{Name: dst, Mode: mode, UID: uid, GID: gid, MTime: mt, RdevMajor: major, RdevMinor: minor}
 }
 
 func (fs *FS) Get(p string) (*Entry, bool) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	p = clean(p)
 	e, ok := fs.m[p]
 	return e, ok
 }
 
 func (fs *FS) List(dir string) []*Entry {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	dir = clean(dir)
 	if dir != "/" && !strings.HasSuffix(dir, "/") { dir += "/" }
 	var out []*Entry
@@ -120,17 +184,56 @@ func (fs *FS) List(dir string) []*Entry {
 	return out
 }
 
+// Walk visits entries in sorted path order. The key set is captured under the
+// read lock and fn runs unlocked, so fn may call back into the FS.
 func (fs *FS) Walk(fn func(*Entry) error) error {
+	fs.mu.RLock()
 	keys := make([]string, 0, len(fs.m))
 	for k := range fs.m { keys = append(keys, k) }
+	fs.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		fs.mu.RLock()
+		e := fs.m[k]
+		fs.mu.RUnlock()
+		if e == nil { continue }
+		if err := fn(e); err != nil { return err }
+	}
+	return nil
+}
+
+// WalkDir is Walk limited to root and the entries below it, root first.
+// Only the matching keys are collected and sorted, so a subtree walk costs
+// one key scan instead of a sort and a callback per entry of the image.
+func (fs *FS) WalkDir(root string, fn func(*Entry) error) error {
+	root = clean(root)
+	pfx := root + "/"
+	if root == "/" { pfx = "/" }
+	fs.mu.RLock()
+	if _, ok := fs.m[root]; !ok {
+		fs.mu.RUnlock()
+		return ErrNotExist
+	}
+	var keys []string
+	for k := range fs.m {
+		if k == root || strings.HasPrefix(k, pfx) { keys = append(keys, k) }
+	}
+	fs.mu.RUnlock()
 	sort.Strings(keys)
 	for _, k := range keys {
-		if err := fn(fs.m[k]); err != nil { return err }
+		fs.mu.RLock()
+		e := fs.m[k]
+		fs.mu.RUnlock()
+		if e == nil { continue }
+		if err := fn(e); err != nil { return err }
 	}
 	return nil
 }
 
 func (fs *FS) Remove(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
 	p = clean(p)
 	if p == "/" { return errors.New("cannot remove root") }
 	for k := range fs.m {
@@ -140,6 +243,8 @@ func (fs *FS) Remove(p string) error {
 }
 
 func (fs *FS) ReadFile(p string) ([]byte, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	p = clean(p)
 	if e, ok := fs.m[p]; ok && e.Mode&ModeFile != 0 {
 		return append([]byte(nil), e.Data...), nil
@@ -148,15 +253,106 @@ func (fs *FS) ReadFile(p string) ([]byte, error) {
 }
 
 func (fs *FS) WriteFile(p string, data []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
 	p = clean(p)
 	if e, ok := fs.m[p]; ok && e.Mode&ModeFile != 0 {
-		e.Data = append(e.Data[:0], data...)
+		// a fresh array: slices handed out before (Walk callbacks, Get) keep
+		// the old content instead of seeing it rewritten under them
+		e.Data = append([]byte(nil), data...)
 		return nil
 	}
 	return errors.New("not a file")
 }
 
+// Glob returns the sorted paths matching pattern (path.Match syntax; "*"
+// does not cross "/").
+func (fs *FS) Glob(pattern string) ([]string, error) {
+	pattern = clean(pattern)
+	if _, err := path.Match(pattern, "/"); err != nil {
+		return nil, err
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	var out []string
+	for k := range fs.m {
+		if ok, _ := path.Match(pattern, k); ok {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Chmod replaces the permission bits (including setuid/setgid/sticky) of p,
+// keeping its type.
+func (fs *FS) Chmod(p string, perm Mode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	e, ok := fs.m[clean(p)]
+	if !ok {
+		return ErrNotExist
+	}
+	e.Mode = e.Mode.Type() | perm&0o7777
+	return nil
+}
+
+// Chown sets the owner of p.
+func (fs *FS) Chown(p string, uid, gid uint32) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	e, ok := fs.m[clean(p)]
+	if !ok {
+		return ErrNotExist
+	}
+	e.UID, e.GID = uid, gid
+	return nil
+}
+
+// SetXattr sets the extended attribute name of p; a nil value removes it.
+func (fs *FS) SetXattr(p, name string, value []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	e, ok := fs.m[clean(p)]
+	if !ok {
+		return ErrNotExist
+	}
+	x := make(map[string][]byte, len(e.Xattrs)+1)
+	for k, v := range e.Xattrs {
+		x[k] = v
+	}
+	if value == nil {
+		delete(x, name)
+	} else {
+		x[name] = append([]byte{}, value...)
+	}
+	if len(x) == 0 {
+		x = nil
+	}
+	e.Xattrs = x
+	return nil
+}
+
+// Chtimes sets the mtime of p.
+func (fs *FS) Chtimes(p string, mt time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	e, ok := fs.m[clean(p)]
+	if !ok {
+		return ErrNotExist
+	}
+	e.MTime = mt
+	return nil
+}
+
 func (fs *FS) Snapshot() map[string]*Entry {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	out := make(map[string]*Entry, len(fs.m))
 	for k, v := range fs.m {
 		cpy := *v
@@ -167,6 +363,8 @@ func (fs *FS) Snapshot() map[string]*Entry {
 }
 
 func (fs *FS) HasFiles() bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	for _, v := range fs.m {
 		if v.Mode & ModeFile != 0 && len(v.Data) > 0 { return true }
 	}
@@ -174,7 +372,126 @@ func (fs *FS) HasFiles() bool {
 }
 
 func (fs *FS) CompareBytes(p string, b []byte) bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	e, ok := fs.m[clean(p)]
 	if !ok || e.Mode&ModeFile == 0 { return false }
 	return bytes.Equal(e.Data, b)
 }
+
+// ErrLoop is returned by ResolveLink when symlink resolution exceeds the hop
+// limit, which in practice means the links form a cycle (ELOOP).
+var ErrLoop = errors.New("memfs: too many levels of symbolic links")
+
+// ErrNotExist is returned by ResolveLink when a path component is missing,
+// including dangling symlink targets.
+var ErrNotExist = errors.New("memfs: no such file or directory")
+
+// DefaultMaxHops matches the Linux MAXSYMLINKS limit.
+const DefaultMaxHops = 40
+
+// ResolveLink resolves p following every symlink, including the final
+// component. Relative targets are interpreted against the directory holding
+// the link, absolute ones against the image root; ".." never climbs above
+// "/". The returned path is the fully resolved one. On ErrNotExist the path
+// of the missing component is returned together with a nil entry.
+func (fs *FS) ResolveLink(p string, maxHops int) (string, *Entry, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	cur := "/"
+	rest := splitPath(clean(p))
+	hops := 0
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			cur = path.Dir(cur)
+			continue
+		}
+		next := path.Join(cur, c)
+		e, ok := fs.m[next]
+		if !ok {
+			return next, nil, ErrNotExist
+		}
+		if e.Mode&ModeLink == 0 || e.Target == "" {
+			cur = next
+			continue
+		}
+		hops++
+		if hops > maxHops {
+			return next, e, ErrLoop
+		}
+		tgt := filepath.ToSlash(e.Target)
+		if strings.HasPrefix(tgt, "/") {
+			cur = "/"
+		}
+		rest = append(splitPath(tgt), rest...)
+	}
+	return cur, fs.m[cur], nil
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+// TypeName returns a human-readable name of the entry type.
+func (m Mode) TypeName() string {
+	switch m.Type() {
+	case ModeDir:
+		return "directory"
+	case ModeLink:
+		return "symbolic link"
+	case ModeChar:
+		return "character device"
+	case ModeBlock:
+		return "block device"
+	case ModeFIFO:
+		return "fifo"
+	default:
+		return "regular file"
+	}
+}
+
+// Symbolic renders m the way ls -l does, e.g. "drwxr-xr-x" or "-rwsr-xr-x".
+func (m Mode) Symbolic() string {
+	b := []byte("?rwxrwxrwx")
+	switch m.Type() {
+	case ModeDir:
+		b[0] = 'd'
+	case ModeLink:
+		b[0] = 'l'
+	case ModeChar:
+		b[0] = 'c'
+	case ModeBlock:
+		b[0] = 'b'
+	case ModeFIFO:
+		b[0] = 'p'
+	default:
+		b[0] = '-'
+	}
+	for i := 0; i < 9; i++ {
+		if m&(1<<uint(8-i)) == 0 {
+			b[i+1] = '-'
+		}
+	}
+	special := func(bit Mode, pos int, set, unset byte) {
+		if m&bit == 0 {
+			return
+		}
+		if b[pos] == '-' {
+			b[pos] = unset
+		} else {
+			b[pos] = set
+		}
+	}
+	special(0o4000, 3, 's', 'S')
+	special(0o2000, 6, 's', 'S')
+	special(0o1000, 9, 't', 'T')
+	return string(b)
+}
@@ -0,0 +1,179 @@
+package memfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var mt = time.Unix(1700000000, 0)
+
+// A slice taken from an entry before WriteFile keeps its content: the new
+// data goes into a fresh array, not over the old one.
+func TestWriteFileFreshCopy(t *testing.T) {
+	fs := New()
+	fs.PutFile("/etc/motd", []byte("hello"), 0o644, 0, 0, mt)
+	e, _ := fs.Get("/etc/motd")
+	old := e.Data
+	if err := fs.WriteFile("/etc/motd", []byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+	if string(old) != "hello" {
+		t.Errorf("old slice rewritten to %q", old)
+	}
+	buf := []byte("world")
+	if err := fs.WriteFile("/etc/motd", buf); err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 'W'
+	if b, _ := fs.ReadFile("/etc/motd"); string(b) != "world" {
+		t.Errorf("file aliases the caller's buffer: %q", b)
+	}
+	if err := fs.WriteFile("/etc", nil); err == nil {
+		t.Error("WriteFile on a directory succeeded")
+	}
+}
+
+// Run with -race: readers going through FS methods never see a torn file
+// while writers replace it.
+func TestConcurrentReadWrite(t *testing.T) {
+	fs := New()
+	a, b := bytes.Repeat([]byte("a"), 4096), bytes.Repeat([]byte("b"), 4096)
+	fs.PutFile("/f", a, 0o644, 0, 0, mt)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				data := a
+				if (i+w)%2 == 0 {
+					data = b
+				}
+				if err := fs.WriteFile("/f", data); err != nil {
+					t.Error(err)
+					return
+				}
+				fs.PutFile(fmt.Sprintf("/d%d/%d", w, i), data, 0o644, 0, 0, mt)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				got, err := fs.ReadFile("/f")
+				if err != nil || !bytes.Equal(got, a) && !bytes.Equal(got, b) {
+					t.Errorf("ReadFile: torn data (%v)", err)
+					return
+				}
+				if e := fs.Snapshot()["/f"]; !bytes.Equal(e.Data, a) && !bytes.Equal(e.Data, b) {
+					t.Error("Snapshot: torn data")
+					return
+				}
+				_ = fs.Walk(func(e *Entry) error { return nil })
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestResolveLink(t *testing.T) {
+	fs := New()
+	fs.PutFile("/bin/busybox", []byte("\x7fELF"), 0o755, 0, 0, mt)
+	fs.PutSymlink("/bin/sh", "busybox", 0, 0, mt)
+	fs.PutSymlink("/usr/bin/sh", "../../bin/sh", 0, 0, mt)
+	fs.PutSymlink("/sbin", "/bin", 0, 0, mt)
+	fs.PutSymlink("/up", "../../../bin/busybox", 0, 0, mt)
+	fs.PutSymlink("/loop/a", "b", 0, 0, mt)
+	fs.PutSymlink("/loop/b", "a", 0, 0, mt)
+	fs.PutSymlink("/dangling", "/nowhere/x", 0, 0, mt)
+
+	for _, tc := range []struct{ p, want string }{
+		{"/bin/sh", "/bin/busybox"},
+		{"/usr/bin/sh", "/bin/busybox"},
+		{"/sbin/sh", "/bin/busybox"},
+		{"/up", "/bin/busybox"}, // ".." stops at the root
+		{"bin/../bin/./sh", "/bin/busybox"},
+	} {
+		got, e, err := fs.ResolveLink(tc.p, 0)
+		if err != nil || got != tc.want || e == nil || e.Name != tc.want {
+			t.Errorf("%s: %q, %v, %v; want %q", tc.p, got, e, err, tc.want)
+		}
+	}
+
+	if got, e, err := fs.ResolveLink("/dangling", 0); !errors.Is(err, ErrNotExist) || got != "/nowhere" || e != nil {
+		t.Errorf("dangling: %q, %v, %v", got, e, err)
+	}
+	if got, _, err := fs.ResolveLink("/loop/a", 0); !errors.Is(err, ErrLoop) || !strings.HasPrefix(got, "/loop/") {
+		t.Errorf("loop: %q, %v", got, err)
+	}
+}
+
+// A chain of n links resolves with maxHops n and fails with n-1; maxHops 0
+// means DefaultMaxHops.
+func TestResolveLinkDepth(t *testing.T) {
+	const n = DefaultMaxHops + 5
+	fs := New()
+	fs.PutFile("/end", nil, 0o644, 0, 0, mt)
+	for i := 0; i < n; i++ {
+		tgt := fmt.Sprintf("l%d", i+1)
+		if i == n-1 {
+			tgt = "end"
+		}
+		fs.PutSymlink(fmt.Sprintf("/l%d", i), tgt, 0, 0, mt)
+	}
+	if got, _, err := fs.ResolveLink("/l0", n); err != nil || got != "/end" {
+		t.Errorf("maxHops %d: %q, %v", n, got, err)
+	}
+	if _, _, err := fs.ResolveLink("/l0", n-1); !errors.Is(err, ErrLoop) {
+		t.Errorf("maxHops %d: %v, want ErrLoop", n-1, err)
+	}
+	if _, _, err := fs.ResolveLink("/l0", 0); !errors.Is(err, ErrLoop) {
+		t.Errorf("default maxHops: %v, want ErrLoop", err)
+	}
+	if got, _, err := fs.ResolveLink(fmt.Sprintf("/l%d", n-DefaultMaxHops), 0); err != nil || got != "/end" {
+		t.Errorf("%d hops with the default: %q, %v", DefaultMaxHops, got, err)
+	}
+}
+
+func TestWalkDirOrder(t *testing.T) {
+	fs := New()
+	for _, p := range []string{"/usr/lib/z", "/usr/bin/b", "/usr/bin/a", "/usrx/f", "/usr.d/f", "/etc/hosts"} {
+		fs.PutFile(p, nil, 0o644, 0, 0, mt)
+	}
+	walk := func(root string) (string, error) {
+		var got []string
+		err := fs.WalkDir(root, func(e *Entry) error {
+			got = append(got, e.Name)
+			return nil
+		})
+		return strings.Join(got, " "), err
+	}
+	if got, err := walk("/usr"); err != nil || got != "/usr /usr/bin /usr/bin/a /usr/bin/b /usr/lib /usr/lib/z" {
+		t.Errorf("/usr: %q, %v", got, err)
+	}
+	if got, _ := walk("/"); !strings.HasPrefix(got, "/ /etc /etc/hosts /usr ") || strings.Count(got, " ")+1 != 13 {
+		t.Errorf("/: %q", got)
+	}
+	if got, err := walk("/usr/bin/a"); err != nil || got != "/usr/bin/a" {
+		t.Errorf("file root: %q, %v", got, err)
+	}
+	if _, err := walk("/nope"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("missing root: %v", err)
+	}
+	stop := errors.New("stop")
+	n := 0
+	err := fs.WalkDir("/usr", func(e *Entry) error {
+		n++
+		if e.Name == "/usr/bin" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Errorf("error from fn: %v after %d entries", err, n)
+	}
+}
@@ -0,0 +1,54 @@
+package memfs
+
+import "os"
+
+// PermOf maps the permission and setuid/setgid/sticky bits of a host
+// os.FileMode to memfs bits; the file type is left to the caller.
+func PermOf(m os.FileMode) Mode {
+	p := Mode(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		p |= 0o4000
+	}
+	if m&os.ModeSetgid != 0 {
+		p |= 0o2000
+	}
+	if m&os.ModeSticky != 0 {
+		p |= 0o1000
+	}
+	return p
+}
+
+// EffectivePerm is the permission part of e.Mode that writers emit. Entries
+// built without any permission bits (a bare type, e.g. from an API caller)
+// get 0755 for directories, 0777 for symlinks and 0644 otherwise, so no
+// output format ends up with unreadable mode-0000 files.
+func EffectivePerm(e *Entry) Mode {
+	if p := e.Mode & 0o7777; p != 0 {
+		return p
+	}
+	switch e.Mode.Type() {
+	case ModeDir:
+		return 0o755
+	case ModeLink:
+		return 0o777
+	}
+	return 0o644
+}
+
+// HostMode is EffectivePerm(e) as an os.FileMode, the inverse of PermOf:
+// 04000/02000/01000 become os.ModeSetuid/ModeSetgid/ModeSticky, since
+// os.Chmod and os.OpenFile ignore the raw bits.
+func HostMode(e *Entry) os.FileMode {
+	p := EffectivePerm(e)
+	m := os.FileMode(p & 0o777)
+	if p&0o4000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if p&0o2000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if p&0o1000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
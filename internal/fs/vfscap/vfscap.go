@@ -0,0 +1,258 @@
+// Package vfscap encodes and decodes file capabilities: the value of the
+// security.capability xattr (struct vfs_cap_data / vfs_ns_cap_data in
+// linux/capability.h) and the text form setcap(8) and getcap(8) use.
+package vfscap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// XattrName is the extended attribute that holds file capabilities.
+const XattrName = "security.capability"
+
+const (
+	revisionMask  = 0xff000000
+	revision1     = 0x01000000 // 32-bit sets
+	revision2     = 0x02000000 // 64-bit sets
+	revision3     = 0x03000000 // revision 2 plus the namespace root UID
+	flagEffective = 0x000001
+
+	size1 = 4 + 2*4
+	size2 = 4 + 2*2*4
+	size3 = size2 + 4
+)
+
+// names: the capabilities by number, as in linux/capability.h.
+var names = []string{
+	"cap_chown", "cap_dac_override", "cap_dac_read_search", "cap_fowner", "cap_fsetid",
+	"cap_kill", "cap_setgid", "cap_setuid", "cap_setpcap", "cap_linux_immutable",
+	"cap_net_bind_service", "cap_net_broadcast", "cap_net_admin", "cap_net_raw", "cap_ipc_lock",
+	"cap_ipc_owner", "cap_sys_module", "cap_sys_rawio", "cap_sys_chroot", "cap_sys_ptrace",
+	"cap_sys_pacct", "cap_sys_admin", "cap_sys_boot", "cap_sys_nice", "cap_sys_resource",
+	"cap_sys_time", "cap_sys_tty_config", "cap_mknod", "cap_lease", "cap_audit_write",
+	"cap_audit_control", "cap_setfcap", "cap_mac_override", "cap_mac_admin", "cap_syslog",
+	"cap_wake_alarm", "cap_block_suspend", "cap_audit_read", "cap_perfmon", "cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+// all: every capability in names ("all" and a bare "=" in the text form).
+var all = uint64(1)<<len(names) - 1
+
+// Set is one file's capabilities. The effective set of a file is a single
+// bit: when it is on, the permitted capabilities are raised at exec.
+type Set struct {
+	Permitted   uint64
+	Inheritable uint64
+	Effective   bool
+	// RootID: the user namespace root the capabilities apply to (revision
+	// 3); 0 for the initial namespace.
+	RootID uint32
+}
+
+// Parse reads the setcap(8) text form: space-separated clauses of a comma
+// list of capabilities ("all", or none before "=" for every capability)
+// followed by operations: "=" sets the listed flags and clears the others,
+// "+" adds flags, "-" drops them; the flags are e, i and p. For example
+// "cap_net_bind_service=ep" or "cap_net_raw,cap_net_admin+ep".
+func Parse(text string) (Set, error) {
+	var perm, inh, eff uint64
+	for _, clause := range strings.Fields(text) {
+		i := strings.IndexAny(clause, "=+-")
+		if i < 0 {
+			return Set{}, fmt.Errorf("%q: want capabilities followed by =, + or - and flags", clause)
+		}
+		var mask uint64
+		if i == 0 {
+			if clause[0] != '=' {
+				return Set{}, fmt.Errorf("%q: no capabilities before %c", clause, clause[0])
+			}
+			mask = all
+		} else {
+			for _, n := range strings.Split(clause[:i], ",") {
+				c, err := lookup(n)
+				if err != nil {
+					return Set{}, err
+				}
+				mask |= c
+			}
+		}
+		for ops := clause[i:]; ops != ""; {
+			op, j := ops[0], 1
+			for j < len(ops) && !strings.ContainsRune("=+-", rune(ops[j])) {
+				j++
+			}
+			flags := ops[1:j]
+			ops = ops[j:]
+			if op == '=' {
+				perm, inh, eff = perm&^mask, inh&^mask, eff&^mask
+				op = '+'
+			}
+			for _, f := range flags {
+				var set *uint64
+				switch f {
+				case 'e':
+					set = &eff
+				case 'i':
+					set = &inh
+				case 'p':
+					set = &perm
+				default:
+					return Set{}, fmt.Errorf("%q: unknown flag %q (want e, i or p)", clause, f)
+				}
+				if op == '+' {
+					*set |= mask
+				} else {
+					*set &^= mask
+				}
+			}
+		}
+	}
+	// the file has one effective bit, not a set
+	if eff != 0 && eff != perm|inh {
+		return Set{}, fmt.Errorf("%q: the effective flag must be on for all or none of the permitted and inheritable capabilities", text)
+	}
+	return Set{Permitted: perm, Inheritable: inh, Effective: eff != 0}, nil
+}
+
+// lookup returns the bit of capability name: a name from
+// linux/capability.h with or without "cap_", "all", or a number.
+func lookup(name string) (uint64, error) {
+	name = strings.ToLower(name)
+	if name == "all" {
+		return all, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= 0 && n < 64 {
+		return 1 << n, nil
+	}
+	if !strings.HasPrefix(name, "cap_") {
+		name = "cap_" + name
+	}
+	for i, n := range names {
+		if n == name {
+			return 1 << i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capability %q", name)
+}
+
+// String renders s the way getcap(8) prints it: capabilities with the
+// same flags grouped, "cap_net_raw=ep", "=ep" for all of them. RootID,
+// when set, follows as " [rootid=N]".
+func (s Set) String() string {
+	// the flags of each capability: e, i, p as bits 4, 2, 1
+	var groups [8]uint64
+	for c := 0; c < 64; c++ {
+		bit := uint64(1) << c
+		f := 0
+		if s.Effective && (s.Permitted|s.Inheritable)&bit != 0 {
+			f |= 4
+		}
+		if s.Inheritable&bit != 0 {
+			f |= 2
+		}
+		if s.Permitted&bit != 0 {
+			f |= 1
+		}
+		groups[f] |= bit
+	}
+	var clauses []string
+	for f := 1; f < 8; f++ {
+		if groups[f] == 0 {
+			continue
+		}
+		flags := ""
+		for i, c := range "eip" {
+			if f&(4>>i) != 0 {
+				flags += string(c)
+			}
+		}
+		clauses = append(clauses, capList(groups[f])+"="+flags)
+	}
+	out := strings.Join(clauses, " ")
+	if out == "" {
+		out = "="
+	}
+	if s.RootID != 0 {
+		out += fmt.Sprintf(" [rootid=%d]", s.RootID)
+	}
+	return out
+}
+
+// capList names the capabilities in mask, "" for all of them.
+func capList(mask uint64) string {
+	if mask == all {
+		return ""
+	}
+	var l []string
+	for c := 0; c < 64; c++ {
+		if mask&(1<<c) == 0 {
+			continue
+		}
+		if c < len(names) {
+			l = append(l, names[c])
+		} else {
+			l = append(l, strconv.Itoa(c))
+		}
+	}
+	return strings.Join(l, ",")
+}
+
+// Encode returns the xattr value: revision 2, or revision 3 when RootID
+// is set.
+func Encode(s Set) []byte {
+	magic, n := uint32(revision2), size2
+	if s.RootID != 0 {
+		magic, n = revision3, size3
+	}
+	if s.Effective {
+		magic |= flagEffective
+	}
+	b := make([]byte, n)
+	binary.LittleEndian.PutUint32(b, magic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(s.Permitted))
+	binary.LittleEndian.PutUint32(b[8:], uint32(s.Inheritable))
+	binary.LittleEndian.PutUint32(b[12:], uint32(s.Permitted>>32))
+	binary.LittleEndian.PutUint32(b[16:], uint32(s.Inheritable>>32))
+	if s.RootID != 0 {
+		binary.LittleEndian.PutUint32(b[20:], s.RootID)
+	}
+	return b
+}
+
+// Decode parses an xattr value of revision 1, 2 or 3.
+func Decode(b []byte) (Set, error) {
+	if len(b) < 4 {
+		return Set{}, fmt.Errorf("capability xattr of %d bytes", len(b))
+	}
+	magic := binary.LittleEndian.Uint32(b)
+	want := 0
+	switch magic & revisionMask {
+	case revision1:
+		want = size1
+	case revision2:
+		want = size2
+	case revision3:
+		want = size3
+	default:
+		return Set{}, fmt.Errorf("unknown capability xattr revision %#x", magic&revisionMask)
+	}
+	if len(b) != want {
+		return Set{}, fmt.Errorf("capability xattr revision %d has %d bytes, want %d", magic>>24, len(b), want)
+	}
+	s := Set{
+		Permitted:   uint64(binary.LittleEndian.Uint32(b[4:])),
+		Inheritable: uint64(binary.LittleEndian.Uint32(b[8:])),
+		Effective:   magic&flagEffective != 0,
+	}
+	if want >= size2 {
+		s.Permitted |= uint64(binary.LittleEndian.Uint32(b[12:])) << 32
+		s.Inheritable |= uint64(binary.LittleEndian.Uint32(b[16:])) << 32
+	}
+	if want == size3 {
+		s.RootID = binary.LittleEndian.Uint32(b[20:])
+	}
+	return s, nil
+}
@@ -0,0 +1,61 @@
+package vfscap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseString(t *testing.T) {
+	for _, tc := range []struct{ in, out string }{
+		{"cap_net_bind_service=ep", "cap_net_bind_service=ep"},
+		{"cap_net_raw,cap_net_admin+ep", "cap_net_admin,cap_net_raw=ep"},
+		{"CAP_NET_RAW+p", "cap_net_raw=p"},
+		{"net_raw=p cap_sys_nice+i", "cap_net_raw=p cap_sys_nice=i"},
+		{"all=ep", "=ep"},
+		{"=ep cap_sys_admin-ep", "cap_chown,cap_dac_override,cap_dac_read_search,cap_fowner,cap_fsetid,cap_kill,cap_setgid,cap_setuid,cap_setpcap,cap_linux_immutable,cap_net_bind_service,cap_net_broadcast,cap_net_admin,cap_net_raw,cap_ipc_lock,cap_ipc_owner,cap_sys_module,cap_sys_rawio,cap_sys_chroot,cap_sys_ptrace,cap_sys_pacct,cap_sys_boot,cap_sys_nice,cap_sys_resource,cap_sys_time,cap_sys_tty_config,cap_mknod,cap_lease,cap_audit_write,cap_audit_control,cap_setfcap,cap_mac_override,cap_mac_admin,cap_syslog,cap_wake_alarm,cap_block_suspend,cap_audit_read,cap_perfmon,cap_bpf,cap_checkpoint_restore=ep"},
+		{"cap_chown=", "="},
+	} {
+		s, err := Parse(tc.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.in, err)
+		}
+		if got := s.String(); got != tc.out {
+			t.Errorf("%q: %q, want %q", tc.in, got, tc.out)
+		}
+	}
+	for _, bad := range []string{"cap_nope=ep", "cap_chown", "+ep", "cap_chown=x", "cap_chown=p cap_kill=ep"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	s, err := Parse("cap_net_bind_service,cap_bpf=ep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// setcap cap_net_bind_service,cap_bpf=ep: revision 2, effective
+	want := []byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	b := Encode(s)
+	if !bytes.Equal(b, want) {
+		t.Fatalf("% x, want % x", b, want)
+	}
+	for _, in := range []Set{s, {Permitted: 1 << 13, Inheritable: 1, RootID: 1000}} {
+		got, err := Decode(Encode(in))
+		if err != nil || got != in {
+			t.Errorf("%+v: decoded %+v, %v", in, got, err)
+		}
+	}
+	v1 := []byte{0x01, 0x00, 0x00, 0x01, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if got, err := Decode(v1); err != nil || got.String() != "cap_net_raw=ep" {
+		t.Errorf("revision 1: %v, %v", got, err)
+	}
+	if _, err := Decode(want[:16]); err == nil {
+		t.Error("short revision 2: no error")
+	}
+}
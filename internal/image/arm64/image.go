@@ -0,0 +1,77 @@
+// Package arm64 reads the 64-byte header of a bare arm64 Linux kernel
+// Image (Documentation/arch/arm64/booting.rst).
+package arm64
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"goimagetool/internal/common"
+)
+
+// Magic is "ARM\x64" at offset 56, little-endian.
+const Magic = 0x644d5241
+
+// HeaderSize: code0/code1, text_offset, image_size, flags, res2-4, magic, res5.
+const HeaderSize = 64
+
+// defaultTextOffset: ядра до 3.17 пишут image_size = 0, и тогда text_offset
+// по booting.rst считается равным 0x80000.
+const defaultTextOffset = 0x80000
+
+// Header holds the fields a boot loader needs.
+type Header struct {
+	TextOffset uint64 // image load offset from a 2 MiB aligned base
+	ImageSize  uint64 // effective size incl. bss; 0 on kernels before 3.17
+	Flags      uint64
+}
+
+// IsImage reports whether b starts with an arm64 Image header.
+func IsImage(b []byte) bool {
+	return len(b) >= HeaderSize && binary.LittleEndian.Uint32(b[56:]) == Magic
+}
+
+// Parse decodes the header at the start of b.
+func Parse(b []byte) (*Header, error) {
+	if len(b) < HeaderSize {
+		return nil, common.TooSmall("arm64", "an arm64 Image", int64(len(b)), HeaderSize)
+	}
+	if m := binary.LittleEndian.Uint32(b[56:]); m != Magic {
+		return nil, common.Corrupt("arm64", 56, fmt.Sprintf("bad magic %#x", m))
+	}
+	h := &Header{
+		TextOffset: binary.LittleEndian.Uint64(b[8:]),
+		ImageSize:  binary.LittleEndian.Uint64(b[16:]),
+		Flags:      binary.LittleEndian.Uint64(b[24:]),
+	}
+	if h.ImageSize == 0 {
+		h.TextOffset = defaultTextOffset
+	}
+	return h, nil
+}
+
+// BigEndian: flags bit 0, the kernel's endianness.
+func (h *Header) BigEndian() bool { return h.Flags&1 != 0 }
+
+// PageSize: flags bits 1-2; 0 when the kernel does not say.
+func (h *Header) PageSize() int {
+	return [4]int{0, 4 << 10, 16 << 10, 64 << 10}[h.Flags>>1&3]
+}
+
+// PlaceAnywhere: flags bit 3; otherwise the base must be as close as
+// possible to the start of DRAM.
+func (h *Header) PlaceAnywhere() bool { return h.Flags&8 != 0 }
+
+// LoadAddr is where the Image goes for a 2 MiB aligned base.
+func (h *Header) LoadAddr(base uint64) uint64 { return base + h.TextOffset }
+
+func (h *Header) String() string {
+	endian, page := "little-endian", "unspecified"
+	if h.BigEndian() {
+		endian = "big-endian"
+	}
+	if p := h.PageSize(); p != 0 {
+		page = fmt.Sprintf("%dK", p>>10)
+	}
+	return fmt.Sprintf("arm64 Image: text_offset=0x%x image_size=%d %s page=%s", h.TextOffset, h.ImageSize, endian, page)
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -48,15 +49,21 @@ func parseHex(b []byte) (uint32, error) {
 	return out, nil
 }
 
-func readHeader(r io.Reader) (*header, error) {
+// readHeader: base — смещение заголовка в архиве, только для ошибок.
+func readHeader(r io.Reader, base int64) (*header, error) {
 	buf := make([]byte, 110)
-	if _, err := io.ReadFull(r, buf); err != nil { return nil, err }
+	if _, err := io.ReadFull(r, buf); err != nil { return nil, common.WrapAt("cpio", base, err) }
 	h := &header{Magic: string(buf[:6])}
 	if h.Magic != "070701" && h.Magic != "070702" {
-		return nil, fmt.Errorf("unsupported cpio magic: %q", h.Magic)
+		return nil, common.Corrupt("cpio", base, fmt.Sprintf("bad header magic %q", h.Magic))
 	}
 	off := 6
-	get := func(n int) (uint32, error) { v, e := parseHex(buf[off:off+n]); off += n; return v, e }
+	get := func(n int) (uint32, error) {
+		v, e := parseHex(buf[off:off+n])
+		if e != nil { e = common.Corrupt("cpio", base+int64(off), "bad header: "+e.Error()) }
+		off += n
+		return v, e
+	}
 	var err error
 	if h.Ino, err = get(8); err != nil { return nil, err }
 	if h.Mode, err = get(8); err != nil { return nil, err }
@@ -76,34 +83,162 @@ func readHeader(r io.Reader) (*header, error) {
 
 func pad4(n uint64) uint64 { return common.AlignUp(n, 4) }
 
+// LoadNewc reads every archive in r, not just the first: after a trailer it
+// skips the zero padding (to 4 or 512 bytes) and continues with the next
+// one until EOF, merging all entries into one FS. Compressed data after an
+// archive is not decoded; LoadSegments takes a decoder for that.
 func LoadNewc(r io.Reader) (*memfs.FS, error) {
+	b, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+	fs, _, err := LoadSegments(b, nil)
+	return fs, err
+}
+
+// LoadNewcInto reads one archive into fs (later entries replace earlier
+// ones, as the kernel unpacker does) and returns its length up to and
+// including the TRAILER!!! record, so the caller can look past it.
+func LoadNewcInto(fs *memfs.FS, r io.Reader) (int64, error) {
 	br := bufio.NewReader(r)
-	fs := memfs.New()
+	if b, _ := br.Peek(110); len(b) < 110 { return 0, common.TooSmall("cpio", "a cpio archive", int64(len(b)), 110) }
+	// off — начало текущей записи; prev — последняя прочитанная запись (для
+	// ошибок в заголовке, когда имя следующей ещё неизвестно)
+	var off int64
+	prev := ""
 	for {
-		h, err := readHeader(br); if err != nil { return nil, err }
+		h, err := readHeader(br, off); if err != nil { return 0, common.WithPath("cpio", prev, err) }
 		nameBytes := make([]byte, h.NameSize)
-		if _, err := io.ReadFull(br, nameBytes); err != nil { return nil, err }
+		if _, err := io.ReadFull(br, nameBytes); err != nil { return 0, common.WithPath("cpio", prev, common.WrapAt("cpio", off+110, err)) }
 		name := strings.TrimRight(string(nameBytes), "\x00")
 		namePad := int(pad4(uint64(110 + h.NameSize)) - uint64(110+h.NameSize))
-		if namePad > 0 { if _, err := io.CopyN(io.Discard, br, int64(namePad)); err != nil { return nil, err } }
-		if name == "TRAILER!!!" { break }
+		if namePad > 0 { if _, err := io.CopyN(io.Discard, br, int64(namePad)); err != nil { return 0, common.WithPath("cpio", name, common.WrapAt("cpio", off+110, err)) } }
+		if name == "TRAILER!!!" { return off + 110 + int64(h.NameSize) + int64(namePad), nil }
+		if err := common.CheckEntryName(name); err != nil { return 0, fmt.Errorf("cpio entry %q: %w", name, err) }
+		if err := common.CheckSize("cpio entry "+name, int64(h.FileSize)); err != nil { return 0, err }
+		dataOff := off + 110 + int64(h.NameSize) + int64(namePad)
 		data := make([]byte, h.FileSize)
-		if _, err := io.ReadFull(br, data); err != nil { return nil, err }
+		if _, err := io.ReadFull(br, data); err != nil { return 0, common.WithPath("cpio", name, common.WrapAt("cpio", dataOff, err)) }
 		datPad := int(pad4(uint64(h.FileSize)) - uint64(h.FileSize))
-		if datPad > 0 { if _, err := io.CopyN(io.Discard, br, int64(datPad)); err != nil { return nil, err } }
+		if datPad > 0 { if _, err := io.CopyN(io.Discard, br, int64(datPad)); err != nil { return 0, common.WithPath("cpio", name, common.WrapAt("cpio", dataOff, err)) } }
+		off = dataOff + int64(h.FileSize) + int64(datPad)
+		prev = name
 		modeType := memfs.Mode(h.Mode & 0170000)
 		if modeType == memfs.ModeDir {
-			fs.PutDir(name, h.UID, h.GID, time.Unix(int64(h.MTime), 0))
+			fs.PutDirMode(name, memfs.Mode(h.Mode), h.UID, h.GID, time.Unix(int64(h.MTime), 0))
 		} else {
 			fs.PutFile(name, data, memfs.Mode(h.Mode), h.UID, h.GID, time.Unix(int64(h.MTime), 0))
 		}
 	}
-	return fs, nil
 }
 
-func StoreNewc(w io.Writer, fs *memfs.FS) error {
-	bw := bufio.NewWriter(w)
+// IsNewc reports whether b starts with a newc (070701) or crc (070702) header.
+func IsNewc(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("070701")) || bytes.HasPrefix(b, []byte("070702"))
+}
+
+// LoadSegments parses an initramfs the way the kernel unpacker does:
+// archives one after another with zero padding between them, e.g. the
+// uncompressed early-microcode cpio in front of the compressed main one.
+// Data that is not a cpio header goes to decode, which returns ok=false if
+// it is not compressed either; the decoded bytes must be archives too.
+// raw is the archives back to back, padding and compression removed.
+func LoadSegments(b []byte, decode func(rest []byte) (out []byte, ok bool, err error)) (fs *memfs.FS, raw []byte, err error) {
+	fs = memfs.New()
+	var walk func(b []byte, decode func([]byte) ([]byte, bool, error)) error
+	walk = func(b []byte, decode func([]byte) ([]byte, bool, error)) error {
+		for first := true; ; first = false {
+			if !first {
+				b = bytes.TrimLeft(b, "\x00")
+				if len(b) == 0 { return nil }
+			}
+			if !IsNewc(b) {
+				if decode != nil {
+					out, ok, err := decode(b)
+					if err != nil { return err }
+					// the codec reads every concatenated member, so this is the last segment
+					if ok { return walk(out, nil) }
+				}
+				// trailing data after an archive has always been ignored
+				if !first { return nil }
+			}
+			n, err := LoadNewcInto(fs, bytes.NewReader(b))
+			if err != nil { return err }
+			raw = append(raw, b[:n]...)
+			b = b[n:]
+		}
+	}
+	if err := walk(b, decode); err != nil { return nil, nil, err }
+	return fs, raw, nil
+}
+
+// StoreOptions tunes StoreNewcWith.
+type StoreOptions struct {
+	// Order: glob patterns (memfs.Glob syntax) emitted first, pattern by
+	// pattern; the rest follows in sorted order. Parent dirs of a listed
+	// entry are emitted right before it, since the kernel unpacker does not
+	// create them.
+	Order []string
+	// Exclude: entries matching memfs.Excluded are left out; the FS is not touched.
+	Exclude []string
+	// Prepend: archive(s) written as is before this one, zero-padded to a
+	// 4-byte boundary (the kernel only looks for a cpio header there), e.g.
+	// the early microcode cpio. A compressing caller writes it uncompressed.
+	Prepend []byte
+	// Pad512: zeros after the trailer up to a 512-byte boundary of the
+	// output, as `find | cpio -H newc` writes it; the kernel needs only 4.
+	Pad512 bool
+	// ZeroIno: inode 0 on every entry, for consumers that expect it. By
+	// default entries are numbered 1, 2, ... in path order, whatever Order
+	// says, so the same tree always gets the same numbers.
+	ZeroIno bool
+}
+
+// PadArchive returns b zero-padded to the 4-byte boundary that the next
+// concatenated archive must start on.
+func PadArchive(b []byte) []byte {
+	return append(b[:len(b):len(b)], make([]byte, pad4(uint64(len(b)))-uint64(len(b)))...)
+}
+
+// ReadOrderFile reads one pattern per line; blank lines and '#' comments are skipped.
+func ReadOrderFile(r io.Reader) ([]string, error) {
+	var out []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") { continue }
+		out = append(out, l)
+	}
+	return out, sc.Err()
+}
+
+func StoreNewc(w io.Writer, fs *memfs.FS) error { return StoreNewcWith(w, fs, StoreOptions{}) }
+
+func orderEntries(fs *memfs.FS, order []string) ([]*memfs.Entry, error) {
+	var files []*memfs.Entry
+	seen := map[string]bool{"/": true}
+	add := func(p string) {
+		if seen[p] { return }
+		if e, ok := fs.Get(p); ok { seen[p] = true; files = append(files, e) }
+	}
+	for _, pat := range order {
+		matches, err := fs.Glob(pat)
+		if err != nil { return nil, fmt.Errorf("order pattern %q: %w", pat, err) }
+		for _, m := range matches {
+			parts := strings.Split(strings.TrimPrefix(m, "/"), "/")
+			for i := 1; i < len(parts); i++ { add("/" + strings.Join(parts[:i], "/")) }
+			add(m)
+		}
+	}
+	_ = fs.Walk(func(e *memfs.Entry) error { if !seen[e.Name] { files = append(files, e) }; return nil })
+	return files, nil
+}
+
+func StoreNewcWith(w io.Writer, fs *memfs.FS, opt StoreOptions) error {
+	files, err := orderEntries(fs, opt.Order)
+	if err != nil { return err }
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
 	defer bw.Flush()
+	if len(opt.Prepend) > 0 { if _, err := bw.Write(PadArchive(opt.Prepend)); err != nil { return err } }
 	writeHex := func(v uint32, n int) { fmt.Fprintf(bw, "%0*X", n, v) }
 	writeHeader := func(h *header, name string) error {
 		if _, err := bw.WriteString("070701"); err != nil { return err }
@@ -117,22 +252,20 @@ func StoreNewc(w io.Writer, fs *memfs.FS) error {
 		if pad > 0 { _, _ = bw.Write(bytes.Repeat([]byte{0}, pad)) }
 		return nil
 	}
-	var files []*memfs.Entry
-	_ = fs.Walk(func(e *memfs.Entry) error { if e.Name != "/" { files = append(files, e) }; return nil })
+	ino := inodeNumbers(files, opt)
 	for _, e := range files {
 		name := strings.TrimPrefix(e.Name, "/")
-		if name == "" { continue }
+		if name == "" || memfs.Excluded(name, opt.Exclude) { continue }
 		h := &header{
-			Ino: 0, UID: e.UID, GID: e.GID, NLink: 1, MTime: uint32(e.MTime.Unix()),
+			Ino: ino[e.Name], UID: e.UID, GID: e.GID, NLink: 1, MTime: uint32(e.MTime.Unix()),
 			DevMajor: 0, DevMinor: 0, RDevMajor: 0, RDevMinor: 0,
 			NameSize: uint32(len(name) + 1),
 		}
-		if e.Mode & memfs.ModeDir != 0 {
-			h.Mode = uint32(memfs.ModeDir | 0755)
+		h.Mode = uint32(e.Mode.Type() | memfs.EffectivePerm(e))
+		if e.Mode.Type() == memfs.ModeDir {
 			h.FileSize = 0
 			if err := writeHeader(h, name); err != nil { return err }
 		} else {
-			h.Mode = uint32(e.Mode)
 			h.FileSize = uint32(len(e.Data))
 			if err := writeHeader(h, name); err != nil { return err }
 			if _, err := bw.Write(e.Data); err != nil { return err }
@@ -142,5 +275,36 @@ func StoreNewc(w io.Writer, fs *memfs.FS) error {
 	}
 	tr := &header{ NameSize: uint32(len("TRAILER!!!")+1) }
 	if err := writeHeader(tr, "TRAILER!!!"); err != nil { return err }
+	if opt.Pad512 {
+		n := uint64(cw.n) + uint64(bw.Buffered())
+		if _, err := bw.Write(make([]byte, common.AlignUp(n, 512)-n)); err != nil { return err }
+	}
 	return nil
 }
+
+// inodeNumbers numbers the stored entries in path order (nil map with
+// ZeroIno). memfs has no hard links, so every entry is its own inode with
+// one link.
+func inodeNumbers(files []*memfs.Entry, opt StoreOptions) map[string]uint32 {
+	if opt.ZeroIno { return nil }
+	var names []string
+	for _, e := range files {
+		if name := strings.TrimPrefix(e.Name, "/"); name != "" && !memfs.Excluded(name, opt.Exclude) { names = append(names, e.Name) }
+	}
+	sort.Strings(names)
+	ino := make(map[string]uint32, len(names))
+	for i, n := range names { ino[n] = uint32(i + 1) }
+	return ino
+}
+
+// countWriter counts the bytes passed on to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	k, err := c.w.Write(p)
+	c.n += int64(k)
+	return k, err
+}
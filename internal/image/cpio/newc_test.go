@@ -0,0 +1,277 @@
+package cpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// newcArchive hand-assembles a newc stream, since StoreNewc only ever sees
+// names that memfs already cleaned.
+func newcArchive(names ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	put := func(name string, mode uint32, data []byte) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			1, mode, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+		buf.Write(data)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	for _, n := range names {
+		put(n, 0o100644, []byte("x\n"))
+	}
+	put("TRAILER!!!", 0, nil)
+	return &buf
+}
+
+func TestLoadNewcRejectsTraversal(t *testing.T) {
+	for _, name := range []string{"../../etc/passwd", "bin/../../../root/.ssh/authorized_keys"} {
+		_, err := LoadNewc(newcArchive("bin/sh", name))
+		if !errors.Is(err, common.ErrUnsafePath) {
+			t.Errorf("%q: got %v, want ErrUnsafePath", name, err)
+		}
+	}
+	fs, err := LoadNewc(newcArchive("bin/sh", "bin/../etc/passwd"))
+	if err != nil {
+		t.Fatalf("in-tree ..: %v", err)
+	}
+	if _, ok := fs.Get("/etc/passwd"); !ok {
+		t.Fatal("/etc/passwd missing")
+	}
+}
+
+func TestLoadNewcAllowUnsafeClamps(t *testing.T) {
+	common.AllowUnsafePaths = true
+	defer func() { common.AllowUnsafePaths = false }()
+	fs, err := LoadNewc(newcArchive("../../etc/passwd"))
+	if err != nil {
+		t.Fatalf("LoadNewc: %v", err)
+	}
+	if _, ok := fs.Get("/etc/passwd"); !ok {
+		t.Fatal("entry not clamped to /etc/passwd")
+	}
+}
+
+func TestNewcRoundTripDirPerms(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutDirMode("/root", memfs.ModeDir|0o700, 0, 0, mt)
+	src.PutDirMode("/tmp", memfs.ModeDir|0o1777, 0, 0, mt)
+	src.PutFile("/root/.profile", []byte("umask 077\n"), 0o600, 0, 0, mt)
+
+	var buf bytes.Buffer
+	if err := StoreNewc(&buf, src); err != nil {
+		t.Fatalf("StoreNewc: %v", err)
+	}
+	dst, err := LoadNewc(&buf)
+	if err != nil {
+		t.Fatalf("LoadNewc: %v", err)
+	}
+	for p, want := range map[string]memfs.Mode{"/root": 0o700, "/tmp": 0o1777} {
+		e, ok := dst.Get(p)
+		if !ok {
+			t.Fatalf("%s: missing", p)
+		}
+		if e.Mode.Type() != memfs.ModeDir || e.Mode&0o7777 != want {
+			t.Errorf("%s: mode %o, want dir %o", p, e.Mode, want)
+		}
+	}
+}
+
+func TestLoadNewcShortInput(t *testing.T) {
+	for _, b := range []string{"", "0707", "070701" + strings.Repeat("0", 50)} {
+		_, err := LoadNewc(strings.NewReader(b))
+		if !errors.Is(err, common.ErrCorrupt) || !strings.Contains(err.Error(), "file too small") {
+			t.Errorf("%d bytes: got %v, want a too-small ErrCorrupt", len(b), err)
+		}
+	}
+}
+
+// Every truncation of a valid archive, and random bytes behind a valid
+// magic, must fail with an error rather than panic or succeed.
+func TestLoadNewcTruncatedAndRandom(t *testing.T) {
+	full := newcArchive("bin/sh", "etc/passwd").Bytes()
+	try := func(what string, b []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("%s (%d bytes): panic: %v", what, len(b), r)
+			}
+		}()
+		if _, err := LoadNewc(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s (%d bytes): accepted", what, len(b))
+		}
+	}
+	for n := 0; n < len(full); n++ {
+		try("truncated", full[:n])
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		b := make([]byte, rnd.Intn(400))
+		rnd.Read(b)
+		if len(b) >= 6 {
+			copy(b, "070701")
+		}
+		try(fmt.Sprintf("random %d", i), b)
+	}
+}
+
+func TestNewcRoundTripSpecialBits(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutFile("/bin/su", []byte("\x7fELF"), 0o4755, 0, 0, mt)
+	src.PutFile("/usr/bin/wall", []byte("\x7fELF"), 0o2755, 0, 5, mt)
+
+	var buf bytes.Buffer
+	if err := StoreNewc(&buf, src); err != nil {
+		t.Fatalf("StoreNewc: %v", err)
+	}
+	dst, err := LoadNewc(&buf)
+	if err != nil {
+		t.Fatalf("LoadNewc: %v", err)
+	}
+	for p, want := range map[string]memfs.Mode{"/bin/su": 0o4755, "/usr/bin/wall": 0o2755} {
+		e, ok := dst.Get(p)
+		if !ok {
+			t.Fatalf("%s: missing", p)
+		}
+		if e.Mode.Type() != memfs.ModeFile || e.Mode&0o7777 != want {
+			t.Errorf("%s: mode %o, want file %o", p, e.Mode, want)
+		}
+	}
+}
+
+func TestLoadSegmentsMicrocodeThenGzip(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(newcArchive("init", "kernel/x86/microcode/GenuineIntel.bin").Bytes())
+	zw.Close()
+	early := newcArchive("kernel/x86/microcode/GenuineIntel.bin")
+	in := append(early.Bytes(), make([]byte, 512-early.Len()%512)...)
+	in = append(in, gz.Bytes()...)
+	decode := func(rest []byte) ([]byte, bool, error) {
+		if !bytes.HasPrefix(rest, []byte{0x1f, 0x8b}) {
+			return nil, false, nil
+		}
+		r, err := gzip.NewReader(bytes.NewReader(rest))
+		if err != nil {
+			return nil, true, err
+		}
+		out, err := io.ReadAll(r)
+		return out, true, err
+	}
+	fs, raw, err := LoadSegments(in, decode)
+	if err != nil {
+		t.Fatalf("LoadSegments: %v", err)
+	}
+	for _, p := range []string{"/init", "/kernel/x86/microcode/GenuineIntel.bin"} {
+		if _, ok := fs.Get(p); !ok {
+			t.Errorf("%s missing", p)
+		}
+	}
+	if want := early.Len() + newcArchive("init", "kernel/x86/microcode/GenuineIntel.bin").Len(); len(raw) != want {
+		t.Errorf("raw: %d bytes, want %d", len(raw), want)
+	}
+
+	// without decode the compressed part is trailing data, ignored as before
+	fs, _, err = LoadSegments(in, nil)
+	if err != nil {
+		t.Fatalf("no decode: %v", err)
+	}
+	if _, ok := fs.Get("/init"); ok {
+		t.Error("/init loaded without decode")
+	}
+}
+
+func TestLoadNewcConcatenated(t *testing.T) {
+	var b bytes.Buffer
+	b.Write(newcArchive("kernel/x86/microcode/AuthenticAMD.bin").Bytes())
+	b.Write(make([]byte, 512-b.Len()%512))
+	b.Write(newcArchive("init", "etc/passwd").Bytes())
+	b.Write(newcArchive("etc/passwd").Bytes())
+	fs, err := LoadNewc(&b)
+	if err != nil {
+		t.Fatalf("LoadNewc: %v", err)
+	}
+	for _, p := range []string{"/kernel/x86/microcode/AuthenticAMD.bin", "/init", "/etc/passwd"} {
+		if _, ok := fs.Get(p); !ok {
+			t.Errorf("%s missing", p)
+		}
+	}
+}
+
+func TestStoreNewcPad512(t *testing.T) {
+	fs := memfs.New()
+	fs.PutFile("/init", []byte("#!/bin/sh\n"), memfs.ModeFile|0o755, 0, 0, time.Unix(0, 0))
+	var plain, padded bytes.Buffer
+	if err := StoreNewc(&plain, fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreNewcWith(&padded, fs, StoreOptions{Pad512: true}); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Len()%512 == 0 || padded.Len() != (plain.Len()+511)/512*512 {
+		t.Fatalf("%d bytes padded to %d", plain.Len(), padded.Len())
+	}
+	if !bytes.Equal(padded.Bytes()[:plain.Len()], plain.Bytes()) || bytes.Count(padded.Bytes()[plain.Len():], []byte{0}) != padded.Len()-plain.Len() {
+		t.Fatal("padding is not zeros after the plain archive")
+	}
+	got, err := LoadNewc(bytes.NewReader(padded.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := got.Get("/init"); !ok || string(e.Data) != "#!/bin/sh\n" {
+		t.Fatalf("/init = %+v", e)
+	}
+}
+
+func TestStoreNewcInodeNumbers(t *testing.T) {
+	fs := memfs.New()
+	mt := time.Unix(0, 0)
+	for _, p := range []string{"/sbin/init", "/etc/passwd", "/bin/sh"} {
+		fs.PutFile(p, []byte(p), memfs.ModeFile|0o755, 0, 0, mt)
+	}
+	inodes := func(opt StoreOptions) map[string]uint32 {
+		var buf bytes.Buffer
+		if err := StoreNewcWith(&buf, fs, opt); err != nil {
+			t.Fatal(err)
+		}
+		out := map[string]uint32{}
+		b := buf.Bytes()
+		for off := 0; ; {
+			var v [13]uint32
+			for i := range v {
+				fmt.Sscanf(string(b[off+6+8*i:off+14+8*i]), "%08X", &v[i])
+			}
+			name := string(b[off+110 : off+110+int(v[11])-1])
+			if name == "TRAILER!!!" {
+				return out
+			}
+			out[name] = v[0]
+			off = int(pad4(uint64(pad4(uint64(off+110+int(v[11]))) + uint64(v[6]))))
+		}
+	}
+	want := map[string]uint32{"bin": 1, "bin/sh": 2, "etc": 3, "etc/passwd": 4, "sbin": 5, "sbin/init": 6}
+	got := inodes(StoreOptions{Order: []string{"/sbin/init"}})
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("inodes %v, want %v", got, want)
+	}
+	for name, ino := range inodes(StoreOptions{ZeroIno: true}) {
+		if ino != 0 {
+			t.Fatalf("%s: inode %d with ZeroIno", name, ino)
+		}
+	}
+}
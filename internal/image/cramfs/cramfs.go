@@ -0,0 +1,362 @@
+// Package cramfs reads cramfs images (fs/cramfs, mkfs.cramfs): a
+// superblock holding the root inode, 12-byte inodes packed with their
+// names into directories, and file data cut into 4 KiB blocks that are
+// each zlib-compressed on their own. Both byte orders (mkfs.cramfs -N)
+// and the 512-byte pad before the superblock (-p) are recognised.
+//
+// cramfs is read-only here. It keeps no mtimes and only the low 8 bits of
+// the GID; Load gives mtime 0.
+package cramfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// Magic starts the superblock, in the image's byte order.
+const Magic = 0x28cd3d45
+
+// Signature follows the magic, size, flags and future fields.
+const Signature = "Compressed ROMFS"
+
+const (
+	superSize = 76
+	inodeSize = 12
+	// PadOffset: where the superblock sits in an image made with -p (the
+	// first 512 bytes are left for a boot loader)
+	PadOffset = 512
+	// blockSize is PAGE_SIZE; mkfs.cramfs -b other sizes only mount on a
+	// kernel with that page size
+	blockSize = 4096
+
+	maxDepth = 256
+)
+
+// superblock flags
+const (
+	flagFSIDv2            = 0x1
+	flagSortedDirs        = 0x2
+	flagHoles             = 0x100
+	flagWrongSignature    = 0x200
+	flagShiftedRootOffset = 0x400
+	flagExtBlockPointers  = 0x800
+
+	supportedFlags = 0xff | flagHoles | flagWrongSignature | flagShiftedRootOffset | flagExtBlockPointers
+)
+
+// block pointer flags (with flagExtBlockPointers)
+const (
+	blkUncompressed = 1 << 31
+	blkDirect       = 1 << 30
+	blkMask         = blkDirect - 1
+	blkDirectShift  = 2
+)
+
+// mode types (S_IFMT)
+const (
+	sIFMT   = 0o170000
+	sIFSOCK = 0o140000
+	sIFLNK  = 0o120000
+	sIFREG  = 0o100000
+	sIFBLK  = 0o060000
+	sIFDIR  = 0o040000
+	sIFCHR  = 0o020000
+	sIFIFO  = 0o010000
+)
+
+// ErrNotCramfs: no cramfs magic at offset 0 or 512.
+var ErrNotCramfs = errors.New("cramfs: no cramfs magic")
+
+// Superblock: the fields of the superblock Load reports.
+type Superblock struct {
+	Offset    int    // 0, or PadOffset for an image made with -p
+	BigEndian bool   // mkfs.cramfs -N big
+	Size      uint32 // the bytes of the image, pad included
+	Flags     uint32
+	Edition   uint32
+	Blocks    uint32
+	Files     uint32
+	Name      string
+}
+
+// find returns the superblock offset and byte order, or -1.
+func find(b []byte) (int, binary.ByteOrder) {
+	for _, off := range []int{0, PadOffset} {
+		if len(b) < off+superSize {
+			break
+		}
+		switch binary.LittleEndian.Uint32(b[off:]) {
+		case Magic:
+			return off, binary.LittleEndian
+		case 0x453dcd28:
+			return off, binary.BigEndian
+		}
+	}
+	return -1, nil
+}
+
+// IsCramfs reports whether b has the cramfs magic at offset 0 or 512, in
+// either byte order.
+func IsCramfs(b []byte) bool {
+	off, _ := find(b)
+	return off >= 0
+}
+
+// Load reads a cramfs image. With the version 2 fsid (every mkfs.cramfs
+// image) the CRC must match, as fsck.cramfs requires.
+func Load(r io.Reader) (*memfs.FS, *Superblock, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	start, bo := find(b)
+	if start < 0 {
+		return nil, nil, ErrNotCramfs
+	}
+	sb := &Superblock{
+		Offset: start, BigEndian: bo == binary.BigEndian,
+		Size: bo.Uint32(b[start+4:]), Flags: bo.Uint32(b[start+8:]),
+		Edition: bo.Uint32(b[start+36:]), Blocks: bo.Uint32(b[start+40:]), Files: bo.Uint32(b[start+44:]),
+		Name: string(bytes.TrimRight(b[start+48:start+64], "\x00")),
+	}
+	if f := sb.Flags &^ supportedFlags; f != 0 {
+		return nil, nil, common.Corrupt("cramfs", int64(start+8), fmt.Sprintf("unsupported flags %#x", f))
+	}
+	if string(b[start+16:start+32]) != Signature && sb.Flags&flagWrongSignature == 0 {
+		return nil, nil, common.Corrupt("cramfs", int64(start+16), "no \"Compressed ROMFS\" signature")
+	}
+	if sb.Flags&flagFSIDv2 == 0 {
+		// version 1 images have no size, CRC or counts
+		sb.Size = uint32(len(b))
+	}
+	if int64(sb.Size) > int64(len(b)) || int(sb.Size) < start+superSize {
+		return nil, nil, common.Corrupt("cramfs", int64(start+4), fmt.Sprintf("size %d, image has %d bytes", sb.Size, len(b)))
+	}
+	b = b[:sb.Size]
+	if sb.Flags&flagFSIDv2 != 0 {
+		want := bo.Uint32(b[start+32:])
+		crc := crc32.ChecksumIEEE(b[start : start+32])
+		crc = crc32.Update(crc, crc32.IEEETable, make([]byte, 4))
+		crc = crc32.Update(crc, crc32.IEEETable, b[start+36:])
+		if crc != want {
+			return nil, nil, common.Corrupt("cramfs", int64(start+32), fmt.Sprintf("bad CRC %#08x, computed %#08x", want, crc))
+		}
+	}
+	l := &loader{b: b, bo: bo, flags: sb.Flags, fs: memfs.New(), seen: map[int]bool{}}
+	root, err := l.inode(start + 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	if root.mode&sIFMT != sIFDIR {
+		return nil, nil, common.Corrupt("cramfs", int64(start+64), "root inode is not a directory")
+	}
+	l.fs.PutDirMode("/", memfs.ModeDir|memfs.Mode(root.mode&0o7777), uint32(root.uid), uint32(root.gid), time.Unix(0, 0))
+	if err := l.dir(root, "/", 0); err != nil {
+		return nil, nil, err
+	}
+	return l.fs, sb, nil
+}
+
+type loader struct {
+	b     []byte
+	bo    binary.ByteOrder
+	flags uint32
+	fs    *memfs.FS
+	seen  map[int]bool // directory contents already read: a loop in a corrupt image
+}
+
+type inode struct {
+	off     int
+	mode    uint16
+	uid     uint16
+	size    uint32 // 24 bits; rdev for devices
+	gid     uint8
+	namelen int
+	offset  int // of the directory entries or the block pointers
+}
+
+// inode decodes the 12-byte inode at off. The bitfields are allocated
+// from the low bits on a little-endian host and from the high bits on a
+// big-endian one.
+func (l *loader) inode(off int) (*inode, error) {
+	if off+inodeSize > len(l.b) {
+		return nil, common.Corrupt("cramfs", int64(off), "inode outside the image")
+	}
+	w0, w1, w2 := l.bo.Uint32(l.b[off:]), l.bo.Uint32(l.b[off+4:]), l.bo.Uint32(l.b[off+8:])
+	in := &inode{off: off}
+	if l.bo == binary.LittleEndian {
+		in.mode, in.uid = uint16(w0), uint16(w0>>16)
+		in.size, in.gid = w1&0xffffff, uint8(w1>>24)
+		in.namelen, in.offset = int(w2&0x3f)*4, int(w2>>6)*4
+	} else {
+		in.mode, in.uid = uint16(w0>>16), uint16(w0)
+		in.size, in.gid = w1>>8, uint8(w1)
+		in.namelen, in.offset = int(w2>>26)*4, int(w2&0x3ffffff)*4
+	}
+	return in, nil
+}
+
+// dir reads the entries of directory in into p.
+func (l *loader) dir(in *inode, p string, depth int) error {
+	if depth > maxDepth {
+		return common.Corrupt("cramfs", int64(in.off), fmt.Sprintf("directories nested deeper than %d", maxDepth))
+	}
+	if in.size == 0 {
+		return nil
+	}
+	off, end := in.offset, in.offset+int(in.size)
+	if end > len(l.b) {
+		return common.Corrupt("cramfs", int64(in.off), fmt.Sprintf("%d bytes of directory entries run past the end of the image", in.size))
+	}
+	if l.seen[off] {
+		return common.Corrupt("cramfs", int64(off), "directory entries reached twice (loop in the tree)")
+	}
+	l.seen[off] = true
+	for off < end {
+		c, err := l.inode(off)
+		if err != nil {
+			return err
+		}
+		if c.namelen == 0 || off+inodeSize+c.namelen > end {
+			return common.Corrupt("cramfs", int64(off), "entry name outside the directory")
+		}
+		name := string(bytes.TrimRight(l.b[off+inodeSize:off+inodeSize+c.namelen], "\x00"))
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return common.Corrupt("cramfs", int64(off), fmt.Sprintf("bad entry name %q", name))
+		}
+		if err := l.entry(c, path.Join(p, name), depth); err != nil {
+			return common.WithPath("cramfs", path.Join(p, name), err)
+		}
+		off += inodeSize + c.namelen
+	}
+	return nil
+}
+
+func (l *loader) entry(in *inode, p string, depth int) error {
+	mt := time.Unix(0, 0)
+	perm := memfs.Mode(in.mode & 0o7777)
+	uid, gid := uint32(in.uid), uint32(in.gid)
+	switch in.mode & sIFMT {
+	case sIFDIR:
+		l.fs.PutDirMode(p, memfs.ModeDir|perm, uid, gid, mt)
+		return l.dir(in, p, depth+1)
+	case sIFREG:
+		data, err := l.data(in)
+		if err != nil {
+			return err
+		}
+		l.fs.PutFile(p, data, memfs.ModeFile|perm, uid, gid, mt)
+	case sIFLNK:
+		data, err := l.data(in)
+		if err != nil {
+			return err
+		}
+		l.fs.PutSymlink(p, string(data), uid, gid, mt)
+	case sIFBLK, sIFCHR:
+		typ := memfs.ModeBlock
+		if in.mode&sIFMT == sIFCHR {
+			typ = memfs.ModeChar
+		}
+		// the size field holds the 16-bit old-style rdev
+		l.fs.PutNode(p, typ, uint32(perm), uid, gid, in.size>>8&0xff, in.size&0xff, mt)
+	case sIFIFO:
+		l.fs.PutNode(p, memfs.ModeFIFO, uint32(perm), uid, gid, 0, 0, mt)
+	case sIFSOCK:
+		// memfs has no sockets
+	default:
+		return common.Corrupt("cramfs", int64(in.off), fmt.Sprintf("unknown file type %#o", in.mode&sIFMT))
+	}
+	return nil
+}
+
+// data reads the blocks of a file or symlink: a table of one 32-bit
+// pointer per block, each the end offset of that block's data (the first
+// starts right after the table). An empty block is a hole. With extended
+// pointers a block may also be stored uncompressed or elsewhere (direct).
+func (l *loader) data(in *inode) ([]byte, error) {
+	size := int(in.size)
+	if size == 0 {
+		return nil, nil
+	}
+	nblocks := (size + blockSize - 1) / blockSize
+	table := in.offset
+	if table+4*nblocks > len(l.b) {
+		return nil, common.Corrupt("cramfs", int64(in.off), "block pointers outside the image")
+	}
+	out := make([]byte, 0, size)
+	prev := table + 4*nblocks // where the next non-direct block starts
+	for i := 0; i < nblocks; i++ {
+		want := min(blockSize, size-i*blockSize)
+		ptr := l.bo.Uint32(l.b[table+4*i:])
+		var uncompressed, direct bool
+		if l.flags&flagExtBlockPointers != 0 {
+			uncompressed, direct = ptr&blkUncompressed != 0, ptr&blkDirect != 0
+			ptr &= blkMask
+		}
+		var start, end int
+		if direct {
+			start = int(ptr) << blkDirectShift
+			if uncompressed {
+				end = start + want
+			} else {
+				if start+2 > len(l.b) {
+					return nil, common.Corrupt("cramfs", int64(table+4*i), fmt.Sprintf("block %d outside the image", i))
+				}
+				n := int(l.bo.Uint16(l.b[start:]))
+				start += 2
+				end = start + n
+			}
+		} else {
+			start, end = prev, int(ptr)
+			prev = end
+		}
+		if end < start || end > len(l.b) {
+			return nil, common.Corrupt("cramfs", int64(table+4*i), fmt.Sprintf("block %d at %d..%d outside the image", i, start, end))
+		}
+		blk := l.b[start:end]
+		switch {
+		case len(blk) == 0:
+			out = append(out, make([]byte, want)...)
+			continue
+		case uncompressed:
+			if len(blk) != want {
+				return nil, common.Corrupt("cramfs", int64(start), fmt.Sprintf("uncompressed block %d has %d bytes, want %d", i, len(blk), want))
+			}
+		default:
+			var err error
+			if blk, err = inflate(blk, want); err != nil {
+				return nil, common.Corrupt("cramfs", int64(start), fmt.Sprintf("block %d: %v", i, err))
+			}
+		}
+		out = append(out, blk...)
+	}
+	return out, nil
+}
+
+// inflate decompresses one zlib block that must give exactly want bytes.
+func inflate(b []byte, want int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, int64(want)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != want {
+		return nil, fmt.Errorf("inflates to %d bytes, want %d", len(out), want)
+	}
+	return out, nil
+}
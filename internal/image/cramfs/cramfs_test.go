@@ -0,0 +1,119 @@
+package cramfs
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// mkcramfs builds a tree on the host and runs mkfs.cramfs on it.
+func mkcramfs(t *testing.T, args ...string) ([]byte, map[string][]byte) {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.cramfs"); err != nil {
+		t.Skip("mkfs.cramfs not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	rnd := make([]byte, 3*blockSize+100)
+	rand.New(rand.NewSource(1)).Read(rnd)
+	files := map[string][]byte{
+		"/etc/hostname": []byte("box\n"),
+		"/bin/busybox":  rnd,
+		"/var/zeros":    make([]byte, 2*blockSize+7), // a hole with -z
+		"/etc/empty":    nil,
+	}
+	for p, data := range files {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(p)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, p), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "/bin/busybox"), os.ModeSetuid|0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "/tmp"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "/tmp"), os.ModeSticky|0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("busybox", filepath.Join(src, "/bin/sh")); err != nil {
+		t.Fatal(err)
+	}
+	img := filepath.Join(dir, "img")
+	out, err := exec.Command("mkfs.cramfs", append(append(args, "-n", "test"), src, img)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("mkfs.cramfs: %v\n%s", err, out)
+	}
+	b, err := os.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, files
+}
+
+func TestLoadMkfsCramfs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		off  int
+		big  bool
+	}{
+		{"little", nil, 0, false},
+		{"big", []string{"-N", "big"}, 0, true},
+		{"padded", []string{"-p"}, PadOffset, false},
+		{"holes", []string{"-z"}, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img, files := mkcramfs(t, tc.args...)
+			if !IsCramfs(img) {
+				t.Fatal("IsCramfs: false")
+			}
+			fs, sb, err := Load(bytes.NewReader(img))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sb.Offset != tc.off || sb.BigEndian != tc.big || sb.Name != "test" {
+				t.Fatalf("superblock %+v", sb)
+			}
+			for p, data := range files {
+				e, ok := fs.Get(p)
+				if !ok || e.Mode.Type() != memfs.ModeFile || !bytes.Equal(e.Data, data) {
+					t.Errorf("%s: missing or data differs", p)
+				}
+			}
+			for p, m := range map[string]memfs.Mode{
+				"/bin/busybox": memfs.ModeFile | 0o4755, "/tmp": memfs.ModeDir | 0o1777, "/etc": memfs.ModeDir | 0o755,
+			} {
+				if e, ok := fs.Get(p); !ok {
+					t.Errorf("%s: missing", p)
+				} else if e.Mode != m {
+					t.Errorf("%s: mode %o, want %o", p, e.Mode, m)
+				}
+			}
+			if e, ok := fs.Get("/bin/sh"); !ok || e.Mode.Type() != memfs.ModeLink || e.Target != "busybox" {
+				t.Errorf("/bin/sh: not a link to busybox")
+			}
+		})
+	}
+}
+
+func TestLoadBadCRC(t *testing.T) {
+	img, _ := mkcramfs(t)
+	img[len(img)/2] ^= 0xff
+	if _, _, err := Load(bytes.NewReader(img)); !errors.Is(err, common.ErrCorrupt) {
+		t.Fatalf("err %v, want corrupt", err)
+	}
+	if _, _, err := Load(bytes.NewReader(make([]byte, 1024))); err != ErrNotCramfs {
+		t.Fatalf("err %v, want ErrNotCramfs", err)
+	}
+}
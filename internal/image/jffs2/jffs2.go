@@ -0,0 +1,395 @@
+// Package jffs2 reads JFFS2 flash images (mkfs.jffs2 output or a raw MTD
+// dump) into a memfs. It is read-only: there is no JFFS2 writer.
+//
+// The image is scanned for nodes the way the kernel mounts it: every
+// 4-byte aligned offset with a node magic and a good header CRC starts a
+// node, anything else (erased flash, cleanmarkers, padding, summaries) is
+// skipped. For each inode the data nodes are applied in version order and
+// for each (parent, name) the newest dirent wins; a dirent with inode 0 is
+// a deletion.
+package jffs2
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// Magic is the node magic (JFFS2_MAGIC_BITMASK), in the image's byte order.
+const Magic = 0x1985
+
+const (
+	nodeAccurate = 0x2000 // cleared on obsolete nodes
+	nodeDirent   = 0xe001
+	nodeInode    = 0xe002
+
+	headerSize = 12
+	direntSize = 40
+	inodeSize  = 68
+
+	rootIno = 1
+
+	// maxNodeData: a data node never holds more than one page (the kernel
+	// writes at most PAGE_SIZE, up to 64 KiB)
+	maxNodeData = 64 << 10
+)
+
+// compression types of an inode node (jffs2.h JFFS2_COMPR_*)
+const (
+	comprNone      = 0
+	comprZero      = 1
+	comprRtime     = 2
+	comprRubinMIPS = 3
+	comprCopy      = 4
+	comprDynRubin  = 5
+	comprZlib      = 6
+	comprLZO       = 7
+	comprLZMA      = 8
+)
+
+var comprNames = map[uint8]string{
+	comprNone: "none", comprZero: "zero", comprRtime: "rtime", comprRubinMIPS: "rubinmips",
+	comprCopy: "copy", comprDynRubin: "dynrubin", comprZlib: "zlib", comprLZO: "lzo", comprLZMA: "lzma",
+}
+
+// ErrNotJFFS2: no valid node anywhere in the image.
+var ErrNotJFFS2 = errors.New("jffs2: no JFFS2 nodes found")
+
+// IsJFFS2 reports whether b starts with a JFFS2 node (magic 0x1985 in
+// either byte order and a matching header CRC); an erase block always
+// starts with a node or a cleanmarker.
+func IsJFFS2(b []byte) bool {
+	if len(b) < headerSize {
+		return false
+	}
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if bo.Uint16(b) == Magic && bo.Uint32(b[8:]) == crc(b[:8]) {
+			return true
+		}
+	}
+	return false
+}
+
+// crc is the kernel's crc32(0, ...): CRC-32 without the pre/post inversion.
+func crc(b []byte) uint32 {
+	return ^crc32.Update(^uint32(0), crc32.IEEETable, b)
+}
+
+type inodeNode struct {
+	off           int
+	version       uint32
+	mode          uint32
+	uid, gid      uint16
+	isize, mtime  uint32
+	offset, dsize uint32
+	compr         uint8
+	data          []byte // compressed, csize bytes
+}
+
+type dirent struct {
+	version uint32
+	ino     uint32
+	name    string
+}
+
+type image struct {
+	bo      binary.ByteOrder
+	inodes  map[uint32][]*inodeNode
+	dirents map[uint32]map[string]*dirent // by parent inode, then name
+}
+
+// Load reads a whole JFFS2 image. Both byte orders are accepted (the
+// first valid node decides); nodes with bad CRCs are skipped like the
+// kernel does, a node whose data cannot be decompressed is an error.
+func Load(r io.Reader) (*memfs.FS, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	im, err := scan(b)
+	if err != nil {
+		return nil, err
+	}
+	fs := memfs.New()
+	if err := im.fill(fs, rootIno, "/", map[uint32]bool{}); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func scan(b []byte) (*image, error) {
+	im := &image{inodes: map[uint32][]*inodeNode{}, dirents: map[uint32]map[string]*dirent{}}
+	for off := 0; off+headerSize <= len(b); {
+		bo := im.bo
+		if bo == nil {
+			switch {
+			case binary.LittleEndian.Uint16(b[off:]) == Magic:
+				bo = binary.LittleEndian
+			case binary.BigEndian.Uint16(b[off:]) == Magic:
+				bo = binary.BigEndian
+			default:
+				off += 4
+				continue
+			}
+		}
+		h := b[off:]
+		totlen := int(bo.Uint32(h[4:]))
+		if bo.Uint16(h) != Magic || bo.Uint32(h[8:]) != crc(h[:8]) || totlen < headerSize || totlen > len(h) {
+			off += 4
+			continue
+		}
+		im.bo = bo
+		if typ := bo.Uint16(h[2:]); typ&nodeAccurate != 0 {
+			im.node(off, typ, h[:totlen])
+		}
+		off += int(common.AlignUp(uint64(totlen), 4))
+	}
+	if im.bo == nil {
+		return nil, ErrNotJFFS2
+	}
+	return im, nil
+}
+
+// node records a dirent or inode node whose CRCs match; other node types
+// (cleanmarker, padding, summary, xattr) carry nothing memfs keeps.
+func (im *image) node(off int, typ uint16, n []byte) {
+	bo := im.bo
+	switch typ {
+	case nodeDirent:
+		if len(n) < direntSize || bo.Uint32(n[32:]) != crc(n[:32]) {
+			return
+		}
+		nsize := int(n[28])
+		if direntSize+nsize > len(n) {
+			return
+		}
+		name := n[direntSize : direntSize+nsize]
+		if bo.Uint32(n[36:]) != crc(name) {
+			return
+		}
+		pino := bo.Uint32(n[12:])
+		d := &dirent{version: bo.Uint32(n[16:]), ino: bo.Uint32(n[20:]), name: string(name)}
+		dir := im.dirents[pino]
+		if dir == nil {
+			dir = map[string]*dirent{}
+			im.dirents[pino] = dir
+		}
+		if old := dir[d.name]; old == nil || d.version > old.version {
+			dir[d.name] = d
+		}
+	case nodeInode:
+		if len(n) < inodeSize || bo.Uint32(n[64:]) != crc(n[:60]) {
+			return
+		}
+		csize := int(bo.Uint32(n[44:]))
+		if inodeSize+csize > len(n) {
+			return
+		}
+		data := n[inodeSize : inodeSize+csize]
+		if bo.Uint32(n[60:]) != crc(data) {
+			return
+		}
+		ino := bo.Uint32(n[12:])
+		im.inodes[ino] = append(im.inodes[ino], &inodeNode{
+			off: off, version: bo.Uint32(n[16:]), mode: bo.Uint32(n[20:]),
+			uid: bo.Uint16(n[24:]), gid: bo.Uint16(n[26:]), isize: bo.Uint32(n[28:]),
+			mtime: bo.Uint32(n[36:]), offset: bo.Uint32(n[40:]), dsize: bo.Uint32(n[48:]),
+			compr: n[56], data: data,
+		})
+	}
+}
+
+// fill adds the children of directory ino (at dir) to fs, recursively;
+// seen guards against directory loops in a corrupt image.
+func (im *image) fill(fs *memfs.FS, ino uint32, dir string, seen map[uint32]bool) error {
+	seen[ino] = true
+	names := make([]string, 0, len(im.dirents[ino]))
+	for name, d := range im.dirents[ino] {
+		if d.ino != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := im.dirents[ino][name]
+		if name == "" || name == "." || name == ".." || bytes.ContainsAny([]byte(name), "/\x00") {
+			continue
+		}
+		nodes := im.inodes[d.ino]
+		if len(nodes) == 0 {
+			continue // dirent without an inode: nothing to show
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].version < nodes[j].version })
+		last := nodes[len(nodes)-1]
+		p := path.Join(dir, name)
+		mode := memfs.Mode(last.mode)
+		uid, gid, mt := uint32(last.uid), uint32(last.gid), time.Unix(int64(last.mtime), 0)
+		switch mode.Type() {
+		case memfs.ModeDir:
+			if seen[d.ino] {
+				continue
+			}
+			fs.PutDirMode(p, mode, uid, gid, mt)
+			if err := im.fill(fs, d.ino, p, seen); err != nil {
+				return err
+			}
+		case memfs.ModeFile:
+			data, err := im.data(d.ino, nodes)
+			if err != nil {
+				return common.WithPath("jffs2", p, err)
+			}
+			fs.PutFile(p, data, mode, uid, gid, mt)
+		case memfs.ModeLink:
+			data, err := im.meta(d.ino, nodes)
+			if err != nil {
+				return common.WithPath("jffs2", p, err)
+			}
+			fs.PutSymlink(p, string(data), uid, gid, mt)
+		case memfs.ModeChar, memfs.ModeBlock, memfs.ModeFIFO:
+			data, err := im.meta(d.ino, nodes)
+			if err != nil {
+				return common.WithPath("jffs2", p, err)
+			}
+			major, minor := im.rdev(data)
+			fs.PutNode(p, mode.Type(), uint32(mode&0o7777), uid, gid, major, minor, mt)
+		}
+	}
+	return nil
+}
+
+// data applies the inode's nodes (sorted by version) over each other and
+// cuts the result to the newest node's size.
+func (im *image) data(ino uint32, nodes []*inodeNode) ([]byte, error) {
+	size := nodes[len(nodes)-1].isize
+	if err := common.CheckSize(fmt.Sprintf("jffs2 inode %d", ino), int64(size)); err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for _, n := range nodes {
+		if n.dsize == 0 || n.offset >= size {
+			continue
+		}
+		chunk, err := decompress(n.compr, n.data, int(n.dsize))
+		if err != nil {
+			return nil, common.Corrupt("jffs2", int64(n.off), fmt.Sprintf("inode %d: %v", ino, err))
+		}
+		end := uint64(n.offset) + uint64(len(chunk))
+		if end > uint64(size) {
+			end = uint64(size)
+		}
+		if end > uint64(len(buf)) {
+			buf = append(buf, make([]byte, int(end)-len(buf))...)
+		}
+		copy(buf[n.offset:end], chunk)
+	}
+	if uint32(len(buf)) < size {
+		buf = append(buf, make([]byte, int(size)-len(buf))...)
+	}
+	return buf, nil
+}
+
+// meta is the data of a symlink or device inode: all of it is in the
+// newest node that has any (isize is not reliable for these).
+func (im *image) meta(ino uint32, nodes []*inodeNode) ([]byte, error) {
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if n := nodes[i]; n.dsize != 0 {
+			b, err := decompress(n.compr, n.data, int(n.dsize))
+			if err != nil {
+				return nil, common.Corrupt("jffs2", int64(n.off), fmt.Sprintf("inode %d: %v", ino, err))
+			}
+			return b, nil
+		}
+	}
+	return nil, nil
+}
+
+// rdev decodes a device inode's data: 2 bytes in the old encoding, 4 in
+// the kernel's new_encode_dev.
+func (im *image) rdev(data []byte) (major, minor uint32) {
+	switch len(data) {
+	case 2:
+		v := uint32(im.bo.Uint16(data))
+		return v >> 8, v & 0xff
+	case 4:
+		v := im.bo.Uint32(data)
+		return (v & 0xfff00) >> 8, (v & 0xff) | (v>>12)&0xfff00
+	}
+	return 0, 0
+}
+
+func decompress(compr uint8, in []byte, dsize int) ([]byte, error) {
+	if dsize > maxNodeData {
+		return nil, fmt.Errorf("node of %d bytes, more than a page", dsize)
+	}
+	switch compr {
+	case comprNone, comprCopy:
+		if len(in) < dsize {
+			return nil, fmt.Errorf("%d bytes of data, want %d", len(in), dsize)
+		}
+		return in[:dsize], nil
+	case comprZero:
+		return make([]byte, dsize), nil
+	case comprZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(in))
+		if err != nil {
+			return nil, fmt.Errorf("zlib: %w", err)
+		}
+		out := make([]byte, dsize)
+		if _, err := io.ReadFull(zr, out); err != nil {
+			return nil, fmt.Errorf("zlib: %w", err)
+		}
+		return out, nil
+	case comprRtime:
+		return rtimeDecompress(in, dsize)
+	case comprRubinMIPS:
+		return rubinDecompress(in, dsize, rubinDividerMIPS, rubinBitsMIPS), nil
+	case comprDynRubin:
+		if len(in) < 8 {
+			return nil, fmt.Errorf("dynrubin: %d bytes of data, want at least 8", len(in))
+		}
+		var bits [8]int
+		for i := range bits {
+			bits[i] = int(in[i])
+		}
+		return rubinDecompress(in[8:], dsize, 256, bits), nil
+	}
+	if name, ok := comprNames[compr]; ok {
+		return nil, fmt.Errorf("compression %s is not supported", name)
+	}
+	return nil, fmt.Errorf("unknown compression type %d", compr)
+}
+
+// rtimeDecompress: each input pair is a literal byte and how many bytes to
+// repeat from after that byte's previous occurrence.
+func rtimeDecompress(in []byte, dsize int) ([]byte, error) {
+	var positions [256]int
+	out := make([]byte, 0, dsize)
+	for pos := 0; len(out) < dsize; {
+		if pos+2 > len(in) {
+			return nil, errors.New("rtime: data ends early")
+		}
+		value, repeat := in[pos], int(in[pos+1])
+		pos += 2
+		out = append(out, value)
+		back := positions[value]
+		positions[value] = len(out)
+		if len(out)+repeat > dsize {
+			return nil, errors.New("rtime: run past the end")
+		}
+		for ; repeat > 0; repeat-- {
+			out = append(out, out[back])
+			back++
+		}
+	}
+	return out, nil
+}
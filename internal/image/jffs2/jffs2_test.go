@@ -0,0 +1,218 @@
+package jffs2
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+
+	"goimagetool/internal/fs/memfs"
+)
+
+// builder writes nodes the way mkfs.jffs2 lays them out (4-byte aligned).
+type builder struct {
+	bo  binary.ByteOrder
+	buf bytes.Buffer
+}
+
+func (b *builder) node(typ uint16, body []byte) {
+	h := make([]byte, headerSize)
+	b.bo.PutUint16(h, Magic)
+	b.bo.PutUint16(h[2:], typ)
+	b.bo.PutUint32(h[4:], uint32(headerSize+len(body)))
+	b.bo.PutUint32(h[8:], crc(h[:8]))
+	b.buf.Write(h)
+	b.buf.Write(body)
+	for b.buf.Len()%4 != 0 {
+		b.buf.WriteByte(0xff)
+	}
+}
+
+func (b *builder) dirent(pino, version, ino uint32, name string) {
+	n := make([]byte, direntSize+len(name))
+	b.bo.PutUint16(n, Magic)
+	b.bo.PutUint16(n[2:], nodeDirent)
+	b.bo.PutUint32(n[4:], uint32(len(n)))
+	b.bo.PutUint32(n[8:], crc(n[:8]))
+	b.bo.PutUint32(n[12:], pino)
+	b.bo.PutUint32(n[16:], version)
+	b.bo.PutUint32(n[20:], ino)
+	n[28] = byte(len(name))
+	b.bo.PutUint32(n[32:], crc(n[:32]))
+	b.bo.PutUint32(n[36:], crc([]byte(name)))
+	copy(n[direntSize:], name)
+	b.node(nodeDirent, n[headerSize:])
+}
+
+func (b *builder) inode(ino, version, mode, isize, offset uint32, compr uint8, dsize int, data []byte) {
+	n := make([]byte, inodeSize+len(data))
+	b.bo.PutUint16(n, Magic)
+	b.bo.PutUint16(n[2:], nodeInode)
+	b.bo.PutUint32(n[4:], uint32(len(n)))
+	b.bo.PutUint32(n[8:], crc(n[:8]))
+	b.bo.PutUint32(n[12:], ino)
+	b.bo.PutUint32(n[16:], version)
+	b.bo.PutUint32(n[20:], mode)
+	b.bo.PutUint16(n[24:], 1000)
+	b.bo.PutUint16(n[26:], 100)
+	b.bo.PutUint32(n[28:], isize)
+	b.bo.PutUint32(n[36:], 1700000000)
+	b.bo.PutUint32(n[40:], offset)
+	b.bo.PutUint32(n[44:], uint32(len(data)))
+	b.bo.PutUint32(n[48:], uint32(dsize))
+	n[56] = compr
+	b.bo.PutUint32(n[60:], crc(data))
+	b.bo.PutUint32(n[64:], crc(n[:60]))
+	copy(n[inodeSize:], data)
+	b.node(nodeInode, n[headerSize:])
+}
+
+// rtimeCompress is fs/jffs2/compr_rtime.c's compressor.
+func rtimeCompress(in []byte) []byte {
+	var positions [256]int
+	var out []byte
+	for pos := 0; pos < len(in); {
+		value := in[pos]
+		out = append(out, value)
+		pos++
+		back := positions[value]
+		positions[value] = pos
+		run := 0
+		for back < pos && pos < len(in) && in[pos] == in[back] && run < 255 {
+			pos++
+			back++
+			run++
+		}
+		out = append(out, byte(run))
+	}
+	return out
+}
+
+// rubinCompress is the encoder half of fs/jffs2/compr_rubin.c.
+func rubinCompress(in []byte, divider int, bits [8]int) []byte {
+	var out []byte
+	nbit := 0
+	push := func(v int64) {
+		if nbit%8 == 0 {
+			out = append(out, 0)
+		}
+		if v != 0 {
+			out[len(out)-1] |= 0x80 >> (nbit % 8)
+		}
+		nbit++
+	}
+	p, q := int64(2*rubinUpperBit), int64(0)
+	for _, c := range in {
+		for i := 0; i < 8; i++ {
+			a, b := int64(divider-bits[i]), int64(bits[i])
+			for q >= rubinUpperBit || p+q <= rubinUpperBit {
+				push(q & rubinUpperBit)
+				q &= rubinLowerBits
+				q <<= 1
+				p <<= 1
+			}
+			i0 := a * p / (a + b)
+			if i0 <= 0 {
+				i0 = 1
+			}
+			if i0 >= p {
+				i0 = p - 1
+			}
+			if c>>i&1 == 0 {
+				p = i0
+			} else {
+				p -= i0
+				q += i0
+			}
+		}
+	}
+	for i := 0; i < rubinRegSize; i++ {
+		push(q & rubinUpperBit)
+		q &= rubinLowerBits
+		q <<= 1
+	}
+	return out
+}
+
+func zlibCompress(t *testing.T, in []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoad(t *testing.T) {
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		b := &builder{bo: bo}
+		text := bytes.Repeat([]byte("hello jffs2 "), 50)
+		// erased flash before the first node is skipped
+		b.buf.Write(bytes.Repeat([]byte{0xff}, 16))
+		b.dirent(1, 1, 2, "etc")
+		b.inode(2, 1, 0o40755, 0, 0, comprNone, 0, nil)
+		b.dirent(2, 2, 3, "motd")
+		b.inode(3, 1, 0o100644, uint32(len(text)), 0, comprZlib, len(text), zlibCompress(t, text))
+		// a newer node overwrites bytes 6..10
+		b.inode(3, 2, 0o100600, uint32(len(text)), 6, comprNone, 5, []byte("JFFS2"))
+		b.dirent(1, 3, 4, "sh")
+		b.inode(4, 1, 0o120777, 7, 0, comprNone, 7, []byte("busybox"))
+		b.dirent(1, 4, 5, "rt")
+		b.inode(5, 1, 0o100644, uint32(len(text)), 0, comprRtime, len(text), rtimeCompress(text))
+		b.dirent(1, 5, 6, "rubin")
+		b.inode(6, 1, 0o100644, uint32(len(text)), 0, comprRubinMIPS, len(text), rubinCompress(text, rubinDividerMIPS, rubinBitsMIPS))
+		dyn := [8]int{10, 200, 128, 30, 60, 90, 120, 250}
+		var dynData []byte
+		for _, v := range dyn {
+			dynData = append(dynData, byte(v))
+		}
+		b.dirent(1, 6, 7, "dyn")
+		b.inode(7, 1, 0o100644, uint32(len(text)), 0, comprDynRubin, len(text), append(dynData, rubinCompress(text, 256, dyn)...))
+		dev := make([]byte, 4)
+		bo.PutUint32(dev, 0x0501) // new_encode_dev(5, 1)
+		b.dirent(1, 7, 8, "console")
+		b.inode(8, 1, 0o20600, 0, 0, comprNone, 4, dev)
+		// deleted: the newer dirent has inode 0
+		b.dirent(1, 8, 9, "gone")
+		b.inode(9, 1, 0o100644, 1, 0, comprNone, 1, []byte("x"))
+		b.dirent(1, 9, 0, "gone")
+		// a node with a broken CRC is ignored
+		b.dirent(1, 10, 3, "bad")
+		b.buf.Bytes()[b.buf.Len()-4] ^= 0xff
+
+		fs, err := Load(bytes.NewReader(b.buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%v: %v", bo, err)
+		}
+		want := append([]byte(nil), text...)
+		copy(want[6:], "JFFS2")
+		if e, ok := fs.Get("/etc/motd"); !ok || !bytes.Equal(e.Data, want) || e.Mode != 0o100600 || e.UID != 1000 || e.GID != 100 {
+			t.Fatalf("%v: /etc/motd = %+v", bo, e)
+		}
+		if e, ok := fs.Get("/sh"); !ok || e.Mode.Type() != memfs.ModeLink || e.Target != "busybox" {
+			t.Fatalf("%v: /sh = %+v", bo, e)
+		}
+		for _, p := range []string{"/rt", "/rubin", "/dyn"} {
+			if e, ok := fs.Get(p); !ok || !bytes.Equal(e.Data, text) {
+				t.Fatalf("%v: %s differs", bo, p)
+			}
+		}
+		if e, ok := fs.Get("/console"); !ok || e.Mode.Type() != memfs.ModeChar || e.RdevMajor != 5 || e.RdevMinor != 1 {
+			t.Fatalf("%v: /console = %+v", bo, e)
+		}
+		for _, p := range []string{"/gone", "/bad"} {
+			if _, ok := fs.Get(p); ok {
+				t.Fatalf("%v: %s should not exist", bo, p)
+			}
+		}
+	}
+}
+
+func TestLoadNotJFFS2(t *testing.T) {
+	if _, err := Load(bytes.NewReader(bytes.Repeat([]byte{0xff}, 4096))); err != ErrNotJFFS2 {
+		t.Fatalf("err = %v, want ErrNotJFFS2", err)
+	}
+}
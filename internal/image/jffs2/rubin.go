@@ -0,0 +1,82 @@
+package jffs2
+
+// Rubin is the arithmetic coder of fs/jffs2/compr_rubin.c: every output
+// byte is eight binary decisions, bit i with the probability bits[i]/divider
+// of being 1. rubinmips uses a fixed table, dynrubin stores its table in
+// the first 8 bytes of the node data. Old images only; mkfs.jffs2 never
+// picks these by default.
+
+const (
+	rubinRegSize   = 16
+	rubinUpperBit  = 1 << (rubinRegSize - 1)
+	rubinLowerBits = rubinUpperBit - 1
+
+	rubinDividerMIPS = 1043
+)
+
+var rubinBitsMIPS = [8]int{277, 249, 290, 267, 229, 341, 212, 241}
+
+type rubinState struct {
+	p, q, recQ int64
+	in         []byte
+	bit        int // next input bit; past the end reads as 0
+}
+
+func (rs *rubinState) pull() int64 {
+	i, shift := rs.bit>>3, 7-rs.bit&7
+	rs.bit++
+	if i >= len(rs.in) {
+		return 0
+	}
+	return int64(rs.in[i]>>shift) & 1
+}
+
+func (rs *rubinState) decode(a, b int64) int {
+	if rs.q >= rubinUpperBit || rs.p+rs.q <= rubinUpperBit {
+		bits := 0
+		for {
+			bits++
+			rs.q &= rubinLowerBits
+			rs.q <<= 1
+			rs.p <<= 1
+			if rs.q < rubinUpperBit && rs.p+rs.q > rubinUpperBit {
+				break
+			}
+		}
+		for ; bits > 0; bits-- {
+			rs.recQ &= rubinLowerBits
+			rs.recQ = rs.recQ<<1 + rs.pull()
+		}
+	}
+	i0 := a * rs.p / (a + b)
+	if i0 <= 0 {
+		i0 = 1
+	}
+	if i0 >= rs.p {
+		i0 = rs.p - 1
+	}
+	symbol := 0
+	if rs.recQ >= rs.q+i0 {
+		symbol = 1
+		rs.q += i0
+		i0 = rs.p - i0
+	}
+	rs.p = i0
+	return symbol
+}
+
+func rubinDecompress(in []byte, dsize, divider int, bits [8]int) []byte {
+	rs := &rubinState{p: 2 * rubinUpperBit, in: in}
+	for i := 0; i < rubinRegSize; i++ {
+		rs.recQ = rs.recQ<<1 + rs.pull()
+	}
+	out := make([]byte, dsize)
+	for o := range out {
+		var c byte
+		for i := 0; i < 8; i++ {
+			c |= byte(rs.decode(int64(divider-bits[i]), int64(bits[i]))) << i
+		}
+		out[o] = c
+	}
+	return out
+}
@@ -2,12 +2,17 @@ package partition
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"unicode/utf16"
+
+	"goimagetool/internal/common"
 )
 
 type gptHeader struct {
@@ -49,7 +54,22 @@ func readGPT(r io.ReadSeeker) (*Table, error) {
 	}
 	hdr := h
 
+	// поля заголовка не доверенные: без проверок битый GPT просит
+	// гигабайты под массив записей
+	if h.NumPartEntries > maxGPTEntries {
+		return nil, common.Corrupt("gpt", SectorSize+80, fmt.Sprintf("%d partition entries, at most %d supported", h.NumPartEntries, maxGPTEntries))
+	}
+	if h.PartEntrySize != 128 && h.PartEntrySize != 256 {
+		return nil, common.Corrupt("gpt", SectorSize+84, fmt.Sprintf("partition entry size %d, want 128 or 256", h.PartEntrySize))
+	}
 	peBytes := int64(h.NumPartEntries) * int64(h.PartEntrySize)
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if h.PartEntryLBA < 2 || h.PartEntryLBA > uint64(size)/SectorSize || int64(h.PartEntryLBA)*SectorSize+peBytes > size {
+		return nil, common.Corrupt("gpt", SectorSize+72, fmt.Sprintf("partition entries at LBA %d (%d bytes) outside the image", h.PartEntryLBA, peBytes))
+	}
 	if _, err := r.Seek(int64(h.PartEntryLBA)*int64(SectorSize), io.SeekStart); err != nil {
 		return nil, err
 	}
@@ -60,18 +80,13 @@ func readGPT(r io.ReadSeeker) (*Table, error) {
 	if crc32LE(data) != h.PartEntryArrayCRC {
 	}
 
-	var entries []gptEntry
-	br := bytes.NewReader(data)
+	var out []Entry
 	for i := uint32(0); i < h.NumPartEntries; i++ {
 		var e gptEntry
-		if err := binary.Read(br, binary.LittleEndian, &e); err != nil {
+		// записи по 256 байт: первые 128 — стандартные поля
+		if err := binary.Read(bytes.NewReader(data[int64(i)*int64(h.PartEntrySize):]), binary.LittleEndian, &e); err != nil {
 			return nil, err
 		}
-		entries = append(entries, e)
-	}
-	var out []Entry
-	for i := range entries {
-		e := &entries[i]
 		if isZero16(e.TypeGUID[:]) || e.FirstLBA == 0 || e.LastLBA == 0 || e.LastLBA < e.FirstLBA {
 			continue
 		}
@@ -89,7 +104,7 @@ func readGPT(r io.ReadSeeker) (*Table, error) {
 		SectorSize: SectorSize,
 		Entries:    out,
 		gptPrimary: &hdr,
-		gptPE:      entries,
+		gptPE:      data,
 	}, nil
 }
 
@@ -140,16 +155,10 @@ func (t *Table) ResizeAware(path string, newSize int64) error {
 		return err
 	}
 
-	peBuf := new(bytes.Buffer)
-	for i := range t.gptPE {
-		if err := binary.Write(peBuf, binary.LittleEndian, &t.gptPE[i]); err != nil {
-			return err
-		}
-	}
 	if _, err := fd.Seek(int64(newBackupPEStart)*int64(SectorSize), io.SeekStart); err != nil {
 		return err
 	}
-	if _, err := fd.Write(peBuf.Bytes()); err != nil {
+	if _, err := fd.Write(t.gptPE); err != nil {
 		return err
 	}
 
@@ -227,3 +236,207 @@ func isZero16(b []byte) bool {
 	}
 	return true
 }
+
+// GPTOptions — layout of a new table; zero values give what current
+// sgdisk/parted produce.
+type GPTOptions struct {
+	Entries int   // partition entry slots, default 128 (of 128 bytes each)
+	Align   int64 // partition start alignment in bytes, default 1 MiB
+}
+
+// PartSpec describes one partition of a new table.
+type PartSpec struct {
+	Name string
+	Type string // "linux", "efi", "swap", "bios" or a GUID; "" = linux
+	Size int64  // bytes, rounded up to sectors; 0 = up to the end of the disk
+}
+
+const (
+	gptEntrySize  = 128
+	gptHeaderSize = 92
+	// maxGPTEntries caps NumPartEntries on read (128 is the usual count)
+	maxGPTEntries = 1024
+)
+
+var gptTypes = map[string]string{
+	"linux": "0fc63daf-8483-4772-8e79-3d69d8477de4",
+	"efi":   "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+	"swap":  "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f",
+	"bios":  "21686148-6449-6e6f-744e-656564454649",
+}
+
+// CreateGPT writes a fresh protective MBR and primary/backup GPT into the
+// existing file at path, sized by the file itself (see `image resize`).
+// Partitions are laid out in order, each start aligned to opt.Align.
+func CreateGPT(path string, parts []PartSpec, opt GPTOptions) (*Table, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeGPT(fd, uint64(fi.Size())/SectorSize, parts, opt); err != nil {
+		return nil, err
+	}
+	return DetectR(fd)
+}
+
+func writeGPT(w io.WriterAt, sectors uint64, parts []PartSpec, opt GPTOptions) error {
+	if opt.Entries == 0 {
+		opt.Entries = 128
+	}
+	if opt.Align == 0 {
+		opt.Align = 1 << 20
+	}
+	if opt.Entries < len(parts) || opt.Entries > 1<<16 {
+		return fmt.Errorf("gpt: %d entries cannot hold %d partitions", opt.Entries, len(parts))
+	}
+	if opt.Align%SectorSize != 0 {
+		return fmt.Errorf("gpt: alignment %d is not a multiple of %d", opt.Align, SectorSize)
+	}
+	alignLBA := uint64(opt.Align / SectorSize)
+
+	peSectors := (uint64(opt.Entries)*gptEntrySize + SectorSize - 1) / SectorSize
+	if sectors < 2*(1+peSectors)+2 {
+		return fmt.Errorf("gpt: disk of %d sectors is too small", sectors)
+	}
+	lastLBA := sectors - 1
+	firstUsable := 2 + peSectors
+	lastUsable := lastLBA - peSectors - 1
+
+	pe := make([]gptEntry, opt.Entries)
+	next := firstUsable
+	for i, p := range parts {
+		start := (next + alignLBA - 1) / alignLBA * alignLBA
+		end := lastUsable
+		if p.Size > 0 {
+			end = start + (uint64(p.Size)+SectorSize-1)/SectorSize - 1
+		}
+		if start > lastUsable || end > lastUsable {
+			return fmt.Errorf("gpt: partition %d (%s) does not fit: ends at LBA %d, last usable %d", i+1, p.Name, end, lastUsable)
+		}
+		typ, err := parseGUID(gptTypeGUID(p.Type))
+		if err != nil {
+			return fmt.Errorf("gpt: partition %d: %w", i+1, err)
+		}
+		e := &pe[i]
+		e.TypeGUID = typ
+		if e.PartGUID, err = randomGUID(); err != nil {
+			return err
+		}
+		e.FirstLBA, e.LastLBA = start, end
+		u := utf16.Encode([]rune(p.Name))
+		if len(u) > len(e.NameUTF16)/2 {
+			return fmt.Errorf("gpt: partition name %q longer than 36 UTF-16 units", p.Name)
+		}
+		for j, v := range u {
+			binary.LittleEndian.PutUint16(e.NameUTF16[j*2:], v)
+		}
+		next = end + 1
+	}
+
+	var peBuf bytes.Buffer
+	if err := binary.Write(&peBuf, binary.LittleEndian, pe); err != nil {
+		return err
+	}
+	peBytes := make([]byte, peSectors*SectorSize)
+	copy(peBytes, peBuf.Bytes())
+
+	diskGUID, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	primary := gptHeader{
+		Rev:               0x00010000,
+		HdrSize:           gptHeaderSize,
+		CurrentLBA:        1,
+		BackupLBA:         lastLBA,
+		FirstUsableLBA:    firstUsable,
+		LastUsableLBA:     lastUsable,
+		DiskGUID:          diskGUID,
+		PartEntryLBA:      2,
+		NumPartEntries:    uint32(opt.Entries),
+		PartEntrySize:     gptEntrySize,
+		PartEntryArrayCRC: crc32LE(peBuf.Bytes()),
+	}
+	copy(primary.Sig[:], "EFI PART")
+	backup := primary
+	backup.CurrentLBA, backup.BackupLBA = lastLBA, 1
+	backup.PartEntryLBA = lastLBA - peSectors
+
+	mbr := make([]byte, SectorSize)
+	mbr[446+4] = 0xEE
+	putLE32(mbr[446+8:], 1)
+	n := lastLBA
+	if n > 0xFFFFFFFF {
+		n = 0xFFFFFFFF
+	}
+	putLE32(mbr[446+12:], uint32(n))
+	mbr[510], mbr[511] = 0x55, 0xAA
+
+	for _, blk := range []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, mbr},
+		{1, headerSector(primary)},
+		{2, peBytes},
+		{backup.PartEntryLBA, peBytes},
+		{lastLBA, headerSector(backup)},
+	} {
+		if _, err := w.WriteAt(blk.data, int64(blk.lba)*SectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headerSector renders h into a full sector with HdrCRC filled in.
+func headerSector(h gptHeader) []byte {
+	var b bytes.Buffer
+	h.HdrCRC = 0
+	_ = binary.Write(&b, binary.LittleEndian, &h)
+	sec := make([]byte, SectorSize)
+	copy(sec, b.Bytes())
+	putLE32(sec[16:20], crc32LE(sec[:h.HdrSize]))
+	return sec
+}
+
+func gptTypeGUID(t string) string {
+	if t == "" {
+		t = "linux"
+	}
+	if g, ok := gptTypes[strings.ToLower(t)]; ok {
+		return g
+	}
+	return t
+}
+
+// parseGUID — обратное к guidStr (первые три поля little-endian).
+func parseGUID(s string) ([16]byte, error) {
+	var g [16]byte
+	h := strings.ReplaceAll(s, "-", "")
+	raw, err := hex.DecodeString(h)
+	if err != nil || len(raw) != 16 || len(s) != 36 {
+		return g, fmt.Errorf("bad GUID %q", s)
+	}
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(g[8:], raw[8:])
+	return g, nil
+}
+
+// randomGUID — version 4 GUID in on-disk byte order.
+func randomGUID() ([16]byte, error) {
+	var g [16]byte
+	if _, err := rand.Read(g[:]); err != nil {
+		return g, err
+	}
+	g[7] = g[7]&0x0f | 0x40 // version (little-endian field)
+	g[8] = g[8]&0x3f | 0x80 // variant
+	return g, nil
+}
@@ -0,0 +1,199 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"goimagetool/internal/common"
+)
+
+func newDisk(t *testing.T, size int64) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(p, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(p, size); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// checkHeader validates the header at lba and its entry array CRC.
+func checkHeader(t *testing.T, img []byte, lba uint64) gptHeader {
+	t.Helper()
+	sec := img[lba*SectorSize : (lba+1)*SectorSize]
+	var h gptHeader
+	if err := binary.Read(bytes.NewReader(sec), binary.LittleEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	if string(h.Sig[:]) != "EFI PART" {
+		t.Fatalf("LBA %d: no GPT signature", lba)
+	}
+	hdr := append([]byte(nil), sec[:h.HdrSize]...)
+	putLE32(hdr[16:20], 0)
+	if got := crc32LE(hdr); got != h.HdrCRC {
+		t.Errorf("LBA %d: header CRC %08x, stored %08x", lba, got, h.HdrCRC)
+	}
+	pe := img[h.PartEntryLBA*SectorSize:][:h.NumPartEntries*h.PartEntrySize]
+	if got := crc32LE(pe); got != h.PartEntryArrayCRC {
+		t.Errorf("LBA %d: entry array CRC %08x, stored %08x", lba, got, h.PartEntryArrayCRC)
+	}
+	return h
+}
+
+func TestCreateGPTDefaults(t *testing.T) {
+	const size = 16 << 20
+	p := newDisk(t, size)
+	tab, err := CreateGPT(p, []PartSpec{{Name: "boot", Type: "efi", Size: 3 << 20}, {Name: "rootfs"}}, GPTOptions{})
+	if err != nil {
+		t.Fatalf("CreateGPT: %v", err)
+	}
+	img, _ := os.ReadFile(p)
+	f, _ := os.Open(p)
+	defer f.Close()
+	got, err := readGPT(f)
+	if err != nil {
+		t.Fatalf("readGPT: %v", err)
+	}
+	if len(got.Entries) != 2 || len(tab.Entries) != 2 {
+		t.Fatalf("entries: %+v", got.Entries)
+	}
+
+	last := uint64(size/SectorSize - 1)
+	h := checkHeader(t, img, 1)
+	b := checkHeader(t, img, last)
+	if h.NumPartEntries != 128 || h.PartEntrySize != 128 {
+		t.Errorf("entries %d x %d, want 128 x 128", h.NumPartEntries, h.PartEntrySize)
+	}
+	if h.FirstUsableLBA != 34 || h.LastUsableLBA != last-33 {
+		t.Errorf("usable %d..%d, want 34..%d", h.FirstUsableLBA, h.LastUsableLBA, last-33)
+	}
+	if h.BackupLBA != last || b.BackupLBA != 1 || b.PartEntryLBA != last-32 {
+		t.Errorf("backup: primary->%d, backup->%d, backup array at %d", h.BackupLBA, b.BackupLBA, b.PartEntryLBA)
+	}
+
+	boot, root := got.Entries[0], got.Entries[1]
+	if boot.Name != "boot" || boot.Type != gptTypes["efi"] || boot.StartLBA != 2048 || boot.EndLBA != 2048+6144-1 {
+		t.Errorf("boot: %+v", boot)
+	}
+	if root.Name != "rootfs" || root.Type != gptTypes["linux"] || root.StartLBA != 8192 || root.EndLBA != h.LastUsableLBA {
+		t.Errorf("rootfs: %+v", root)
+	}
+	if !isProtectiveMBR(img[:SectorSize]) {
+		t.Error("no protective MBR")
+	}
+}
+
+func TestCreateGPTEntriesAlign(t *testing.T) {
+	p := newDisk(t, 4<<20)
+	if _, err := CreateGPT(p, []PartSpec{{Name: "a", Size: 1000}, {Name: "b", Size: 4096}}, GPTOptions{Entries: 4, Align: 4096}); err != nil {
+		t.Fatalf("CreateGPT: %v", err)
+	}
+	img, _ := os.ReadFile(p)
+	h := checkHeader(t, img, 1)
+	if h.NumPartEntries != 4 || h.FirstUsableLBA != 3 {
+		t.Errorf("entries %d, first usable %d; want 4, 3", h.NumPartEntries, h.FirstUsableLBA)
+	}
+	f, _ := os.Open(p)
+	defer f.Close()
+	got, err := readGPT(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := got.Entries; len(e) != 2 || e[0].StartLBA != 8 || e[0].EndLBA != 9 || e[1].StartLBA != 16 || e[1].EndLBA != 23 {
+		t.Errorf("layout: %+v", e)
+	}
+}
+
+func TestCreateGPTRejects(t *testing.T) {
+	p := newDisk(t, 2<<20)
+	for name, tc := range map[string]struct {
+		parts []PartSpec
+		opt   GPTOptions
+	}{
+		"too few entries": {[]PartSpec{{Name: "a"}, {Name: "b"}}, GPTOptions{Entries: 1}},
+		"odd align":       {[]PartSpec{{Name: "a"}}, GPTOptions{Align: 1000}},
+		"does not fit":    {[]PartSpec{{Name: "a", Size: 4 << 20}}, GPTOptions{}},
+		"bad type":        {[]PartSpec{{Name: "a", Type: "nope"}}, GPTOptions{}},
+	} {
+		if _, err := CreateGPT(p, tc.parts, tc.opt); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// gptDisk is a small disk with two GPT partitions, as bytes.
+func gptDisk(t testing.TB) []byte {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(p, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateGPT(p, []PartSpec{{Name: "a", Size: 64 << 10}, {Name: "b"}}, GPTOptions{Align: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestReadGPTRejectsBadHeader(t *testing.T) {
+	for name, patch := range map[string]func(h []byte){
+		"huge entry count": func(h []byte) { binary.LittleEndian.PutUint32(h[80:], 1<<31) },
+		"entry size 0":     func(h []byte) { binary.LittleEndian.PutUint32(h[84:], 0) },
+		"entry size 512":   func(h []byte) { binary.LittleEndian.PutUint32(h[84:], 512) },
+		"entries past end": func(h []byte) { binary.LittleEndian.PutUint64(h[72:], 2040) },
+		"entries at LBA 0": func(h []byte) { binary.LittleEndian.PutUint64(h[72:], 0) },
+		"huge entry LBA":   func(h []byte) { binary.LittleEndian.PutUint64(h[72:], 1<<62) },
+	} {
+		img := gptDisk(t)
+		patch(img[SectorSize:])
+		if _, err := readGPT(bytes.NewReader(img)); !errors.Is(err, common.ErrCorrupt) {
+			t.Errorf("%s: got %v, want ErrCorrupt", name, err)
+		}
+	}
+}
+
+// Entries of 256 bytes: the first 128 are the standard fields.
+func TestReadGPTWideEntries(t *testing.T) {
+	img := gptDisk(t)
+	h := img[SectorSize:]
+	n := binary.LittleEndian.Uint32(h[80:])
+	pe := img[2*SectorSize:]
+	wide := make([]byte, 2*len(pe[:n*128]))
+	for i := uint32(0); i < n; i++ {
+		copy(wide[i*256:], pe[i*128:(i+1)*128])
+	}
+	copy(pe, wide)
+	binary.LittleEndian.PutUint32(h[84:], 256)
+	got, err := readGPT(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != 2 || got.Entries[0].Name != "a" || got.Entries[1].Name != "b" {
+		t.Errorf("entries: %+v", got.Entries)
+	}
+}
+
+// Random header fields must never panic or allocate more than the image.
+func FuzzReadGPTHeader(f *testing.F) {
+	img := gptDisk(f)
+	f.Add(img[SectorSize : SectorSize+gptHeaderSize])
+	f.Add(make([]byte, gptHeaderSize))
+	f.Fuzz(func(t *testing.T, hdr []byte) {
+		disk := append([]byte(nil), img...)
+		copy(disk[SectorSize:SectorSize+gptHeaderSize], hdr)
+		copy(disk[SectorSize:], "EFI PART")
+		tab, err := readGPT(bytes.NewReader(disk))
+		if err == nil && int64(len(tab.gptPE)) > int64(len(disk)) {
+			t.Fatalf("entry array of %d bytes from a %d-byte image", len(tab.gptPE), len(disk))
+		}
+	})
+}
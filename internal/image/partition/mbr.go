@@ -3,6 +3,7 @@ package partition
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 type mbrEntry struct {
@@ -14,7 +15,34 @@ type mbrEntry struct {
 	Sect uint32
 }
 
-func readMBR(sec []byte) (*Table, error) {
+func isExtended(typ byte) bool { return typ == 0x05 || typ == 0x0F || typ == 0x85 }
+
+func parseMBREntry(sec []byte, i int) mbrEntry {
+	off := 446 + i*16
+	return mbrEntry{
+		Boot: sec[off],
+		Type: sec[off+4],
+		LBA:  binary.LittleEndian.Uint32(sec[off+8:]),
+		Sect: binary.LittleEndian.Uint32(sec[off+12:]),
+	}
+}
+
+func mbrPart(idx int, base uint64, e mbrEntry) Entry {
+	start := base + uint64(e.LBA)
+	return Entry{
+		Index:    idx,
+		StartLBA: start,
+		EndLBA:   start + uint64(e.Sect) - 1,
+		Type:     fmt.Sprintf("MBR 0x%02X", e.Type),
+		Bootable: e.Boot == 0x80,
+	}
+}
+
+// readMBR lists the primary partitions under their slot numbers (1-4) and
+// the logical ones from the extended partition's EBR chain as 5, 6, ...,
+// like Linux does. The extended container itself is not listed. r is only
+// read when there is an extended partition.
+func readMBR(sec []byte, r io.ReadSeeker) (*Table, error) {
 	if len(sec) < SectorSize {
 		return nil, fmt.Errorf("short mbr")
 	}
@@ -22,27 +50,27 @@ func readMBR(sec []byte) (*Table, error) {
 		return nil, fmt.Errorf("bad mbr signature")
 	}
 	var ents []Entry
+	var ext *mbrEntry
 	for i := 0; i < 4; i++ {
-		off := 446 + i*16
-		e := mbrEntry{
-			Boot: sec[off],
-			Type: sec[off+4],
-			LBA:  binary.LittleEndian.Uint32(sec[off+8:]),
-			Sect: binary.LittleEndian.Uint32(sec[off+12:]),
-		}
+		e := parseMBREntry(sec, i)
 		if e.Type == 0 || e.Sect == 0 {
 			continue
 		}
-		start := uint64(e.LBA)
-		end := start + uint64(e.Sect) - 1
-		ents = append(ents, Entry{
-			Index:    len(ents) + 1,
-			StartLBA: start,
-			EndLBA:   end,
-			Type:     fmt.Sprintf("MBR 0x%02X", e.Type),
-			Name:     "",
-			Bootable: e.Boot == 0x80,
-		})
+		if isExtended(e.Type) {
+			if ext != nil {
+				return nil, fmt.Errorf("mbr: more than one extended partition")
+			}
+			ext = &e
+			continue
+		}
+		ents = append(ents, mbrPart(i+1, 0, e))
+	}
+	if ext != nil {
+		logical, err := readEBRChain(r, uint64(ext.LBA), uint64(ext.Sect))
+		if err != nil {
+			return nil, err
+		}
+		ents = append(ents, logical...)
 	}
 	return &Table{
 		Scheme:     MBR,
@@ -50,3 +78,45 @@ func readMBR(sec []byte) (*Table, error) {
 		Entries:    ents,
 	}, nil
 }
+
+// readEBRChain follows the extended boot records inside the extended
+// partition [extStart, extStart+extSize). In each EBR the first entry is the
+// logical partition, relative to that EBR; the second points to the next
+// EBR, relative to extStart. EBRs need not be in disk order, but a chain
+// that comes back to an EBR already read is rejected.
+func readEBRChain(r io.ReadSeeker, extStart, extSize uint64) ([]Entry, error) {
+	var ents []Entry
+	seen := map[uint64]bool{}
+	sec := make([]byte, SectorSize)
+	for ebr := extStart; ; {
+		seen[ebr] = true
+		if _, err := r.Seek(int64(ebr)*SectorSize, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, sec); err != nil {
+			return nil, fmt.Errorf("mbr: EBR at LBA %d: %w", ebr, err)
+		}
+		if sec[510] != 0x55 || sec[511] != 0xAA {
+			return nil, fmt.Errorf("mbr: EBR at LBA %d: bad signature", ebr)
+		}
+		if e := parseMBREntry(sec, 0); e.Type != 0 && e.Sect != 0 {
+			p := mbrPart(5+len(ents), ebr, e)
+			if p.EndLBA >= extStart+extSize {
+				return nil, fmt.Errorf("mbr: logical partition %d runs past the extended partition", p.Index)
+			}
+			ents = append(ents, p)
+		}
+		next := parseMBREntry(sec, 1)
+		if !isExtended(next.Type) || next.Sect == 0 {
+			return ents, nil
+		}
+		n := extStart + uint64(next.LBA)
+		if n >= extStart+extSize {
+			return nil, fmt.Errorf("mbr: EBR at LBA %d links to LBA %d outside the extended partition", ebr, n)
+		}
+		if seen[n] {
+			return nil, fmt.Errorf("mbr: EBR at LBA %d links back to LBA %d (loop)", ebr, n)
+		}
+		ebr = n
+	}
+}
@@ -0,0 +1,92 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+// putMBREntry fills slot i of the boot record at sector lba of img.
+func putMBREntry(img []byte, lba, i int, typ byte, start, sectors uint32) {
+	sec := img[lba*SectorSize:]
+	off := 446 + i*16
+	sec[off+4] = typ
+	binary.LittleEndian.PutUint32(sec[off+8:], start)
+	binary.LittleEndian.PutUint32(sec[off+12:], sectors)
+	sec[510], sec[511] = 0x55, 0xAA
+}
+
+// mbrDisk: primary 1 at 2048, slot 2 empty, extended in slot 3 at 4096
+// holding logicals at 4096+63 and 6144+63; each partition starts with a
+// marker string.
+func mbrDisk() []byte {
+	img := make([]byte, 10000*SectorSize)
+	putMBREntry(img, 0, 0, 0x83, 2048, 1024)
+	img[446] = 0x80
+	putMBREntry(img, 0, 2, 0x0F, 4096, 4096)
+	putMBREntry(img, 4096, 0, 0x83, 63, 1000)
+	putMBREntry(img, 4096, 1, 0x05, 2048, 2000)
+	putMBREntry(img, 6144, 0, 0x82, 63, 1000)
+	copy(img[2048*SectorSize:], "primary")
+	copy(img[(4096+63)*SectorSize:], "logical5")
+	copy(img[(6144+63)*SectorSize:], "logical6")
+	return img
+}
+
+func TestMBRLogicalPartitions(t *testing.T) {
+	tab, err := DetectR(bytes.NewReader(mbrDisk()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{
+		{Index: 1, StartLBA: 2048, EndLBA: 3071, Type: "MBR 0x83", Bootable: true},
+		{Index: 5, StartLBA: 4159, EndLBA: 5158, Type: "MBR 0x83"},
+		{Index: 6, StartLBA: 6207, EndLBA: 7206, Type: "MBR 0x82"},
+	}
+	if tab.Scheme != MBR || len(tab.Entries) != len(want) {
+		t.Fatalf("got %+v", tab.Entries)
+	}
+	for i, e := range tab.Entries {
+		if e != want[i] {
+			t.Errorf("entry %d: %+v, want %+v", i, e, want[i])
+		}
+	}
+	if _, ok := tab.findIdx("2"); ok {
+		t.Error("empty slot 2 resolved")
+	}
+}
+
+func TestMBRExtractLogical(t *testing.T) {
+	p := newDisk(t, 0)
+	if err := os.WriteFile(p, mbrDisk(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := p + ".p6"
+	if err := Extract(p, "6", out); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(out)
+	if len(b) != 1000*SectorSize || !bytes.HasPrefix(b, []byte("logical6")) {
+		t.Errorf("partition 6: %d bytes starting %q", len(b), b[:8])
+	}
+}
+
+func TestMBRBadEBRChain(t *testing.T) {
+	for name, tc := range map[string]struct {
+		patch func(img []byte)
+		want  string
+	}{
+		"loop":        {func(img []byte) { putMBREntry(img, 6144, 1, 0x05, 0, 2000) }, "loop"},
+		"outside":     {func(img []byte) { putMBREntry(img, 6144, 1, 0x05, 5000, 10) }, "outside"},
+		"no EBR":      {func(img []byte) { img[6144*SectorSize+510] = 0 }, "bad signature"},
+		"past extent": {func(img []byte) { putMBREntry(img, 6144, 0, 0x83, 63, 4000) }, "runs past"},
+	} {
+		img := mbrDisk()
+		tc.patch(img)
+		if _, err := DetectR(bytes.NewReader(img)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", name, err, tc.want)
+		}
+	}
+}
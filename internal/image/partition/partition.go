@@ -8,6 +8,8 @@ import (
 	"io"
 	"os"
 	"strings"
+
+	"goimagetool/internal/common"
 )
 
 const (
@@ -38,10 +40,11 @@ type Table struct {
 	// GPT specifics
 	gptPrimary *gptHeader
 	gptBackup  *gptHeader
-	gptPE      []gptEntry
+	gptPE      []byte // entry array as read, rewritten as is by ResizeAware
 }
 
-var errNoPT = errors.New("no partition table")
+// ErrNoTable: neither an MBR nor a GPT with partitions.
+var ErrNoTable = errors.New("no partition table")
 
 func Detect(path string) (*Table, error) {
 	f, err := os.Open(path)
@@ -66,14 +69,18 @@ func DetectR(r io.ReadSeeker) (*Table, error) {
 			return t, nil
 		}
 	}
-	if t, err := readMBR(buf); err == nil && len(t.Entries) > 0 {
+	t, mbrErr := readMBR(buf, r)
+	if mbrErr == nil && len(t.Entries) > 0 {
 		return t, nil
 	}
 	// Try GPT even if not protective (some tools write bad MBR)
 	if t, err := readGPT(r); err == nil && len(t.Entries) > 0 {
 		return t, nil
 	}
-	return nil, errNoPT
+	if mbrErr != nil && sigOK(buf) {
+		return nil, mbrErr // битая цепочка EBR, а не отсутствие таблицы
+	}
+	return nil, ErrNoTable
 }
 
 func List(path string) ([]Entry, Scheme, error) {
@@ -98,6 +105,9 @@ func Extract(path string, idxOrName string, out string) error {
 		return err
 	}
 	defer f.Close()
+	if err := common.PrepareOutput(out); err != nil {
+		return err
+	}
 	g, err := os.Create(out)
 	if err != nil {
 		return err
@@ -193,12 +203,14 @@ func Replace(path string, idxOrName string, in string) error {
 }
 
 func (t *Table) findIdx(s string) (int, bool) {
-	// by index (1-based)
+	// by index (1-based; MBR logical partitions start at 5)
 	if len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
 		var x int
 		fmt.Sscanf(s, "%d", &x)
-		if x >= 1 && x <= len(t.Entries) {
-			return x - 1, true
+		for i, e := range t.Entries {
+			if e.Index == x {
+				return i, true
+			}
 		}
 	}
 	// by name (GPT)
@@ -211,11 +223,12 @@ func (t *Table) findIdx(s string) (int, bool) {
 	return 0, false
 }
 
+func sigOK(sec []byte) bool {
+	return len(sec) >= SectorSize && sec[510] == 0x55 && sec[511] == 0xAA
+}
+
 func isProtectiveMBR(sec []byte) bool {
-	if len(sec) < SectorSize {
-		return false
-	}
-	if sec[510] != 0x55 || sec[511] != 0xAA {
+	if !sigOK(sec) {
 		return false
 	}
 	for i := 0; i < 4; i++ {
@@ -0,0 +1,379 @@
+// Package romfs reads and writes the Linux romfs format
+// (Documentation/filesystems/romfs.rst): a superblock with the
+// "-rom1fs-" signature and a volume name, then 16-byte aligned file
+// headers chained by their next field. Everything is big-endian.
+//
+// romfs keeps only the file type and an executable bit: owners, mtimes
+// and the other permission bits do not survive Store. Load gives the modes
+// the kernel shows (0644, 0755 with the exec bit, 0777 symlinks, 0600
+// devices), owner 0:0 and mtime 0.
+package romfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// Signature starts every romfs image.
+const Signature = "-rom1fs-"
+
+const (
+	align      = 16
+	headerSize = 16
+	// the superblock checksum covers this much of the image (or all of a
+	// smaller one)
+	checksumSpan = 512
+	// Store pads the image to a multiple of this, as genromfs does, so it
+	// can go on a block device as is
+	padTo = 1024
+
+	maxHardlinkHops = 16
+	maxDepth        = 256
+)
+
+// file types in the low 3 bits of a header's next field
+const (
+	typeHardlink = 0
+	typeDir      = 1
+	typeFile     = 2
+	typeSymlink  = 3
+	typeBlock    = 4
+	typeChar     = 5
+	typeSocket   = 6
+	typeFIFO     = 7
+
+	flagExec = 8
+	typeMask = 7
+	nextMask = ^uint32(15)
+)
+
+// ErrNotRomfs: no "-rom1fs-" signature.
+var ErrNotRomfs = errors.New("romfs: no -rom1fs- signature")
+
+// IsRomfs reports whether b starts with the romfs signature.
+func IsRomfs(b []byte) bool {
+	return len(b) >= len(Signature) && string(b[:len(Signature)]) == Signature
+}
+
+// Superblock: what the first header holds besides the signature.
+type Superblock struct {
+	Size   uint32 // full_size: the bytes that belong to the filesystem
+	Volume string
+}
+
+// checksum is the sum of the big-endian 32-bit words of b (len a
+// multiple of 4); a valid block sums to 0.
+func checksum(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i+4 <= len(b); i += 4 {
+		sum += binary.BigEndian.Uint32(b[i:])
+	}
+	return sum
+}
+
+func alignUp(n int) int {
+	return int(common.AlignUp(uint64(n), align))
+}
+
+// cstring reads a NUL-terminated name at off; it ends within the image.
+func cstring(b []byte, off int) (string, int, error) {
+	end := bytes.IndexByte(b[off:], 0)
+	if end < 0 {
+		return "", 0, common.Corrupt("romfs", int64(off), "name runs past the end of the image")
+	}
+	return string(b[off : off+end]), alignUp(end + 1), nil
+}
+
+// Load reads a romfs image. The superblock checksum must match, as the
+// kernel requires to mount it.
+func Load(r io.Reader) (*memfs.FS, *Superblock, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !IsRomfs(b) {
+		return nil, nil, ErrNotRomfs
+	}
+	if len(b) < 32 {
+		return nil, nil, common.TooSmall("romfs", "a romfs image", int64(len(b)), 32)
+	}
+	size := binary.BigEndian.Uint32(b[8:])
+	if int64(size) > int64(len(b)) || size < 32 {
+		return nil, nil, common.Corrupt("romfs", 8, fmt.Sprintf("full size %d, image has %d bytes", size, len(b)))
+	}
+	b = b[:size]
+	if checksum(b[:min(checksumSpan, len(b))&^3]) != 0 {
+		return nil, nil, common.Corrupt("romfs", 12, "bad superblock checksum")
+	}
+	vol, n, err := cstring(b, 16)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs := memfs.New()
+	l := &loader{b: b, fs: fs, seen: map[int]bool{}}
+	if err := l.dir(16+n, "/", 0); err != nil {
+		return nil, nil, err
+	}
+	return fs, &Superblock{Size: size, Volume: vol}, nil
+}
+
+type loader struct {
+	b    []byte
+	fs   *memfs.FS
+	seen map[int]bool // headers already read: a loop in a corrupt image
+}
+
+type header struct {
+	off        int
+	next, info uint32
+	size       uint32
+	name       string
+	data       int // offset of the data after the name
+}
+
+func (l *loader) header(off int) (*header, error) {
+	if off%align != 0 || off+headerSize > len(l.b) {
+		return nil, common.Corrupt("romfs", int64(off), "file header outside the image")
+	}
+	h := &header{
+		off: off, next: binary.BigEndian.Uint32(l.b[off:]),
+		info: binary.BigEndian.Uint32(l.b[off+4:]), size: binary.BigEndian.Uint32(l.b[off+8:]),
+	}
+	name, n, err := l.cstring(off + headerSize)
+	if err != nil {
+		return nil, err
+	}
+	h.name, h.data = name, off+headerSize+n
+	return h, nil
+}
+
+func (l *loader) cstring(off int) (string, int, error) {
+	if off >= len(l.b) {
+		return "", 0, common.Corrupt("romfs", int64(off), "name outside the image")
+	}
+	return cstring(l.b, off)
+}
+
+func (l *loader) bytes(h *header) ([]byte, error) {
+	if int64(h.data)+int64(h.size) > int64(len(l.b)) {
+		return nil, common.Corrupt("romfs", int64(h.off), fmt.Sprintf("%d bytes of data run past the end of the image", h.size))
+	}
+	return l.b[h.data : h.data+int(h.size)], nil
+}
+
+// dir reads the header list starting at off into directory p.
+func (l *loader) dir(off int, p string, depth int) error {
+	if depth > maxDepth {
+		return common.Corrupt("romfs", int64(off), fmt.Sprintf("directories nested deeper than %d", maxDepth))
+	}
+	for off != 0 {
+		if l.seen[off] {
+			return common.Corrupt("romfs", int64(off), "file header reached twice (loop in the header chain)")
+		}
+		l.seen[off] = true
+		h, err := l.header(off)
+		if err != nil {
+			return err
+		}
+		next := int(h.next & nextMask)
+		if h.name != "." && h.name != ".." && h.name != "" && !strings.Contains(h.name, "/") {
+			if err := l.entry(h, path.Join(p, h.name), depth); err != nil {
+				return common.WithPath("romfs", path.Join(p, h.name), err)
+			}
+		}
+		off = next
+	}
+	return nil
+}
+
+func (l *loader) entry(h *header, p string, depth int) error {
+	t := h
+	for hops := 0; t.next&typeMask == typeHardlink; hops++ {
+		if hops == maxHardlinkHops {
+			return common.Corrupt("romfs", int64(h.off), "hard link chain too long")
+		}
+		var err error
+		if t, err = l.header(int(t.info)); err != nil {
+			return err
+		}
+	}
+	mt := time.Unix(0, 0)
+	var exec memfs.Mode
+	if t.next&flagExec != 0 {
+		exec = 0o111
+	}
+	switch t.next & typeMask {
+	case typeDir:
+		l.fs.PutDirMode(p, memfs.ModeDir|0o644|exec, 0, 0, mt)
+		return l.dir(int(t.info), p, depth+1)
+	case typeFile:
+		data, err := l.bytes(t)
+		if err != nil {
+			return err
+		}
+		l.fs.PutFile(p, data, memfs.ModeFile|0o644|exec, 0, 0, mt)
+	case typeSymlink:
+		data, err := l.bytes(t)
+		if err != nil {
+			return err
+		}
+		l.fs.PutSymlink(p, string(bytes.TrimRight(data, "\x00")), 0, 0, mt)
+	case typeBlock, typeChar:
+		typ := memfs.ModeBlock
+		if t.next&typeMask == typeChar {
+			typ = memfs.ModeChar
+		}
+		l.fs.PutNode(p, typ, uint32(0o600|exec), 0, 0, t.info>>16, t.info&0xffff, mt)
+	case typeFIFO:
+		l.fs.PutNode(p, memfs.ModeFIFO, uint32(0o644|exec), 0, 0, 0, 0, mt)
+	case typeSocket:
+		// memfs has no sockets
+	}
+	return nil
+}
+
+// Options for Store.
+type Options struct {
+	Volume string // volume name; "" = "romfs" (genromfs puts a timestamp here)
+}
+
+type node struct {
+	name     string
+	typ      uint32
+	exec     bool
+	info     uint32
+	link     *node // hard link target ("." and "..")
+	data     []byte
+	children []*node
+	off      int
+	next     int
+}
+
+// Store writes fs as a romfs image. Directories list "." and ".." first,
+// as genromfs writes them; other entries follow in name order.
+func Store(w io.Writer, fs *memfs.FS, opt Options) error {
+	vol := opt.Volume
+	if vol == "" {
+		vol = "romfs"
+	}
+	if strings.IndexByte(vol, 0) >= 0 {
+		return errors.New("romfs: volume name contains NUL")
+	}
+	root, err := tree(fs, "/")
+	if err != nil {
+		return err
+	}
+	// the root has no header of its own: its "." stands for it
+	dot := &node{name: ".", typ: typeDir, exec: true}
+	dot.children = append([]*node{dot, {name: "..", typ: typeHardlink, link: dot}}, root...)
+	list := dot.children
+	pos := headerSize + alignUp(len(vol)+1)
+	layout(list, dot, &pos)
+	dot.info = uint32(dot.off)
+	if int64(pos) > 1<<32-padTo {
+		return fmt.Errorf("romfs: image of %d bytes is over the 4 GiB the format can address", pos)
+	}
+	size := int(common.AlignUp(uint64(pos), padTo))
+	img := make([]byte, size)
+	copy(img, Signature)
+	binary.BigEndian.PutUint32(img[8:], uint32(size))
+	copy(img[16:], vol)
+	emit(img, list)
+	binary.BigEndian.PutUint32(img[12:], -checksum(img[:min(checksumSpan, size)]))
+	_, err = w.Write(img)
+	return err
+}
+
+// tree builds the nodes below directory dir.
+func tree(fs *memfs.FS, dir string) ([]*node, error) {
+	var out []*node
+	ents := fs.List(dir)
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name < ents[j].Name })
+	for _, e := range ents {
+		n := &node{name: path.Base(e.Name), exec: memfs.EffectivePerm(e)&0o111 != 0}
+		switch e.Mode.Type() {
+		case memfs.ModeDir:
+			n.typ = typeDir
+			kids, err := tree(fs, e.Name)
+			if err != nil {
+				return nil, err
+			}
+			n.children = kids
+		case memfs.ModeFile:
+			if int64(len(e.Data)) >= 1<<32 {
+				return nil, fmt.Errorf("romfs: %s: %d bytes, the format stores at most 4 GiB per file", e.Name, len(e.Data))
+			}
+			n.typ, n.data = typeFile, e.Data
+		case memfs.ModeLink:
+			n.typ, n.data = typeSymlink, []byte(e.Target)
+		case memfs.ModeBlock, memfs.ModeChar:
+			if e.RdevMajor > 0xffff || e.RdevMinor > 0xffff {
+				return nil, fmt.Errorf("romfs: %s: device %d:%d does not fit 16-bit major/minor", e.Name, e.RdevMajor, e.RdevMinor)
+			}
+			n.typ, n.info = typeChar, e.RdevMajor<<16|e.RdevMinor
+			if e.Mode.Type() == memfs.ModeBlock {
+				n.typ = typeBlock
+			}
+		case memfs.ModeFIFO:
+			n.typ = typeFIFO
+		default:
+			return nil, fmt.Errorf("romfs: %s: unsupported file type %o", e.Name, e.Mode.Type())
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// layout gives every node of list (and of the directories in it) its
+// header offset: a directory's entries follow its header directly.
+// parent is the node whose header ".." entries link to.
+func layout(list []*node, parent *node, pos *int) {
+	for i, n := range list {
+		n.off = *pos
+		*pos += headerSize + alignUp(len(n.name)+1) + alignUp(len(n.data))
+		if n.typ == typeDir && n.name != "." {
+			self := &node{name: ".", typ: typeHardlink, link: n}
+			up := &node{name: "..", typ: typeHardlink, link: parent}
+			n.children = append([]*node{self, up}, n.children...)
+			layout(n.children, n, pos)
+			n.info = uint32(n.children[0].off)
+		}
+		if i > 0 {
+			list[i-1].next = n.off
+		}
+	}
+}
+
+func emit(img []byte, list []*node) {
+	for _, n := range list {
+		h := img[n.off:]
+		next := uint32(n.next) | n.typ
+		if n.exec || n.typ == typeHardlink && n.link.exec {
+			next |= flagExec
+		}
+		info := n.info
+		if n.link != nil {
+			info = uint32(n.link.off)
+		}
+		binary.BigEndian.PutUint32(h, next)
+		binary.BigEndian.PutUint32(h[4:], info)
+		binary.BigEndian.PutUint32(h[8:], uint32(len(n.data)))
+		nameLen := alignUp(len(n.name) + 1)
+		copy(h[headerSize:], n.name)
+		binary.BigEndian.PutUint32(h[12:], -checksum(h[:headerSize+nameLen]))
+		copy(h[headerSize+nameLen:], n.data)
+		if n.typ == typeDir && n.name != "." {
+			emit(img, n.children)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package romfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"goimagetool/internal/fs/memfs"
+)
+
+func TestStoreLoad(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutDir("/bin", 0, 0, mt)
+	src.PutFile("/bin/busybox", bytes.Repeat([]byte{0x7f, 'E', 'L', 'F'}, 100), memfs.ModeFile|0o755, 0, 0, mt)
+	src.PutSymlink("/bin/sh", "busybox", 0, 0, mt)
+	src.PutFile("/etc/motd", []byte("hello\n"), memfs.ModeFile|0o600, 1000, 1000, mt)
+	src.PutDirMode("/etc/empty", memfs.ModeDir|0o700, 0, 0, mt)
+	src.PutNode("/dev/console", memfs.ModeChar, 0o600, 0, 0, 5, 1, mt)
+	src.PutNode("/dev/mmcblk0", memfs.ModeBlock, 0o660, 0, 0, 179, 0, mt)
+	src.PutNode("/dev/initctl", memfs.ModeFIFO, 0o600, 0, 0, 0, 0, mt)
+
+	var buf bytes.Buffer
+	if err := Store(&buf, src, Options{Volume: "test vol"}); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	if len(img)%padTo != 0 || binary.BigEndian.Uint32(img[8:]) != uint32(len(img)) {
+		t.Fatalf("image of %d bytes, full size %d", len(img), binary.BigEndian.Uint32(img[8:]))
+	}
+	fs, sb, err := Load(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Volume != "test vol" {
+		t.Fatalf("volume %q", sb.Volume)
+	}
+	want := map[string]memfs.Mode{
+		"/bin": memfs.ModeDir | 0o755, "/dev": memfs.ModeDir | 0o755, "/bin/busybox": memfs.ModeFile | 0o755, "/bin/sh": memfs.ModeLink | 0o777,
+		"/etc": memfs.ModeDir | 0o755, "/etc/motd": memfs.ModeFile | 0o644, "/etc/empty": memfs.ModeDir | 0o755,
+		"/dev/console": memfs.ModeChar | 0o600, "/dev/mmcblk0": memfs.ModeBlock | 0o600, "/dev/initctl": memfs.ModeFIFO | 0o644,
+	}
+	n := 0
+	_ = fs.Walk(func(e *memfs.Entry) error {
+		if e.Name == "/" {
+			return nil
+		}
+		n++
+		if m, ok := want[e.Name]; !ok || e.Mode != m {
+			t.Errorf("%s: mode %o, want %o", e.Name, e.Mode, m)
+		}
+		if s, ok := src.Get(e.Name); ok && !bytes.Equal(s.Data, e.Data) {
+			t.Errorf("%s: data differs", e.Name)
+		}
+		return nil
+	})
+	if n != len(want) {
+		t.Fatalf("%d entries, want %d", n, len(want))
+	}
+	if e, _ := fs.Get("/bin/sh"); e.Target != "busybox" {
+		t.Fatalf("/bin/sh -> %q", e.Target)
+	}
+	if e, _ := fs.Get("/dev/mmcblk0"); e.RdevMajor != 179 || e.RdevMinor != 0 {
+		t.Fatalf("/dev/mmcblk0 %d:%d", e.RdevMajor, e.RdevMinor)
+	}
+
+	// Store lays headers out back to back: each one (with its padded name)
+	// sums to 0, like genromfs writes them
+	headers := 0
+	for off := headerSize + alignUp(len("test vol")+1); off < len(img) && binary.BigEndian.Uint32(img[off:]) != 0; headers++ {
+		name, nlen, err := cstring(img, off+headerSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum(img[off:off+headerSize+nlen]) != 0 {
+			t.Fatalf("header %q at %#x: bad checksum", name, off)
+		}
+		off += headerSize + nlen + alignUp(int(binary.BigEndian.Uint32(img[off+8:])))
+	}
+	// 10 entries, "." and ".." in the root and in the 4 directories
+	if headers != 10+2*5 {
+		t.Fatalf("%d headers", headers)
+	}
+}
+
+func TestLoadBadChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	src := memfs.New()
+	src.PutFile("/a", []byte("a"), memfs.ModeFile|0o644, 0, 0, time.Unix(0, 0))
+	if err := Store(&buf, src, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	img[100] ^= 1
+	if _, _, err := Load(bytes.NewReader(img)); err == nil {
+		t.Fatal("bad superblock checksum accepted")
+	}
+}
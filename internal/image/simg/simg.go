@@ -0,0 +1,197 @@
+// Package simg expands Android sparse images (the format fastboot and
+// factory images use for system/vendor/userdata) into raw filesystem bytes.
+package simg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"goimagetool/internal/common"
+)
+
+// Magic is the little-endian header magic (bytes 3a ff 26 ed on disk).
+const Magic = 0xed26ff3a
+
+const (
+	fileHeaderLen  = 28
+	chunkHeaderLen = 12
+
+	chunkRaw      = 0xcac1
+	chunkFill     = 0xcac2
+	chunkDontCare = 0xcac3
+	chunkCRC32    = 0xcac4
+)
+
+// header — sparse_header_t из libsparse.
+type header struct {
+	Magic         uint32
+	Major, Minor  uint16
+	FileHdrSz     uint16
+	ChunkHdrSz    uint16
+	BlkSz         uint32
+	TotalBlks     uint32
+	TotalChunks   uint32
+	ImageChecksum uint32
+}
+
+// IsSparse reports whether b starts with a sparse image header.
+func IsSparse(b []byte) bool {
+	return len(b) >= 4 && binary.LittleEndian.Uint32(b) == Magic
+}
+
+// Expand writes the raw image described by the sparse stream r to w:
+// raw chunks are copied, fill chunks repeat their 4-byte pattern and
+// don't-care chunks become zeros. CRC32 chunks are checked against the
+// data written so far. Returns the number of bytes written.
+func Expand(w io.Writer, r io.Reader) (int64, error) {
+	var h header
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return 0, common.WrapAt("simg", 0, err)
+	}
+	if h.Magic != Magic {
+		return 0, common.Corrupt("simg", 0, "bad magic")
+	}
+	if h.Major != 1 {
+		return 0, common.Corrupt("simg", 4, fmt.Sprintf("unsupported version %d.%d", h.Major, h.Minor))
+	}
+	if h.FileHdrSz < fileHeaderLen || h.ChunkHdrSz < chunkHeaderLen {
+		return 0, common.Corrupt("simg", 8, "header sizes too small")
+	}
+	if h.BlkSz == 0 || h.BlkSz%4 != 0 {
+		return 0, common.Corrupt("simg", 12, fmt.Sprintf("bad block size %d", h.BlkSz))
+	}
+	total := int64(h.BlkSz) * int64(h.TotalBlks)
+	if err := common.CheckSize("simg", total); err != nil {
+		return 0, err
+	}
+	// заголовки могут быть длиннее известных полей — хвост пропускаем
+	off := int64(h.FileHdrSz)
+	if _, err := io.CopyN(io.Discard, r, off-fileHeaderLen); err != nil {
+		return 0, common.WrapAt("simg", fileHeaderLen, err)
+	}
+
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(w, crc)
+	var written int64
+	var ch [chunkHeaderLen]byte
+	for i := uint32(0); i < h.TotalChunks; i++ {
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			return written, common.WrapAt("simg", off, err)
+		}
+		typ := binary.LittleEndian.Uint16(ch[0:])
+		blocks := binary.LittleEndian.Uint32(ch[4:])
+		totalSz := int64(binary.LittleEndian.Uint32(ch[8:]))
+		size := int64(blocks) * int64(h.BlkSz)
+		body := totalSz - int64(h.ChunkHdrSz)
+		if body < 0 {
+			return written, common.Corrupt("simg", off, fmt.Sprintf("chunk %d: total size %d below header size", i, totalSz))
+		}
+		if written+size > total {
+			return written, common.Corrupt("simg", off, fmt.Sprintf("chunk %d: runs past the %d-byte image", i, total))
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(h.ChunkHdrSz)-chunkHeaderLen); err != nil {
+			return written, common.WrapAt("simg", off, err)
+		}
+		dataOff := off + int64(h.ChunkHdrSz)
+
+		var err error
+		switch typ {
+		case chunkRaw:
+			if body != size {
+				return written, common.Corrupt("simg", off, fmt.Sprintf("raw chunk %d: %d data bytes for %d blocks", i, body, blocks))
+			}
+			_, err = io.CopyN(out, r, size)
+		case chunkFill:
+			if body != 4 {
+				return written, common.Corrupt("simg", off, fmt.Sprintf("fill chunk %d: %d data bytes, want 4", i, body))
+			}
+			var pat [4]byte
+			if _, err = io.ReadFull(r, pat[:]); err == nil {
+				err = writeRepeat(out, pat[:], size)
+			}
+		case chunkDontCare:
+			if body != 0 {
+				return written, common.Corrupt("simg", off, fmt.Sprintf("don't-care chunk %d carries %d data bytes", i, body))
+			}
+			err = writeRepeat(out, []byte{0, 0, 0, 0}, size)
+		case chunkCRC32:
+			if body != 4 || blocks != 0 {
+				return written, common.Corrupt("simg", off, fmt.Sprintf("crc32 chunk %d: bad size", i))
+			}
+			var want uint32
+			if err = binary.Read(r, binary.LittleEndian, &want); err == nil && want != crc.Sum32() {
+				return written, common.Corrupt("simg", off, fmt.Sprintf("crc32 mismatch: %08x, data has %08x", want, crc.Sum32()))
+			}
+		default:
+			return written, common.Corrupt("simg", off, fmt.Sprintf("chunk %d: unknown type %#04x", i, typ))
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return written, common.WrapAt("simg", dataOff, io.ErrUnexpectedEOF)
+			}
+			return written, err
+		}
+		written += size
+		off += totalSz
+	}
+	if written != total {
+		return written, common.Corrupt("simg", off, fmt.Sprintf("chunks cover %d of %d bytes", written, total))
+	}
+	if h.ImageChecksum != 0 && h.ImageChecksum != crc.Sum32() {
+		return written, common.Corrupt("simg", 24, fmt.Sprintf("image crc32 mismatch: %08x, data has %08x", h.ImageChecksum, crc.Sum32()))
+	}
+	return written, nil
+}
+
+// Unsparse expands a whole sparse image held in memory.
+func Unsparse(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := Expand(&buf, bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errEnough stops Expand once Prefix has what it asked for.
+var errEnough = errors.New("simg: prefix complete")
+
+type prefixWriter struct {
+	buf []byte
+	n   int
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	k := min(len(b), p.n-len(p.buf))
+	p.buf = append(p.buf, b[:k]...)
+	if len(p.buf) >= p.n {
+		return k, errEnough
+	}
+	return k, nil
+}
+
+// Prefix expands only the first n bytes of the raw image (fewer if the
+// image is smaller) — enough to sniff the filesystem inside.
+func Prefix(r io.Reader, n int) ([]byte, error) {
+	p := &prefixWriter{n: n}
+	if _, err := Expand(p, r); err != nil && !errors.Is(err, errEnough) {
+		return p.buf, err
+	}
+	return p.buf, nil
+}
+
+// writeRepeat writes n bytes of pat repeated (n is a multiple of len(pat)).
+func writeRepeat(w io.Writer, pat []byte, n int64) error {
+	chunk := bytes.Repeat(pat, 64<<10/len(pat))
+	for n > 0 {
+		k := min(n, int64(len(chunk)))
+		if _, err := w.Write(chunk[:k]); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
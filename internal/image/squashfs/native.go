@@ -0,0 +1,725 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/compress"
+	"goimagetool/internal/fs/memfs"
+
+	"github.com/anchore/go-lzo"
+	"github.com/pierrec/lz4/v4"
+)
+
+// The native reader (LoadNative) parses the image itself: metadata blocks,
+// the inode, directory, fragment, ID and xattr tables, and data blocks
+// decompressed one by one. Unlike Load it needs no temporary file and keeps
+// owners, device nodes, FIFOs and xattrs.
+
+const (
+	superSize     = 96
+	metaBlockSize = 8192
+	metaUncomp    = 0x8000 // metadata block header: stored uncompressed
+	dataUncomp    = 1 << 24
+	noFragment    = 0xffffffff // also: no xattrs
+	maxDirDepth   = 256
+)
+
+// inode types
+const (
+	typeDir = iota + 1
+	typeFile
+	typeSymlink
+	typeBlock
+	typeChar
+	typeFIFO
+	typeSocket
+	typeLDir
+	typeLFile
+	typeLSymlink
+	typeLBlock
+	typeLChar
+	typeLFIFO
+	typeLSocket
+)
+
+// xattr name prefixes by type (the low byte of an xattr key's type)
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// LoadNative reads a squashfs 4.0 image with the built-in reader. compression
+// is checked as in Load.
+func LoadNative(r io.Reader, compression string) (*memfs.FS, *Superblock, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) < superSize {
+		return nil, nil, common.TooSmall("squashfs", "a squashfs image", int64(len(b)), superSize)
+	}
+	var sb Superblock
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &sb); err != nil {
+		return nil, nil, common.WrapAt("squashfs", 0, err)
+	}
+	if sb.Magic != 0x73717368 {
+		return nil, nil, &common.FormatError{Format: "squashfs", Offset: 0, Msg: fmt.Sprintf("bad magic %#x", sb.Magic), Err: ErrBadMagic}
+	}
+	if sb.Major != 4 {
+		return nil, nil, common.Corrupt("squashfs", 28, fmt.Sprintf("version %d.%d, only 4.0 is read", sb.Major, sb.Minor))
+	}
+	comp := sb.Compressor()
+	if comp == "" {
+		return nil, nil, fmt.Errorf("squashfs uses compression id %d which isn't supported in this build: %w", sb.CompressionID, ErrUnsupportedCompression)
+	}
+	if want := strings.ToLower(compression); want != "" && want != "auto" && want != "none" && want != comp {
+		return nil, nil, fmt.Errorf("squashfs uses %s, not %s (give auto or %s)", comp, want, comp)
+	}
+	if sb.BlockSize < 4096 || sb.BlockSize > 1<<20 || sb.BlockSize&(sb.BlockSize-1) != 0 {
+		return nil, nil, common.Corrupt("squashfs", 12, fmt.Sprintf("block size %d", sb.BlockSize))
+	}
+	if sb.BytesUsed > uint64(len(b)) {
+		return nil, nil, common.Corrupt("squashfs", 40, fmt.Sprintf("%d bytes used, image has %d", sb.BytesUsed, len(b)))
+	}
+	l := &native{b: b[:sb.BytesUsed], sb: &sb, comp: comp, meta: map[int64]metaBlock{}, seen: map[uint64]bool{}, fs: memfs.New()}
+	if err := l.readTables(); err != nil {
+		return nil, nil, err
+	}
+	if err := l.root(); err != nil {
+		return nil, nil, err
+	}
+	return l.fs, &sb, nil
+}
+
+type native struct {
+	b    []byte
+	sb   *Superblock
+	comp string
+	meta map[int64]metaBlock // decompressed metadata blocks by image offset
+	seen map[uint64]bool     // directory inodes already listed: a loop in a corrupt image
+
+	ids       []uint32
+	frags     []fragment
+	xattrIDs  []xattrID
+	xattrBase int64 // start of the xattr key/value metadata blocks
+	fs        *memfs.FS
+}
+
+type metaBlock struct {
+	data []byte
+	next int64 // image offset of the following block
+}
+
+type fragment struct {
+	start uint64
+	size  uint32
+}
+
+type xattrID struct {
+	ref   uint64
+	count uint32
+}
+
+// decompress one block (metadata or data) of at most max bytes.
+func (l *native) decompress(in []byte, max int) ([]byte, error) {
+	switch l.comp {
+	case "gzip":
+		zr, err := zlib.NewReader(bytes.NewReader(in))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(io.LimitReader(zr, int64(max)+1))
+		if err != nil {
+			return nil, err
+		}
+		return out, checkLen(out, max)
+	case "lz4":
+		out := make([]byte, max)
+		n, err := lz4.UncompressBlock(in, out)
+		if err != nil {
+			return nil, err
+		}
+		return out[:n], nil
+	case "lzo":
+		out := make([]byte, max)
+		n, err := lzo.Decompress(in, out)
+		if err != nil {
+			return nil, err
+		}
+		return out[:n], nil
+	}
+	out, err := compress.Decompress(in, l.comp)
+	if err != nil {
+		return nil, err
+	}
+	return out, checkLen(out, max)
+}
+
+func checkLen(out []byte, max int) error {
+	if len(out) > max {
+		return fmt.Errorf("block inflates past %d bytes", max)
+	}
+	return nil
+}
+
+// metaBlock reads the metadata block at image offset off.
+func (l *native) metaBlock(off int64) (metaBlock, error) {
+	if m, ok := l.meta[off]; ok {
+		return m, nil
+	}
+	if off < 0 || off+2 > int64(len(l.b)) {
+		return metaBlock{}, common.Corrupt("squashfs", off, "metadata block outside the image")
+	}
+	h := binary.LittleEndian.Uint16(l.b[off:])
+	n := int64(h &^ metaUncomp)
+	if n == 0 || n > metaBlockSize || off+2+n > int64(len(l.b)) {
+		return metaBlock{}, common.Corrupt("squashfs", off, fmt.Sprintf("metadata block of %d bytes", n))
+	}
+	data := l.b[off+2 : off+2+n]
+	if h&metaUncomp == 0 {
+		var err error
+		if data, err = l.decompress(data, metaBlockSize); err != nil {
+			return metaBlock{}, common.Corrupt("squashfs", off, fmt.Sprintf("metadata block: %v", err))
+		}
+	}
+	m := metaBlock{data: data, next: off + 2 + n}
+	l.meta[off] = m
+	return m, nil
+}
+
+// cursor reads metadata across block boundaries.
+type cursor struct {
+	l   *native
+	blk int64 // image offset of the current block
+	off int
+}
+
+// at returns a cursor at ref (block offset from table << 16 | offset).
+func (l *native) at(table int64, ref uint64) *cursor {
+	return &cursor{l: l, blk: table + int64(ref>>16), off: int(ref & 0xffff)}
+}
+
+func (c *cursor) read(n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		m, err := c.l.metaBlock(c.blk)
+		if err != nil {
+			return nil, err
+		}
+		if c.off > len(m.data) {
+			return nil, common.Corrupt("squashfs", c.blk, fmt.Sprintf("offset %d past the %d bytes of the metadata block", c.off, len(m.data)))
+		}
+		k := min(n-len(out), len(m.data)-c.off)
+		out = append(out, m.data[c.off:c.off+k]...)
+		c.off += k
+		if c.off == len(m.data) && len(out) < n {
+			c.blk, c.off = m.next, 0
+		}
+	}
+	return out, nil
+}
+
+func (c *cursor) u16() (uint16, error) {
+	b, err := c.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (c *cursor) u32() (uint32, error) {
+	b, err := c.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// u32s reads consecutive u32 fields into ps.
+func (c *cursor) u32s(ps ...*uint32) error {
+	for _, p := range ps {
+		v, err := c.u32()
+		if err != nil {
+			return err
+		}
+		*p = v
+	}
+	return nil
+}
+
+func (c *cursor) u64() (uint64, error) {
+	b, err := c.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// table reads count entries of size bytes from a table of metadata blocks
+// whose u64 locations start at index.
+func (l *native) table(index uint64, count, size int) ([]byte, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	total := count * size
+	blocks := (total + metaBlockSize - 1) / metaBlockSize
+	if index+uint64(blocks)*8 > uint64(len(l.b)) {
+		return nil, common.Corrupt("squashfs", int64(index), "table index outside the image")
+	}
+	out := make([]byte, 0, total)
+	for i := 0; i < blocks; i++ {
+		m, err := l.metaBlock(int64(binary.LittleEndian.Uint64(l.b[index+uint64(i)*8:])))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m.data...)
+	}
+	if len(out) < total {
+		return nil, common.Corrupt("squashfs", int64(index), fmt.Sprintf("table of %d entries holds %d bytes", count, len(out)))
+	}
+	return out[:total], nil
+}
+
+func (l *native) readTables() error {
+	ids, err := l.table(l.sb.IDTableStart, int(l.sb.NoIDs), 4)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(ids); i += 4 {
+		l.ids = append(l.ids, binary.LittleEndian.Uint32(ids[i:]))
+	}
+	if l.sb.FragTableStart != ^uint64(0) && l.sb.Fragments > 0 {
+		if l.sb.Fragments > uint32(len(l.b)) {
+			return common.Corrupt("squashfs", 16, fmt.Sprintf("%d fragments", l.sb.Fragments))
+		}
+		fr, err := l.table(l.sb.FragTableStart, int(l.sb.Fragments), 16)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(fr); i += 16 {
+			l.frags = append(l.frags, fragment{start: binary.LittleEndian.Uint64(fr[i:]), size: binary.LittleEndian.Uint32(fr[i+8:])})
+		}
+	}
+	if x := l.sb.XAttrIDTableStart; x != ^uint64(0) {
+		if x+16 > uint64(len(l.b)) {
+			return common.Corrupt("squashfs", 48, "xattr table outside the image")
+		}
+		l.xattrBase = int64(binary.LittleEndian.Uint64(l.b[x:]))
+		n := binary.LittleEndian.Uint32(l.b[x+8:])
+		if n > uint32(len(l.b)) {
+			return common.Corrupt("squashfs", int64(x+8), fmt.Sprintf("%d xattr ids", n))
+		}
+		xs, err := l.table(x+16, int(n), 16)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(xs); i += 16 {
+			l.xattrIDs = append(l.xattrIDs, xattrID{ref: binary.LittleEndian.Uint64(xs[i:]), count: binary.LittleEndian.Uint32(xs[i+8:])})
+		}
+	}
+	return nil
+}
+
+type inode struct {
+	typ      uint16
+	perm     memfs.Mode
+	uid, gid uint32
+	mtime    time.Time
+	xattr    uint32
+
+	// directories
+	dirBlock  uint32
+	dirOffset uint16
+	dirSize   uint32
+
+	// files
+	start   uint64
+	size    uint64
+	frag    uint32
+	fragOff uint32
+	blocks  []uint32
+	target  string
+	rdev    uint32
+}
+
+func (l *native) id(i uint16) (uint32, error) {
+	if int(i) >= len(l.ids) {
+		return 0, common.Corrupt("squashfs", int64(l.sb.IDTableStart), fmt.Sprintf("id index %d of %d", i, len(l.ids)))
+	}
+	return l.ids[i], nil
+}
+
+// inode reads the inode at ref in the inode table.
+func (l *native) inode(ref uint64) (*inode, error) {
+	c := l.at(int64(l.sb.InodeTableStart), ref)
+	h, err := c.read(16)
+	if err != nil {
+		return nil, err
+	}
+	in := &inode{
+		typ:   binary.LittleEndian.Uint16(h),
+		perm:  memfs.Mode(binary.LittleEndian.Uint16(h[2:]) & 0o7777),
+		mtime: time.Unix(int64(binary.LittleEndian.Uint32(h[8:])), 0),
+		xattr: noFragment,
+	}
+	if in.uid, err = l.id(binary.LittleEndian.Uint16(h[4:])); err != nil {
+		return nil, err
+	}
+	if in.gid, err = l.id(binary.LittleEndian.Uint16(h[6:])); err != nil {
+		return nil, err
+	}
+	var skip32 uint32 // nlink, parent inode: not kept
+	switch in.typ {
+	case typeDir:
+		var size, off uint16
+		if err := c.u32s(&in.dirBlock, &skip32); err != nil {
+			return nil, err
+		}
+		if size, err = c.u16(); err != nil {
+			return nil, err
+		}
+		if off, err = c.u16(); err != nil {
+			return nil, err
+		}
+		in.dirSize, in.dirOffset = uint32(size), off
+		err = c.u32s(&skip32)
+	case typeLDir:
+		var icount uint16
+		if err := c.u32s(&skip32, &in.dirSize, &in.dirBlock, &skip32); err != nil {
+			return nil, err
+		}
+		if icount, err = c.u16(); err != nil {
+			return nil, err
+		}
+		if in.dirOffset, err = c.u16(); err != nil {
+			return nil, err
+		}
+		if err := c.u32s(&in.xattr); err != nil {
+			return nil, err
+		}
+		// directory index entries: u32 index, u32 start, u32 size, name
+		for i := 0; i < int(icount); i++ {
+			var idx, start, n uint32
+			if err := c.u32s(&idx, &start, &n); err != nil {
+				return nil, err
+			}
+			if _, err := c.read(int(n) + 1); err != nil {
+				return nil, err
+			}
+		}
+	case typeFile:
+		var start, size uint32
+		if err := c.u32s(&start, &in.frag, &in.fragOff, &size); err != nil {
+			return nil, err
+		}
+		in.start, in.size = uint64(start), uint64(size)
+		err = l.blockList(c, in)
+	case typeLFile:
+		if in.start, err = c.u64(); err != nil {
+			return nil, err
+		}
+		if in.size, err = c.u64(); err != nil {
+			return nil, err
+		}
+		if _, err = c.u64(); err != nil { // sparse bytes
+			return nil, err
+		}
+		if err := c.u32s(&skip32, &in.frag, &in.fragOff, &in.xattr); err != nil {
+			return nil, err
+		}
+		err = l.blockList(c, in)
+	case typeSymlink, typeLSymlink:
+		var n uint32
+		if err := c.u32s(&skip32, &n); err != nil {
+			return nil, err
+		}
+		if n > 4096 {
+			return nil, common.Corrupt("squashfs", int64(l.sb.InodeTableStart), fmt.Sprintf("symlink target of %d bytes", n))
+		}
+		t, err := c.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		in.target = string(t)
+		if in.typ == typeLSymlink {
+			err = c.u32s(&in.xattr)
+		}
+	case typeBlock, typeChar, typeLBlock, typeLChar:
+		err = c.u32s(&skip32, &in.rdev)
+		if err == nil && in.typ >= typeLDir {
+			err = c.u32s(&in.xattr)
+		}
+	case typeFIFO, typeSocket, typeLFIFO, typeLSocket:
+		err = c.u32s(&skip32)
+		if err == nil && in.typ >= typeLDir {
+			err = c.u32s(&in.xattr)
+		}
+	default:
+		return nil, common.Corrupt("squashfs", int64(l.sb.InodeTableStart), fmt.Sprintf("unknown inode type %d", in.typ))
+	}
+	return in, err
+}
+
+// blockList reads the data block sizes that follow a file inode: one per
+// full block, and one for the tail unless it sits in a fragment.
+func (l *native) blockList(c *cursor, in *inode) error {
+	if err := common.CheckSize("squashfs file", int64(in.size)); err != nil {
+		return err
+	}
+	bs := uint64(l.sb.BlockSize)
+	n := in.size / bs
+	if in.frag == noFragment && in.size%bs != 0 {
+		n++
+	}
+	if n*4 > uint64(len(l.b)) {
+		return common.Corrupt("squashfs", int64(l.sb.InodeTableStart), fmt.Sprintf("file of %d bytes has more blocks than the image", in.size))
+	}
+	in.blocks = make([]uint32, n)
+	for i := range in.blocks {
+		v, err := c.u32()
+		if err != nil {
+			return err
+		}
+		in.blocks[i] = v
+	}
+	return nil
+}
+
+// dataBlock reads one data block (or fragment block) stored at off.
+func (l *native) dataBlock(off uint64, size uint32, want int) ([]byte, error) {
+	n := uint64(size &^ dataUncomp)
+	if off+n > uint64(len(l.b)) {
+		return nil, common.Corrupt("squashfs", int64(off), fmt.Sprintf("data block of %d bytes outside the image", n))
+	}
+	raw := l.b[off : off+n]
+	if size&dataUncomp != 0 {
+		return raw, nil
+	}
+	out, err := l.decompress(raw, want)
+	if err != nil {
+		return nil, common.Corrupt("squashfs", int64(off), fmt.Sprintf("data block: %v", err))
+	}
+	return out, nil
+}
+
+func (l *native) fileData(in *inode) ([]byte, error) {
+	bs := int(l.sb.BlockSize)
+	out := make([]byte, 0, in.size)
+	off := in.start
+	for _, sz := range in.blocks {
+		want := min(bs, int(in.size)-len(out))
+		if sz == 0 {
+			// a sparse block
+			out = append(out, make([]byte, want)...)
+			continue
+		}
+		blk, err := l.dataBlock(off, sz, bs)
+		if err != nil {
+			return nil, err
+		}
+		if len(blk) < want {
+			return nil, common.Corrupt("squashfs", int64(off), fmt.Sprintf("data block of %d bytes, want %d", len(blk), want))
+		}
+		out = append(out, blk[:want]...)
+		off += uint64(sz &^ dataUncomp)
+	}
+	if in.frag != noFragment && uint64(len(out)) < in.size {
+		if int(in.frag) >= len(l.frags) {
+			return nil, common.Corrupt("squashfs", int64(l.sb.FragTableStart), fmt.Sprintf("fragment %d of %d", in.frag, len(l.frags)))
+		}
+		f := l.frags[in.frag]
+		blk, err := l.dataBlock(f.start, f.size, bs)
+		if err != nil {
+			return nil, err
+		}
+		tail := int(in.size) - len(out)
+		if int(in.fragOff)+tail > len(blk) {
+			return nil, common.Corrupt("squashfs", int64(f.start), fmt.Sprintf("fragment %d: %d bytes at %d past its %d bytes", in.frag, tail, in.fragOff, len(blk)))
+		}
+		out = append(out, blk[in.fragOff:int(in.fragOff)+tail]...)
+	}
+	return out, nil
+}
+
+// xattrs reads the key/value pairs of xattr id i.
+func (l *native) xattrs(i uint32) (map[string][]byte, error) {
+	if i == noFragment {
+		return nil, nil
+	}
+	if int(i) >= len(l.xattrIDs) {
+		return nil, common.Corrupt("squashfs", int64(l.sb.XAttrIDTableStart), fmt.Sprintf("xattr id %d of %d", i, len(l.xattrIDs)))
+	}
+	id := l.xattrIDs[i]
+	c := l.at(l.xattrBase, id.ref)
+	out := map[string][]byte{}
+	for k := 0; k < int(id.count); k++ {
+		typ, err := c.u16()
+		if err != nil {
+			return nil, err
+		}
+		n, err := c.u16()
+		if err != nil {
+			return nil, err
+		}
+		name, err := c.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		vn, err := c.u32()
+		if err != nil {
+			return nil, err
+		}
+		if vn > 1<<16 {
+			return nil, common.Corrupt("squashfs", l.xattrBase, fmt.Sprintf("xattr value of %d bytes", vn))
+		}
+		v, err := c.read(int(vn))
+		if err != nil {
+			return nil, err
+		}
+		if typ&0x100 != 0 {
+			// out of line: the value is a reference to the real one
+			if len(v) != 8 {
+				return nil, common.Corrupt("squashfs", l.xattrBase, "bad out-of-line xattr reference")
+			}
+			vc := l.at(l.xattrBase, binary.LittleEndian.Uint64(v))
+			if vn, err = vc.u32(); err != nil {
+				return nil, err
+			}
+			if vn > 1<<16 {
+				return nil, common.Corrupt("squashfs", l.xattrBase, fmt.Sprintf("xattr value of %d bytes", vn))
+			}
+			if v, err = vc.read(int(vn)); err != nil {
+				return nil, err
+			}
+		}
+		if p := int(typ & 0xff); p < len(xattrPrefixes) {
+			out[xattrPrefixes[p]+string(name)] = v
+		}
+	}
+	return out, nil
+}
+
+func (l *native) root() error {
+	in, err := l.inode(l.sb.RootInodeRef)
+	if err != nil {
+		return err
+	}
+	if in.typ != typeDir && in.typ != typeLDir {
+		return common.Corrupt("squashfs", 32, "root inode is not a directory")
+	}
+	l.fs.PutDirMode("/", memfs.ModeDir|in.perm, in.uid, in.gid, in.mtime)
+	if err := l.setXattrs("/", in); err != nil {
+		return err
+	}
+	return l.dir(l.sb.RootInodeRef, in, "/", 0)
+}
+
+func (l *native) setXattrs(p string, in *inode) error {
+	x, err := l.xattrs(in.xattr)
+	if err != nil {
+		return err
+	}
+	for k, v := range x {
+		if err := l.fs.SetXattr(p, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dir lists directory in (inode ref) into p. The listing is runs of a
+// header (count-1, inode block, base inode number) and entries (offset in
+// that block, inode number delta, type, name size-1, name).
+func (l *native) dir(ref uint64, in *inode, p string, depth int) error {
+	if depth > maxDirDepth {
+		return common.Corrupt("squashfs", int64(l.sb.DirectoryTableStart), fmt.Sprintf("directories nested deeper than %d", maxDirDepth))
+	}
+	if l.seen[ref] {
+		return common.Corrupt("squashfs", int64(l.sb.InodeTableStart), "directory reached twice (loop in the tree)")
+	}
+	l.seen[ref] = true
+	if in.dirSize <= 3 {
+		return nil // the size counts 3 bytes more than the listing
+	}
+	c := l.at(int64(l.sb.DirectoryTableStart), uint64(in.dirBlock)<<16|uint64(in.dirOffset))
+	left := int(in.dirSize) - 3
+	for left > 0 {
+		h, err := c.read(12)
+		if err != nil {
+			return err
+		}
+		left -= 12
+		count := binary.LittleEndian.Uint32(h) + 1
+		blk := binary.LittleEndian.Uint32(h[4:])
+		if count > 256 {
+			return common.Corrupt("squashfs", int64(l.sb.DirectoryTableStart), fmt.Sprintf("directory header with %d entries", count))
+		}
+		for i := 0; i < int(count); i++ {
+			e, err := c.read(8)
+			if err != nil {
+				return err
+			}
+			n := int(binary.LittleEndian.Uint16(e[6:])) + 1
+			if n > maxNameLen {
+				return common.Corrupt("squashfs", int64(l.sb.DirectoryTableStart), fmt.Sprintf("name of %d bytes", n))
+			}
+			nb, err := c.read(n)
+			if err != nil {
+				return err
+			}
+			left -= 8 + n
+			name := string(nb)
+			if name == "." || name == ".." || strings.Contains(name, "/") {
+				return common.Corrupt("squashfs", int64(l.sb.DirectoryTableStart), fmt.Sprintf("bad entry name %q", name))
+			}
+			child := path.Join(p, name)
+			cref := uint64(blk)<<16 | uint64(binary.LittleEndian.Uint16(e))
+			if err := l.entry(cref, child, depth); err != nil {
+				return common.WithPath("squashfs", child, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *native) entry(ref uint64, p string, depth int) error {
+	in, err := l.inode(ref)
+	if err != nil {
+		return err
+	}
+	switch in.typ {
+	case typeDir, typeLDir:
+		l.fs.PutDirMode(p, memfs.ModeDir|in.perm, in.uid, in.gid, in.mtime)
+		if err := l.setXattrs(p, in); err != nil {
+			return err
+		}
+		return l.dir(ref, in, p, depth+1)
+	case typeFile, typeLFile:
+		data, err := l.fileData(in)
+		if err != nil {
+			return err
+		}
+		l.fs.PutFile(p, data, memfs.ModeFile|in.perm, in.uid, in.gid, in.mtime)
+	case typeSymlink, typeLSymlink:
+		l.fs.PutSymlink(p, in.target, in.uid, in.gid, in.mtime)
+	case typeBlock, typeChar, typeLBlock, typeLChar:
+		typ := memfs.ModeBlock
+		if in.typ == typeChar || in.typ == typeLChar {
+			typ = memfs.ModeChar
+		}
+		major, minor := in.rdev>>8&0xfff, in.rdev&0xff|in.rdev>>12&0xfff00
+		l.fs.PutNode(p, typ, uint32(in.perm), in.uid, in.gid, major, minor, in.mtime)
+	case typeFIFO, typeLFIFO:
+		l.fs.PutNode(p, memfs.ModeFIFO, uint32(in.perm), in.uid, in.gid, 0, 0, in.mtime)
+	default:
+		// memfs has no sockets
+		return nil
+	}
+	return l.setXattrs(p, in)
+}
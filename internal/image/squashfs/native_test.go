@@ -0,0 +1,188 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"testing"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// sqBuilder lays out a small gzip squashfs by hand: inodes are written
+// children first so a directory listing can point at them, and each
+// table fits one metadata block.
+type sqBuilder struct {
+	inodes, dirs bytes.Buffer
+	n            uint32
+}
+
+type sqDent struct {
+	name string
+	ref  uint64
+	typ  uint16
+}
+
+func le(vs ...any) []byte {
+	var b bytes.Buffer
+	for _, v := range vs {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+func zlibBytes(t *testing.T, b []byte) []byte {
+	var out bytes.Buffer
+	zw := zlib.NewWriter(&out)
+	zw.Write(b)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func (b *sqBuilder) inode(typ, perm, uid, gid uint16, body []byte) uint64 {
+	ref := uint64(b.inodes.Len())
+	b.n++
+	b.inodes.Write(le(typ, perm, uid, gid, uint32(1700000000), b.n))
+	b.inodes.Write(body)
+	return ref
+}
+
+func (b *sqBuilder) dir(perm uint16, ents []sqDent) uint64 {
+	sort.Slice(ents, func(i, j int) bool { return ents[i].name < ents[j].name })
+	start := b.dirs.Len()
+	if len(ents) > 0 {
+		b.dirs.Write(le(uint32(len(ents)-1), uint32(0), uint32(1)))
+		for _, e := range ents {
+			b.dirs.Write(le(uint16(e.ref), int16(0), e.typ, uint16(len(e.name)-1)))
+			b.dirs.WriteString(e.name)
+		}
+	}
+	size := b.dirs.Len() - start + 3
+	return b.inode(typeDir, perm, 0, 0, le(uint32(0), uint32(2), uint16(size), uint16(start), uint32(1)))
+}
+
+// testImage: /bin/busybox (two blocks, one stored raw, the tail in a
+// fragment, a security.capability xattr), /bin/sh -> busybox, /etc/motd
+// (owner 1000, in the fragment), /var/hole (sparse), /dev/console.
+func testImage(t *testing.T) ([]byte, map[string][]byte) {
+	const bs = 4096
+	busybox := bytes.Repeat([]byte("busybox!"), (2*bs+100)/8)
+	busybox = append(busybox, "tail"...)
+	motd := []byte("hello\n")
+	caps := []byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	img := bytes.NewBuffer(make([]byte, superSize))
+	blk0 := zlibBytes(t, busybox[:bs])
+	dataStart := uint64(img.Len())
+	img.Write(blk0)
+	img.Write(busybox[bs : 2*bs])
+	tail := busybox[2*bs:]
+	fragStart := uint64(img.Len())
+	fragBlk := zlibBytes(t, append(append([]byte{}, tail...), motd...))
+	img.Write(fragBlk)
+
+	var b sqBuilder
+	bb := b.inode(typeLFile, 0o755, 0, 0, le(dataStart, uint64(len(busybox)), uint64(0), uint32(1),
+		uint32(0), uint32(0), uint32(0), uint32(len(blk0)), uint32(bs)|dataUncomp))
+	sh := b.inode(typeSymlink, 0o777, 0, 0, append(le(uint32(1), uint32(7)), "busybox"...))
+	bin := b.dir(0o755, []sqDent{{"busybox", bb, typeFile}, {"sh", sh, typeSymlink}})
+	mo := b.inode(typeFile, 0o600, 1, 1, le(uint32(0), uint32(0), uint32(len(tail)), uint32(len(motd))))
+	etc := b.dir(0o755, []sqDent{{"motd", mo, typeFile}})
+	hole := b.inode(typeFile, 0o644, 0, 0, le(uint32(0), uint32(noFragment), uint32(0), uint32(2*bs), uint32(0), uint32(0)))
+	vr := b.dir(0o755, []sqDent{{"hole", hole, typeFile}})
+	con := b.inode(typeChar, 0o600, 0, 0, le(uint32(1), uint32(5<<8|1)))
+	dev := b.dir(0o755, []sqDent{{"console", con, typeChar}})
+	root := b.dir(0o755, []sqDent{{"bin", bin, typeDir}, {"etc", etc, typeDir}, {"var", vr, typeDir}, {"dev", dev, typeDir}})
+
+	inodeTable := uint64(img.Len())
+	zi := zlibBytes(t, b.inodes.Bytes())
+	img.Write(le(uint16(len(zi))))
+	img.Write(zi)
+	dirTable := uint64(img.Len())
+	img.Write(le(uint16(b.dirs.Len()) | metaUncomp))
+	img.Write(b.dirs.Bytes())
+	// one-block tables, then their u64 index
+	table := func(data []byte) uint64 {
+		blk := uint64(img.Len())
+		img.Write(le(uint16(len(data)) | metaUncomp))
+		img.Write(data)
+		idx := uint64(img.Len())
+		img.Write(le(blk))
+		return idx
+	}
+	frags := table(le(fragStart, uint32(len(fragBlk)), uint32(0)))
+	ids := table(le(uint32(0), uint32(1000)))
+	kv := uint64(img.Len())
+	pair := append(append(le(uint16(2), uint16(10)), "capability"...), le(uint32(len(caps)))...)
+	pair = append(pair, caps...)
+	img.Write(le(uint16(len(pair)) | metaUncomp))
+	img.Write(pair)
+	xidBlk := uint64(img.Len())
+	xid := le(uint64(0), uint32(1), uint32(len(pair)))
+	img.Write(le(uint16(len(xid)) | metaUncomp))
+	img.Write(xid)
+	xattrs := uint64(img.Len())
+	img.Write(le(kv, uint32(1), uint32(0), xidBlk))
+
+	out := img.Bytes()
+	sb := Superblock{
+		Magic: 0x73717368, Inodes: b.n, MkfsTime: 1700000000, BlockSize: bs, Fragments: 1,
+		CompressionID: 1, BlockLog: 12, NoIDs: 2, Major: 4,
+		RootInodeRef: root, BytesUsed: uint64(len(out)), IDTableStart: ids, XAttrIDTableStart: xattrs,
+		InodeTableStart: inodeTable, DirectoryTableStart: dirTable, FragTableStart: frags, LookupTableStart: ^uint64(0),
+	}
+	copy(out, le(sb))
+	return out, map[string][]byte{"/bin/busybox": busybox, "/etc/motd": motd, "/var/hole": make([]byte, 2*bs)}
+}
+
+func TestLoadNative(t *testing.T) {
+	img, files := testImage(t)
+	fs, sb, err := LoadNative(bytes.NewReader(img), "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Compressor() != "gzip" {
+		t.Errorf("compressor %q", sb.Compressor())
+	}
+	for p, data := range files {
+		if e, ok := fs.Get(p); !ok || !bytes.Equal(e.Data, data) {
+			t.Errorf("%s: missing or data differs", p)
+		}
+	}
+	if e, ok := fs.Get("/etc/motd"); !ok || e.Mode != memfs.ModeFile|0o600 || e.UID != 1000 || e.MTime.Unix() != 1700000000 {
+		t.Errorf("/etc/motd: %+v", e)
+	}
+	if e, ok := fs.Get("/bin/sh"); !ok || e.Target != "busybox" {
+		t.Errorf("/bin/sh: %+v", e)
+	}
+	if e, ok := fs.Get("/dev/console"); !ok || e.Mode != memfs.ModeChar|0o600 || e.RdevMajor != 5 || e.RdevMinor != 1 {
+		t.Errorf("/dev/console: %+v", e)
+	}
+	if e, ok := fs.Get("/bin/busybox"); !ok || len(e.Xattrs["security.capability"]) != 20 {
+		t.Errorf("/bin/busybox: xattrs %q", e.Xattrs)
+	}
+	if _, _, err := LoadNative(bytes.NewReader(img), "xz"); err == nil {
+		t.Error("gzip image loaded as xz")
+	}
+}
+
+func TestLoadNativeCorrupt(t *testing.T) {
+	img, _ := testImage(t)
+	// the fragment table points past the end
+	sb := bytes.Clone(img)
+	binary.LittleEndian.PutUint64(sb[80:], uint64(len(img)))
+	if _, _, err := LoadNative(bytes.NewReader(sb), ""); !errors.Is(err, common.ErrCorrupt) {
+		t.Errorf("fragment table past the end: %v", err)
+	}
+	// every truncation fails cleanly
+	for n := superSize; n < len(img); n += 7 {
+		if _, _, err := LoadNative(bytes.NewReader(img[:n]), ""); err == nil {
+			t.Errorf("%d of %d bytes: accepted", n, len(img))
+		}
+	}
+}
@@ -2,5 +2,8 @@
 
 package squashfs
 
-func chown(path string, uid, gid int) error  { return nil }
-func lchown(path string, uid, gid int) error { return nil }
+import "time"
+
+func chown(path string, uid, gid int) error   { return nil }
+func lchown(path string, uid, gid int) error  { return nil }
+func lchtimes(path string, t time.Time) error { return nil }
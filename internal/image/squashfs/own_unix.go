@@ -2,7 +2,18 @@
 
 package squashfs
 
-import "os"
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
 
 func chown(path string, uid, gid int) error  { return os.Chown(path, uid, gid) }
 func lchown(path string, uid, gid int) error { return os.Lchown(path, uid, gid) }
+
+// lchtimes sets the times of the symlink itself (os.Chtimes follows it).
+func lchtimes(path string, t time.Time) error {
+	tv := unix.NsecToTimeval(t.UnixNano())
+	return unix.Lutimes(path, []unix.Timeval{tv, tv})
+}
@@ -1,15 +1,20 @@
 package squashfs
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"goimagetool/internal/common"
 	"goimagetool/internal/fs/memfs"
 
 	befile "github.com/diskfs/go-diskfs/backend/file"
@@ -43,10 +48,80 @@ type Superblock struct {
 
 type Options struct {
 	Compression   string // "", gzip, xz, zstd, lz4, lzo, lzma
-	Label         string
-	NonExportable bool
-	NonSparse     bool
+	Label         string // в superblock squashfs нет поля метки, go-diskfs SetLabel всегда отказывает — отклоняем явно
+	NonExportable bool // без lookup-таблицы: на байты меньше, но образ нельзя отдать по NFS
+	NonSparse     bool // не искать дыры: нулевые блоки пишутся как данные
 	WithXattrs    bool
+
+	// Хвосты файлов короче блока по умолчанию пакуются вместе во фрагменты.
+	NoFragments     bool // каждый хвост в свой блок: образ больше, читается без fragment table
+	AlwaysFragments bool // mksquashfs -always-use-fragments; go-diskfs не умеет — отклоняем явно
+
+	// Тонкая настройка компрессора; нули = умолчания go-diskfs.
+	GzipLevel  int      // 1..9
+	GzipWindow int      // 8..15
+	XzDictSize int      // 8KiB..block size, 2^n или 2^n+2^(n-1)
+	XzFilters  []string // BCJ: x86, powerpc, ia64, arm, armthumb, sparc
+	LZ4HC      bool     // go-diskfs не даёт включить HC — отклоняем явно
+
+	// Progress, если задан, вызывается на каждую выгружаемую в workspace
+	// запись: сколько записей и байт данных уже пройдено.
+	Progress func(files int, bytes int64)
+
+	// MkfsTime, если задан, пишется в superblock вместо текущего времени
+	// (go-diskfs ставит time.Now) — для воспроизводимых образов.
+	MkfsTime time.Time
+
+	// Dropped, если задан, получает записи, которые в образ не попадут
+	// (см. Dropped), и Store продолжает; без него Store с ними падает
+	// с *DroppedError, ничего не записав.
+	Dropped func(path, reason string)
+}
+
+// maxNameLen: SQUASHFS_NAME_LEN, the longest name a directory entry holds.
+const maxNameLen = 256
+
+// Dropped is an entry Store cannot represent: device nodes and FIFOs (the
+// go-diskfs writer does not build them) and names the workspace or the
+// format rejects are left out; files and directories with setuid, setgid or
+// sticky bits are written without them (the writer keeps only 0777).
+type Dropped struct {
+	Path   string
+	Reason string
+}
+
+// DroppedError lists what a Store without Options.Dropped would have lost.
+type DroppedError struct {
+	Entries []Dropped
+}
+
+func (e *DroppedError) Error() string {
+	parts := make([]string, 0, 4)
+	for i, d := range e.Entries {
+		if i == 3 {
+			parts = append(parts, fmt.Sprintf("and %d more", len(e.Entries)-i))
+			break
+		}
+		parts = append(parts, d.Path+": "+d.Reason)
+	}
+	return fmt.Sprintf("squashfs: %d entries cannot be represented (%s)", len(e.Entries), strings.Join(parts, "; "))
+}
+
+// badName: the host refused the name itself, not the write.
+func badName(err error) bool {
+	return errors.Is(err, syscall.ENAMETOOLONG) || errors.Is(err, syscall.EINVAL)
+}
+
+// blockSize — размер блока, с которым go-diskfs создаёт образ (Create(..., 0)).
+const blockSize = 128 << 10
+
+var xzFilters = map[string]sqfs.XzFilter{
+	"x86":      sqfs.XzFilterX86,
+	"powerpc":  sqfs.XzFilterPowerPC,
+	"ia64":     sqfs.XzFilterIA64,
+	"arm":      sqfs.XzFilterArm,
+	"armthumb": sqfs.XzFilterArmThumb,
+	"sparc":    sqfs.XzFilterSparc,
 }
 
 func Detect(r io.Reader) (bool, error) {
@@ -58,33 +133,69 @@ func Detect(r io.Reader) (bool, error) {
 	return n >= 4 && hdr[0] == 'h' && hdr[1] == 's' && hdr[2] == 'q' && hdr[3] == 's', nil
 }
 
-// Load: валидируем superblock и копируем в memfs.
-func Load(r io.Reader, _ string) (*memfs.FS, *Superblock, error) {
-	tmp, err := os.MkdirTemp("", "goimagetool-sqfs-in-*")
+// compressorNames: superblock compression id -> имя, как в Options.Compression.
+var compressorNames = map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+
+// Compressor returns the codec name of the image ("" if unknown).
+func (sb *Superblock) Compressor() string { return compressorNames[sb.CompressionID] }
+
+// ErrUnsupportedCompression: the image uses a compressor go-diskfs cannot
+// read (Load) or write (Store) in this build.
+var ErrUnsupportedCompression = errors.New("compression not supported in this build")
+
+// readable/writable: what the go-diskfs reader and writer handle; its lzo
+// compressor only decompresses.
+var (
+	readable = map[string]bool{"gzip": true, "lzma": true, "lzo": true, "xz": true, "lz4": true, "zstd": true}
+	writable = map[string]bool{"gzip": true, "lzma": true, "xz": true, "lz4": true, "zstd": true}
+)
+
+// CanWrite reports whether Store can write images compressed with name.
+func CanWrite(name string) bool { return writable[strings.ToLower(name)] }
+
+// Load: валидируем superblock и копируем в memfs. compression — что ждёт
+// вызывающий: "", auto или none не проверяются, иначе должен совпасть с
+// компрессором образа.
+func Load(r io.Reader, compression string) (*memfs.FS, *Superblock, error) {
+	tmp, release, err := common.MkdirTemp("goimagetool-sqfs-in-*")
 	if err != nil {
 		return nil, nil, err
 	}
-	defer os.RemoveAll(tmp)
+	defer release()
 
 	img := filepath.Join(tmp, "in.squashfs")
 	f, err := os.Create(img)
 	if err != nil {
 		return nil, nil, err
 	}
-	if _, err = io.Copy(f, r); err != nil {
+	n, err := io.Copy(f, r)
+	if err != nil {
 		f.Close()
 		return nil, nil, err
 	}
 	if err = f.Close(); err != nil {
 		return nil, nil, err
 	}
+	if n < 96 {
+		return nil, nil, common.TooSmall("squashfs", "a squashfs image", n, 96)
+	}
 
 	sb, err := readSuper(img)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, common.WrapAt("squashfs", 0, err)
 	}
 	if sb.Magic != 0x73717368 {
-		return nil, nil, ErrBadMagic
+		return nil, nil, &common.FormatError{Format: "squashfs", Offset: 0, Msg: fmt.Sprintf("bad magic %#x", sb.Magic), Err: ErrBadMagic}
+	}
+	comp := sb.Compressor()
+	switch {
+	case comp == "":
+		return nil, nil, fmt.Errorf("squashfs uses compression id %d which isn't supported in this build: %w", sb.CompressionID, ErrUnsupportedCompression)
+	case !readable[comp]:
+		return nil, nil, fmt.Errorf("squashfs uses %s which isn't supported in this build: %w", comp, ErrUnsupportedCompression)
+	}
+	if want := strings.ToLower(compression); want != "" && want != "auto" && want != "none" && want != comp {
+		return nil, nil, fmt.Errorf("squashfs uses %s, not %s (give auto or %s)", comp, want, comp)
 	}
 
 	b, err := befile.OpenFromPath(img, true)
@@ -93,7 +204,7 @@ func Load(r io.Reader, _ string) (*memfs.FS, *Superblock, error) {
 	}
 	fs, err := sqfs.Read(b, 0, 0, 0)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("squashfs (%s): %w", comp, err)
 	}
 	defer fs.Close()
 
@@ -124,7 +235,7 @@ func copyOut(sfs *sqfs.FileSystem, m *memfs.FS, dir string) error {
 			ents, err = sfs.ReadDir("")
 		}
 		if err != nil {
-			return err
+			return common.WithPath("squashfs", dir, err)
 		}
 	}
 	for _, fi := range ents {
@@ -134,7 +245,7 @@ func copyOut(sfs *sqfs.FileSystem, m *memfs.FS, dir string) error {
 		}
 		src := filepath.Clean("/" + strings.TrimPrefix(filepath.Join(dir, name), "/"))
 		mode := fi.Mode()
-		perm := uint32(mode.Perm())
+		perm := uint32(memfs.PermOf(mode))
 
 		switch {
 		case mode.IsDir():
@@ -157,12 +268,12 @@ func copyOut(sfs *sqfs.FileSystem, m *memfs.FS, dir string) error {
 		default:
 			fr, err := sfs.OpenFile(src, os.O_RDONLY)
 			if err != nil {
-				return err
+				return common.WithPath("squashfs", src, err)
 			}
-			data, err := io.ReadAll(fr)
+			data, err := io.ReadAll(common.LimitReader(fr))
 			_ = fr.Close()
 			if err != nil {
-				return err
+				return common.WithPath("squashfs", src, err)
 			}
 			m.PutFile(src, data, memfs.Mode(0100000|perm), 0, 0, fi.ModTime())
 		}
@@ -173,88 +284,174 @@ func copyOut(sfs *sqfs.FileSystem, m *memfs.FS, dir string) error {
 // Store: выгружаем memfs в workspace и финализируем SquashFS.
 // Сохраняем mode/mtime, best-effort chown/lchown на Unix.
 func Store(w io.Writer, m *memfs.FS, opt Options) error {
-	tmp, err := os.MkdirTemp("", "goimagetool-sqfs-out-*")
+	return StoreContext(context.Background(), w, m, opt)
+}
+
+// StoreContext — Store с отменой: ctx проверяется между записями при
+// выгрузке и перед Finalize (сам Finalize из go-diskfs не прерывается).
+func StoreContext(ctx context.Context, w io.Writer, m *memfs.FS, opt Options) error {
+	// опции проверяем до того, как выгружать дерево
+	if opt.AlwaysFragments {
+		if opt.NoFragments {
+			return fmt.Errorf("squashfs: no-fragments and always-fragments are mutually exclusive")
+		}
+		return fmt.Errorf("squashfs: always-fragments is not exposed by the go-diskfs writer")
+	}
+	if opt.Label != "" {
+		return fmt.Errorf("squashfs: the format has no volume label (label %q)", opt.Label)
+	}
+	comp, err := toCompressor(opt)
+	if err != nil {
+		return err
+	}
+	tmp, release, err := common.MkdirTemp("goimagetool-sqfs-out-*")
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmp)
+	defer release()
 
 	out := filepath.Join(tmp, "out.squashfs")
-	b, err := befile.CreateFromPath(out, 0)
+	// CreateFromPath wants the final size up front; Finalize grows the file itself
+	of, err := os.Create(out)
 	if err != nil {
 		return err
 	}
+	defer of.Close()
+	b := befile.New(of, false)
 	sfs, err := sqfs.Create(b, 0, 0, 0)
 	if err != nil {
 		return err
 	}
 	defer sfs.Close()
 
-	if opt.Label != "" {
-		_ = sfs.SetLabel(opt.Label)
-	}
 	ws := sfs.Workspace()
 	if ws == "" {
 		return fmt.Errorf("squashfs: empty workspace")
 	}
 
+	var files int
+	var written int64
+	var dirs []*memfs.Entry
+	var dropped []Dropped
+	lost := map[string]bool{} // выброшенные каталоги: их содержимое тоже не попадёт
+	drop := func(e *memfs.Entry, reason string) {
+		dropped = append(dropped, Dropped{e.Name, reason})
+		if e.Mode.Type() == memfs.ModeDir {
+			lost[e.Name] = true
+		}
+	}
+	specialBits := func(e *memfs.Entry) {
+		if p := memfs.EffectivePerm(e); p&0o7000 != 0 {
+			dropped = append(dropped, Dropped{e.Name, fmt.Sprintf("mode %04o: setuid/setgid/sticky bits are not supported by the squashfs writer", p)})
+		}
+	}
+	if root, ok := m.Get("/"); ok {
+		dirs = append(dirs, root)
+	}
 	err = m.Walk(func(e *memfs.Entry) error {
 		if e.Name == "/" {
 			return nil
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if opt.Progress != nil {
+			files++
+			written += int64(len(e.Data))
+			opt.Progress(files, written)
+		}
 		dst := filepath.Join(ws, filepath.FromSlash(strings.TrimPrefix(e.Name, "/")))
-		switch {
-		case e.Mode&memfs.ModeDir != 0:
-			if err := os.MkdirAll(dst, 0o755); err != nil {
+		if lost[path.Dir(e.Name)] {
+			drop(e, "parent directory cannot be represented")
+			return nil
+		}
+		if n := len(path.Base(e.Name)); n > maxNameLen {
+			drop(e, fmt.Sprintf("name is %d bytes, squashfs allows %d", n, maxNameLen))
+			return nil
+		}
+		switch e.Mode.Type() {
+		case memfs.ModeDir:
+			if err := os.MkdirAll(dst, 0o755); badName(err) {
+				drop(e, err.Error())
+				return nil
+			} else if err != nil {
 				return err
 			}
 			applyDirMeta(dst, e)
+			specialBits(e)
+			dirs = append(dirs, e)
 
-		case e.Mode&memfs.ModeLink != 0:
+		case memfs.ModeLink:
 			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 				return err
 			}
 			_ = os.Remove(dst)
-			if err := os.Symlink(e.Target, dst); err != nil {
+			if err := os.Symlink(e.Target, dst); badName(err) {
+				drop(e, err.Error())
+				return nil
+			} else if err != nil {
 				return err
 			}
 			applyLinkMeta(dst, e)
 
-		case (e.Mode&(memfs.ModeChar|memfs.ModeBlock|memfs.ModeFIFO)) != 0:
-			// спец-узлы пропускаем (squashfs writer из go-diskfs их не собирает)
+		case memfs.ModeChar, memfs.ModeBlock, memfs.ModeFIFO:
+			// squashfs writer из go-diskfs спец-узлы не собирает
+			drop(e, e.Mode.TypeName()+" nodes are not supported by the squashfs writer")
 			return nil
 
 		default:
 			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 				return err
 			}
-			mode := os.FileMode(uint32(e.Mode) & 0o7777)
-			if mode == 0 {
-				mode = 0o644
-			}
-			if err := os.WriteFile(dst, e.Data, mode); err != nil {
+			if err := os.WriteFile(dst, e.Data, os.FileMode(memfs.EffectivePerm(e))); badName(err) {
+				drop(e, err.Error())
+				return nil
+			} else if err != nil {
 				return err
 			}
 			applyFileMeta(dst, e)
+			specialBits(e)
 		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
-
-	comp, err := toCompressor(opt.Compression)
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	if err := sfs.Finalize(sqfs.FinalizeOptions{
-		Compression:   comp,
-		NonExportable: opt.NonExportable,
-		NonSparse:     opt.NonSparse,
-		Xattrs:        opt.WithXattrs,
+	if len(dropped) > 0 {
+		if opt.Dropped == nil {
+			return &DroppedError{Entries: dropped}
+		}
+		for _, d := range dropped {
+			opt.Dropped(d.Path, d.Reason)
+		}
+	}
+	// файлы, созданные в каталоге, сдвинули его mtime — возвращаем
+	for _, e := range dirs {
+		dst := filepath.Join(ws, filepath.FromSlash(strings.TrimPrefix(e.Name, "/")))
+		_ = os.Chtimes(dst, safeTime(e.MTime), safeTime(e.MTime))
+	}
+
+	// go-diskfs читает цели симлинков и xattr по путям относительно
+	// workspace, так что Finalize идёт с ним в качестве cwd
+	if err := inDir(ws, func() error {
+		return sfs.Finalize(sqfs.FinalizeOptions{
+			Compression:   comp,
+			NonExportable: opt.NonExportable,
+			NonSparse:     opt.NonSparse,
+			Xattrs:        opt.WithXattrs,
+			NoFragments:   opt.NoFragments,
+		})
 	}); err != nil {
 		return err
 	}
+	if !opt.MkfsTime.IsZero() {
+		if err := setMkfsTime(out, opt.MkfsTime); err != nil {
+			return err
+		}
+	}
 
 	f, err := os.Open(out)
 	if err != nil {
@@ -265,42 +462,131 @@ func Store(w io.Writer, m *memfs.FS, opt Options) error {
 	return err
 }
 
-func toCompressor(name string) (sqfs.Compressor, error) {
-	switch strings.ToLower(strings.TrimSpace(name)) {
+// chdirMu: the working directory is per process, not per goroutine.
+var chdirMu sync.Mutex
+
+// inDir runs fn with dir as the working directory and restores it after.
+func inDir(dir string, fn func() error) error {
+	chdirMu.Lock()
+	defer chdirMu.Unlock()
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+	return fn()
+}
+
+func toCompressor(opt Options) (sqfs.Compressor, error) {
+	name := strings.ToLower(strings.TrimSpace(opt.Compression))
+	if (opt.GzipLevel != 0 || opt.GzipWindow != 0) && name != "" && name != "gzip" {
+		return nil, fmt.Errorf("squashfs: gzip options given for %s", name)
+	}
+	if (opt.XzDictSize != 0 || len(opt.XzFilters) > 0) && name != "xz" {
+		return nil, fmt.Errorf("squashfs: xz options given for %s", name)
+	}
+	switch name {
 	case "", "gzip":
-		return &sqfs.CompressorGzip{}, nil
+		c := &sqfs.CompressorGzip{}
+		if opt.GzipLevel != 0 {
+			if opt.GzipLevel < 1 || opt.GzipLevel > 9 {
+				return nil, fmt.Errorf("squashfs: gzip level %d out of range 1..9", opt.GzipLevel)
+			}
+			c.CompressionLevel = uint32(opt.GzipLevel)
+		}
+		if opt.GzipWindow != 0 {
+			if opt.GzipWindow < 8 || opt.GzipWindow > 15 {
+				return nil, fmt.Errorf("squashfs: gzip window %d out of range 8..15", opt.GzipWindow)
+			}
+			c.WindowSize = uint16(opt.GzipWindow)
+		}
+		return c, nil
 	case "xz":
-		return &sqfs.CompressorXz{}, nil
+		c := &sqfs.CompressorXz{}
+		if d := opt.XzDictSize; d != 0 {
+			if !validXzDict(d) {
+				return nil, fmt.Errorf("squashfs: xz dict size %d: want 2^n or 2^n+2^(n-1) within 8K..%dK", d, blockSize>>10)
+			}
+			c.DictionarySize = uint32(d)
+		}
+		for _, f := range opt.XzFilters {
+			xf, ok := xzFilters[strings.ToLower(f)]
+			if !ok {
+				return nil, fmt.Errorf("squashfs: unknown xz filter %q", f)
+			}
+			if c.ExecutableFilters == nil {
+				c.ExecutableFilters = map[sqfs.XzFilter]bool{}
+			}
+			c.ExecutableFilters[xf] = true
+		}
+		return c, nil
 	case "zstd":
 		return &sqfs.CompressorZstd{}, nil
 	case "lz4":
+		if opt.LZ4HC {
+			return nil, fmt.Errorf("squashfs: lz4 high-compression is not exposed by the go-diskfs writer")
+		}
 		return &sqfs.CompressorLz4{}, nil
 	case "lzo":
-		return &sqfs.CompressorLzo{}, nil
+		return nil, fmt.Errorf("squashfs: lzo: %w (the go-diskfs writer only decompresses it)", ErrUnsupportedCompression)
 	case "lzma":
 		return &sqfs.CompressorLzma{}, nil
 	default:
-		return nil, fmt.Errorf("unknown compressor: %s", name)
+		return nil, fmt.Errorf("unknown compressor: %s", opt.Compression)
 	}
 }
 
+// validXzDict: ограничения mksquashfs на словарь xz.
+func validXzDict(d int) bool {
+	if d < 8<<10 || d > blockSize {
+		return false
+	}
+	for n := 13; 1<<n <= blockSize; n++ {
+		if d == 1<<n || d == 1<<n+1<<(n-1) {
+			return true
+		}
+	}
+	return false
+}
+
 // --- metadata helpers ---
 
+// setMkfsTime patches the superblock's modification_time (offset 8); the
+// superblock carries no checksum.
+func setMkfsTime(path string, t time.Time) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(t.Unix()))
+	if _, err := f.WriteAt(b[:], 8); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// chown сбрасывает setuid/setgid, поэтому chmod — после него
 func applyFileMeta(path string, e *memfs.Entry) {
 	_ = os.Chtimes(path, safeTime(e.MTime), safeTime(e.MTime))
-	_ = os.Chmod(path, os.FileMode(uint32(e.Mode)&0o7777))
 	_ = chown(path, int(e.UID), int(e.GID)) // no-op на !unix
+	_ = os.Chmod(path, memfs.HostMode(e))
 }
 
 func applyDirMeta(path string, e *memfs.Entry) {
-	_ = os.Chmod(path, os.FileMode(uint32(e.Mode)&0o7777))
-	_ = os.Chtimes(path, safeTime(e.MTime), safeTime(e.MTime))
 	_ = chown(path, int(e.UID), int(e.GID))
+	_ = os.Chmod(path, memfs.HostMode(e))
+	_ = os.Chtimes(path, safeTime(e.MTime), safeTime(e.MTime))
 }
 
 func applyLinkMeta(path string, e *memfs.Entry) {
-	// chmod/chtimes для symlink либо не поддерживаются, либо меняют цель → пропускаем
+	// chmod для symlink не поддерживается или меняет цель → только owner и время
 	_ = lchown(path, int(e.UID), int(e.GID)) // no-op на !unix
+	_ = lchtimes(path, safeTime(e.MTime))
 }
 
 func safeTime(t time.Time) time.Time {
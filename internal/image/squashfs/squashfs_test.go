@@ -0,0 +1,81 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+func TestLoadShortInput(t *testing.T) {
+	for _, n := range []int{0, 1, 4, 95} {
+		b := make([]byte, n)
+		copy(b, "hsqs")
+		_, _, err := Load(bytes.NewReader(b), "")
+		if !errors.Is(err, common.ErrCorrupt) || !strings.Contains(err.Error(), "file too small") {
+			t.Errorf("%d bytes: got %v, want a too-small ErrCorrupt", n, err)
+		}
+	}
+}
+
+// Random data without the magic never reaches the go-diskfs reader.
+func TestLoadRandomInput(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		b := make([]byte, rnd.Intn(1024))
+		rnd.Read(b)
+		if len(b) >= 4 && string(b[:4]) == "hsqs" {
+			b[0] = 0
+		}
+		if _, _, err := Load(bytes.NewReader(b), ""); err == nil {
+			t.Errorf("buffer %d (%d bytes): accepted", i, len(b))
+		}
+	}
+}
+
+// The go-diskfs writer keeps only the 0777 bits, so a setuid binary must
+// fail the store rather than come back as a plain 0755 file.
+func TestStoreReportsSpecialBits(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutFile("/bin/su", []byte("\x7fELF"), 0o4755, 0, 0, mt)
+	src.PutFile("/bin/sh", []byte("\x7fELF"), 0o755, 0, 0, mt)
+
+	err := Store(io.Discard, src, Options{Compression: "gzip"})
+	var de *DroppedError
+	if !errors.As(err, &de) {
+		t.Fatalf("Store: got %v, want *DroppedError", err)
+	}
+	if len(de.Entries) != 1 || de.Entries[0].Path != "/bin/su" || !strings.Contains(de.Entries[0].Reason, "4755") {
+		t.Errorf("dropped %+v, want only /bin/su with its mode", de.Entries)
+	}
+}
+
+// superblockOnly: a 96-byte v4 superblock with compression id, nothing else.
+func superblockOnly(id uint16) []byte {
+	b := make([]byte, 96)
+	copy(b, "hsqs")
+	binary.LittleEndian.PutUint16(b[20:], id)
+	return b
+}
+
+// The compression checks run before the go-diskfs reader sees the image.
+func TestLoadChecksCompression(t *testing.T) {
+	if _, _, err := Load(bytes.NewReader(superblockOnly(9)), "auto"); !errors.Is(err, ErrUnsupportedCompression) || !strings.Contains(err.Error(), "id 9") {
+		t.Errorf("id 9: got %v, want ErrUnsupportedCompression", err)
+	}
+	_, _, err := Load(bytes.NewReader(superblockOnly(4)), "gzip")
+	if err == nil || !strings.Contains(err.Error(), "squashfs uses xz, not gzip") {
+		t.Errorf("xz image loaded as gzip: got %v", err)
+	}
+	if CanWrite("lzo") || !CanWrite("XZ") {
+		t.Error("CanWrite: want lzo read-only, xz writable")
+	}
+}
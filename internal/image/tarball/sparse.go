@@ -0,0 +1,147 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// archive/tar can read GNU sparse entries but drops GNU.sparse.* records on
+// write, so PAX 1.0 sparse entries are emitted as raw blocks between
+// regular entries: an 'x' header carrying the sparse records, then a
+// regular header whose body is the sparse map followed by the data regions.
+
+const blockSize = 512
+
+// fitsUSTAR: s fits the 32-byte ASCII uname/gname field of a USTAR header.
+func fitsUSTAR(s string) bool {
+	return len(s) <= 32 && strings.IndexFunc(s, func(r rune) bool { return r >= 0x80 }) < 0
+}
+
+func writeSparse(tw *tar.Writer, w io.Writer, name string, e *memfs.Entry, regions []common.Region, uname, gname string) error {
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if len(base) > 80 {
+		base = base[:80]
+	}
+
+	var smap bytes.Buffer
+	entries, end := regions, int64(0)
+	if len(regions) > 0 {
+		end = regions[len(regions)-1].Off + regions[len(regions)-1].Len
+	}
+	if end < int64(len(e.Data)) {
+		// trailing hole: a zero-length region marks the real end
+		entries = append(append([]common.Region(nil), regions...), common.Region{Off: int64(len(e.Data))})
+	}
+	fmt.Fprintf(&smap, "%d\n", len(entries))
+	var dataLen int64
+	for _, r := range entries {
+		fmt.Fprintf(&smap, "%d\n%d\n", r.Off, r.Len)
+		dataLen += r.Len
+	}
+	smap.Write(make([]byte, padLen(int64(smap.Len()))))
+
+	var pax bytes.Buffer
+	recs := [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", name},
+		{"GNU.sparse.realsize", strconv.Itoa(len(e.Data))},
+	}
+	// names that don't fit the USTAR header go in PAX records
+	if !fitsUSTAR(uname) {
+		recs = append(recs, [2]string{"uname", uname})
+		uname = ""
+	}
+	if !fitsUSTAR(gname) {
+		recs = append(recs, [2]string{"gname", gname})
+		gname = ""
+	}
+	xr := xattrRecords(e)
+	keys := make([]string, 0, len(xr))
+	for k := range xr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		recs = append(recs, [2]string{k, xr[k]})
+	}
+	for _, kv := range recs {
+		pax.WriteString(paxRecord(kv[0], kv[1]))
+	}
+
+	mt := e.MTime.Truncate(time.Second)
+	xh, err := rawHeader(&tar.Header{Name: "PaxHeaders.0/" + base, Size: int64(pax.Len()), Mode: 0o644, ModTime: mt}, tar.TypeXHeader)
+	if err != nil {
+		return err
+	}
+	fh, err := rawHeader(&tar.Header{
+		Name:    "GNUSparseFile.0/" + base,
+		Size:    int64(smap.Len()) + dataLen,
+		Mode:    int64(memfs.EffectivePerm(e)),
+		Uid:     int(e.UID),
+		Gid:     int(e.GID),
+		Uname:   uname,
+		Gname:   gname,
+		ModTime: mt,
+	}, tar.TypeReg)
+	if err != nil {
+		return err
+	}
+
+	out := [][]byte{xh, pax.Bytes(), make([]byte, padLen(int64(pax.Len()))), fh, smap.Bytes()}
+	for _, r := range entries {
+		out = append(out, e.Data[r.Off:r.Off+r.Len])
+	}
+	out = append(out, make([]byte, padLen(dataLen)))
+	for _, b := range out {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func padLen(n int64) int64 { return int64(common.AlignUp(uint64(n), blockSize)) - n }
+
+// paxRecord formats "<len> key=value\n" where len counts itself.
+func paxRecord(k, v string) string {
+	rest := " " + k + "=" + v + "\n"
+	n := len(rest) + 1
+	for len(strconv.Itoa(n))+len(rest) != n {
+		n++
+	}
+	return strconv.Itoa(n) + rest
+}
+
+// rawHeader renders h as one USTAR block via archive/tar and then sets the
+// type flag (archive/tar refuses to encode 'x' itself), fixing the checksum.
+func rawHeader(h *tar.Header, flag byte) ([]byte, error) {
+	var buf bytes.Buffer
+	h.Typeflag = tar.TypeReg
+	h.Format = tar.FormatUSTAR
+	if err := tar.NewWriter(&buf).WriteHeader(h); err != nil {
+		return nil, err
+	}
+	blk := append([]byte(nil), buf.Bytes()[:blockSize]...)
+	blk[156] = flag
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return blk, nil
+}
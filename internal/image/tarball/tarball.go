@@ -2,20 +2,25 @@ package tarball
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"goimagetool/internal/common"
 	"goimagetool/internal/fs/memfs"
 )
 
 // Load: fill MemFS from an uncompressed tar stream.
 func Load(m *memfs.FS, r io.Reader) error {
 	tr := tar.NewReader(r)
-	snap := m.Snapshot()
 
+	// ensureParents creates only missing parents as placeholders; a directory
+	// that already exists (explicit entry seen earlier) keeps its metadata.
+	exists := func(p string) bool { _, ok := m.Get(p); return ok }
 	ensureParents := func(p string, uid, gid uint32, mt time.Time) {
 		p = filepath.ToSlash(p)
 		if p == "" || p == "/" {
@@ -26,7 +31,7 @@ func Load(m *memfs.FS, r io.Reader) error {
 			dir = "/"
 		}
 		stack := []string{}
-		for dir != "/" && snap[dir] == nil {
+		for dir != "/" && !exists(dir) {
 			stack = append(stack, dir)
 			dir = filepath.ToSlash(filepath.Dir(dir))
 			if dir == "." {
@@ -34,11 +39,7 @@ func Load(m *memfs.FS, r io.Reader) error {
 			}
 		}
 		for i := len(stack) - 1; i >= 0; i-- {
-			d := stack[i]
-			if snap[d] == nil {
-				m.PutDir(d, uid, gid, mt)
-				snap = m.Snapshot()
-			}
+			m.PutDir(stack[i], uid, gid, mt)
 		}
 	}
 
@@ -50,6 +51,9 @@ func Load(m *memfs.FS, r io.Reader) error {
 		if err != nil {
 			return err
 		}
+		if err := common.CheckEntryName(h.Name); err != nil {
+			return fmt.Errorf("tar entry %q: %w", h.Name, err)
+		}
 		name := "/" + strings.TrimLeft(filepath.ToSlash(h.Name), "/")
 		uid, gid := uint32(h.Uid), uint32(h.Gid)
 		mt := h.ModTime
@@ -60,8 +64,9 @@ func Load(m *memfs.FS, r io.Reader) error {
 
 		switch h.Typeflag {
 		case tar.TypeDir:
+			// explicit entry wins over a placeholder made for an earlier child
 			if name != "/" {
-				m.PutDir(name, uid, gid, mt)
+				m.PutDirMode(name, memfs.ModeDir|perm, uid, gid, mt)
 			}
 
 		case tar.TypeSymlink:
@@ -80,7 +85,15 @@ func Load(m *memfs.FS, r io.Reader) error {
 			ensureParents(name, uid, gid, mt)
 			m.PutNode(name, memfs.ModeFIFO, uint32(perm), uid, gid, 0, 0, mt)
 
-		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			if isSparse(h) {
+				if err := common.CheckSparseExpand(name, h.Size); err != nil {
+					return err
+				}
+			}
+			if err := common.CheckSize("tar entry "+name, h.Size); err != nil {
+				return err
+			}
 			ensureParents(name, uid, gid, mt)
 			var buf []byte
 			if h.Size > 0 {
@@ -103,13 +116,82 @@ func Load(m *memfs.FS, r io.Reader) error {
 
 		default:
 			// skip others
+			continue
+		}
+		for k, v := range h.PAXRecords {
+			if x, ok := strings.CutPrefix(k, xattrPrefix); ok {
+				_ = m.SetXattr(name, x, []byte(v))
+			}
 		}
 	}
 	return nil
 }
 
+// WriteOptions tunes WriteWith.
+type WriteOptions struct {
+	// SparseThreshold: regular files with zero runs of at least this many
+	// bytes are written as PAX 1.0 GNU sparse entries. 0 = always dense,
+	// which is what busybox tar and other minimal readers understand.
+	SparseThreshold int
+	// Exclude: entries matching memfs.Excluded are left out; the FS is not touched.
+	Exclude []string
+	// Unames, Gnames: uid→user and gid→group names for the Uname/Gname
+	// header fields (ParseIDNames reads passwd(5)/group(5) files). nil, or
+	// an ID missing from the map, leaves the name blank: numeric only.
+	Unames, Gnames map[uint32]string
+	// NumericOwner blanks every name even when the maps are set
+	// (tar --numeric-owner).
+	NumericOwner bool
+}
+
+// owner returns the Uname/Gname of e under opt.
+func (opt WriteOptions) owner(e *memfs.Entry) (uname, gname string) {
+	if opt.NumericOwner {
+		return "", ""
+	}
+	return opt.Unames[e.UID], opt.Gnames[e.GID]
+}
+
+// ParseIDNames reads a passwd(5) or group(5) file into an ID→name map:
+// the name is field 1 and the ID field 3 of each line in both. Comments and
+// malformed lines are skipped; for an ID listed twice the first name wins,
+// as with getpwuid(3).
+func ParseIDNames(b []byte) map[uint32]string {
+	m := map[uint32]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Split(line, ":")
+		if len(f) < 3 || f[0] == "" || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(f[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, dup := m[uint32(id)]; !dup {
+			m[uint32(id)] = f[0]
+		}
+	}
+	return m
+}
+
+// isSparse: archive/tar hides the sparse map and yields the expanded data;
+// the records that described it are still visible.
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
 // Write: dump MemFS into an uncompressed tar stream.
-func Write(m *memfs.FS, w io.Writer) error {
+func Write(m *memfs.FS, w io.Writer) error { return WriteWith(m, w, WriteOptions{}) }
+
+func WriteWith(m *memfs.FS, w io.Writer, opt WriteOptions) error {
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
@@ -129,23 +211,25 @@ func Write(m *memfs.FS, w io.Writer) error {
 			continue
 		}
 		name := strings.TrimPrefix(filepath.ToSlash(e.Name), "/")
-		if name == "" {
+		if name == "" || memfs.Excluded(name, opt.Exclude) {
 			continue
 		}
 
 		h := &tar.Header{
 			Name:    name,
-			Mode:    int64(uint32(e.Mode) & 0o7777),
-			ModTime: e.MTime,
+			Mode:    int64(memfs.EffectivePerm(e)),
+			ModTime: e.MTime.Truncate(time.Second), // archive/tar would round to the nearest second
 			Uid:     int(e.UID),
 			Gid:     int(e.GID),
 		}
+		h.Uname, h.Gname = opt.owner(e)
 		if h.ModTime.IsZero() {
 			h.ModTime = time.Now()
 		}
+		h.PAXRecords = xattrRecords(e)
 
-		switch {
-		case e.Mode&memfs.ModeDir != 0:
+		switch e.Mode.Type() {
+		case memfs.ModeDir:
 			if !strings.HasSuffix(h.Name, "/") {
 				h.Name += "/"
 			}
@@ -155,7 +239,7 @@ func Write(m *memfs.FS, w io.Writer) error {
 				return err
 			}
 
-		case e.Mode&memfs.ModeLink != 0:
+		case memfs.ModeLink:
 			h.Typeflag = tar.TypeSymlink
 			h.Linkname = e.Target
 			h.Size = 0
@@ -163,21 +247,21 @@ func Write(m *memfs.FS, w io.Writer) error {
 				return err
 			}
 
-		case e.Mode&memfs.ModeChar != 0:
-			h.Typeflag = tar.TypeChar
-			h.Size = 0
+		case memfs.ModeBlock:
+			h.Typeflag = tar.TypeBlock
+			setDev(h, e)
 			if err := tw.WriteHeader(h); err != nil {
 				return err
 			}
 
-		case e.Mode&memfs.ModeBlock != 0:
-			h.Typeflag = tar.TypeBlock
-			h.Size = 0
+		case memfs.ModeChar:
+			h.Typeflag = tar.TypeChar
+			setDev(h, e)
 			if err := tw.WriteHeader(h); err != nil {
 				return err
 			}
 
-		case e.Mode&memfs.ModeFIFO != 0:
+		case memfs.ModeFIFO:
 			h.Typeflag = tar.TypeFifo
 			h.Size = 0
 			if err := tw.WriteHeader(h); err != nil {
@@ -185,6 +269,14 @@ func Write(m *memfs.FS, w io.Writer) error {
 			}
 
 		default:
+			if opt.SparseThreshold > 0 {
+				if regions := common.DataRegions(e.Data, opt.SparseThreshold); regions != nil {
+					if err := writeSparse(tw, w, name, e, regions, h.Uname, h.Gname); err != nil {
+						return err
+					}
+					continue
+				}
+			}
 			h.Typeflag = tar.TypeReg
 			h.Size = int64(len(e.Data))
 			if err := tw.WriteHeader(h); err != nil {
@@ -199,3 +291,31 @@ func Write(m *memfs.FS, w io.Writer) error {
 	}
 	return nil
 }
+
+// xattrPrefix: the PAX records GNU tar and bsdtar keep xattrs in.
+const xattrPrefix = "SCHILY.xattr."
+
+// xattrRecords returns the PAX records for the xattrs of e, nil if none.
+func xattrRecords(e *memfs.Entry) map[string]string {
+	if len(e.Xattrs) == 0 {
+		return nil
+	}
+	recs := make(map[string]string, len(e.Xattrs))
+	for k, v := range e.Xattrs {
+		recs[xattrPrefix+k] = string(v)
+	}
+	return recs
+}
+
+// ustarMaxDev is the largest device number representable in the 8-byte
+// octal USTAR field; larger values need the GNU base-256 encoding.
+const ustarMaxDev = 07777777
+
+func setDev(h *tar.Header, e *memfs.Entry) {
+	h.Size = 0
+	h.Devmajor = int64(e.RdevMajor)
+	h.Devminor = int64(e.RdevMinor)
+	if h.Devmajor > ustarMaxDev || h.Devminor > ustarMaxDev {
+		h.Format = tar.FormatGNU
+	}
+}
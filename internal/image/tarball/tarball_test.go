@@ -0,0 +1,241 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+func TestWriteLoadDeviceNumbers(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutNode("/dev/console", memfs.ModeChar, 0o600, 0, 5, 5, 1, mt)
+	src.PutNode("/dev/sda", memfs.ModeBlock, 0o660, 0, 6, 8, 0, mt)
+	src.PutNode("/dev/big", memfs.ModeChar, 0o600, 0, 0, 0x1000000, 0x2000000, mt)
+
+	var buf bytes.Buffer
+	if err := Write(src, &buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	dst := memfs.New()
+	if err := Load(dst, &buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path     string
+		typ      memfs.Mode
+		maj, min uint32
+	}{
+		{"/dev/console", memfs.ModeChar, 5, 1},
+		{"/dev/sda", memfs.ModeBlock, 8, 0},
+		{"/dev/big", memfs.ModeChar, 0x1000000, 0x2000000},
+	} {
+		e, ok := dst.Get(tc.path)
+		if !ok {
+			t.Fatalf("%s: missing after round trip", tc.path)
+		}
+		if e.Mode.Type() != tc.typ {
+			t.Errorf("%s: type %o, want %o", tc.path, e.Mode.Type(), tc.typ)
+		}
+		if e.RdevMajor != tc.maj || e.RdevMinor != tc.min {
+			t.Errorf("%s: rdev %d:%d, want %d:%d", tc.path, e.RdevMajor, e.RdevMinor, tc.maj, tc.min)
+		}
+	}
+}
+
+func maliciousTar(t *testing.T, name string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	body := []byte("root::0:0::/:/bin/sh\n")
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(body)
+	tw.Close()
+	return &buf
+}
+
+func TestLoadRejectsTraversal(t *testing.T) {
+	for _, name := range []string{"../../etc/passwd", "a/../../etc/passwd", "/../etc/passwd"} {
+		err := Load(memfs.New(), maliciousTar(t, name))
+		if !errors.Is(err, common.ErrUnsafePath) {
+			t.Errorf("%q: got %v, want ErrUnsafePath", name, err)
+		}
+	}
+	if err := Load(memfs.New(), maliciousTar(t, "a/../etc/passwd")); err != nil {
+		t.Errorf("in-tree ..: %v", err)
+	}
+}
+
+func TestLoadAllowUnsafeClamps(t *testing.T) {
+	common.AllowUnsafePaths = true
+	defer func() { common.AllowUnsafePaths = false }()
+	m := memfs.New()
+	if err := Load(m, maliciousTar(t, "../../etc/passwd")); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, ok := m.Get("/etc/passwd"); !ok {
+		t.Fatal("entry not clamped to /etc/passwd")
+	}
+}
+
+func TestLoadDirMetadataAnyOrder(t *testing.T) {
+	dirT := time.Unix(1500000000, 0)
+	fileT := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		// explicit dir first, child later
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o700, Uid: 5, Gid: 6, ModTime: dirT},
+		{Name: "etc/ssh/key", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: fileT},
+		// child first, explicit dir later
+		{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, ModTime: fileT},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o750, Uid: 7, Gid: 8, ModTime: dirT},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	m := memfs.New()
+	if err := Load(m, &buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, tc := range []struct {
+		path     string
+		perm     memfs.Mode
+		uid, gid uint32
+		mt       time.Time
+	}{
+		{"/etc", 0o700, 5, 6, dirT},
+		{"/etc/ssh", 0o755, 0, 0, fileT}, // placeholder
+		{"/usr/bin", 0o750, 7, 8, dirT},
+	} {
+		e, ok := m.Get(tc.path)
+		if !ok {
+			t.Fatalf("%s: missing", tc.path)
+		}
+		if e.Mode.Type() != memfs.ModeDir || e.Mode&0o7777 != tc.perm {
+			t.Errorf("%s: mode %o, want dir %o", tc.path, e.Mode, tc.perm)
+		}
+		if e.UID != tc.uid || e.GID != tc.gid {
+			t.Errorf("%s: owner %d:%d, want %d:%d", tc.path, e.UID, e.GID, tc.uid, tc.gid)
+		}
+		if !e.MTime.Equal(tc.mt) {
+			t.Errorf("%s: mtime %v, want %v", tc.path, e.MTime, tc.mt)
+		}
+	}
+}
+
+func TestWriteLoadSpecialBits(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutFile("/bin/su", []byte("\x7fELF"), 0o4755, 0, 0, mt)
+	src.PutDirMode("/tmp", memfs.ModeDir|0o1777, 0, 0, mt)
+
+	var buf bytes.Buffer
+	if err := Write(src, &buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	dst := memfs.New()
+	if err := Load(dst, &buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for p, want := range map[string]memfs.Mode{"/bin/su": memfs.ModeFile | 0o4755, "/tmp": memfs.ModeDir | 0o1777} {
+		e, ok := dst.Get(p)
+		if !ok {
+			t.Fatalf("%s: missing", p)
+		}
+		if e.Mode != want {
+			t.Errorf("%s: mode %o, want %o", p, e.Mode, want)
+		}
+	}
+}
+
+func TestWriteLoadXattrs(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutFile("/bin/ping", []byte("\x7fELF"), 0o755, 0, 0, mt)
+	src.PutFile("/var/sparse", make([]byte, 64<<10), 0o644, 0, 0, mt)
+	caps := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, p := range []string{"/bin/ping", "/var/sparse"} {
+		if err := src.SetXattr(p, "security.capability", caps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.SetXattr("/var/sparse", "user.note", []byte("x"))
+
+	var buf bytes.Buffer
+	if err := WriteWith(src, &buf, WriteOptions{SparseThreshold: 4096}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	dst := memfs.New()
+	if err := Load(dst, &buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for p, n := range map[string]int{"/bin/ping": 1, "/var/sparse": 2} {
+		e, ok := dst.Get(p)
+		if !ok {
+			t.Fatalf("%s: missing", p)
+		}
+		if len(e.Xattrs) != n || !bytes.Equal(e.Xattrs["security.capability"], caps) {
+			t.Errorf("%s: xattrs %q", p, e.Xattrs)
+		}
+	}
+}
+
+func TestWriteOwnerNames(t *testing.T) {
+	mt := time.Unix(1700000000, 0)
+	src := memfs.New()
+	src.PutFile("/etc/motd", []byte("hi\n"), 0o644, 0, 0, mt)
+	src.PutFile("/home/www/big", make([]byte, 64<<10), 0o644, 33, 1000, mt)
+	src.PutFile("/opt/nobody", nil, 0o644, 65534, 65534, mt)
+	users := ParseIDNames([]byte("root:x:0:0:root:/root:/bin/sh\n# comment\nwww-data:x:33:33::/var/www:/bin/false\nbroken\ntoor:x:0:0::/:/bin/sh\n"))
+	groups := ParseIDNames([]byte("root:x:0:\nusers-with-a-very-long-group-name:x:1000:www-data\n"))
+	if users[0] != "root" || len(users) != 2 || len(groups) != 2 {
+		t.Fatalf("ParseIDNames: %v %v", users, groups)
+	}
+
+	read := func(opt WriteOptions) map[string][2]string {
+		opt.SparseThreshold = 4096
+		var buf bytes.Buffer
+		if err := WriteWith(src, &buf, opt); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		got := map[string][2]string{}
+		tr := tar.NewReader(&buf)
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if h.Typeflag == tar.TypeReg {
+				got[h.Name] = [2]string{h.Uname, h.Gname}
+			}
+		}
+		return got
+	}
+	got := read(WriteOptions{Unames: users, Gnames: groups})
+	for p, want := range map[string][2]string{
+		"etc/motd":     {"root", "root"},
+		"home/www/big": {"www-data", "users-with-a-very-long-group-name"}, // sparse, gname in PAX
+		"opt/nobody":   {"", ""},
+	} {
+		if got[p] != want {
+			t.Errorf("%s: names %q, want %q", p, got[p], want)
+		}
+	}
+	for p, names := range read(WriteOptions{Unames: users, Gnames: groups, NumericOwner: true}) {
+		if names != [2]string{} {
+			t.Errorf("--numeric-owner: %s: names %q", p, names)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Package ubi reads UBI images (ubinize output or a raw NAND dump): it
+// parses the erase-block headers and reassembles the logical volumes.
+// What a volume holds (usually UBIFS, sometimes squashfs or a kernel) is
+// up to the caller; see package ubifs.
+package ubi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+const (
+	ecMagic  = "UBI#"
+	vidMagic = "UBI!"
+
+	hdrSize = 64 // EC and VID headers, the CRC is over the first 60 bytes
+
+	// LayoutVolumeID: the internal volume holding the volume table (two
+	// copies, LEB 0 and 1).
+	LayoutVolumeID = 0x7fffefff
+
+	vtblRecordSize = 172
+	vtblMaxRecords = 128
+
+	volDynamic = 1
+	volStatic  = 2
+)
+
+// ErrNotUBI: no erase block starts with a valid EC header.
+var ErrNotUBI = errors.New("ubi: no UBI erase-block headers found")
+
+// crc is UBI's crc32(UBI_CRC32_INIT, ...): CRC-32 with the initial
+// inversion but not the final one.
+func crc(b []byte) uint32 {
+	return ^crc32.ChecksumIEEE(b)
+}
+
+// IsUBI reports whether b starts with a UBI erase-counter header.
+func IsUBI(b []byte) bool {
+	return len(b) >= hdrSize && string(b[:4]) == ecMagic && binary.BigEndian.Uint32(b[60:]) == crc(b[:60])
+}
+
+// Volume is one reassembled volume. Data of a dynamic volume runs up to
+// its last mapped LEB (unmapped ones inside read as 0xff, as on flash); a
+// static volume is exactly the data it was written with.
+type Volume struct {
+	ID       uint32
+	Name     string
+	Static   bool
+	Reserved uint32 // PEBs reserved in the volume table
+	LEBs     int    // mapped LEBs found in the image
+	LEBSize  int    // usable bytes per LEB (LEB size minus alignment padding)
+	Data     []byte
+}
+
+// Type is "static" or "dynamic", as ubinize.ini writes it.
+func (v *Volume) Type() string {
+	if v.Static {
+		return "static"
+	}
+	return "dynamic"
+}
+
+// Image is a parsed UBI image.
+type Image struct {
+	PEBSize    int
+	LEBSize    int // PEB size minus the headers (data offset)
+	VIDOffset  int
+	DataOffset int
+	ImageSeq   uint32
+	PEBs       int // erase blocks with a valid EC header
+	Volumes    []*Volume
+}
+
+// Volume returns the volume called name, or with that decimal ID.
+func (im *Image) Volume(name string) (*Volume, error) {
+	for _, v := range im.Volumes {
+		if v.Name == name || fmt.Sprint(v.ID) == name {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("ubi: no volume %q", name)
+}
+
+type leb struct {
+	peb      int
+	sqnum    uint64
+	dataSize uint32
+	usedEBs  uint32
+	dataPad  uint32
+	static   bool
+}
+
+// Read parses a whole UBI image. pebSize 0 finds the erase-block size by
+// itself (the distance to the next EC header of the same image).
+func Read(b []byte, pebSize int) (*Image, error) {
+	if !IsUBI(b) {
+		return nil, ErrNotUBI
+	}
+	im := &Image{
+		VIDOffset:  int(binary.BigEndian.Uint32(b[16:])),
+		DataOffset: int(binary.BigEndian.Uint32(b[20:])),
+		ImageSeq:   binary.BigEndian.Uint32(b[24:]),
+	}
+	if pebSize == 0 {
+		pebSize = im.guessPEBSize(b)
+	}
+	if im.VIDOffset+hdrSize > pebSize || im.DataOffset >= pebSize || im.DataOffset < im.VIDOffset+hdrSize {
+		return nil, fmt.Errorf("ubi: bad header offsets: VID header at %d, data at %d, erase block %d bytes", im.VIDOffset, im.DataOffset, pebSize)
+	}
+	im.PEBSize, im.LEBSize = pebSize, pebSize-im.DataOffset
+
+	// newest copy (highest sqnum) of every (volume, LEB)
+	lebs := map[uint32]map[uint32]*leb{}
+	for peb := 0; (peb+1)*pebSize <= len(b); peb++ {
+		p := b[peb*pebSize : (peb+1)*pebSize]
+		if !IsUBI(p) {
+			continue // bad or erased block
+		}
+		im.PEBs++
+		vid := p[im.VIDOffset : im.VIDOffset+hdrSize]
+		if string(vid[:4]) != vidMagic || binary.BigEndian.Uint32(vid[60:]) != crc(vid[:60]) {
+			continue // free block: EC header only
+		}
+		volID, lnum := binary.BigEndian.Uint32(vid[8:]), binary.BigEndian.Uint32(vid[12:])
+		l := &leb{
+			peb: peb, sqnum: binary.BigEndian.Uint64(vid[40:]),
+			dataSize: binary.BigEndian.Uint32(vid[20:]), usedEBs: binary.BigEndian.Uint32(vid[24:]),
+			dataPad: binary.BigEndian.Uint32(vid[28:]), static: vid[5] == volStatic,
+		}
+		// a copy made by wear-leveling has its data CRC; a torn one is skipped
+		if vid[6] != 0 && (int(l.dataSize) > im.LEBSize || binary.BigEndian.Uint32(vid[32:]) != crc(p[im.DataOffset:im.DataOffset+int(l.dataSize)])) {
+			continue
+		}
+		if lebs[volID] == nil {
+			lebs[volID] = map[uint32]*leb{}
+		}
+		if old := lebs[volID][lnum]; old == nil || l.sqnum > old.sqnum {
+			lebs[volID][lnum] = l
+		}
+	}
+	if im.PEBs == 0 {
+		return nil, ErrNotUBI
+	}
+
+	vtbl := im.volumeTable(b, lebs[LayoutVolumeID])
+	ids := make([]uint32, 0, len(lebs))
+	for id := range lebs {
+		if id != LayoutVolumeID {
+			ids = append(ids, id)
+		}
+	}
+	for id := range vtbl {
+		if lebs[id] == nil {
+			ids = append(ids, id) // in the table, but nothing written yet
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		v := vtbl[id]
+		if v == nil {
+			v = &Volume{ID: id, Name: fmt.Sprintf("vol%d", id)}
+		}
+		im.assemble(b, v, lebs[id])
+		im.Volumes = append(im.Volumes, v)
+	}
+	return im, nil
+}
+
+// guessPEBSize: the smallest power of two (4 KiB..2 MiB) at which another
+// EC header of the same image starts; a single-block image is all one PEB.
+func (im *Image) guessPEBSize(b []byte) int {
+	for size := 4 << 10; size <= 2<<20 && size < len(b); size <<= 1 {
+		if size > im.DataOffset && IsUBI(b[size:]) && binary.BigEndian.Uint32(b[size+24:]) == im.ImageSeq {
+			return size
+		}
+	}
+	return len(b)
+}
+
+// volumeTable reads the volume table from the layout volume (LEB 0, or
+// its copy in LEB 1), indexed by volume ID.
+func (im *Image) volumeTable(b []byte, layout map[uint32]*leb) map[uint32]*Volume {
+	for _, lnum := range []uint32{0, 1} {
+		l := layout[lnum]
+		if l == nil {
+			continue
+		}
+		data := b[l.peb*im.PEBSize+im.DataOffset : (l.peb+1)*im.PEBSize]
+		vols := map[uint32]*Volume{}
+		ok := true
+		for i := 0; i < vtblMaxRecords && (i+1)*vtblRecordSize <= len(data); i++ {
+			r := data[i*vtblRecordSize : (i+1)*vtblRecordSize]
+			if binary.BigEndian.Uint32(r[168:]) != crc(r[:168]) {
+				ok = false
+				break
+			}
+			reserved := binary.BigEndian.Uint32(r)
+			if reserved == 0 {
+				continue
+			}
+			nlen := int(binary.BigEndian.Uint16(r[14:]))
+			if nlen > 127 {
+				nlen = 127
+			}
+			vols[uint32(i)] = &Volume{
+				ID: uint32(i), Name: string(bytes.TrimRight(r[16:16+nlen], "\x00")),
+				Static: r[12] == volStatic, Reserved: reserved,
+				LEBSize: im.LEBSize - int(binary.BigEndian.Uint32(r[8:])),
+			}
+		}
+		if ok {
+			return vols
+		}
+	}
+	return nil
+}
+
+func (im *Image) assemble(b []byte, v *Volume, lebs map[uint32]*leb) {
+	if v.LEBSize == 0 {
+		v.LEBSize = im.LEBSize
+		for _, l := range lebs {
+			v.LEBSize = im.LEBSize - int(l.dataPad)
+			v.Static = l.static
+			break
+		}
+	}
+	if len(lebs) == 0 {
+		return
+	}
+	last := uint32(0)
+	for lnum := range lebs {
+		if lnum > last {
+			last = lnum
+		}
+	}
+	if v.Static {
+		// used_ebs says how many LEBs the volume has, data_size how much
+		// of each is used
+		for _, l := range lebs {
+			if l.usedEBs > 0 {
+				last = l.usedEBs - 1
+				break
+			}
+		}
+	}
+	v.LEBs = len(lebs)
+	var out []byte
+	for lnum := uint32(0); lnum <= last; lnum++ {
+		l := lebs[lnum]
+		if l == nil {
+			if !v.Static {
+				out = append(out, bytes.Repeat([]byte{0xff}, v.LEBSize)...)
+			}
+			continue
+		}
+		data := b[l.peb*im.PEBSize+im.DataOffset:]
+		n := v.LEBSize
+		if v.Static && int(l.dataSize) < n {
+			n = int(l.dataSize)
+		}
+		out = append(out, data[:n]...)
+	}
+	v.Data = out
+}
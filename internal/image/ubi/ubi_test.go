@@ -0,0 +1,124 @@
+package ubi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	testPEB  = 16 << 10
+	testVID  = 512
+	testData = 1024
+	testLEB  = testPEB - testData
+	testSeq  = 0x1234
+)
+
+type builder struct {
+	buf   bytes.Buffer
+	sqnum uint64
+}
+
+func (b *builder) ec() []byte {
+	p := bytes.Repeat([]byte{0xff}, testPEB)
+	copy(p, ecMagic)
+	p[4] = 1
+	binary.BigEndian.PutUint64(p[8:], 1)
+	binary.BigEndian.PutUint32(p[16:], testVID)
+	binary.BigEndian.PutUint32(p[20:], testData)
+	binary.BigEndian.PutUint32(p[24:], testSeq)
+	clear(p[28:60])
+	binary.BigEndian.PutUint32(p[60:], crc(p[:60]))
+	return p
+}
+
+// peb appends an erase block holding LEB lnum of volume id.
+func (b *builder) peb(id, lnum uint32, static bool, usedEBs uint32, data []byte) {
+	p := b.ec()
+	vid := p[testVID : testVID+hdrSize]
+	clear(vid)
+	copy(vid, vidMagic)
+	vid[4] = 1
+	vid[5] = volDynamic
+	if static {
+		vid[5] = volStatic
+		binary.BigEndian.PutUint32(vid[20:], uint32(len(data)))
+		binary.BigEndian.PutUint32(vid[24:], usedEBs)
+		binary.BigEndian.PutUint32(vid[32:], crc(data))
+	}
+	binary.BigEndian.PutUint32(vid[8:], id)
+	binary.BigEndian.PutUint32(vid[12:], lnum)
+	b.sqnum++
+	binary.BigEndian.PutUint64(vid[40:], b.sqnum)
+	binary.BigEndian.PutUint32(vid[60:], crc(vid[:60]))
+	copy(p[testData:], data)
+	b.buf.Write(p)
+}
+
+func vtblRecord(reserved uint32, static bool, name string) []byte {
+	r := make([]byte, vtblRecordSize)
+	if reserved > 0 {
+		binary.BigEndian.PutUint32(r, reserved)
+		binary.BigEndian.PutUint32(r[4:], 1)
+		r[12] = volDynamic
+		if static {
+			r[12] = volStatic
+		}
+		binary.BigEndian.PutUint16(r[14:], uint16(len(name)))
+		copy(r[16:], name)
+	}
+	binary.BigEndian.PutUint32(r[168:], crc(r[:168]))
+	return r
+}
+
+func TestRead(t *testing.T) {
+	var vtbl []byte
+	vtbl = append(vtbl, vtblRecord(8, false, "rootfs")...)
+	vtbl = append(vtbl, vtblRecord(2, true, "kernel")...)
+	for i := 2; i < vtblMaxRecords; i++ {
+		vtbl = append(vtbl, vtblRecord(0, false, "")...)
+	}
+	leb0 := bytes.Repeat([]byte{'A'}, testLEB)
+	leb2 := bytes.Repeat([]byte{'C'}, testLEB)
+	kernel := bytes.Repeat([]byte("kernel"), 3000) // 18000 bytes: two LEBs
+
+	b := &builder{}
+	b.peb(LayoutVolumeID, 0, false, 0, vtbl)
+	b.peb(LayoutVolumeID, 1, false, 0, vtbl)
+	b.peb(0, 0, false, 0, bytes.Repeat([]byte{'a'}, testLEB)) // replaced below
+	b.peb(0, 2, false, 0, leb2)
+	b.buf.Write(b.ec()) // free block
+	b.buf.Write(bytes.Repeat([]byte{0xff}, testPEB))
+	b.peb(1, 0, true, 2, kernel[:testLEB])
+	b.peb(1, 1, true, 2, kernel[testLEB:])
+	b.peb(0, 0, false, 0, leb0)
+
+	im, err := Read(b.buf.Bytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.PEBSize != testPEB || im.LEBSize != testLEB || im.PEBs != 8 || len(im.Volumes) != 2 {
+		t.Fatalf("image = %+v", im)
+	}
+	root, err := im.Volume("rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte(nil), leb0...), bytes.Repeat([]byte{0xff}, testLEB)...), leb2...)
+	if root.Static || root.LEBs != 2 || !bytes.Equal(root.Data, want) {
+		t.Fatalf("rootfs: static=%v lebs=%d size=%d", root.Static, root.LEBs, len(root.Data))
+	}
+	k, err := im.Volume("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Name != "kernel" || k.Type() != "static" || !bytes.Equal(k.Data, kernel) {
+		t.Fatalf("kernel: %s %s size=%d", k.Name, k.Type(), len(k.Data))
+	}
+}
+
+func TestReadNotUBI(t *testing.T) {
+	if _, err := Read(make([]byte, testPEB), 0); err != ErrNotUBI {
+		t.Fatalf("err = %v, want ErrNotUBI", err)
+	}
+}
@@ -0,0 +1,459 @@
+// Package ubifs reads a UBIFS volume (mkfs.ubifs output, or a volume
+// taken out of a UBI image) into a memfs. It is read-only.
+//
+// The tree is what the last commit recorded: the master node points at
+// the root of the index B-tree, whose leaves are the inode, directory
+// entry and data nodes. Journal buds written after that commit are not
+// replayed, so a dump of a mounted, never-synced filesystem can miss the
+// newest changes; images built by mkfs.ubifs have none.
+package ubifs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/anchore/go-lzo"
+	"github.com/klauspost/compress/zstd"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/fs/memfs"
+)
+
+// Magic is the node magic (little-endian at offset 0 of every node).
+const Magic = 0x06101831
+
+const (
+	chSize       = 24 // common header
+	sbNodeSize   = 4096
+	mstNodeSize  = 512
+	idxNodeSize  = 28
+	branchSize   = 20 // lnum, offs, len, 8-byte simple key
+	inoNodeSize  = 160
+	dentSize     = 56
+	dataNodeSize = 48
+
+	blockSize = 4096
+
+	rootIno = 1
+)
+
+// node types
+const (
+	typeIno  = 0
+	typeData = 1
+	typeDent = 2
+	typeXent = 3
+	typeSB   = 6
+	typeMst  = 7
+	typeIdx  = 9
+)
+
+// keyData: the key type (top 3 bits of the key's second word) of data
+// nodes; the other 29 bits are the block number.
+const keyData = 1
+
+// superblock flags that change the on-flash format beyond what is read here
+const (
+	flagEncryption = 0x10
+	flagAuth       = 0x20
+)
+
+const (
+	comprNone = 0
+	comprLZO  = 1
+	comprZlib = 2
+	comprZstd = 3
+)
+
+// maxIndexDepth bounds the index walk in a corrupt image.
+const maxIndexDepth = 64
+
+// ErrNotUBIFS: the data does not start with a UBIFS superblock node.
+var ErrNotUBIFS = errors.New("ubifs: no UBIFS superblock")
+
+// crc is UBIFS's crc32(UBIFS_CRC32_INIT, ...) over the node after the
+// magic and CRC fields.
+func crc(b []byte) uint32 {
+	return ^crc32.ChecksumIEEE(b)
+}
+
+// IsUBIFS reports whether b starts with a UBIFS superblock node.
+func IsUBIFS(b []byte) bool {
+	return len(b) >= chSize && binary.LittleEndian.Uint32(b) == Magic && b[20] == typeSB
+}
+
+// Superblock: the fields info shows.
+type Superblock struct {
+	LEBSize    int
+	LEBCount   uint32
+	MinIOSize  uint32
+	FmtVersion uint32
+	Compressor string // default for new data
+	UUID       [16]byte
+}
+
+var comprNames = map[uint16]string{comprNone: "none", comprLZO: "lzo", comprZlib: "zlib", comprZstd: "zstd"}
+
+type inode struct {
+	size     uint64
+	mode     uint32
+	uid, gid uint32
+	mtime    time.Time
+	data     []byte // symlink target or device number
+}
+
+type dent struct {
+	name string
+	ino  uint64
+}
+
+type volume struct {
+	b       []byte
+	sb      Superblock
+	inodes  map[uint64]*inode
+	dents   map[uint64][]dent
+	blocks  map[uint64]map[uint32][]byte // by inode, then block number; still compressed
+	comprOf map[uint64]map[uint32]uint16
+	sizeOf  map[uint64]map[uint32]uint32
+	zstd    *zstd.Decoder // made on the first zstd block
+}
+
+// Load reads a UBIFS volume: LEB 0 holds the superblock, the LEB size
+// comes from it.
+func Load(r io.Reader) (*memfs.FS, *Superblock, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := &volume{
+		b: b, inodes: map[uint64]*inode{}, dents: map[uint64][]dent{},
+		blocks: map[uint64]map[uint32][]byte{}, comprOf: map[uint64]map[uint32]uint16{}, sizeOf: map[uint64]map[uint32]uint32{},
+	}
+	if err := v.superblock(); err != nil {
+		return nil, nil, err
+	}
+	lnum, offs, err := v.master()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := v.index(lnum, offs, 0); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if v.zstd != nil {
+			v.zstd.Close()
+		}
+	}()
+	fs := memfs.New()
+	if err := v.fill(fs, rootIno, "/", map[uint64]bool{}); err != nil {
+		return nil, nil, err
+	}
+	return fs, &v.sb, nil
+}
+
+// at is the byte offset of lnum:offs in the volume.
+func (v *volume) at(lnum, offs uint32) int64 {
+	return int64(lnum)*int64(v.sb.LEBSize) + int64(offs)
+}
+
+// node returns the node at lnum:offs after checking its header and CRC.
+func (v *volume) node(lnum, offs uint32) ([]byte, error) {
+	at := v.at(lnum, offs)
+	if at+chSize > int64(len(v.b)) {
+		return nil, common.Corrupt("ubifs", at, fmt.Sprintf("node LEB %d:%#x is past the end of the volume", lnum, offs))
+	}
+	n := v.b[at:]
+	if binary.LittleEndian.Uint32(n) != Magic {
+		return nil, common.Corrupt("ubifs", at, fmt.Sprintf("no node magic at LEB %d:%#x", lnum, offs))
+	}
+	size := int64(binary.LittleEndian.Uint32(n[16:]))
+	if size < chSize || at+size > int64(len(v.b)) {
+		return nil, common.Corrupt("ubifs", at, fmt.Sprintf("node length %d at LEB %d:%#x", size, lnum, offs))
+	}
+	n = n[:size]
+	if binary.LittleEndian.Uint32(n[4:]) != crc(n[8:]) {
+		return nil, common.Corrupt("ubifs", at, fmt.Sprintf("bad node CRC at LEB %d:%#x", lnum, offs))
+	}
+	return n, nil
+}
+
+func (v *volume) superblock() error {
+	if !IsUBIFS(v.b) || len(v.b) < sbNodeSize {
+		return ErrNotUBIFS
+	}
+	size := binary.LittleEndian.Uint32(v.b[16:])
+	if size < 88 || int(size) > len(v.b) || binary.LittleEndian.Uint32(v.b[4:]) != crc(v.b[8:size]) {
+		return common.Corrupt("ubifs", 0, "bad superblock CRC")
+	}
+	sb := v.b[:size]
+	if sb[27] != 0 {
+		return fmt.Errorf("ubifs: key format %d is not supported", sb[27])
+	}
+	if flags := binary.LittleEndian.Uint32(sb[28:]); flags&flagEncryption != 0 {
+		return errors.New("ubifs: encrypted filesystems are not supported")
+	} else if flags&flagAuth != 0 {
+		return errors.New("ubifs: authenticated filesystems are not supported")
+	}
+	v.sb = Superblock{
+		MinIOSize: binary.LittleEndian.Uint32(sb[32:]), LEBSize: int(binary.LittleEndian.Uint32(sb[36:])),
+		LEBCount: binary.LittleEndian.Uint32(sb[40:]), FmtVersion: binary.LittleEndian.Uint32(sb[80:]),
+		Compressor: comprNames[binary.LittleEndian.Uint16(sb[84:])],
+	}
+	if len(sb) >= 124 {
+		copy(v.sb.UUID[:], sb[108:124])
+	}
+	if v.sb.LEBSize < sbNodeSize {
+		return common.Corrupt("ubifs", 36, fmt.Sprintf("bad LEB size %d", v.sb.LEBSize))
+	}
+	return nil
+}
+
+// master finds the newest valid master node (LEBs 1 and 2 each hold a
+// sequence of copies) and returns the index root.
+func (v *volume) master() (lnum, offs uint32, err error) {
+	var best []byte
+	for _, l := range []uint32{1, 2} {
+		for o := 0; o+mstNodeSize <= v.sb.LEBSize; o += 8 {
+			at := int(l)*v.sb.LEBSize + o
+			if at+chSize > len(v.b) {
+				break
+			}
+			if binary.LittleEndian.Uint32(v.b[at:]) != Magic || v.b[at+20] != typeMst {
+				continue
+			}
+			n, err := v.node(l, uint32(o))
+			if err != nil || len(n) < 60 {
+				continue
+			}
+			if best == nil || binary.LittleEndian.Uint64(n[8:]) > binary.LittleEndian.Uint64(best[8:]) {
+				best = n
+			}
+		}
+	}
+	if best == nil {
+		return 0, 0, common.Corrupt("ubifs", int64(v.sb.LEBSize), "no valid master node in LEB 1 or 2")
+	}
+	return binary.LittleEndian.Uint32(best[48:]), binary.LittleEndian.Uint32(best[52:]), nil
+}
+
+// index walks the index B-tree below lnum:offs and records its leaves.
+func (v *volume) index(lnum, offs uint32, depth int) error {
+	if depth > maxIndexDepth {
+		return common.Corrupt("ubifs", v.at(lnum, offs), fmt.Sprintf("index deeper than %d levels", maxIndexDepth))
+	}
+	n, err := v.node(lnum, offs)
+	if err != nil {
+		return err
+	}
+	if n[20] != typeIdx || len(n) < idxNodeSize {
+		return common.Corrupt("ubifs", v.at(lnum, offs), fmt.Sprintf("node type %d where the index expects an index node", n[20]))
+	}
+	count, level := int(binary.LittleEndian.Uint16(n[24:])), binary.LittleEndian.Uint16(n[26:])
+	if idxNodeSize+count*branchSize > len(n) {
+		return common.Corrupt("ubifs", v.at(lnum, offs), fmt.Sprintf("%d index branches do not fit the node", count))
+	}
+	for i := 0; i < count; i++ {
+		br := n[idxNodeSize+i*branchSize:]
+		bl, bo := binary.LittleEndian.Uint32(br), binary.LittleEndian.Uint32(br[4:])
+		if level > 0 {
+			if err := v.index(bl, bo, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		leaf, err := v.node(bl, bo)
+		if err != nil {
+			return err
+		}
+		if err := v.leaf(leaf, bl, bo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *volume) leaf(n []byte, lnum, offs uint32) error {
+	bad := func() error {
+		return common.Corrupt("ubifs", v.at(lnum, offs), fmt.Sprintf("truncated node (type %d)", n[20]))
+	}
+	switch n[20] {
+	case typeIno:
+		if len(n) < inoNodeSize {
+			return bad()
+		}
+		inum := uint64(binary.LittleEndian.Uint32(n[24:]))
+		dlen := int(binary.LittleEndian.Uint32(n[112:]))
+		if inoNodeSize+dlen > len(n) {
+			return bad()
+		}
+		v.inodes[inum] = &inode{
+			size:  binary.LittleEndian.Uint64(n[48:]),
+			mtime: time.Unix(int64(binary.LittleEndian.Uint64(n[72:])), int64(binary.LittleEndian.Uint32(n[88:]))),
+			uid:   binary.LittleEndian.Uint32(n[96:]), gid: binary.LittleEndian.Uint32(n[100:]),
+			mode: binary.LittleEndian.Uint32(n[104:]),
+			data: n[inoNodeSize : inoNodeSize+dlen],
+		}
+	case typeDent:
+		if len(n) < dentSize {
+			return bad()
+		}
+		nlen := int(binary.LittleEndian.Uint16(n[50:]))
+		if dentSize+nlen > len(n) {
+			return bad()
+		}
+		parent := uint64(binary.LittleEndian.Uint32(n[24:]))
+		v.dents[parent] = append(v.dents[parent], dent{name: string(n[dentSize : dentSize+nlen]), ino: binary.LittleEndian.Uint64(n[40:])})
+	case typeData:
+		if len(n) < dataNodeSize {
+			return bad()
+		}
+		inum := uint64(binary.LittleEndian.Uint32(n[24:]))
+		k := binary.LittleEndian.Uint32(n[28:])
+		if k>>29 != keyData {
+			return common.Corrupt("ubifs", v.at(lnum, offs), fmt.Sprintf("data node with key type %d", k>>29))
+		}
+		block := k & (1<<29 - 1)
+		if v.blocks[inum] == nil {
+			v.blocks[inum] = map[uint32][]byte{}
+			v.comprOf[inum] = map[uint32]uint16{}
+			v.sizeOf[inum] = map[uint32]uint32{}
+		}
+		v.blocks[inum][block] = n[dataNodeSize:]
+		v.comprOf[inum][block] = binary.LittleEndian.Uint16(n[44:])
+		v.sizeOf[inum][block] = binary.LittleEndian.Uint32(n[40:])
+	case typeXent:
+		// extended attributes: memfs has no place for them
+	default:
+		return common.Corrupt("ubifs", v.at(lnum, offs), fmt.Sprintf("node type %d in the index", n[20]))
+	}
+	return nil
+}
+
+// fill adds the entries of directory inum (at dir) to fs, recursively.
+func (v *volume) fill(fs *memfs.FS, inum uint64, dir string, seen map[uint64]bool) error {
+	seen[inum] = true
+	ents := v.dents[inum]
+	sort.Slice(ents, func(i, j int) bool { return ents[i].name < ents[j].name })
+	for _, d := range ents {
+		if d.name == "" || d.name == "." || d.name == ".." || bytes.ContainsAny([]byte(d.name), "/\x00") {
+			continue
+		}
+		ino := v.inodes[d.ino]
+		if ino == nil {
+			return common.WithPath("ubifs", path.Join(dir, d.name), fmt.Errorf("inode %d is not in the index", d.ino))
+		}
+		p := path.Join(dir, d.name)
+		mode := memfs.Mode(ino.mode)
+		switch mode.Type() {
+		case memfs.ModeDir:
+			if seen[d.ino] {
+				continue
+			}
+			fs.PutDirMode(p, mode, ino.uid, ino.gid, ino.mtime)
+			if err := v.fill(fs, d.ino, p, seen); err != nil {
+				return err
+			}
+		case memfs.ModeFile:
+			data, err := v.data(d.ino, ino.size)
+			if err != nil {
+				return common.WithPath("ubifs", p, err)
+			}
+			fs.PutFile(p, data, mode, ino.uid, ino.gid, ino.mtime)
+		case memfs.ModeLink:
+			fs.PutSymlink(p, string(ino.data), ino.uid, ino.gid, ino.mtime)
+		case memfs.ModeChar, memfs.ModeBlock, memfs.ModeFIFO:
+			major, minor := rdev(ino.data)
+			fs.PutNode(p, mode.Type(), uint32(mode&0o7777), ino.uid, ino.gid, major, minor, ino.mtime)
+		}
+	}
+	return nil
+}
+
+// rdev decodes union ubifs_dev_desc: new_encode_dev in 4 bytes, or
+// huge_encode_dev in 8.
+func rdev(b []byte) (major, minor uint32) {
+	var v uint64
+	switch len(b) {
+	case 4:
+		v = uint64(binary.LittleEndian.Uint32(b))
+	case 8:
+		v = binary.LittleEndian.Uint64(b)
+	default:
+		return 0, 0
+	}
+	return uint32(v&0xfff00) >> 8, uint32(v&0xff) | uint32(v>>12)&0xfff00
+}
+
+// data assembles a file from its 4 KiB blocks; holes read as zeros.
+func (v *volume) data(inum, size uint64) ([]byte, error) {
+	if err := common.CheckSize(fmt.Sprintf("ubifs inode %d", inum), int64(size)); err != nil {
+		return nil, err
+	}
+	out := make([]byte, size)
+	for block, c := range v.blocks[inum] {
+		at := uint64(block) * blockSize
+		if at >= size {
+			continue
+		}
+		b, err := v.decompress(v.comprOf[inum][block], c, int(v.sizeOf[inum][block]))
+		if err != nil {
+			return nil, fmt.Errorf("ubifs: inode %d block %d: %w", inum, block, err)
+		}
+		copy(out[at:], b)
+	}
+	return out, nil
+}
+
+func (v *volume) decompress(compr uint16, in []byte, size int) ([]byte, error) {
+	if size > blockSize {
+		return nil, fmt.Errorf("block of %d bytes", size)
+	}
+	out := make([]byte, size)
+	switch compr {
+	case comprNone:
+		if len(in) < size {
+			return nil, fmt.Errorf("%d bytes of data, want %d", len(in), size)
+		}
+		copy(out, in)
+	case comprLZO:
+		n, err := lzo.Decompress(in, out)
+		if err != nil {
+			return nil, fmt.Errorf("lzo: %w", err)
+		}
+		if n != size {
+			return nil, fmt.Errorf("lzo: %d bytes, want %d", n, size)
+		}
+	case comprZlib:
+		// raw deflate (the kernel uses negative window bits)
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(in)), out); err != nil {
+			return nil, fmt.Errorf("zlib: %w", err)
+		}
+	case comprZstd:
+		if v.zstd == nil {
+			d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			v.zstd = d
+		}
+		b, err := v.zstd.DecodeAll(in, nil)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		if len(b) != size {
+			return nil, fmt.Errorf("zstd: %d bytes, want %d", len(b), size)
+		}
+		out = b
+	default:
+		return nil, fmt.Errorf("unknown compression type %d", compr)
+	}
+	return out, nil
+}
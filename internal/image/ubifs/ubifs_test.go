@@ -0,0 +1,215 @@
+package ubifs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"goimagetool/internal/fs/memfs"
+)
+
+const testLEB = 16 << 10
+
+// builder lays out a minimal committed UBIFS: superblock in LEB 0, master
+// nodes in LEB 1, leaves and index nodes from LEB 3 on.
+type builder struct {
+	b     []byte
+	sqnum uint64
+	lnum  uint32
+	offs  int
+}
+
+func newBuilder() *builder {
+	return &builder{b: bytes.Repeat([]byte{0xff}, 4*testLEB), lnum: 3}
+}
+
+func (bd *builder) header(typ byte, n []byte) {
+	binary.LittleEndian.PutUint32(n, Magic)
+	bd.sqnum++
+	binary.LittleEndian.PutUint64(n[8:], bd.sqnum)
+	binary.LittleEndian.PutUint32(n[16:], uint32(len(n)))
+	n[20] = typ
+	n[21], n[22], n[23] = 0, 0, 0
+	binary.LittleEndian.PutUint32(n[4:], crc(n[8:]))
+}
+
+func (bd *builder) writeAt(lnum uint32, offs int, typ byte, n []byte) {
+	bd.header(typ, n)
+	copy(bd.b[int(lnum)*testLEB+offs:], n)
+}
+
+// put appends a node to the current data LEB and returns its position.
+func (bd *builder) put(typ byte, n []byte) (uint32, uint32) {
+	if bd.offs+len(n) > testLEB {
+		bd.lnum++
+		bd.offs = 0
+	}
+	if end := int(bd.lnum+1) * testLEB; end > len(bd.b) {
+		bd.b = append(bd.b, bytes.Repeat([]byte{0xff}, end-len(bd.b))...)
+	}
+	lnum, offs := bd.lnum, bd.offs
+	bd.writeAt(lnum, offs, typ, n)
+	bd.offs += (len(n) + 7) &^ 7
+	return lnum, uint32(offs)
+}
+
+func key(n []byte, inum uint32, typ, low uint32) {
+	binary.LittleEndian.PutUint32(n[24:], inum)
+	binary.LittleEndian.PutUint32(n[28:], typ<<29|low)
+}
+
+type branch struct{ lnum, offs, len uint32 }
+
+func (bd *builder) ino(inum uint32, mode uint32, size uint64, data []byte) branch {
+	n := make([]byte, inoNodeSize+len(data))
+	key(n, inum, 0, 0)
+	binary.LittleEndian.PutUint64(n[48:], size)
+	binary.LittleEndian.PutUint64(n[72:], 1700000000)
+	binary.LittleEndian.PutUint32(n[92:], 1)
+	binary.LittleEndian.PutUint32(n[96:], 1000)
+	binary.LittleEndian.PutUint32(n[100:], 100)
+	binary.LittleEndian.PutUint32(n[104:], mode)
+	binary.LittleEndian.PutUint32(n[112:], uint32(len(data)))
+	copy(n[inoNodeSize:], data)
+	l, o := bd.put(typeIno, n)
+	return branch{l, o, uint32(len(n))}
+}
+
+func (bd *builder) dent(parent, inum uint32, name string) branch {
+	n := make([]byte, dentSize+len(name)+1)
+	key(n, parent, 2, 0x1234)
+	binary.LittleEndian.PutUint64(n[40:], uint64(inum))
+	binary.LittleEndian.PutUint16(n[50:], uint16(len(name)))
+	copy(n[dentSize:], name)
+	l, o := bd.put(typeDent, n)
+	return branch{l, o, uint32(len(n))}
+}
+
+func (bd *builder) data(inum, block uint32, compr uint16, size int, data []byte) branch {
+	n := make([]byte, dataNodeSize+len(data))
+	key(n, inum, keyData, block)
+	binary.LittleEndian.PutUint32(n[40:], uint32(size))
+	binary.LittleEndian.PutUint16(n[44:], compr)
+	copy(n[dataNodeSize:], data)
+	l, o := bd.put(typeData, n)
+	return branch{l, o, uint32(len(n))}
+}
+
+func (bd *builder) idx(level uint16, brs []branch) branch {
+	n := make([]byte, idxNodeSize+len(brs)*branchSize)
+	binary.LittleEndian.PutUint16(n[24:], uint16(len(brs)))
+	binary.LittleEndian.PutUint16(n[26:], level)
+	for i, br := range brs {
+		b := n[idxNodeSize+i*branchSize:]
+		binary.LittleEndian.PutUint32(b, br.lnum)
+		binary.LittleEndian.PutUint32(b[4:], br.offs)
+		binary.LittleEndian.PutUint32(b[8:], br.len)
+	}
+	l, o := bd.put(typeIdx, n)
+	return branch{l, o, uint32(len(n))}
+}
+
+func (bd *builder) finish(root branch) []byte {
+	sb := make([]byte, sbNodeSize)
+	binary.LittleEndian.PutUint32(sb[32:], 2048)
+	binary.LittleEndian.PutUint32(sb[36:], testLEB)
+	binary.LittleEndian.PutUint32(sb[40:], uint32(len(bd.b)/testLEB))
+	binary.LittleEndian.PutUint32(sb[80:], 4)
+	binary.LittleEndian.PutUint16(sb[84:], comprZlib)
+	bd.writeAt(0, 0, typeSB, sb)
+	// an older master copy with a bogus root, then the current one
+	for i, r := range []branch{{99, 0, 0}, root} {
+		m := make([]byte, mstNodeSize)
+		binary.LittleEndian.PutUint32(m[48:], r.lnum)
+		binary.LittleEndian.PutUint32(m[52:], r.offs)
+		binary.LittleEndian.PutUint32(m[56:], r.len)
+		bd.writeAt(1, i*2048, typeMst, m)
+	}
+	return bd.b
+}
+
+func deflate(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// lzoLiterals is an LZO1X stream of literals only (n <= 238).
+func lzoLiterals(b []byte) []byte {
+	return append(append([]byte{byte(17 + len(b))}, b...), 0x11, 0, 0)
+}
+
+func TestLoad(t *testing.T) {
+	bd := newBuilder()
+	hostname := []byte("buildroot\n")
+	block0 := bytes.Repeat([]byte("0123456789abcdef"), 256) // 4096 bytes
+	block1 := []byte("lzo block")
+	block3 := bytes.Repeat([]byte{'z'}, 100)
+	enc, _ := zstd.NewWriter(nil)
+	zblock3 := enc.EncodeAll(block3, nil)
+	enc.Close()
+	bigSize := 3*blockSize + len(block3)
+
+	leaves := []branch{
+		bd.ino(1, 0o40755, 0, nil),
+		bd.dent(1, 65, "etc"),
+		bd.ino(65, 0o40755, 0, nil),
+		bd.dent(65, 66, "hostname"),
+		bd.ino(66, 0o100644, uint64(len(hostname)), nil),
+		bd.data(66, 0, comprNone, len(hostname), hostname),
+		bd.dent(1, 67, "big"),
+		bd.ino(67, 0o100755, uint64(bigSize), nil),
+		bd.data(67, 0, comprZlib, len(block0), deflate(t, block0)),
+		bd.data(67, 1, comprLZO, len(block1), lzoLiterals(block1)),
+		// block 2 is a hole
+		bd.data(67, 3, comprZstd, len(block3), zblock3),
+		bd.dent(1, 68, "sh"),
+		bd.ino(68, 0o120777, 7, []byte("busybox")),
+		bd.dent(1, 69, "null"),
+		bd.ino(69, 0o20666, 0, []byte{3, 1, 0, 0}), // new_encode_dev(1, 3)
+	}
+	root := bd.idx(1, []branch{bd.idx(0, leaves[:8]), bd.idx(0, leaves[8:])})
+	fs, sb, err := Load(bytes.NewReader(bd.finish(root)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.LEBSize != testLEB || sb.Compressor != "zlib" {
+		t.Fatalf("superblock = %+v", sb)
+	}
+	if e, ok := fs.Get("/etc/hostname"); !ok || !bytes.Equal(e.Data, hostname) || e.UID != 1000 || e.GID != 100 {
+		t.Fatalf("/etc/hostname = %+v", e)
+	}
+	want := make([]byte, bigSize)
+	copy(want, block0)
+	copy(want[blockSize:], block1)
+	copy(want[3*blockSize:], block3)
+	if e, ok := fs.Get("/big"); !ok || !bytes.Equal(e.Data, want) || e.Mode != 0o100755 {
+		t.Fatalf("/big differs")
+	}
+	if e, ok := fs.Get("/sh"); !ok || e.Mode.Type() != memfs.ModeLink || e.Target != "busybox" {
+		t.Fatalf("/sh = %+v", e)
+	}
+	if e, ok := fs.Get("/null"); !ok || e.Mode.Type() != memfs.ModeChar || e.RdevMajor != 1 || e.RdevMinor != 3 {
+		t.Fatalf("/null = %+v", e)
+	}
+}
+
+func TestLoadBadCRC(t *testing.T) {
+	bd := newBuilder()
+	dir := bd.ino(1, 0o40755, 0, nil)
+	root := bd.idx(0, []branch{dir})
+	b := bd.finish(root)
+	b[int(dir.lnum)*testLEB+int(dir.offs)+100] ^= 1
+	if _, _, err := Load(bytes.NewReader(b)); err == nil {
+		t.Fatal("a node with a bad CRC was accepted")
+	}
+}
@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"strings"
+
+	"goimagetool/internal/common"
 )
 
 const (
@@ -55,17 +60,17 @@ type nodeCtx struct {
 
 func parseFDT(b []byte) (structBlk, strBlk []byte, err error) {
 	if len(b) < 40 {
-		return nil, nil, errors.New("fdt: short header")
+		return nil, nil, common.TooSmall("fdt", "a FIT image", int64(len(b)), 40)
 	}
 	var h fdtHeader
 	_ = binary.Read(bytes.NewReader(b[:40]), binary.BigEndian, &h)
 	if h.Magic != fdtMagic {
-		return nil, nil, errors.New("fdt: bad magic")
+		return nil, nil, common.Corrupt("fdt", 0, fmt.Sprintf("bad magic %#x", h.Magic))
 	}
 	if int(h.OffDTStruct)+int(h.SizeDTStruct) > len(b) ||
 		int(h.OffDTStrings)+int(h.SizeDTStrings) > len(b) ||
 		int(h.OffMemRsvmap) > len(b) {
-		return nil, nil, errors.New("fdt: bad offsets")
+		return nil, nil, common.Corrupt("fdt", 8, "block offsets past end of blob")
 	}
 	structBlk = b[h.OffDTStruct : h.OffDTStruct+h.SizeDTStruct]
 	strBlk = b[h.OffDTStrings : h.OffDTStrings+h.SizeDTStrings]
@@ -80,13 +85,49 @@ func asString(v []byte) string {
 	return string(v[:i])
 }
 
+// asStringList: FDT string list ("a\0b\0").
+func asStringList(v []byte) []string {
+	v = bytes.TrimRight(v, "\x00")
+	if len(v) == 0 {
+		return nil
+	}
+	return strings.Split(string(v), "\x00")
+}
+
+// asAddr: load/entry are one or two cells (#address-cells), big-endian.
+func asAddr(v []byte) uint64 {
+	switch len(v) {
+	case 4:
+		return uint64(binary.BigEndian.Uint32(v))
+	case 8:
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+// putAddr uses one cell while the address fits, like mkimage on 32-bit
+// boards; U-Boot accepts either width.
+func putAddr(a uint64) []byte {
+	if a>>32 == 0 {
+		return binary.BigEndian.AppendUint32(nil, uint32(a))
+	}
+	return binary.BigEndian.AppendUint64(nil, a)
+}
+
+func putStringList(l []string) []byte {
+	return []byte(strings.Join(l, "\x00") + "\x00")
+}
+
 // Read(r): старый core вызывает Read(io.Reader). Реальный парсинг FIT ITB (FDT).
 func Read(r io.Reader) (*Fit, error) {
 	b, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	if len(b) < 4 || binary.BigEndian.Uint32(b[:4]) != fdtMagic {
+	if len(b) < 4 {
+		return nil, common.TooSmall("fdt", "a FIT image", int64(len(b)), 4)
+	}
+	if binary.BigEndian.Uint32(b[:4]) != fdtMagic {
 		f := New()
 		_ = f.AddTyped("blob0", b, "sha1", "custom")
 		f.Default = "blob0"
@@ -101,17 +142,31 @@ func Read(r io.Reader) (*Fit, error) {
 	f := New()
 	stack := make([]nodeCtx, 0, 8)
 	rd := bytes.NewReader(structBlk)
+	// ошибки разбора: смещение токена в блобе и путь текущего узла
+	base := int64(binary.BigEndian.Uint32(b[8:12]))
+	var tokOff int64
+	fail := func(err error) error {
+		p := ""
+		if len(stack) > 0 {
+			p = stack[len(stack)-1].path
+		}
+		return common.WithPath("fdt", p, common.WrapAt("fdt", tokOff, err))
+	}
 
 	var inImages, inConfigs bool
 	var curImg *Image
 	var curImgName string
-	var defaultConfig string
-	var cfgKernel string
+	var curCfg *Config
+	// внешние данные (mkimage -E): data-offset — от конца FDT, выровненного
+	// до 4 байт; data-position — от начала файла; длина — data-size
+	extBase := (int64(binary.BigEndian.Uint32(b[4:8])) + 3) &^ 3
+	var ext extData
 
 	for {
+		tokOff = base + rd.Size() - int64(rd.Len())
 		var token uint32
 		if err := binary.Read(rd, binary.BigEndian, &token); err != nil {
-			return nil, err
+			return nil, fail(err)
 		}
 		switch token {
 		case fdtBeginNode:
@@ -119,7 +174,7 @@ func Read(r io.Reader) (*Fit, error) {
 			for {
 				b1 := make([]byte, 1)
 				if _, err := rd.Read(b1); err != nil {
-					return nil, err
+					return nil, fail(err)
 				}
 				if b1[0] == 0 {
 					break
@@ -128,7 +183,7 @@ func Read(r io.Reader) (*Fit, error) {
 			}
 			if pad := (4 - (1+len(nameBuf))%4) % 4; pad > 0 {
 				if _, err := rd.Seek(int64(pad), 1); err != nil {
-					return nil, err
+					return nil, fail(err)
 				}
 			}
 			name := string(nameBuf)
@@ -150,16 +205,31 @@ func Read(r io.Reader) (*Fit, error) {
 			}
 			if inImages && len(stack) >= 2 && stack[len(stack)-2].path == "/images" && name != "" {
 				curImgName = name
-				curImg = &Image{Name: name, HashAlgo: "sha1", Type: "custom"}
+				curImg = &Image{Name: name, Type: "custom"}
+				ext = extData{off: -1, pos: -1, size: -1}
+			}
+			// hash, hash-1, hash@1…: каждый подузел — отдельный хэш
+			if curImg != nil && len(stack) >= 3 && stack[len(stack)-3].path == "/images" && stringsHasPrefix(name, "hash") {
+				curImg.Hashes = append(curImg.Hashes, Hash{Algo: "sha1"})
+			}
+			if inConfigs && len(stack) >= 2 && stack[len(stack)-2].path == "/configurations" {
+				curCfg = &Config{Name: name}
 			}
 
 		case fdtEndNode:
 			if len(stack) == 0 {
-				return nil, errors.New("fdt: stack underflow")
+				return nil, fail(common.Corrupt("fdt", tokOff, "END_NODE without BEGIN_NODE"))
 			}
 			if inImages && len(stack) >= 2 && stack[len(stack)-2].path == "/images" && stack[len(stack)-1].name == curImgName && curImg != nil {
-				if curImg.Digest == nil {
-					curImg.Digest = hashData(curImg.HashAlgo, curImg.Data)
+				if curImg.Data == nil {
+					data, err := ext.slice(b, extBase)
+					if err != nil {
+						return nil, fail(err)
+					}
+					curImg.Data = data
+				}
+				if len(curImg.Hashes) == 0 {
+					curImg.Hashes = []Hash{{Algo: "sha1", Value: hashData("sha1", curImg.Data)}}
 				}
 				f.imgs[curImg.Name] = curImg
 				if f.Default == "" {
@@ -171,6 +241,10 @@ func Read(r io.Reader) (*Fit, error) {
 			if stack[len(stack)-1].path == "/images" {
 				inImages = false
 			}
+			if inConfigs && curCfg != nil && len(stack) >= 2 && stack[len(stack)-2].path == "/configurations" {
+				f.Configs = append(f.Configs, curCfg)
+				curCfg = nil
+			}
 			if stack[len(stack)-1].path == "/configurations" {
 				inConfigs = false
 			}
@@ -179,20 +253,23 @@ func Read(r io.Reader) (*Fit, error) {
 		case fdtProp:
 			var sz, nameOff uint32
 			if err := binary.Read(rd, binary.BigEndian, &sz); err != nil {
-				return nil, err
+				return nil, fail(err)
 			}
 			if err := binary.Read(rd, binary.BigEndian, &nameOff); err != nil {
-				return nil, err
+				return nil, fail(err)
+			}
+			if int64(sz) > int64(rd.Len()) {
+				return nil, fail(common.Corrupt("fdt", tokOff, fmt.Sprintf("property length %d overruns struct block", sz)))
 			}
 			val := make([]byte, sz)
 			if sz > 0 {
-				if _, err := rd.Read(val); err != nil {
-					return nil, err
+				if _, err := io.ReadFull(rd, val); err != nil {
+					return nil, fail(err)
 				}
 			}
 			if pad := (4 - (int(sz)%4)) % 4; pad > 0 {
 				if _, err := rd.Seek(int64(pad), 1); err != nil {
-					return nil, err
+					return nil, fail(err)
 				}
 			}
 			propName := getCString(strBlk, nameOff)
@@ -205,6 +282,18 @@ func Read(r io.Reader) (*Fit, error) {
 				switch propName {
 				case "data":
 					curImg.Data = append([]byte(nil), val...)
+				case "data-size":
+					ext.size = int64(asAddr(val))
+				case "data-offset":
+					ext.off, ext.at = int64(asAddr(val)), tokOff
+				case "data-position":
+					ext.pos, ext.at = int64(asAddr(val)), tokOff
+				case "load":
+					curImg.Load = asAddr(val)
+				case "entry":
+					curImg.Entry = asAddr(val)
+				case "compression":
+					curImg.Compression = asString(val)
 				case "type":
 					t := asString(val)
 					if t == "flat_dt" {
@@ -214,33 +303,43 @@ func Read(r io.Reader) (*Fit, error) {
 					}
 				}
 			}
-			if inImages && curImg != nil && len(stack) >= 3 && stack[len(stack)-3].path == "/images" && stringsHasPrefix(stack[len(stack)-1].name, "hash") {
+			if inImages && curImg != nil && len(curImg.Hashes) > 0 && len(stack) >= 3 && stack[len(stack)-3].path == "/images" && stringsHasPrefix(stack[len(stack)-1].name, "hash") {
+				h := &curImg.Hashes[len(curImg.Hashes)-1]
 				switch propName {
 				case "algo":
-					a := asString(val)
-					if a == "sha-1" {
-						a = "sha1"
-					}
-					curImg.HashAlgo = normAlgo(a)
+					h.Algo = normAlgo(asString(val))
 				case "value":
-					curImg.Digest = append([]byte(nil), val...)
+					h.Value = append([]byte(nil), val...)
 				}
 			}
 
 			if inConfigs && curPath == "/configurations" && propName == "default" {
-				defaultConfig = asString(val)
+				f.DefaultConfig = asString(val)
 			}
-			if inConfigs && len(stack) >= 2 && stack[len(stack)-2].path == "/configurations" {
+			if inConfigs && curCfg != nil && len(stack) >= 2 && stack[len(stack)-2].path == "/configurations" {
 				switch propName {
 				case "kernel":
-					cfgKernel = asString(val)
+					curCfg.Kernel = asString(val)
+				case "fdt":
+					// базовое дерево и за ним оверлеи
+					if l := asStringList(val); len(l) > 0 {
+						curCfg.FDT, curCfg.Overlays = l[0], l[1:]
+					}
+				case "loadables":
+					curCfg.Loadables = asStringList(val)
+				case "ramdisk":
+					curCfg.Ramdisk = asString(val)
+				case "compatible":
+					curCfg.Compatible = asStringList(val)
 				}
 			}
 
 		case fdtNop:
 		case fdtEnd:
-			if defaultConfig != "" && cfgKernel != "" {
-				f.Default = cfgKernel
+			if f.DefaultConfig != "" {
+				if c, err := f.Config(f.DefaultConfig); err == nil && c.Kernel != "" {
+					f.Default = c.Kernel
+				}
 			}
 			if f.Default == "" {
 				names := f.List()
@@ -250,17 +349,49 @@ func Read(r io.Reader) (*Fit, error) {
 			}
 			return f, nil
 		default:
-			return nil, errors.New("fdt: bad token")
+			return nil, fail(common.Corrupt("fdt", tokOff, fmt.Sprintf("bad token %#x", token)))
 		}
 	}
 }
 
+// extData — data-size/data-offset/data-position образа, -1 = нет свойства;
+// at — смещение свойства для сообщения об ошибке.
+type extData struct {
+	off, pos, size, at int64
+}
+
+// slice returns the external payload of an image from the whole file b:
+// data-position is absolute, data-offset counts from base (the aligned end
+// of the FDT); with both, data-position wins. nil when the image has
+// neither (no data at all).
+func (e extData) slice(b []byte, base int64) ([]byte, error) {
+	start := e.pos
+	if start < 0 && e.off >= 0 {
+		start = base + e.off
+	}
+	if start < 0 {
+		return nil, nil
+	}
+	if e.size < 0 {
+		return nil, common.Corrupt("fdt", e.at, "external data without data-size")
+	}
+	if start > int64(len(b)) || e.size > int64(len(b))-start {
+		return nil, common.Corrupt("fdt", e.at, fmt.Sprintf("external data %d bytes at %#x is past the end of the file (%d bytes)", e.size, start, len(b)))
+	}
+	return append([]byte(nil), b[start:start+e.size]...), nil
+}
+
 // Write(w, f): старый core вызывает Write(io.Writer, *FIT). Собираем валидный ITB.
 func Write(w io.Writer, f *Fit) error {
 	if f == nil || len(f.imgs) == 0 {
 		return errors.New("fit: empty")
 	}
-	_ = f.Verify()
+	// пустые значения хэшей; у образов AddFile они посчитаны при добавлении
+	for _, img := range f.imgs {
+		if img.Path == "" {
+			img.checkHashes()
+		}
+	}
 
 	sb := new(bytes.Buffer)
 	addStr := func(s string) uint32 {
@@ -278,6 +409,41 @@ func Write(w io.Writer, f *Fit) error {
 	offKernel := addStr("kernel")
 	offFdt := addStr("fdt")
 	offRamdisk := addStr("ramdisk")
+	offCompat := addStr("compatible")
+	var offLoadables uint32
+	if f.hasLoadables() {
+		offLoadables = addStr("loadables")
+	}
+	var offLoad, offEntry uint32
+	if f.hasAddrs() {
+		offLoad = addStr("load")
+		offEntry = addStr("entry")
+	}
+	var offCompression uint32
+	if f.hasCompression() {
+		offCompression = addStr("compression")
+	}
+	// строки подписей — только если они есть, чтобы не менять неподписанные ITB
+	var offKeyHint, offSignImages, offHashedNodes, offHashedStrings uint32
+	if f.signed() {
+		offKeyHint = addStr("key-name-hint")
+		offSignImages = addStr("sign-images")
+		offHashedNodes = addStr("hashed-nodes")
+		offHashedStrings = addStr("hashed-strings")
+	}
+	type pendingSig struct {
+		sig   *Signature
+		nodes []string
+		at    int // смещение value в struct-блоке
+	}
+	var pending []pendingSig
+	// lazy: data образов AddFile — в struct-блоке пока свойство нулевой
+	// длины; at — смещение сразу за его заголовком
+	type lazyData struct {
+		img *Image
+		at  int
+	}
+	var lazy []lazyData
 
 	sbStruct := new(bytes.Buffer)
 	putU32 := func(v uint32) { _ = binary.Write(sbStruct, binary.BigEndian, v) }
@@ -300,6 +466,10 @@ func Write(w io.Writer, f *Fit) error {
 		}
 	}
 	putEnd := func() { putToken(fdtEndNode) }
+	putSigProps := func(sig *Signature) {
+		putProp(offAlgo, append([]byte(sig.Algo), 0x00))
+		putProp(offKeyHint, append([]byte(sig.KeyName), 0x00))
+	}
 
 	putBegin("") // root
 
@@ -311,7 +481,12 @@ func Write(w io.Writer, f *Fit) error {
 			continue
 		}
 		putBegin(img.Name)
-		putProp(offData, img.Data)
+		if img.Path != "" {
+			putProp(offData, nil)
+			lazy = append(lazy, lazyData{img, sbStruct.Len()})
+		} else {
+			putProp(offData, img.Data)
+		}
 		t := img.Type
 		if t == "fdt" {
 			t = "flat_dt"
@@ -320,48 +495,96 @@ func Write(w io.Writer, f *Fit) error {
 			t = "custom"
 		}
 		putProp(offType, append([]byte(t), 0x00))
+		if img.Compression != "" {
+			putProp(offCompression, append([]byte(img.Compression), 0x00))
+		}
+		if img.Load != 0 || img.Entry != 0 {
+			putProp(offLoad, putAddr(img.Load))
+			putProp(offEntry, putAddr(img.Entry))
+		}
 
-		putBegin("hash")
-		algo := img.HashAlgo
-		if algo == "sha1" {
-			algo = "sha-1"
+		for n, h := range img.Hashes {
+			putBegin(fmt.Sprintf("hash-%d", n+1))
+			algo := h.Algo
+			if algo == "sha1" {
+				algo = "sha-1"
+			}
+			putProp(offAlgo, append([]byte(algo), 0x00))
+			putProp(offValue, h.Value)
+			putEnd() // hash-N
+		}
+		for n := range img.Signatures {
+			sig := &img.Signatures[n]
+			if sig.key != nil {
+				r, err := img.Open()
+				if err != nil {
+					return err
+				}
+				v, err := sig.signStream(r)
+				r.Close()
+				if err != nil {
+					return fmt.Errorf("fit: sign %s: %w", img.Name, err)
+				}
+				sig.Value = v
+			}
+			putBegin(fmt.Sprintf("signature-%d", n+1))
+			putSigProps(sig)
+			putProp(offValue, sig.Value)
+			putEnd() // signature-N
 		}
-		putProp(offAlgo, append([]byte(algo), 0x00))
-		putProp(offValue, img.Digest)
-		putEnd() // hash
 
 		putEnd() // image
 	}
 	putEnd() // images
 
 	putBegin("configurations")
-	defCfg := "conf-1"
-	putProp(offDefault, append([]byte(defCfg), 0x00))
-	putBegin(defCfg)
-
-	defKernel := f.Default
-	if defKernel == "" && len(names) > 0 {
-		defKernel = names[0]
+	configs, defCfg := f.Configs, f.DefaultConfig
+	if len(configs) == 0 {
+		configs, defCfg = []*Config{f.implicitConfig()}, "conf-1"
 	}
-	if defKernel != "" {
-		putProp(offKernel, append([]byte(defKernel), 0x00))
+	if defCfg == "" {
+		defCfg = configs[0].Name
 	}
-	var fdtName, rdName string
-	for _, n := range names {
-		if fdtName == "" && f.imgs[n].Type == "fdt" {
-			fdtName = n
+	putProp(offDefault, append([]byte(defCfg), 0x00))
+	for _, c := range configs {
+		putBegin(c.Name)
+		for _, p := range []struct {
+			off uint32
+			v   string
+		}{{offKernel, c.Kernel}, {offFdt, c.FDT}, {offRamdisk, c.Ramdisk}} {
+			if p.v != "" {
+				if p.off == offFdt {
+					putProp(p.off, putStringList(append([]string{c.FDT}, c.Overlays...)))
+					continue
+				}
+				putProp(p.off, append([]byte(p.v), 0x00))
+			}
 		}
-		if rdName == "" && f.imgs[n].Type == "ramdisk" {
-			rdName = n
+		if len(c.Loadables) > 0 {
+			putProp(offLoadables, putStringList(c.Loadables))
 		}
+		if len(c.Compatible) > 0 {
+			putProp(offCompat, putStringList(c.Compatible))
+		}
+		for n := range c.Signatures {
+			sig := &c.Signatures[n]
+			putBegin(fmt.Sprintf("signature-%d", n+1))
+			putSigProps(sig)
+			putProp(offSignImages, putStringList(sig.SignImages))
+			if sig.key == nil {
+				putProp(offValue, sig.Value)
+			} else {
+				// значение — после сборки блоба, оно регионы не затрагивает
+				nodes := f.signedNodes(c, sig)
+				putProp(offHashedNodes, putStringList(nodes))
+				putProp(offHashedStrings, binary.BigEndian.AppendUint32(make([]byte, 4), uint32(sb.Len())))
+				putProp(offValue, make([]byte, sig.key.Size()))
+				pending = append(pending, pendingSig{sig, nodes, sbStruct.Len() - sig.key.Size()})
+			}
+			putEnd() // signature-N
+		}
+		putEnd()
 	}
-	if fdtName != "" {
-		putProp(offFdt, append([]byte(fdtName), 0x00))
-	}
-	if rdName != "" {
-		putProp(offRamdisk, append([]byte(rdName), 0x00))
-	}
-	putEnd() // conf-1
 	putEnd() // configurations
 
 	putEnd()              // root
@@ -397,10 +620,145 @@ func Write(w io.Writer, f *Fit) error {
 	out.Write(sbStruct.Bytes())
 	out.Write(sb.Bytes())
 
-	_, err := w.Write(out.Bytes())
+	blob := out.Bytes()
+	for _, p := range pending {
+		regs, err := fdtRegions(blob, p.nodes, signExclude)
+		if err != nil {
+			return err
+		}
+		parts := make([][]byte, len(regs))
+		for i, r := range regs {
+			parts[i] = blob[r[0] : r[0]+r[1]]
+		}
+		v, err := p.sig.signDigest(parts...)
+		if err != nil {
+			return fmt.Errorf("fit: sign config: %w", err)
+		}
+		p.sig.Value = v
+		copy(blob[offStruct+p.at:], v)
+	}
+
+	if len(lazy) == 0 {
+		_, err := w.Write(blob)
+		return err
+	}
+	// Подписи конфигураций data не покрывают (signExclude), поэтому их
+	// считали по блобу без данных; теперь вставляем данные потоком.
+	// Смещения блоков в заголовке сдвигаются на размер данных.
+	grow := int64(0)
+	for _, l := range lazy {
+		grow += (l.img.Size + 3) &^ 3
+	}
+	if int64(h.TotalSize)+grow > 1<<32-1 {
+		return errors.New("fit: image over 4 GiB does not fit the FDT header")
+	}
+	h.SizeDTStruct += uint32(grow)
+	h.OffDTStrings += uint32(grow)
+	h.TotalSize += uint32(grow)
+	hb := new(bytes.Buffer)
+	_ = binary.Write(hb, binary.BigEndian, &h)
+	copy(blob, hb.Bytes())
+	st := blob[offStruct : offStruct+sbStruct.Len()]
+	if _, err := w.Write(blob[:offStruct]); err != nil {
+		return err
+	}
+	prev := 0
+	for _, l := range lazy {
+		binary.BigEndian.PutUint32(st[l.at-8:], uint32(l.img.Size))
+		if _, err := w.Write(st[prev:l.at]); err != nil {
+			return err
+		}
+		if err := l.img.copyData(w); err != nil {
+			return err
+		}
+		if pad := (4 - l.img.Size%4) % 4; pad > 0 {
+			if _, err := w.Write(make([]byte, pad)); err != nil {
+				return err
+			}
+		}
+		prev = l.at
+	}
+	if _, err := w.Write(st[prev:]); err != nil {
+		return err
+	}
+	_, err := w.Write(blob[offStruct+sbStruct.Len():])
 	return err
 }
 
+// copyData streams the file of an AddFile image to w and checks it still
+// has the size and the first hash recorded by AddFile.
+func (img *Image) copyData(w io.Writer) error {
+	r, err := img.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var hw hash.Hash
+	dst := w
+	if len(img.Hashes) > 0 {
+		if hw = newHash(img.Hashes[0].Algo); hw != nil {
+			dst = io.MultiWriter(w, hw)
+		}
+	}
+	n, err := io.Copy(dst, io.LimitReader(r, img.Size))
+	if err != nil {
+		return err
+	}
+	var one [1]byte
+	if k, _ := r.Read(one[:]); n != img.Size || k > 0 {
+		return fmt.Errorf("fit: %s: %s changed size since it was added", img.Name, img.Path)
+	}
+	if hw != nil && !equalBytes(hw.Sum(nil), img.Hashes[0].Value) {
+		return fmt.Errorf("fit: %s: %s changed since it was added", img.Name, img.Path)
+	}
+	return nil
+}
+
+// hasAddrs reports whether any image has a load or entry address.
+func (f *Fit) hasAddrs() bool {
+	for _, img := range f.imgs {
+		if img.Load != 0 || img.Entry != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCompression reports whether any image has a compression property.
+func (f *Fit) hasCompression() bool {
+	for _, img := range f.imgs {
+		if img.Compression != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLoadables reports whether any configuration lists loadables.
+func (f *Fit) hasLoadables() bool {
+	for _, c := range f.Configs {
+		if len(c.Loadables) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// signed reports whether any image or configuration carries a signature.
+func (f *Fit) signed() bool {
+	for _, img := range f.imgs {
+		if len(img.Signatures) > 0 {
+			return true
+		}
+	}
+	for _, c := range f.Configs {
+		if len(c.Signatures) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func stringsHasPrefix(s, p string) bool {
 	return len(s) >= len(p) && s[:len(p)] == p
 }
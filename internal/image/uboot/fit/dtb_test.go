@@ -0,0 +1,286 @@
+package fit
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"goimagetool/internal/common"
+)
+
+func TestReadShortInput(t *testing.T) {
+	bufs := [][]byte{nil, {0xd0}, {0xd0, 0x0d, 0xfe}, {0xd0, 0x0d, 0xfe, 0xed}, append([]byte{0xd0, 0x0d, 0xfe, 0xed}, make([]byte, 35)...)}
+	for _, b := range bufs {
+		_, err := Read(bytes.NewReader(b))
+		if !errors.Is(err, common.ErrCorrupt) || !strings.Contains(err.Error(), "file too small") {
+			t.Errorf("%d bytes: got %v, want a too-small ErrCorrupt", len(b), err)
+		}
+	}
+}
+
+// Random FDT-looking buffers must fail cleanly; only panics are bugs here,
+// since arbitrary non-FDT data is accepted as a raw blob by design.
+func TestReadRandomInput(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, rnd.Intn(512))
+		rnd.Read(b)
+		if len(b) >= 40 {
+			binary.BigEndian.PutUint32(b, fdtMagic)
+			// offsets mostly inside the buffer, so the struct walk runs
+			for _, off := range []int{8, 12, 32, 36} {
+				binary.BigEndian.PutUint32(b[off:], uint32(rnd.Intn(len(b))))
+			}
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("buffer %d (%d bytes): panic: %v", i, len(b), r)
+				}
+			}()
+			_, _ = Read(bytes.NewReader(b))
+		}()
+	}
+}
+
+// fdtBuilder assembles a minimal FDT by hand, for layouts Write never
+// produces (external data).
+type fdtBuilder struct {
+	st, str bytes.Buffer
+	names   map[string]uint32
+}
+
+func (fb *fdtBuilder) u32(v uint32) { _ = binary.Write(&fb.st, binary.BigEndian, v) }
+
+func (fb *fdtBuilder) pad() {
+	for fb.st.Len()%4 != 0 {
+		fb.st.WriteByte(0)
+	}
+}
+
+func (fb *fdtBuilder) begin(name string) {
+	fb.u32(fdtBeginNode)
+	fb.st.WriteString(name)
+	fb.st.WriteByte(0)
+	fb.pad()
+}
+
+func (fb *fdtBuilder) end() { fb.u32(fdtEndNode) }
+
+func (fb *fdtBuilder) prop(name string, val []byte) {
+	if fb.names == nil {
+		fb.names = map[string]uint32{}
+	}
+	off, ok := fb.names[name]
+	if !ok {
+		off = uint32(fb.str.Len())
+		fb.names[name] = off
+		fb.str.WriteString(name)
+		fb.str.WriteByte(0)
+	}
+	fb.u32(fdtProp)
+	fb.u32(uint32(len(val)))
+	fb.u32(off)
+	fb.st.Write(val)
+	fb.pad()
+}
+
+func (fb *fdtBuilder) propU32(name string, v uint32) {
+	fb.prop(name, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// bytes: header, empty reserve map, struct and strings blocks.
+func (fb *fdtBuilder) bytes() []byte {
+	fb.u32(fdtEnd)
+	const offStruct = 40 + 16
+	h := fdtHeader{
+		Magic:         fdtMagic,
+		OffDTStruct:   offStruct,
+		OffDTStrings:  uint32(offStruct + fb.st.Len()),
+		OffMemRsvmap:  40,
+		Version:       17,
+		LastCompVer:   16,
+		SizeDTStrings: uint32(fb.str.Len()),
+		SizeDTStruct:  uint32(fb.st.Len()),
+	}
+	h.TotalSize = h.OffDTStrings + h.SizeDTStrings
+	var out bytes.Buffer
+	_ = binary.Write(&out, binary.BigEndian, h)
+	out.Write(make([]byte, 16))
+	out.Write(fb.st.Bytes())
+	out.Write(fb.str.Bytes())
+	return out.Bytes()
+}
+
+// externalFit builds an ITB with one kernel image whose payload follows the
+// FDT: prop is "data-offset" (mkimage -E) or "data-position" (mkimage -p).
+// The FDT size is not a multiple of 4, so data-offset has to count from
+// the aligned end.
+func externalFit(prop string, payload []byte, size uint32) []byte {
+	// сначала считаем длину FDT с нулевым смещением, потом собираем заново
+	build := func(at uint32) []byte {
+		var fb fdtBuilder
+		fb.begin("")
+		fb.begin("images")
+		fb.begin("kernel")
+		fb.prop("description", []byte("x\x00"))
+		fb.prop("type", []byte("kernel\x00"))
+		fb.propU32("data-size", size)
+		fb.propU32(prop, at)
+		fb.begin("hash-1")
+		sum := sha1.Sum(payload)
+		fb.prop("value", sum[:])
+		fb.prop("algo", []byte("sha1\x00"))
+		fb.end()
+		fb.end()
+		fb.end()
+		fb.end()
+		return fb.bytes()
+	}
+	b := build(0)
+	base := uint32(len(b)+3) &^ 3
+	at := uint32(0)
+	if prop == "data-position" {
+		// mkimage -p кладёт данные на фиксированную позицию с зазором
+		at = base + 64
+	}
+	b = build(at)
+	start := at
+	if prop == "data-offset" {
+		start = base + at
+	}
+	b = append(b, make([]byte, int(start)-len(b))...)
+	return append(b, payload...)
+}
+
+func TestReadExternalData(t *testing.T) {
+	payload := []byte("external kernel payload, 37 bytes...")
+	for _, prop := range []string{"data-offset", "data-position"} {
+		itb := externalFit(prop, payload, uint32(len(payload)))
+		f, err := Read(bytes.NewReader(itb))
+		if err != nil {
+			t.Fatalf("%s: %v", prop, err)
+		}
+		img, err := f.Get("kernel")
+		if err != nil {
+			t.Fatalf("%s: %v", prop, err)
+		}
+		if !bytes.Equal(img.Data, payload) {
+			t.Errorf("%s: data %q, want %q", prop, img.Data, payload)
+		}
+		if err := f.Verify(); err != nil {
+			t.Errorf("%s: verify: %v", prop, err)
+		}
+		infos, err := ReadHeader(bytes.NewReader(itb))
+		if err != nil || len(infos) != 1 {
+			t.Fatalf("%s: ReadHeader: %v %v", prop, infos, err)
+		}
+		if in := infos[0]; !in.External || in.Size != int64(len(payload)) || !bytes.Equal(itb[in.Offset:in.Offset+in.Size], payload) {
+			t.Errorf("%s: ReadHeader: %+v", prop, in)
+		}
+		// перезапись встраивает данные и остаётся читаемой
+		var out bytes.Buffer
+		if err := Write(&out, f); err != nil {
+			t.Fatalf("%s: write: %v", prop, err)
+		}
+		g, err := Read(&out)
+		if err != nil {
+			t.Fatalf("%s: reread: %v", prop, err)
+		}
+		if img, _ := g.Get("kernel"); img == nil || !bytes.Equal(img.Data, payload) {
+			t.Errorf("%s: data lost on rewrite", prop)
+		}
+	}
+}
+
+func TestReadExternalDataPastEnd(t *testing.T) {
+	payload := []byte("short")
+	for _, prop := range []string{"data-offset", "data-position"} {
+		itb := externalFit(prop, payload, 4096)
+		_, err := Read(bytes.NewReader(itb))
+		if !errors.Is(err, common.ErrCorrupt) || !strings.Contains(err.Error(), "past the end") {
+			t.Errorf("%s: got %v, want ErrCorrupt past the end", prop, err)
+		}
+	}
+}
+
+func TestCompressionPropertyAndSetData(t *testing.T) {
+	f := New()
+	if err := f.AddTyped("kernel", []byte("kernel"), "sha1", "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddTyped("initrd", []byte("old"), "crc32,sha256", "ramdisk"); err != nil {
+		t.Fatal(err)
+	}
+	rd, _ := f.Get("initrd")
+	rd.Compression = "gzip"
+	rd.SetData([]byte("new ramdisk"))
+
+	var buf bytes.Buffer
+	if err := Write(&buf, f); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	g, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if err := g.Verify(); err != nil {
+		t.Fatalf("Verify after SetData: %v", err)
+	}
+	img, _ := g.Get("initrd")
+	if img.Compression != "gzip" || string(img.Data) != "new ramdisk" {
+		t.Errorf("initrd: compression %q, data %q", img.Compression, img.Data)
+	}
+	if k, _ := g.Get("kernel"); k.Compression != "" {
+		t.Errorf("kernel: compression %q, want none written", k.Compression)
+	}
+	if name, err := g.DefaultRamdisk(); err != nil || name != "initrd" {
+		t.Errorf("DefaultRamdisk: %q, %v", name, err)
+	}
+}
+
+// fdt and loadables are string lists: every entry is kept through Write/Read
+// and checked by DanglingRefs, not only the first one.
+func TestConfigStringListRefs(t *testing.T) {
+	f := New()
+	for _, n := range []string{"kernel", "fdt-base", "fdt-overlay", "fw-a", "fw-b"} {
+		if err := f.AddTyped(n, []byte(n), "sha1", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = f.AddConfig(&Config{Name: "conf-1", Kernel: "kernel", FDT: "fdt-base", Overlays: []string{"fdt-overlay"}, Loadables: []string{"fw-a", "fw-b"}})
+	var buf bytes.Buffer
+	if err := Write(&buf, f); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	g, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	c, err := g.Config("conf-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FDT != "fdt-base" || strings.Join(c.Overlays, ",") != "fdt-overlay" || strings.Join(c.Loadables, ",") != "fw-a,fw-b" {
+		t.Fatalf("conf-1 read back as fdt %q overlays %q loadables %q", c.FDT, c.Overlays, c.Loadables)
+	}
+	if err := g.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if u := g.ConfigsUsing("fw-b"); len(u) != 1 {
+		t.Errorf("ConfigsUsing(fw-b) = %q", u)
+	}
+	g.Remove("fdt-overlay")
+	g.Remove("fw-b")
+	want := `conf-1: fdt "fdt-overlay"; conf-1: loadables "fw-b"`
+	if d := strings.Join(g.DanglingRefs(), "; "); d != want {
+		t.Errorf("DanglingRefs: %q, want %q", d, want)
+	}
+	if err := g.Verify(); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Verify: %v", err)
+	}
+}
@@ -1,25 +1,78 @@
 package fit
 
 import (
+	"bytes"
+	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
 	"sort"
 	"strings"
 )
 
 type Image struct {
-	Name     string
-	Type     string // kernel|fdt|ramdisk|custom
-	Data     []byte
-	HashAlgo string // sha1|sha256|sha512
-	Digest   []byte
+	Name   string
+	Type   string // kernel|fdt|ramdisk|custom
+	Data   []byte
+	Hashes []Hash // подузлы hash-1, hash-2, … в порядке записи
+
+	// Load/Entry — свойства load и entry; оба 0 — не записываются
+	Load, Entry uint64
+
+	// Compression — свойство compression (none, gzip, lzma, lz4, zstd…):
+	// чем U-Boot распаковывает Data; "" — свойства нет
+	Compression string
+
+	Signatures []Signature // подузлы signature-N
+
+	// Path/Size — образ из AddFile: Data остаётся nil, файл читается
+	// потоком только при Write и проверке хэшей.
+	Path string
+	Size int64
+}
+
+// Hash — один hash-подузел образа; их может быть несколько (например,
+// crc32 для быстрой проверки и sha256).
+type Hash struct {
+	Algo  string // crc32|md5|sha1|sha256|sha512; прочие храним как есть и не проверяем
+	Value []byte
+}
+
+// HashAlgos lists the algorithms in node order, e.g. "crc32,sha256".
+func (img *Image) HashAlgos() string {
+	a := make([]string, len(img.Hashes))
+	for i, h := range img.Hashes {
+		a[i] = h.Algo
+	}
+	return strings.Join(a, ",")
+}
+
+// Config — узел /configurations/<name>; образы указываются по имени.
+type Config struct {
+	Name       string
+	Kernel     string
+	FDT        string
+	Ramdisk    string
+	Compatible []string // в ITB — список строк через \0, по нему U-Boot выбирает конфиг
+	Overlays   []string // fdt = "base", "overlay"...: всё после первого — оверлеи
+	Loadables  []string // loadables: прошивки и прочее, что U-Boot просто загружает
+
+	Signatures []Signature
 }
 
 type Fit struct {
 	imgs    map[string]*Image
 	Default string
+
+	// Configs в порядке появления; пусто — Write синтезирует conf-1 из Default.
+	Configs       []*Config
+	DefaultConfig string
 }
 
 // Старое имя, которого ждёт core.
@@ -27,47 +80,198 @@ type FIT = Fit
 
 func New() *Fit { return &Fit{imgs: make(map[string]*Image)} }
 
+// normAlgo: "" and sha-1 are sha1; unknown names are kept lowercased.
 func normAlgo(a string) string {
-	switch strings.ToLower(a) {
+	switch a = strings.ToLower(strings.TrimSpace(a)); a {
+	case "", "sha1", "sha-1":
+		return "sha1"
 	case "sha256", "sha-256":
 		return "sha256"
 	case "sha512", "sha-512":
 		return "sha512"
 	default:
-		return "sha1"
+		return a
 	}
 }
 
-func hashData(algo string, b []byte) []byte {
+// newHash returns nil for algorithms we cannot compute.
+func newHash(algo string) hash.Hash {
 	switch algo {
+	case "crc32":
+		// U-Boot хранит crc32 как fdt32, big-endian — так и пишет Sum
+		return crc32.NewIEEE()
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
 	case "sha256":
-		h := sha256.Sum256(b)
-		return h[:]
+		return sha256.New()
 	case "sha512":
-		h := sha512.Sum512(b)
-		return h[:]
-	default:
-		h := sha1.Sum(b)
-		return h[:]
+		return sha512.New()
+	}
+	return nil
+}
+
+// hashData returns nil for algorithms we cannot compute.
+func hashData(algo string, b []byte) []byte {
+	h := newHash(algo)
+	if h == nil {
+		return nil
+	}
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// hashStream feeds r once through every algorithm; a nil entry in the
+// result marks an algorithm we cannot compute.
+func hashStream(r io.Reader, algos []string) ([][]byte, error) {
+	hs := make([]hash.Hash, len(algos))
+	var ws []io.Writer
+	for i, a := range algos {
+		if hs[i] = newHash(a); hs[i] != nil {
+			ws = append(ws, hs[i])
+		}
+	}
+	if _, err := io.Copy(io.MultiWriter(ws...), r); err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(algos))
+	for i, h := range hs {
+		if h != nil {
+			out[i] = h.Sum(nil)
+		}
+	}
+	return out, nil
+}
+
+// Open returns the image data: Data, or the file of an AddFile image.
+func (img *Image) Open() (io.ReadCloser, error) {
+	if img.Path == "" {
+		return io.NopCloser(bytes.NewReader(img.Data)), nil
+	}
+	return os.Open(img.Path)
+}
+
+// ReadData is Open + ReadAll: the whole payload in memory.
+func (img *Image) ReadData() ([]byte, error) {
+	if img.Path == "" {
+		return img.Data, nil
+	}
+	return os.ReadFile(img.Path)
+}
+
+// checkHashes fills empty values and compares the rest; hashes with an
+// unknown algorithm are skipped. An unreadable AddFile source fails.
+func (img *Image) checkHashes() bool {
+	algos := make([]string, len(img.Hashes))
+	for i, h := range img.Hashes {
+		algos[i] = h.Algo
+	}
+	r, err := img.Open()
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	sums, err := hashStream(r, algos)
+	if err != nil {
+		return false
+	}
+	ok := true
+	for i := range img.Hashes {
+		h := &img.Hashes[i]
+		got := sums[i]
+		switch {
+		case got == nil:
+		case len(h.Value) == 0:
+			h.Value = got
+		case !equalBytes(got, h.Value):
+			ok = false
+		}
+	}
+	return ok
+}
+
+// SetData replaces the payload (an AddFile image becomes an in-memory
+// one) and recomputes every hash with its algorithm. Signatures are left
+// as they are and no longer match until the FIT is signed again.
+func (img *Image) SetData(data []byte) {
+	img.Data = append([]byte(nil), data...)
+	img.Path, img.Size = "", 0
+	for i := range img.Hashes {
+		img.Hashes[i].Value = hashData(img.Hashes[i].Algo, data)
 	}
 }
 
 func (f *Fit) Add(name string, data []byte, algo string) { _ = f.AddTyped(name, data, algo, "") }
 
+// AddTyped adds or replaces an image; algo is one algorithm or a comma
+// list ("crc32,sha256"), one hash node each; "" means sha1. The name must
+// be a valid node name (CheckNodeName).
 func (f *Fit) AddTyped(name string, data []byte, algo, typ string) error {
-	if name == "" {
-		return errors.New("fit: empty name")
+	if err := CheckNodeName(name); err != nil {
+		return fmt.Errorf("fit: image name %w", err)
 	}
 	if f.imgs == nil {
 		f.imgs = make(map[string]*Image)
 	}
-	a := normAlgo(algo)
 	img := &Image{
-		Name:     name,
-		Type:     strings.ToLower(typ),
-		Data:     append([]byte(nil), data...),
-		HashAlgo: a,
-		Digest:   hashData(a, data),
+		Name: name,
+		Type: strings.ToLower(typ),
+		Data: append([]byte(nil), data...),
+	}
+	for _, a := range strings.Split(algo, ",") {
+		a = normAlgo(a)
+		v := hashData(a, data)
+		if v == nil {
+			return fmt.Errorf("fit: unsupported hash algo %q (crc32|md5|sha1|sha256|sha512)", a)
+		}
+		img.Hashes = append(img.Hashes, Hash{Algo: a, Value: v})
+	}
+	f.imgs[name] = img
+	if f.Default == "" {
+		f.Default = name
+	}
+	return nil
+}
+
+// AddFile is AddTyped for payloads too big to keep in memory: only path
+// is recorded and hashed (one streaming pass), and Write streams the file
+// into the ITB. The file must not change until then; Write checks the size
+// and the first hash.
+func (f *Fit) AddFile(name, path, algo, typ string) error {
+	if err := CheckNodeName(name); err != nil {
+		return fmt.Errorf("fit: image name %w", err)
+	}
+	var algos []string
+	for _, a := range strings.Split(algo, ",") {
+		a = normAlgo(a)
+		if newHash(a) == nil {
+			return fmt.Errorf("fit: unsupported hash algo %q (crc32|md5|sha1|sha256|sha512)", a)
+		}
+		algos = append(algos, a)
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("fit: %s: not a regular file", path)
+	}
+	sums, err := hashStream(fh, algos)
+	if err != nil {
+		return err
+	}
+	img := &Image{Name: name, Type: strings.ToLower(typ), Path: path, Size: fi.Size()}
+	for i, a := range algos {
+		img.Hashes = append(img.Hashes, Hash{Algo: a, Value: sums[i]})
+	}
+	if f.imgs == nil {
+		f.imgs = make(map[string]*Image)
 	}
 	f.imgs[name] = img
 	if f.Default == "" {
@@ -76,16 +280,69 @@ func (f *Fit) AddTyped(name string, data []byte, algo, typ string) error {
 	return nil
 }
 
+// Remove deletes an image. If it was the default, the next image in name
+// order takes over, kernels first, so the FIT keeps a predictable default.
 func (f *Fit) Remove(name string) {
 	if f == nil || f.imgs == nil {
 		return
 	}
 	delete(f.imgs, name)
 	if f.Default == name {
-		f.Default = ""
+		f.Default = f.nextDefault(name)
 	}
 }
 
+func (f *Fit) nextDefault(after string) string {
+	names := f.List()
+	pick := func(ok func(*Image) bool) string {
+		first := ""
+		for _, n := range names {
+			if !ok(f.imgs[n]) {
+				continue
+			}
+			if n > after {
+				return n
+			}
+			if first == "" {
+				first = n
+			}
+		}
+		return first
+	}
+	if n := pick(func(img *Image) bool { return img.Type == "kernel" }); n != "" {
+		return n
+	}
+	return pick(func(*Image) bool { return true })
+}
+
+// ConfigsUsing returns the names of configurations referencing image name.
+func (f *Fit) ConfigsUsing(name string) []string {
+	var out []string
+	for _, c := range f.Configs {
+		for _, r := range c.refs() {
+			if r[1] == name {
+				out = append(out, c.Name)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// refs lists the config's image references as (property, image) pairs,
+// every entry of the fdt and loadables string lists included.
+func (c *Config) refs() [][2]string {
+	out := [][2]string{{"kernel", c.Kernel}, {"fdt", c.FDT}}
+	for _, o := range c.Overlays {
+		out = append(out, [2]string{"fdt", o})
+	}
+	out = append(out, [2]string{"ramdisk", c.Ramdisk})
+	for _, l := range c.Loadables {
+		out = append(out, [2]string{"loadables", l})
+	}
+	return out
+}
+
 func (f *Fit) SetDefault(name string) {
 	if f == nil || f.imgs == nil {
 		return
@@ -118,38 +375,142 @@ func (f *Fit) Get(name string) (*Image, error) {
 	return img, nil
 }
 
+// AddConfig добавляет или заменяет конфигурацию с тем же именем.
+func (f *Fit) AddConfig(c *Config) error {
+	if c == nil || c.Name == "" {
+		return errors.New("fit: empty config name")
+	}
+	for i, old := range f.Configs {
+		if old.Name == c.Name {
+			f.Configs[i] = c
+			return nil
+		}
+	}
+	f.Configs = append(f.Configs, c)
+	if f.DefaultConfig == "" {
+		f.DefaultConfig = c.Name
+	}
+	return nil
+}
+
+// implicitConfig is the conf-1 Write synthesizes when there are no
+// configurations: the default image as kernel plus the first fdt and
+// ramdisk images.
+func (f *Fit) implicitConfig() *Config {
+	names := f.List()
+	c := &Config{Name: "conf-1", Kernel: f.Default}
+	if c.Kernel == "" && len(names) > 0 {
+		c.Kernel = names[0]
+	}
+	for _, n := range names {
+		if c.FDT == "" && f.imgs[n].Type == "fdt" {
+			c.FDT = n
+		}
+		if c.Ramdisk == "" && f.imgs[n].Type == "ramdisk" {
+			c.Ramdisk = n
+		}
+	}
+	return c
+}
+
+// DefaultRamdisk names the ramdisk U-Boot would boot: the one of the
+// default configuration, or without configurations the only image of type
+// ramdisk.
+func (f *Fit) DefaultRamdisk() (string, error) {
+	if len(f.Configs) > 0 {
+		c, err := f.Config(f.DefaultConfig)
+		if err != nil {
+			c = f.Configs[0]
+		}
+		if c.Ramdisk == "" {
+			return "", fmt.Errorf("fit: config %s has no ramdisk", c.Name)
+		}
+		return c.Ramdisk, nil
+	}
+	var found []string
+	for _, n := range f.List() {
+		if f.imgs[n].Type == "ramdisk" {
+			found = append(found, n)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", errors.New("fit: no ramdisk image")
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("fit: several ramdisk images (%s), name one", strings.Join(found, ", "))
+}
+
+func (f *Fit) Config(name string) (*Config, error) {
+	for _, c := range f.Configs {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, errors.New("fit: config not found")
+}
+
+func (f *Fit) RemoveConfig(name string) {
+	for i, c := range f.Configs {
+		if c.Name == name {
+			f.Configs = append(f.Configs[:i], f.Configs[i+1:]...)
+			break
+		}
+	}
+	if f.DefaultConfig == name {
+		f.DefaultConfig = ""
+		if len(f.Configs) > 0 {
+			f.DefaultConfig = f.Configs[0].Name
+		}
+	}
+}
+
 func (f *Fit) Verify() error {
 	if f == nil || f.imgs == nil {
 		return errors.New("fit: empty")
 	}
 	for _, img := range f.imgs {
-		if img == nil {
-			continue
-		}
-		got := hashData(img.HashAlgo, img.Data)
-		if len(img.Digest) == 0 {
-			img.Digest = got
-			continue
-		}
-		if !equalBytes(got, img.Digest) {
+		if img != nil && !img.checkHashes() {
 			return errors.New("fit: verify failed: " + img.Name)
 		}
 	}
+	// хэши сошлись, но конфиг со ссылкой в никуда всё равно не загрузится
+	if d := f.DanglingRefs(); len(d) > 0 {
+		return errors.New("fit: dangling config references: " + strings.Join(d, "; "))
+	}
 	return nil
 }
 
-// VerifyOne — то же самое, но для одного образа; если digest пуст — заполняем им.
+// DanglingRefs lists config references to images missing from /images (and
+// a default config that does not exist), e.g. `conf-a: fdt "fdt-a"`.
+func (f *Fit) DanglingRefs() []string {
+	var out []string
+	for _, c := range f.Configs {
+		for _, r := range c.refs() {
+			if r[1] == "" {
+				continue
+			}
+			if _, ok := f.imgs[r[1]]; !ok {
+				out = append(out, fmt.Sprintf("%s: %s %q", c.Name, r[0], r[1]))
+			}
+		}
+	}
+	if f.DefaultConfig != "" {
+		if _, err := f.Config(f.DefaultConfig); err != nil {
+			out = append(out, fmt.Sprintf("default config %q", f.DefaultConfig))
+		}
+	}
+	return out
+}
+
+// VerifyOne — то же самое, но для одного образа (все его hash-узлы); пустые значения заполняем.
 func (f *Fit) VerifyOne(name string) (bool, error) {
 	img, err := f.Get(name)
 	if err != nil {
 		return false, err
 	}
-	got := hashData(img.HashAlgo, img.Data)
-	if len(img.Digest) == 0 {
-		img.Digest = got
-		return true, nil
-	}
-	return equalBytes(got, img.Digest), nil
+	return img.checkHashes(), nil
 }
 
 func equalBytes(a, b []byte) bool {
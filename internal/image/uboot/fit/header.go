@@ -0,0 +1,171 @@
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"goimagetool/internal/common"
+)
+
+// ImageInfo — оглавление одного образа /images/<name> без его данных.
+type ImageInfo struct {
+	Name      string
+	Type      string   // как в Image.Type: flat_dt -> fdt
+	Size      int64    // размер data (или data-size у external-data FIT)
+	Offset    int64    // смещение данных от начала файла
+	External  bool     // данные за пределами FDT (mkimage -E)
+	HashAlgos []string // в порядке hash-узлов
+}
+
+// maxPropRead caps the properties ReadHeader loads; data is never loaded.
+const maxPropRead = 1 << 20
+
+// ReadHeader lists the images of the ITB in r without reading their
+// payloads: only the FDT header, the strings block and the struct tokens
+// are read; data properties are skipped by offset. External data
+// (data-offset, counted from the 4-byte aligned end of the FDT, or
+// data-position, absolute) is reported with External set.
+func ReadHeader(r io.ReaderAt) ([]ImageInfo, error) {
+	hb := make([]byte, 40)
+	if n, err := r.ReadAt(hb, 0); n < len(hb) {
+		if err == io.EOF {
+			return nil, common.TooSmall("fdt", "a FIT image", int64(n), 40)
+		}
+		return nil, err
+	}
+	var h fdtHeader
+	_ = binary.Read(bytes.NewReader(hb), binary.BigEndian, &h)
+	if h.Magic != fdtMagic {
+		return nil, common.Corrupt("fdt", 0, fmt.Sprintf("bad magic %#x", h.Magic))
+	}
+	if err := common.CheckSize("fdt strings", int64(h.SizeDTStrings)); err != nil {
+		return nil, err
+	}
+	strBlk := make([]byte, h.SizeDTStrings)
+	if err := readFull(r, strBlk, int64(h.OffDTStrings)); err != nil {
+		return nil, err
+	}
+
+	base, end := int64(h.OffDTStruct), int64(h.OffDTStruct)+int64(h.SizeDTStruct)
+	off := base
+	read := func(n int64) ([]byte, error) {
+		if off+n > end {
+			return nil, common.Corrupt("fdt", off, "token runs past struct block")
+		}
+		b := make([]byte, n)
+		if err := readFull(r, b, off); err != nil {
+			return nil, err
+		}
+		off += n
+		return b, nil
+	}
+	u32 := func() (uint32, error) {
+		b, err := read(4)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint32(b), nil
+	}
+
+	var out []ImageInfo
+	var path []string
+	var cur *ImageInfo
+	extBase := (int64(h.TotalSize) + 3) &^ 3
+	for {
+		tok, err := u32()
+		if err != nil {
+			return nil, err
+		}
+		switch tok {
+		case fdtBeginNode:
+			var name []byte
+			for {
+				b, err := read(4)
+				if err != nil {
+					return nil, err
+				}
+				if i := bytes.IndexByte(b, 0); i >= 0 {
+					name = append(name, b[:i]...)
+					break
+				}
+				name = append(name, b...)
+			}
+			path = append(path, string(name))
+			// path[0] — корень "", path[1] — images, path[2] — образ
+			if len(path) == 3 && path[1] == "images" {
+				out = append(out, ImageInfo{Name: string(name), Type: "custom"})
+				cur = &out[len(out)-1]
+			}
+			if cur != nil && len(path) == 4 && stringsHasPrefix(path[3], "hash") {
+				cur.HashAlgos = append(cur.HashAlgos, "sha1")
+			}
+		case fdtEndNode:
+			if len(path) == 0 {
+				return nil, common.Corrupt("fdt", off-4, "END_NODE without BEGIN_NODE")
+			}
+			if len(path) == 3 {
+				cur = nil
+			}
+			path = path[:len(path)-1]
+		case fdtProp:
+			sz, err := u32()
+			if err != nil {
+				return nil, err
+			}
+			nameOff, err := u32()
+			if err != nil {
+				return nil, err
+			}
+			valOff, padded := off, (int64(sz)+3)&^3
+			name := getCString(strBlk, nameOff)
+			if cur == nil || len(path) < 3 || name == "data" || sz > maxPropRead {
+				if valOff+padded > end {
+					return nil, common.Corrupt("fdt", valOff, fmt.Sprintf("property length %d overruns struct block", sz))
+				}
+				if cur != nil && len(path) == 3 && name == "data" {
+					cur.Size, cur.Offset = int64(sz), valOff
+				}
+				off += padded
+				continue
+			}
+			b, err := read(padded)
+			if err != nil {
+				return nil, err
+			}
+			val := b[:sz]
+			switch {
+			case len(path) == 4 && name == "algo" && stringsHasPrefix(path[3], "hash"):
+				cur.HashAlgos[len(cur.HashAlgos)-1] = normAlgo(asString(val))
+			case len(path) != 3:
+			case name == "type":
+				if cur.Type = asString(val); cur.Type == "flat_dt" {
+					cur.Type = "fdt"
+				}
+			case name == "data-size":
+				cur.Size = int64(asAddr(val))
+			case name == "data-offset":
+				cur.Offset, cur.External = extBase+int64(asAddr(val)), true
+			case name == "data-position":
+				cur.Offset, cur.External = int64(asAddr(val)), true
+			}
+		case fdtNop:
+		case fdtEnd:
+			return out, nil
+		default:
+			return nil, common.Corrupt("fdt", off-4, fmt.Sprintf("bad token %#x", tok))
+		}
+	}
+}
+
+// readFull: ReaderAt may return io.EOF together with a full buffer.
+func readFull(r io.ReaderAt, b []byte, off int64) error {
+	if n, err := r.ReadAt(b, off); n < len(b) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return common.WrapAt("fdt", off, err)
+	}
+	return nil
+}
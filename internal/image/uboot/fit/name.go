@@ -0,0 +1,86 @@
+package fit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrBadName: an image name that is not a valid device-tree node name.
+var ErrBadName = errors.New("invalid node name")
+
+// maxNodeName is the devicetree spec limit for the node-name part (before
+// an optional @unit-address).
+const maxNodeName = 31
+
+func nodeNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == ',' || c == '.' || c == '_' || c == '+' || c == '-'
+}
+
+// CheckNodeName checks name against the devicetree node-name rules that
+// U-Boot relies on: node-name[@unit-address], 1..31 characters from
+// [0-9a-zA-Z,._+-] starting with a letter, the unit address from the
+// same set.
+func CheckNodeName(name string) error {
+	base, unit, hasUnit := strings.Cut(name, "@")
+	switch {
+	case base == "":
+		return fmt.Errorf("%q: %w: empty", name, ErrBadName)
+	case len(base) > maxNodeName:
+		return fmt.Errorf("%q: %w: longer than %d characters", name, ErrBadName, maxNodeName)
+	case !(base[0] >= 'a' && base[0] <= 'z' || base[0] >= 'A' && base[0] <= 'Z'):
+		return fmt.Errorf("%q: %w: must start with a letter", name, ErrBadName)
+	case hasUnit && unit == "":
+		return fmt.Errorf("%q: %w: empty unit address after @", name, ErrBadName)
+	}
+	for _, part := range []string{base, unit} {
+		for i := 0; i < len(part); i++ {
+			if !nodeNameChar(part[i]) {
+				return fmt.Errorf("%q: %w: character %q not allowed (only 0-9a-zA-Z,._+-)", name, ErrBadName, part[i])
+			}
+		}
+	}
+	return nil
+}
+
+// SanitizeNodeName rewrites name into one CheckNodeName accepts: other
+// characters (and a second @) become '_', a name not starting with a
+// letter gets an "img-" prefix, and the node-name part is cut to 31.
+func SanitizeNodeName(name string) string {
+	base, unit, hasUnit := strings.Cut(name, "@")
+	clean := func(s string) string {
+		b := []byte(s)
+		for i := range b {
+			if !nodeNameChar(b[i]) {
+				b[i] = '_'
+			}
+		}
+		return string(b)
+	}
+	base = clean(base)
+	if base == "" || !(base[0] >= 'a' && base[0] <= 'z' || base[0] >= 'A' && base[0] <= 'Z') {
+		base = "img-" + base
+	}
+	if len(base) > maxNodeName {
+		base = base[:maxNodeName]
+	}
+	if unit = clean(unit); hasUnit && unit != "" {
+		return base + "@" + unit
+	}
+	return base
+}
+
+// BadNames lists the images whose names CheckNodeName rejects, e.g. from
+// a hand-crafted ITB; Read keeps them as they are.
+func (f *Fit) BadNames() []string {
+	var out []string
+	for name := range f.imgs {
+		if err := CheckNodeName(name); err != nil {
+			out = append(out, "image "+err.Error())
+		}
+	}
+	sort.Strings(out)
+	return out
+}
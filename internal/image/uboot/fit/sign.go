@@ -0,0 +1,264 @@
+package fit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Signature — подузел signature-N образа или конфигурации. Пока у подписи
+// есть ключ (см. Sign), Value вычисляет Write, по тем же правилам, что
+// mkimage -k: подпись образа покрывает его data, подпись конфигурации —
+// регионы FDT (см. fdtRegions).
+type Signature struct {
+	Algo       string   // "sha256,rsa2048"
+	KeyName    string   // key-name-hint: по нему U-Boot ищет ключ в своём FDT
+	SignImages []string // только у конфигураций: "kernel", "fdt", "ramdisk"
+	Value      []byte
+
+	key *rsa.PrivateKey
+}
+
+// signExclude — свойства, которые подпись конфигурации не покрывает
+// (exc_prop в U-Boot: данные защищены hash-узлами образов).
+var signExclude = []string{"data", "data-size", "data-position", "data-offset"}
+
+// parseSignAlgo splits "sha256,rsa2048" into the hash and the key size.
+func parseSignAlgo(algo string) (crypto.Hash, int, error) {
+	hname, kname, _ := strings.Cut(strings.ToLower(algo), ",")
+	var h crypto.Hash
+	switch hname {
+	case "sha1":
+		h = crypto.SHA1
+	case "sha256":
+		h = crypto.SHA256
+	case "sha512":
+		h = crypto.SHA512
+	default:
+		return 0, 0, fmt.Errorf("fit: unsupported signature hash %q (sha1|sha256|sha512)", hname)
+	}
+	switch kname {
+	case "rsa2048":
+		return h, 2048, nil
+	case "rsa4096":
+		return h, 4096, nil
+	}
+	return 0, 0, fmt.Errorf("fit: unsupported signature algo %q (rsa2048|rsa4096)", kname)
+}
+
+// ParsePrivateKey reads an RSA private key from PEM, PKCS#1 ("RSA PRIVATE
+// KEY", what mkimage keys usually are) or PKCS#8 ("PRIVATE KEY").
+func ParsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, errors.New("fit: key is not PEM")
+	}
+	switch blk.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(blk.Bytes)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rk, ok := k.(*rsa.PrivateKey); ok {
+			return rk, nil
+		}
+		return nil, errors.New("fit: key is not RSA")
+	}
+	return nil, fmt.Errorf("fit: unsupported PEM block %q", blk.Type)
+}
+
+// Sign attaches a signature by key to every target, a configuration or an
+// image name (configurations are looked up first). No targets means every
+// configuration; a FIT without any gets the conf-1 Write would synthesize,
+// so there is a node to sign. A signature with the same key name is
+// replaced. Values are computed by Write, i.e. on store.
+func (f *Fit) Sign(key *rsa.PrivateKey, algo, keyName string, targets ...string) error {
+	if f == nil || len(f.imgs) == 0 {
+		return errors.New("fit: empty")
+	}
+	_, bits, err := parseSignAlgo(algo)
+	if err != nil {
+		return err
+	}
+	if key.N.BitLen() != bits {
+		return fmt.Errorf("fit: %d-bit key for %s", key.N.BitLen(), algo)
+	}
+	if keyName == "" {
+		return errors.New("fit: empty key name")
+	}
+	sig := Signature{Algo: strings.ToLower(algo), KeyName: keyName, key: key}
+	if len(targets) == 0 {
+		if len(f.Configs) == 0 {
+			_ = f.AddConfig(f.implicitConfig())
+		}
+		for _, c := range f.Configs {
+			targets = append(targets, c.Name)
+		}
+	}
+	for _, t := range targets {
+		if c, err := f.Config(t); err == nil {
+			s := sig
+			for _, ref := range [][2]string{{"kernel", c.Kernel}, {"fdt", c.FDT}, {"ramdisk", c.Ramdisk}} {
+				if ref[1] != "" {
+					s.SignImages = append(s.SignImages, ref[0])
+				}
+			}
+			c.Signatures = putSignature(c.Signatures, s)
+			continue
+		}
+		img, err := f.Get(t)
+		if err != nil {
+			return fmt.Errorf("fit: %s: no such config or image", t)
+		}
+		img.Signatures = putSignature(img.Signatures, sig)
+	}
+	return nil
+}
+
+func putSignature(l []Signature, s Signature) []Signature {
+	for i := range l {
+		if l[i].KeyName == s.KeyName {
+			l[i] = s
+			return l
+		}
+	}
+	return append(l, s)
+}
+
+// signDigest hashes the concatenated regions and signs them with PKCS#1 v1.5.
+func (s *Signature) signDigest(regions ...[]byte) ([]byte, error) {
+	rs := make([]io.Reader, len(regions))
+	for i, r := range regions {
+		rs[i] = bytes.NewReader(r)
+	}
+	return s.signStream(io.MultiReader(rs...))
+}
+
+// signStream is signDigest over a stream (the file of an AddFile image).
+func (s *Signature) signStream(r io.Reader) ([]byte, error) {
+	h, _, err := parseSignAlgo(s.Algo)
+	if err != nil {
+		return nil, err
+	}
+	d := h.New()
+	if _, err := io.Copy(d, r); err != nil {
+		return nil, err
+	}
+	return rsa.SignPKCS1v15(nil, s.key, h, d.Sum(nil))
+}
+
+// signedNodes is the hashed-nodes list of a config signature: the root, the
+// config and, for every signed image, its node and its hash subnodes.
+func (f *Fit) signedNodes(c *Config, s *Signature) []string {
+	out := []string{"/", "/configurations/" + c.Name}
+	for _, kind := range s.SignImages {
+		name := map[string]string{"kernel": c.Kernel, "fdt": c.FDT, "ramdisk": c.Ramdisk}[kind]
+		img, ok := f.imgs[name]
+		if !ok {
+			continue
+		}
+		out = append(out, "/images/"+name)
+		for n := range img.Hashes {
+			out = append(out, fmt.Sprintf("/images/%s/hash-%d", name, n+1))
+		}
+	}
+	return out
+}
+
+// fdtRegions ports fdt_find_regions() from U-Boot: the {offset, size} byte
+// ranges of blob that a config signature over the nodes inc covers. Those
+// nodes are taken with their properties (minus exclude); their parents and
+// children only contribute the begin/end tags. The FDT_END tag and the
+// whole strings block close the list.
+func fdtRegions(blob []byte, inc, exclude []string) ([][2]int, error) {
+	be := binary.BigEndian
+	base := int(be.Uint32(blob[8:]))
+	st := blob[base : base+int(be.Uint32(blob[36:]))]
+	strs := blob[be.Uint32(blob[12:]):]
+
+	var regs [][2]int
+	var stack []int
+	path := ""
+	start, want := -1, 0
+	off, next := 0, 0
+	for tag := uint32(0); tag != fdtEnd; off = next {
+		if off+4 > len(st) {
+			return nil, errors.New("fit: struct block without FDT_END")
+		}
+		tag = be.Uint32(st[off:])
+		next = off + 4
+		stop, include := next, 0
+		switch tag {
+		case fdtProp:
+			next = off + 12 + (int(be.Uint32(st[off+4:]))+3)&^3
+			stop = off
+			if want >= 2 && !slices.Contains(exclude, getCString(strs, be.Uint32(st[off+8:]))) {
+				include = 1
+			}
+		case fdtNop:
+			stop = off
+			if want >= 2 {
+				include = 1
+			}
+		case fdtBeginNode:
+			name := getCString(st, uint32(off+4))
+			next = off + 4 + (len(name)+4)&^3
+			if path != "/" {
+				path += "/"
+			}
+			path += name
+			stack = append(stack, want)
+			if want == 1 {
+				stop = off
+			}
+			switch {
+			case slices.Contains(inc, path):
+				want = 2
+			case want > 0:
+				want--
+			default:
+				stop = off
+			}
+			include = want
+		case fdtEndNode:
+			if len(stack) == 0 {
+				return nil, errors.New("fit: END_NODE without BEGIN_NODE")
+			}
+			include = want
+			want = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if i := strings.LastIndexByte(path, '/'); i >= 0 {
+				path = path[:i]
+			}
+		case fdtEnd:
+			include = 1
+		default:
+			return nil, fmt.Errorf("fit: bad token %#x", tag)
+		}
+		if include > 0 && start < 0 {
+			// стык с предыдущим регионом — продолжаем его
+			if n := len(regs); n > 0 && base+off == regs[n-1][0]+regs[n-1][1] {
+				start = regs[n-1][0] - base
+				regs = regs[:n-1]
+			} else {
+				start = off
+			}
+		}
+		if include == 0 && start >= 0 {
+			regs = append(regs, [2]int{base + start, stop - start})
+			start = -1
+		}
+	}
+	regs = append(regs, [2]int{base + start, next - start})
+	return append(regs, [2]int{int(be.Uint32(blob[12:])), int(be.Uint32(blob[32:]))}), nil
+}
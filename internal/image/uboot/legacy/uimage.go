@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+
+	"goimagetool/internal/common"
 )
 
 const Magic uint32 = 0x27051956
@@ -33,15 +35,26 @@ func (h *Header) String() string {
 
 func Read(r io.Reader) (*Header, []byte, error) {
 	var h Header
-	if err := binary.Read(r, binary.BigEndian, &h); err != nil { return nil, nil, err }
+	hb := make([]byte, HeaderSize)
+	if n, err := io.ReadFull(r, hb); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF { return nil, nil, common.TooSmall("uimage", "a uImage", int64(n), HeaderSize) }
+		return nil, nil, err
+	}
+	_ = binary.Read(bytes.NewReader(hb), binary.BigEndian, &h)
 	if h.Magic != Magic { return nil, nil, errors.New("invalid uImage magic") }
 	orig := h.HCRC
 	h.HCRC = 0
 	var buf bytes.Buffer
 	if err := binary.Write(&buf, binary.BigEndian, &h); err != nil { return nil, nil, err }
 	if crc32.ChecksumIEEE(buf.Bytes()) != orig { return nil, nil, errors.New("uImage header CRC mismatch") }
+	if err := common.CheckSize("uImage payload", int64(h.Size)); err != nil { return nil, nil, err }
 	data := make([]byte, h.Size)
-	if _, err := io.ReadFull(r, data); err != nil { return nil, nil, err }
+	if n, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, common.Corrupt("uimage", HeaderSize+int64(n), fmt.Sprintf("truncated payload: header declares %d bytes, got %d", h.Size, n))
+		}
+		return nil, nil, err
+	}
 	if crc32.ChecksumIEEE(data) != h.DCRC { return nil, nil, errors.New("uImage data CRC mismatch") }
 	return &h, data, nil
 }
@@ -60,3 +73,54 @@ func Write(w io.Writer, h *Header, data []byte) error {
 	_, err := w.Write(data)
 	return err
 }
+
+// HeaderSize — размер заголовка uImage на диске.
+const HeaderSize = 64
+
+// Check — результат проверки CRC без отказа на первой ошибке.
+type Check struct {
+	H         Header
+	HCRCCalc  uint32
+	DCRCCalc  uint32
+	Truncated bool // payload короче, чем h.Size
+}
+
+func (c *Check) HCRCOK() bool { return c.HCRCCalc == c.H.HCRC }
+func (c *Check) DCRCOK() bool { return !c.Truncated && c.DCRCCalc == c.H.DCRC }
+
+func headerCRC(h Header) uint32 {
+	h.HCRC = 0
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, &h)
+	return crc32.ChecksumIEEE(buf.Bytes())
+}
+
+// Verify: like Read, but reports HCRC and DCRC separately instead of failing.
+func Verify(b []byte) (*Check, error) {
+	if len(b) < HeaderSize { return nil, errors.New("uImage: file shorter than header") }
+	var c Check
+	if err := binary.Read(bytes.NewReader(b[:HeaderSize]), binary.BigEndian, &c.H); err != nil { return nil, err }
+	if c.H.Magic != Magic { return nil, errors.New("invalid uImage magic") }
+	c.HCRCCalc = headerCRC(c.H)
+	end := uint64(HeaderSize) + uint64(c.H.Size)
+	if end > uint64(len(b)) {
+		c.Truncated = true
+		end = uint64(len(b))
+	}
+	c.DCRCCalc = crc32.ChecksumIEEE(b[HeaderSize:end])
+	return &c, nil
+}
+
+// FixCRC patches DCRC (over the current payload) and then HCRC in place.
+// Everything else in b, including bytes after the payload, is left untouched.
+func FixCRC(b []byte) (*Check, error) {
+	c, err := Verify(b)
+	if err != nil { return nil, err }
+	if c.Truncated { return nil, fmt.Errorf("uImage: payload truncated (%d of %d bytes)", len(b)-HeaderSize, c.H.Size) }
+	c.H.DCRC = c.DCRCCalc
+	c.H.HCRC = headerCRC(c.H)
+	c.HCRCCalc = c.H.HCRC
+	binary.BigEndian.PutUint32(b[24:28], c.H.DCRC)
+	binary.BigEndian.PutUint32(b[4:8], c.H.HCRC)
+	return c, nil
+}
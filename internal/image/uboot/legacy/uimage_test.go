@@ -0,0 +1,53 @@
+package legacy
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"goimagetool/internal/common"
+)
+
+func TestReadShortInput(t *testing.T) {
+	for _, n := range []int{0, 1, 4, HeaderSize - 1} {
+		_, _, err := Read(bytes.NewReader(make([]byte, n)))
+		if !errors.Is(err, common.ErrCorrupt) || !strings.Contains(err.Error(), "file too small") {
+			t.Errorf("%d bytes: got %v, want a too-small ErrCorrupt", n, err)
+		}
+	}
+}
+
+func TestReadTruncatedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, &Header{Name: [32]byte{'k'}}, []byte("kernel payload")); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	_, _, err := Read(bytes.NewReader(b[:len(b)-4]))
+	if !errors.Is(err, common.ErrCorrupt) || !strings.Contains(err.Error(), "truncated payload") {
+		t.Fatalf("got %v, want truncated payload", err)
+	}
+}
+
+func TestReadRandomInput(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		b := make([]byte, rnd.Intn(4*HeaderSize))
+		rnd.Read(b)
+		if i%2 == 0 && len(b) >= 4 {
+			copy(b, []byte{0x27, 0x05, 0x19, 0x56})
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("buffer %d (%d bytes): panic: %v", i, len(b), r)
+				}
+			}()
+			if _, _, err := Read(bytes.NewReader(b)); err == nil {
+				t.Errorf("buffer %d (%d bytes): random data accepted", i, len(b))
+			}
+		}()
+	}
+}
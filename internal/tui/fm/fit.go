@@ -0,0 +1,335 @@
+package fm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+
+	"goimagetool/internal/common"
+	"goimagetool/internal/core"
+	"goimagetool/internal/image/arm64"
+	"goimagetool/internal/image/uboot/fit"
+)
+
+// FIT mode: the image panel lists /images of the loaded FIT instead of the
+// image FS; the host panel stays as is and is the source/target of F5.
+
+func (f *fm) fit() *fit.Fit {
+	m, _ := f.st.Meta.(*core.FitMeta)
+	if m == nil {
+		return nil
+	}
+	return m.F
+}
+
+func (f *fm) fitFooterText() string {
+	lbl := func(fn, t string) string { return fmt.Sprintf("[black:white] %s [-:-:-] [yellow]%s[-]", fn, t) }
+	return strings.Join([]string{
+		lbl("F1", "Help"),
+		lbl("F2", "FS"),
+		lbl("F3", "Info"),
+		lbl("F4", "Type"),
+		lbl("F5", "Add/Extr"),
+		lbl("F6", "Default"),
+		lbl("F8", "Remove"),
+		lbl("F10", "Quit"),
+	}, "  ")
+}
+
+// toggleFit switches the image panel between the FS and the FIT list.
+func (f *fm) toggleFit() {
+	switch {
+	case !f.fitMode && f.fit() == nil:
+		f.alert("no FIT loaded (load kernel-fit or fit new first)")
+		return
+	case f.fitMode && f.st.FS == nil:
+		f.alert("no filesystem image loaded")
+		return
+	}
+	f.fitMode = !f.fitMode
+	if f.fitMode {
+		f.left.SetTitle(" FIT images ")
+	} else {
+		f.left.SetTitle(" image FS ")
+	}
+	_ = f.refresh(pLeft)
+	f.drawHeader()
+	f.drawFooter()
+}
+
+// drawFit: name, default marker, type, hashes, size, load/entry.
+func (f *fm) drawFit() {
+	f.left.Clear()
+	ft := f.fit()
+	f.fitNames = ft.List()
+	if f.fitIndex >= len(f.fitNames) {
+		f.fitIndex = len(f.fitNames) - 1
+	}
+	if f.fitIndex < 0 {
+		f.fitIndex = 0
+	}
+	for i, name := range f.fitNames {
+		img, _ := ft.Get(name)
+		mark := " "
+		if ft.Default == name {
+			mark = "*"
+		}
+		typ := img.Type
+		if typ == "" {
+			typ = "blob"
+		}
+		line := fmt.Sprintf("%s%-16s %-8s %-12s %10d", mark, tview.Escape(name), typ, img.HashAlgos(), fitSize(img))
+		if img.Load != 0 || img.Entry != 0 {
+			line += fmt.Sprintf(" @0x%x", img.Load)
+		}
+		if i == f.fitIndex {
+			fmt.Fprintf(f.left, "[black:teal]%s[-:-:-]\n", line)
+		} else {
+			fmt.Fprintf(f.left, "%s\n", line)
+		}
+	}
+	if len(f.fitNames) == 0 {
+		fmt.Fprint(f.left, "(no images; F5 in the host panel adds one)\n")
+	}
+}
+
+func fitSize(img *fit.Image) int64 {
+	if img.Path != "" {
+		return img.Size
+	}
+	return int64(len(img.Data))
+}
+
+func (f *fm) fitCurrent() (*fit.Image, bool) {
+	if f.fitIndex < 0 || f.fitIndex >= len(f.fitNames) {
+		return nil, false
+	}
+	img, err := f.fit().Get(f.fitNames[f.fitIndex])
+	return img, err == nil
+}
+
+// fitKey handles the keys in FIT mode; false leaves the event to the FS
+// bindings (Tab, F2, F10, everything in the host panel but F5).
+func (f *fm) fitKey(ev *tcell.EventKey) bool {
+	if ev.Key() == tcell.KeyF1 {
+		f.alert("FIT mode: F2 back to FS  F3 Info  F4 set type  F5 extract (image panel) / add (host panel)  F6 set default  F8 remove  F10 Quit")
+		return true
+	}
+	if f.active == pRight {
+		if ev.Key() == tcell.KeyF5 {
+			f.fitAdd()
+			return true
+		}
+		return false
+	}
+	switch ev.Key() {
+	case tcell.KeyUp:
+		f.fitMove(-1)
+	case tcell.KeyDown:
+		f.fitMove(+1)
+	case tcell.KeyPgUp:
+		f.fitMove(-15)
+	case tcell.KeyPgDn:
+		f.fitMove(+15)
+	case tcell.KeyHome:
+		f.fitMove(-(1<<30 - 1))
+	case tcell.KeyEnd:
+		f.fitMove(1<<30 - 1)
+	case tcell.KeyF3, tcell.KeyEnter, tcell.KeyRight:
+		f.fitInfo()
+	case tcell.KeyF4:
+		f.fitSetType()
+	case tcell.KeyF5:
+		f.fitExtract()
+	case tcell.KeyF6:
+		if img, ok := f.fitCurrent(); ok {
+			f.fit().SetDefault(img.Name)
+			f.drawFit()
+			f.drawHeader()
+		}
+	case tcell.KeyF8:
+		f.fitRemove()
+	case tcell.KeyTab, tcell.KeyF2, tcell.KeyF10, tcell.KeyEsc:
+		return false
+	}
+	// прочие клавиши FS-панели (F7 Mkdir, ← …) в FIT-режиме ничего не делают
+	return true
+}
+
+func (f *fm) fitMove(d int) {
+	f.fitIndex += d
+	f.drawFit()
+}
+
+func (f *fm) fitInfo() {
+	img, ok := f.fitCurrent()
+	if !ok {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s, %d bytes\n", img.Name, img.Type, fitSize(img))
+	if img.Path != "" {
+		fmt.Fprintf(&b, "data: %s (read on store)\n", img.Path)
+	}
+	for _, h := range img.Hashes {
+		fmt.Fprintf(&b, "%s: %x\n", h.Algo, h.Value)
+	}
+	if img.Load != 0 || img.Entry != 0 {
+		fmt.Fprintf(&b, "load 0x%x entry 0x%x\n", img.Load, img.Entry)
+	}
+	if users := f.fit().ConfigsUsing(img.Name); len(users) > 0 {
+		fmt.Fprintf(&b, "used by: %s\n", strings.Join(users, ", "))
+	}
+	f.alert(b.String())
+}
+
+func (f *fm) fitSetType() {
+	img, ok := f.fitCurrent()
+	if !ok {
+		return
+	}
+	f.ask("type of "+img.Name+" (kernel|fdt|ramdisk|...)", img.Type, func(typ string) {
+		img.Type = strings.ToLower(strings.TrimSpace(typ))
+		f.drawFit()
+	})
+}
+
+// fitExtract writes the selected image into the host panel's directory.
+func (f *fm) fitExtract() {
+	img, ok := f.fitCurrent()
+	if !ok {
+		return
+	}
+	dst := filepath.Join(f.rightPath, filepath.Base(img.Name))
+	write := func() {
+		data, err := img.ReadData()
+		if err == nil {
+			err = common.WriteFileAtomic(dst, func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			})
+		}
+		if err != nil {
+			f.alert(err.Error())
+			return
+		}
+		_ = f.refresh(pRight)
+	}
+	if exist(dst) {
+		f.askYes("Overwrite host file "+dst+"?", write)
+		return
+	}
+	write()
+}
+
+// fitAdd adds the host file under the cursor as an image, named after the
+// file; an existing image of that name is replaced, keeping its hashes,
+// type and load/entry.
+// An arm64 Image becomes a kernel with load/entry from its header, as in
+// 'fit add'.
+func (f *fm) fitAdd() {
+	if f.rightIndex < 0 || len(f.rightItems) == 0 {
+		return
+	}
+	idx := f.rightIndex
+	if !f.isRoot(f.rightPath) {
+		idx--
+	}
+	if idx < 0 || idx >= len(f.rightItems) || f.rightItems[idx].isDir {
+		return
+	}
+	src := f.rightItems[idx].path
+	f.ask("add to FIT as", f.rightItems[idx].name, func(name string) {
+		if name == "" {
+			return
+		}
+		ft := f.fit()
+		algo, typ := "sha1", ""
+		var load, entry uint64
+		if old, err := ft.Get(name); err == nil {
+			algo, typ, load, entry = old.HashAlgos(), old.Type, old.Load, old.Entry
+		}
+		b, err := os.ReadFile(src)
+		if err != nil {
+			f.alert(err.Error())
+			return
+		}
+		ah, _ := arm64.Parse(b)
+		if ah != nil && typ == "" {
+			typ = "kernel"
+		}
+		if err := ft.AddTyped(name, b, algo, typ); err != nil {
+			f.alert(err.Error())
+			return
+		}
+		img, _ := ft.Get(name)
+		img.Load, img.Entry = load, entry
+		if ah != nil && typ == "kernel" {
+			img.Load = ah.LoadAddr(0)
+			img.Entry = img.Load
+		}
+		f.fitNames = ft.List()
+		for i, n := range f.fitNames {
+			if n == name {
+				f.fitIndex = i
+			}
+		}
+		f.drawFit()
+		f.drawHeader()
+	})
+}
+
+func (f *fm) fitRemove() {
+	img, ok := f.fitCurrent()
+	if !ok {
+		return
+	}
+	text := "Remove " + img.Name + "?"
+	if users := f.fit().ConfigsUsing(img.Name); len(users) > 0 {
+		text += "\nStill referenced by config " + strings.Join(users, ", ")
+	}
+	f.askYes(text, func() {
+		f.fit().Remove(img.Name)
+		f.drawFit()
+		f.drawHeader()
+	})
+}
+
+// ask/askYes are prompt/confirm that return at once and call done from
+// the UI loop, so they can be opened from a key handler.
+func (f *fm) ask(title, value string, done func(string)) {
+	out := value
+	form := tview.NewForm().
+		AddInputField("value", value, 40, nil, func(s string) { out = s })
+	closeDlg := func() {
+		f.pages.RemovePage("ask")
+		f.updateTitles()
+	}
+	form.AddButton("OK", func() { closeDlg(); done(out) })
+	form.AddButton("Cancel", closeDlg)
+	form.SetBorder(true)
+	form.SetTitle(" " + title + " ")
+	form.SetTitleAlign(tview.AlignLeft)
+	dlg := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(nil, 1, 0, false).
+		AddItem(form, 7, 0, true).
+		AddItem(nil, 1, 0, false)
+	f.pages.AddAndSwitchToPage("ask", dlg, true)
+}
+
+func (f *fm) askYes(text string, yes func()) {
+	m := tview.NewModal().SetText(text).AddButtons([]string{"Yes", "No"})
+	m.SetDoneFunc(func(i int, _ string) {
+		f.pages.RemovePage("askyes")
+		f.updateTitles()
+		if i == 0 {
+			yes()
+		}
+	})
+	f.pages.AddAndSwitchToPage("askyes", m, true)
+}
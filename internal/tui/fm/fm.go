@@ -2,7 +2,9 @@ package fm
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -15,6 +17,7 @@ import (
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 
+	"goimagetool/internal/common"
 	"goimagetool/internal/core"
 	"goimagetool/internal/fs/memfs"
 )
@@ -61,13 +64,18 @@ type fm struct {
 	rightIndex int
 	leftItems  []item
 	rightItems []item
+
+	// FIT mode (F2): левая панель — /images загруженного FIT, см. fit.go
+	fitMode  bool
+	fitIndex int
+	fitNames []string
 }
 
 func Run(st *core.State, hostStart string) error {
 	if st == nil {
 		st = core.New()
 	}
-	if st.FS == nil {
+	if st.FS == nil && st.Kind != core.KindKernelFIT {
 		st.FS = memfs.New()
 		st.FS.PutDir("/", 0, 0, time.Now())
 	}
@@ -92,6 +100,7 @@ func Run(st *core.State, hostStart string) error {
 		leftPath:  "/",
 		rightPath: hostStart,
 		active:    pLeft,
+		fitMode:   st.Kind == core.KindKernelFIT,
 	}
 
 	f.style()
@@ -135,14 +144,16 @@ func (f *fm) style() {
 		tv.SetScrollable(false)
 	}
 	f.left.SetTitle(" image FS ")
+	if f.fitMode { f.left.SetTitle(" FIT images ") }
 	f.right.SetTitle(" host ")
 }
 
 func (f *fm) footerText() string {
+	if f.fitMode { return f.fitFooterText() }
 	lbl := func(fn, t string) string { return fmt.Sprintf("[black:white] %s [-:-:-] [yellow]%s[-]", fn, t) }
 	return strings.Join([]string{
 		lbl("F1", "Help"),
-		lbl("F2", "Menu"),
+		lbl("F2", "FIT"),
 		lbl("F3", "View"),
 		lbl("F4", "Edit"),
 		lbl("F5", "Copy"),
@@ -166,6 +177,11 @@ func (f *fm) layout() {
 
 func (f *fm) drawHeader() {
 	f.header.Clear()
+	if f.fitMode {
+		fmt.Fprintf(f.header, "[yellow]FIT[-]: [white]%d images, default %s[-]   [yellow]HOST[-]: [white]%s[-]",
+			len(f.fit().List()), f.fit().Default, f.safe(f.rightPath))
+		return
+	}
 	fmt.Fprintf(f.header, "[yellow]FS[-]: [white]%s[-]   [yellow]HOST[-]: [white]%s[-]",
 		f.safe(f.leftPath), f.safe(f.rightPath))
 }
@@ -221,6 +237,7 @@ func (f *fm) formatFileItem(name string, isDir bool, size int64, modTime time.Ti
 }
 
 func (f *fm) drawPanel(pn panel) {
+	if pn == pLeft && f.fitMode { f.drawFit(); return }
 	var tv *tview.TextView
 	var items []item
 	var currentIndex int
@@ -251,6 +268,7 @@ func (f *fm) drawPanel(pn panel) {
 }
 
 func (f *fm) refresh(pn panel) error {
+	if pn == pLeft && f.fitMode { f.drawFit(); return nil }
 	if pn == pLeft {
 		items, err := f.listFS(f.leftPath)
 		if err != nil { return err }
@@ -270,12 +288,16 @@ func (f *fm) listFS(path string) ([]item, error) {
 	snap := f.st.FS.Snapshot()
 	p := filepath.ToSlash(path)
 	if p == "" { p = "/" }
+	// путь может проходить через symlink — листим реальный каталог
+	if resolved, _, err := f.st.FS.ResolveLink(p, memfs.DefaultMaxHops); err == nil { p = resolved }
 	prefix := p
 	if prefix == "/" { prefix = "" }
 	seen := map[string]bool{}
+	var names []string
+	_ = f.st.FS.WalkDir(p, func(e *memfs.Entry) error { names = append(names, e.Name); return nil })
 
-	for full := range snap {
-		if full == "/" || !strings.HasPrefix(full, p) { continue }
+	for _, full := range names {
+		if full == "/" { continue }
 		rest := strings.TrimPrefix(full, prefix)
 		if !strings.HasPrefix(rest, "/") { continue }
 		rest = strings.TrimPrefix(rest, "/")
@@ -285,8 +307,9 @@ func (f *fm) listFS(path string) ([]item, error) {
 		if seen[first] { continue }
 		seen[first] = true
 		child := snap[f.join(p, first)]
-		isDir := child != nil && (child.Mode&memfs.ModeDir) != 0
-		isLink := child != nil && (child.Mode&memfs.ModeLink) != 0
+		// биты типов пересекаются (0120000 & 0100000) — сравниваем Type() целиком
+		isDir := child != nil && child.Mode.Type() == memfs.ModeDir
+		isLink := child != nil && child.Mode.Type() == memfs.ModeLink
 		var size int64
 		var modTime time.Time
 		if child != nil {
@@ -334,6 +357,7 @@ func (f *fm) listHost(path string) ([]item, error) {
 
 func (f *fm) bindKeys() {
 	f.app.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		if f.fitMode && f.fitKey(ev) { return nil }
 		switch ev.Key() {
 		case tcell.KeyTab:
 			if f.active == pLeft { f.active = pRight } else { f.active = pLeft }
@@ -355,8 +379,10 @@ func (f *fm) bindKeys() {
 		case tcell.KeyLeft:
 			f.up(); return nil
 		case tcell.KeyF1:
-			f.alert("F1 Help  F2 Menu  F3 View  F4 Edit  F5 Copy  F6 Move  F7 Mkdir  F8 Delete  F9 PullDn  F10 Quit\nTAB — panel, Enter/→ — open, ← — up")
+			f.alert("F1 Help  F2 FIT  F3 View  F4 Edit  F5 Copy  F6 Move  F7 Mkdir  F8 Delete  F9 PullDn  F10 Quit\nTAB — panel, Enter/→ — open, ← — up")
 			return nil
+		case tcell.KeyF2:
+			f.toggleFit(); return nil
 		case tcell.KeyF3:
 			_ = f.view(); return nil
 		case tcell.KeyF4:
@@ -405,6 +431,9 @@ func (f *fm) enter() {
 		if f.leftPath != "/" && f.leftIndex == 0 { f.up(); return }
 		idx := f.leftIndex
 		if f.leftPath != "/" { idx-- }
+		if idx >= 0 && idx < len(f.leftItems) && f.leftItems[idx].isLink {
+			f.enterLink(f.leftItems[idx]); return
+		}
 		if idx >= 0 && idx < len(f.leftItems) && f.leftItems[idx].isDir {
 			f.leftPath = f.leftItems[idx].path
 			f.leftIndex = 0
@@ -423,6 +452,30 @@ func (f *fm) enter() {
 	}
 }
 
+// enterLink: symlink в образе — каталог открываем (по разрешённому пути),
+// файл показываем во viewer'е; петля или висячая ссылка — alert.
+func (f *fm) enterLink(it item) {
+	resolved, e, err := f.st.FS.ResolveLink(it.path, memfs.DefaultMaxHops)
+	switch {
+	case errors.Is(err, memfs.ErrLoop):
+		f.alert(fmt.Sprintf("%s: symlink loop", it.path)); return
+	case errors.Is(err, memfs.ErrNotExist) || e == nil:
+		f.alert(fmt.Sprintf("%s: dangling symlink (%s missing)", it.path, resolved)); return
+	case err != nil:
+		f.alert(err.Error()); return
+	}
+	switch e.Mode.Type() {
+	case memfs.ModeDir:
+		f.leftPath = resolved
+		f.leftIndex = 0
+		_ = f.refresh(pLeft); f.drawHeader()
+	case memfs.ModeFile:
+		f.viewBytes(e.Data, it.name)
+	default:
+		f.alert(fmt.Sprintf("%s -> %s: not a file or directory", it.path, resolved))
+	}
+}
+
 func (f *fm) up() {
 	if f.active == pLeft {
 		if f.leftPath == "/" { return }
@@ -514,25 +567,31 @@ func (f *fm) copy() error {
 
 func (f *fm) copyFSToHost(srcFS, dstHost string) error {
 	e := f.st.FS.Snapshot()[srcFS]; if e == nil { return fmt.Errorf("not found: %s", srcFS) }
-	if e.Mode&memfs.ModeDir != 0 {
+	switch e.Mode.Type() {
+	case memfs.ModeDir:
 		if err := os.MkdirAll(dstHost, 0o755); err != nil { return err }
 		children, _ := f.listFS(srcFS)
 		for _, c := range children {
 			if err := f.copyFSToHost(c.path, filepath.Join(dstHost, c.name)); err != nil { return err }
 		}
-		return nil
-	}
-	if e.Mode&memfs.ModeLink != 0 {
+		// права каталога — после содержимого (0555 и т.п.)
+		return os.Chmod(dstHost, memfs.HostMode(e))
+	case memfs.ModeLink:
+		if err := common.PrepareOutput(dstHost); err != nil { return err }
 		_ = os.RemoveAll(dstHost)
 		return os.Symlink(e.Target, dstHost)
 	}
-	return os.WriteFile(dstHost, e.Data, 0o644)
+	// как store: --no-clobber/--backup и замена только целиком записанным файлом
+	if err := common.WriteFileAtomic(dstHost, func(w io.Writer) error {
+		_, err := w.Write(e.Data); return err
+	}); err != nil { return err }
+	return os.Chmod(dstHost, memfs.HostMode(e))
 }
 
 func (f *fm) copyHostToFS(srcHost, dstFS string) error {
 	fi, err := os.Lstat(srcHost); if err != nil { return err }
 	if fi.IsDir() {
-		f.st.FS.PutDir(dstFS, 0, 0, fi.ModTime())
+		f.st.FS.PutDirMode(dstFS, memfs.ModeDir|memfs.PermOf(fi.Mode()), 0, 0, fi.ModTime())
 		ents, err := os.ReadDir(srcHost); if err != nil { return err }
 		for _, de := range ents {
 			if err := f.copyHostToFS(filepath.Join(srcHost, de.Name()), f.join(dstFS, de.Name())); err != nil { return err }
@@ -545,7 +604,7 @@ func (f *fm) copyHostToFS(srcHost, dstFS string) error {
 		return nil
 	}
 	b, err := os.ReadFile(srcHost); if err != nil { return err }
-	f.st.FS.PutFile(dstFS, b, memfs.Mode(0o644), 0, 0, fi.ModTime())
+	f.st.FS.PutFile(dstFS, b, memfs.ModeFile|memfs.PermOf(fi.Mode()), 0, 0, fi.ModTime())
 	return nil
 }
 